@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Admin session list page sizes
+const (
+	DefaultAdminPageSize = 50
+	MaxAdminPageSize     = 500
+)
+
+// requireAdmin wraps a handler so only administrators can reach it
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := ""
+		if cookie, err := r.Cookie("cyh_session"); err == nil {
+			if user, valid := authManager.ValidateSession(cookie.Value); valid {
+				username = user
+			}
+		}
+
+		if username == "" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !authManager.IsAdmin(username) {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// parseTimeParam accepts an RFC 3339 time or Unix milliseconds
+func parseTimeParam(value string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.UnixMilli(ms), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// handleAdminSessions lists sessions across all users: GET /api/admin/sessions?user=&mode=&live=&since=&limit=&offset=
+func handleAdminSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := SessionFilter{
+		User:  query.Get("user"),
+		Mode:  query.Get("mode"),
+		Limit: DefaultAdminPageSize,
+	}
+
+	if v := query.Get("live"); v != "" {
+		live, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "Invalid live filter", http.StatusBadRequest)
+			return
+		}
+		filter.Live = &live
+	}
+	if v := query.Get("since"); v != "" {
+		since, err := parseTimeParam(v)
+		if err != nil {
+			http.Error(w, "Invalid since (use RFC 3339 or Unix milliseconds)", http.StatusBadRequest)
+			return
+		}
+		filter.Since = since
+	}
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		if limit > MaxAdminPageSize {
+			limit = MaxAdminPageSize
+		}
+		filter.Limit = limit
+	}
+	if v := query.Get("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			http.Error(w, "Invalid offset", http.StatusBadRequest)
+			return
+		}
+		filter.Offset = offset
+	}
+
+	sessions, total, err := sessionMgr.ListAllSessions(filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Add viewer counts for live sessions
+	for _, s := range sessions {
+		if s.IsLive {
+			s.ViewerCount = liveHub.GetViewerCount(s.ID)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sessions": sessions,
+		"total":    total,
+		"limit":    filter.Limit,
+		"offset":   filter.Offset,
+	})
+}
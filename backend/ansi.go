@@ -0,0 +1,183 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// StripANSI removes terminal escape sequences and control characters from
+// recorded output, leaving plain text. Newlines and tabs are kept and CRLF
+// line endings become LF.
+func StripANSI(s string) string {
+	text, _ := stripANSIMarked(s, nil)
+	return text
+}
+
+// stripANSIMarked is StripANSI that also maps offsets: for each of marks (byte
+// offsets into s, ascending) it returns the offset in the stripped text where
+// the text from that point on starts
+func stripANSIMarked(s string, marks []int) (string, []int) {
+	var b strings.Builder
+	b.Grow(len(s))
+	mapped := make([]int, 0, len(marks))
+
+	for i := 0; i < len(s); i++ {
+		for len(mapped) < len(marks) && marks[len(mapped)] <= i {
+			mapped = append(mapped, b.Len())
+		}
+
+		c := s[i]
+		if c != 0x1b {
+			if (c >= 0x20 && c != 0x7f) || c == '\n' || c == '\t' {
+				b.WriteByte(c)
+			}
+			continue
+		}
+
+		// Escape sequence: skip to its end
+		i++
+		if i >= len(s) {
+			break
+		}
+		switch s[i] {
+		case '[': // CSI: parameters and intermediates, then a final byte 0x40-0x7e
+			for i++; i < len(s) && (s[i] < 0x40 || s[i] > 0x7e); i++ {
+			}
+		case ']', 'P', 'X', '^', '_': // OSC/DCS/SOS/PM/APC strings end at BEL or ST (ESC \)
+			for i++; i < len(s); i++ {
+				if s[i] == 0x07 {
+					break
+				}
+				if s[i] == 0x1b && i+1 < len(s) && s[i+1] == '\\' {
+					i++
+					break
+				}
+			}
+		default: // Two-byte escapes, possibly with intermediates (e.g. ESC ( B)
+			for ; i < len(s) && s[i] >= 0x20 && s[i] <= 0x2f; i++ {
+			}
+		}
+	}
+
+	for len(mapped) < len(marks) {
+		mapped = append(mapped, b.Len())
+	}
+	return b.String(), mapped
+}
+
+// maxPendingCSI bounds how much of an unfinished CSI sequence sgrStripper
+// holds back; anything longer isn't a real sequence and is passed through
+const maxPendingCSI = 64
+
+// sgrStripper removes SGR (color and text attribute) sequences from a stream
+// of terminal output while keeping cursor movement, erasing and the other
+// controls full-screen programs need. A sequence split across chunks is held
+// back until the rest arrives.
+type sgrStripper struct {
+	pending string
+}
+
+// Strip returns chunk without SGR sequences
+func (st *sgrStripper) Strip(chunk string) string {
+	s := st.pending + chunk
+	st.pending = ""
+
+	var b strings.Builder
+	b.Grow(len(s))
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != 0x1b {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		if i+1 >= len(s) {
+			st.pending = s[i:]
+			break
+		}
+		if s[i+1] != '[' {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		// CSI: parameters and intermediates, then a final byte 0x40-0x7e
+		end := i + 2
+		for end < len(s) && (s[end] < 0x40 || s[end] > 0x7e) {
+			end++
+		}
+		if end >= len(s) {
+			if len(s)-i <= maxPendingCSI {
+				st.pending = s[i:]
+			} else {
+				b.WriteString(s[i:])
+			}
+			break
+		}
+		if s[end] != 'm' {
+			b.WriteString(s[i : end+1])
+		}
+		i = end
+	}
+
+	return b.String()
+}
+
+// Flush returns what Strip held back, for when the stream ends
+func (st *sgrStripper) Flush() string {
+	rest := st.pending
+	st.pending = ""
+	return rest
+}
+
+// paneSGRStripper strips a recording's output events, keeping each pane's
+// stream (the main terminal's is "") apart
+type paneSGRStripper map[string]*sgrStripper
+
+// Strip returns an output event's data without SGR sequences
+func (ps paneSGRStripper) Strip(e *SessionEvent) string {
+	st, ok := ps[e.Pane]
+	if !ok {
+		st = &sgrStripper{}
+		ps[e.Pane] = st
+	}
+	return st.Strip(e.Data)
+}
+
+// Flush returns output events, stamped with timestamp, for what each pane's
+// stripper held back when the recording ends
+func (ps paneSGRStripper) Flush(timestamp int64) []*SessionEvent {
+	panes := make([]string, 0, len(ps))
+	for pane := range ps {
+		panes = append(panes, pane)
+	}
+	sort.Strings(panes)
+
+	var events []*SessionEvent
+	for _, pane := range panes {
+		if rest := ps[pane].Flush(); rest != "" {
+			events = append(events, &SessionEvent{Type: "output", Timestamp: timestamp, Data: rest, Pane: pane})
+		}
+	}
+	return events
+}
+
+// stripRecordingSGR removes color sequences from a whole recording's output.
+// Sequences cut off by the end of the recording are kept as output events.
+func stripRecordingSGR(events []*SessionEvent) []*SessionEvent {
+	stripper := paneSGRStripper{}
+	for _, e := range events {
+		if e.Type == "output" {
+			e.Data = stripper.Strip(e)
+		}
+	}
+	if len(events) == 0 {
+		return events
+	}
+	return append(events, stripper.Flush(events[len(events)-1].Timestamp)...)
+}
+
+// StripSGR removes color and text attribute sequences from complete output
+func StripSGR(s string) string {
+	var st sgrStripper
+	return st.Strip(s) + st.Flush()
+}
@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestStripRecordingSGRKeepsCutOffSequences(t *testing.T) {
+	events := []*SessionEvent{
+		{Type: "output", Timestamp: 10, Data: "\x1b[31mred\x1b[0m"},
+		{Type: "output", Timestamp: 20, Pane: "p1", Data: "pane\x1b[1"},
+		{Type: "input", Timestamp: 30, Data: "q"},
+		{Type: "output", Timestamp: 40, Data: "bye\x1b["},
+	}
+
+	got := stripRecordingSGR(events)
+	want := []SessionEvent{
+		{Type: "output", Timestamp: 10, Data: "red"},
+		{Type: "output", Timestamp: 20, Pane: "p1", Data: "pane"},
+		{Type: "input", Timestamp: 30, Data: "q"},
+		{Type: "output", Timestamp: 40, Data: "bye"},
+		{Type: "output", Timestamp: 40, Data: "\x1b["},
+		{Type: "output", Timestamp: 40, Pane: "p1", Data: "\x1b[1"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d events, want %d", len(got), len(want))
+	}
+	for i, e := range got {
+		if *e != want[i] {
+			t.Fatalf("event %d = %+v, want %+v", i, *e, want[i])
+		}
+	}
+}
+
+func TestSGRStripperFlush(t *testing.T) {
+	var st sgrStripper
+	if got := st.Strip("abc\x1b[3"); got != "abc" {
+		t.Fatalf("Strip = %q, want %q", got, "abc")
+	}
+	if got := st.Flush(); got != "\x1b[3" {
+		t.Fatalf("Flush = %q, want the held back sequence", got)
+	}
+	if got := st.Flush(); got != "" {
+		t.Fatalf("second Flush = %q, want nothing", got)
+	}
+}
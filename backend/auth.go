@@ -15,9 +15,21 @@ import (
 
 // User represents a registered user
 type User struct {
-	Username     string    `json:"username"`
-	PasswordHash string    `json:"password_hash"`
-	CreatedAt    time.Time `json:"created_at"`
+	Username     string          `json:"username"`
+	PasswordHash string          `json:"password_hash"`
+	CreatedAt    time.Time       `json:"created_at"`
+	Preferences  UserPreferences `json:"preferences"`
+	IsAdmin      bool            `json:"is_admin,omitempty"`
+}
+
+// UserPreferences holds per-user terminal settings (all off by default)
+type UserPreferences struct {
+	BellNotifications bool `json:"bell_notifications"` // Send a "bell" control message when output contains BEL
+	StripBell         bool `json:"strip_bell"`         // Remove the raw BEL byte from output when notifying
+	AutoNameSessions  bool `json:"auto_name_sessions"` // Name new sessions after their first command
+	TitleMessages     bool `json:"title_messages"`     // Send a "title" control message when the shell sets the window title
+	IncognitoHistory  bool `json:"incognito_history"`  // Don't save commands to history; saved history reads as empty
+	PasteGuard        bool `json:"paste_guard"`        // Hold multi-line or binary pastes until the client confirms them
 }
 
 // Session represents an active session
@@ -31,32 +43,59 @@ type Session struct {
 // AuthConfig represents authentication settings
 type AuthConfig struct {
 	Enabled bool `json:"enabled"`
+
+	// Login lifetime as Go durations (e.g. "168h"). A login lasts SessionTTL
+	// from sign-in, or from the last request when SlidingSessions is on, but
+	// never longer than MaxSessionAge from sign-in ("" for no cap).
+	SessionTTL      string `json:"session_ttl,omitempty"`
+	SlidingSessions bool   `json:"sliding_sessions,omitempty"`
+	MaxSessionAge   string `json:"max_session_age,omitempty"`
 }
 
-// AuthManager manages authentication
+const (
+	defaultSessionTTL = 7 * 24 * time.Hour
+
+	// sessionSaveInterval throttles persisting sliding expiry refreshes
+	sessionSaveInterval = time.Minute
+
+	// sessionRefreshInterval is the least a sliding login's expiry is
+	// extended by, so most requests only need a read lock
+	sessionRefreshInterval = time.Minute
+
+	// sessionSweepInterval is how often expired logins are removed
+	sessionSweepInterval = 10 * time.Minute
+
+	// maxCookieAge is the longest lifetime browsers honor (400 days)
+	maxCookieAge = 400 * 24 * 60 * 60
+)
+
+// AuthManager manages authentication. mu guards all of its fields: methods
+// that only read take RLock and never modify anything, while every change,
+// including dropping expired logins, takes Lock. Expired logins are refused
+// when used and removed by sessionSweepLoop.
 type AuthManager struct {
-	mu       sync.RWMutex
-	users    map[string]User
-	sessions map[string]Session
-	config   AuthConfig
-	dataDir  string
+	mu            sync.RWMutex
+	users         map[string]User
+	sessions      map[string]Session
+	config        AuthConfig
+	dataDir       string
+	sessionTTL    time.Duration // Parsed from config
+	maxSessionAge time.Duration // 0 = no absolute cap
+	lastSave      time.Time     // Last sessions.json write for sliding refreshes
 }
 
 var authManager = &AuthManager{
-	users:    make(map[string]User),
-	sessions: make(map[string]Session),
+	users:      make(map[string]User),
+	sessions:   make(map[string]Session),
+	sessionTTL: defaultSessionTTL,
 }
 
-// Init initializes the auth manager
-func (am *AuthManager) Init() error {
+// Init initializes the auth manager with users, sessions and config stored in dataDir
+func (am *AuthManager) Init(dataDir string) error {
 	am.mu.Lock()
 	defer am.mu.Unlock()
 
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		homeDir = "/tmp"
-	}
-	am.dataDir = filepath.Join(homeDir, ".cyh_terminal")
+	am.dataDir = dataDir
 
 	if err := os.MkdirAll(am.dataDir, 0755); err != nil {
 		return err
@@ -136,6 +175,40 @@ func (am *AuthManager) loadConfig() {
 		return
 	}
 	json.Unmarshal(data, &am.config)
+	am.applySessionLifetime()
+}
+
+// applySessionLifetime parses the login lifetime settings, keeping the
+// defaults for missing or invalid values
+func (am *AuthManager) applySessionLifetime() {
+	am.sessionTTL = defaultSessionTTL
+	if am.config.SessionTTL != "" {
+		if ttl, err := time.ParseDuration(am.config.SessionTTL); err == nil && ttl > 0 {
+			am.sessionTTL = ttl
+		} else {
+			logWarnf("⚠️  Invalid session_ttl %q in auth_config.json, using %s", am.config.SessionTTL, defaultSessionTTL)
+		}
+	}
+
+	am.maxSessionAge = 0
+	if am.config.MaxSessionAge != "" {
+		if maxAge, err := time.ParseDuration(am.config.MaxSessionAge); err == nil && maxAge > 0 {
+			am.maxSessionAge = maxAge
+		} else {
+			logWarnf("⚠️  Invalid max_session_age %q in auth_config.json, not capping logins", am.config.MaxSessionAge)
+		}
+	}
+}
+
+// sessionExpiry is when a login should expire if last used at now
+func (am *AuthManager) sessionExpiry(createdAt, now time.Time) time.Time {
+	expires := now.Add(am.sessionTTL)
+	if am.maxSessionAge > 0 {
+		if limit := createdAt.Add(am.maxSessionAge); expires.After(limit) {
+			expires = limit
+		}
+	}
+	return expires
 }
 
 func (am *AuthManager) saveConfig() error {
@@ -189,33 +262,113 @@ func (am *AuthManager) CreateSession(username string) string {
 	defer am.mu.Unlock()
 
 	token := generateToken()
+	now := time.Now()
 	am.sessions[token] = Session{
 		Token:     token,
 		Username:  username,
-		CreatedAt: time.Now(),
-		ExpiresAt: time.Now().Add(7 * 24 * time.Hour), // 7 days
+		CreatedAt: now,
+		ExpiresAt: am.sessionExpiry(now, now),
 	}
 
 	am.saveSessions()
 	return token
 }
 
-// ValidateSession validates a session token
+// ValidateSession validates a session token. It enforces the absolute login
+// cap and, with sliding sessions, extends the expiry on use.
 func (am *AuthManager) ValidateSession(token string) (string, bool) {
+	now := time.Now()
+
 	am.mu.RLock()
-	defer am.mu.RUnlock()
+	session, exists := am.sessions[token]
+	valid := exists && !am.sessionExpired(session, now)
+	refresh := valid && am.config.SlidingSessions &&
+		am.sessionExpiry(session.CreatedAt, now).Sub(session.ExpiresAt) >= sessionRefreshInterval
+	am.mu.RUnlock()
+
+	if !valid {
+		return "", false // Left for sessionSweepLoop to remove
+	}
+	if refresh {
+		am.refreshSession(token, now)
+	}
+	return session.Username, true
+}
+
+// sessionExpired reports whether a login has run out, including logins from
+// before max_session_age was configured. Callers hold am.mu.
+func (am *AuthManager) sessionExpired(session Session, now time.Time) bool {
+	if now.After(session.ExpiresAt) {
+		return true
+	}
+	return am.maxSessionAge > 0 && now.After(session.CreatedAt.Add(am.maxSessionAge))
+}
+
+// refreshSession extends a sliding login's expiry as of now
+func (am *AuthManager) refreshSession(token string, now time.Time) {
+	am.mu.Lock()
+	defer am.mu.Unlock()
 
+	// The login may have been deleted or refreshed since it was validated
 	session, exists := am.sessions[token]
 	if !exists {
-		return "", false
+		return
+	}
+	if expires := am.sessionExpiry(session.CreatedAt, now); expires.After(session.ExpiresAt) {
+		session.ExpiresAt = expires
+		am.sessions[token] = session
+		if now.Sub(am.lastSave) >= sessionSaveInterval {
+			am.lastSave = now
+			am.saveSessions()
+		}
 	}
+}
 
-	if time.Now().After(session.ExpiresAt) {
-		delete(am.sessions, token)
-		return "", false
+// sweepExpiredSessions removes expired logins, returning how many it removed
+func (am *AuthManager) sweepExpiredSessions() int {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	now := time.Now()
+	removed := 0
+	for token, session := range am.sessions {
+		if am.sessionExpired(session, now) {
+			delete(am.sessions, token)
+			removed++
+		}
 	}
+	if removed > 0 {
+		am.saveSessions()
+	}
+	return removed
+}
 
-	return session.Username, true
+// sessionSweepLoop removes expired logins every sessionSweepInterval
+func (am *AuthManager) sessionSweepLoop() {
+	ticker := time.NewTicker(sessionSweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if removed := am.sweepExpiredSessions(); removed > 0 {
+			logDebugf("Removed %d expired login(s)", removed)
+		}
+	}
+}
+
+// CookieMaxAge is the login cookie lifetime in seconds. The server enforces
+// expiry, so the cookie only has to outlive the longest possible login.
+func (am *AuthManager) CookieMaxAge() int {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+
+	switch {
+	case am.maxSessionAge > 0:
+		return int(am.maxSessionAge.Seconds())
+	case am.config.SlidingSessions:
+		return maxCookieAge
+	default:
+		return int(am.sessionTTL.Seconds())
+	}
 }
 
 // DeleteSession deletes a session
@@ -241,6 +394,41 @@ func (am *AuthManager) SetEnabled(enabled bool) error {
 	return am.saveConfig()
 }
 
+// GetPreferences returns a user's preferences (defaults for unknown users and guests)
+func (am *AuthManager) GetPreferences(username string) UserPreferences {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+	return am.users[username].Preferences
+}
+
+// SetPreferences updates a user's preferences
+func (am *AuthManager) SetPreferences(username string, prefs UserPreferences) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	user, exists := am.users[username]
+	if !exists {
+		return &AuthError{Message: "User not found"}
+	}
+	user.Preferences = prefs
+	am.users[username] = user
+	return am.saveUsers()
+}
+
+// IsAdmin reports whether a user is an administrator (users.json flag or CYH_ADMIN_USERS)
+func (am *AuthManager) IsAdmin(username string) bool {
+	if username == "" || username == "guest" {
+		return false
+	}
+	if serverConfig.AdminUsers[username] {
+		return true
+	}
+
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+	return am.users[username].IsAdmin
+}
+
 // HasUsers returns if there are any registered users
 func (am *AuthManager) HasUsers() bool {
 	am.mu.RLock()
@@ -248,6 +436,44 @@ func (am *AuthManager) HasUsers() bool {
 	return len(am.users) > 0
 }
 
+// ResetAdmin makes a user an administrator with a new random password,
+// creating the user if needed, and logs out their existing sessions. The
+// password is returned so it can be shown once; only its hash is kept.
+func (am *AuthManager) ResetAdmin(username string) (string, error) {
+	if len(username) < 3 || username == "guest" {
+		return "", &AuthError{Message: "Username must be at least 3 chars and not guest"}
+	}
+
+	password := generatePassword()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	am.mu.Lock()
+	defer am.mu.Unlock()
+
+	user, exists := am.users[username]
+	if !exists {
+		user = User{Username: username, CreatedAt: time.Now()}
+	}
+	user.PasswordHash = string(hash)
+	user.IsAdmin = true
+	am.users[username] = user
+	if err := am.saveUsers(); err != nil {
+		return "", err
+	}
+
+	for token, session := range am.sessions {
+		if session.Username == username {
+			delete(am.sessions, token)
+		}
+	}
+	am.saveSessions()
+
+	return password, nil
+}
+
 // AuthError represents an authentication error
 type AuthError struct {
 	Message string
@@ -263,6 +489,13 @@ func generateToken() string {
 	return hex.EncodeToString(bytes)
 }
 
+// generatePassword returns a random 24-character password
+func generatePassword() string {
+	bytes := make([]byte, 12)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
+
 // HTTP Handlers
 
 func handleAuthLogin(w http.ResponseWriter, r *http.Request) {
@@ -294,7 +527,7 @@ func handleAuthLogin(w http.ResponseWriter, r *http.Request) {
 		Name:     "cyh_session",
 		Value:    token,
 		Path:     "/",
-		MaxAge:   604800, // 7 days
+		MaxAge:   authManager.CookieMaxAge(),
 		HttpOnly: true,
 		SameSite: http.SameSiteStrictMode,
 	})
@@ -341,7 +574,7 @@ func handleAuthSignup(w http.ResponseWriter, r *http.Request) {
 		Name:     "cyh_session",
 		Value:    token,
 		Path:     "/",
-		MaxAge:   604800, // 7 days
+		MaxAge:   authManager.CookieMaxAge(),
 		HttpOnly: true,
 		SameSite: http.SameSiteStrictMode,
 	})
@@ -383,6 +616,13 @@ func handleAuthStatus(w http.ResponseWriter, r *http.Request) {
 		"has_users":    authManager.HasUsers(),
 		"logged_in":    false,
 		"username":     "",
+		"maintenance":  false,
+	}
+
+	// Lets pages say why new terminals are refused (see maintenance.go)
+	if message, on := maintenance.Active(); on {
+		response["maintenance"] = true
+		response["maintenance_message"] = message
 	}
 
 	cookie, err := r.Cookie("cyh_session")
@@ -431,6 +671,57 @@ func handleAuthSettings(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 }
 
+// handlePreferences gets or updates the logged-in user's preferences
+func handlePreferences(w http.ResponseWriter, r *http.Request) {
+	username := ""
+	if cookie, err := r.Cookie("cyh_session"); err == nil {
+		if user, valid := authManager.ValidateSession(cookie.Value); valid {
+			username = user
+		}
+	}
+
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(authManager.GetPreferences(username))
+
+	case http.MethodPost:
+		// Decode over the current values so omitted fields are kept
+		prefs := authManager.GetPreferences(username)
+		if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+
+		if err := authManager.SetPreferences(username, prefs); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(prefs)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// redirectsToLogin reports whether a request without a valid login is for a
+// frontend page, which is sent to the login page instead of getting a 401.
+// Client-side routes count when a browser navigates to them.
+func redirectsToLogin(r *http.Request) bool {
+	path := r.URL.Path
+	if path == "/" || path == "/index.html" {
+		return true
+	}
+	return isFrontendRoute(path) && strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
 // AuthMiddleware checks authentication for protected routes
 func authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -457,7 +748,7 @@ func authMiddleware(next http.Handler) http.Handler {
 		cookie, err := r.Cookie("cyh_session")
 		if err != nil {
 			// Redirect to login for HTML pages
-			if path == "/" || path == "/index.html" {
+			if redirectsToLogin(r) {
 				http.Redirect(w, r, "/login.html", http.StatusFound)
 				return
 			}
@@ -466,7 +757,7 @@ func authMiddleware(next http.Handler) http.Handler {
 		}
 
 		if _, valid := authManager.ValidateSession(cookie.Value); !valid {
-			if path == "/" || path == "/index.html" {
+			if redirectsToLogin(r) {
 				http.Redirect(w, r, "/login.html", http.StatusFound)
 				return
 			}
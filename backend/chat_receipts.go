@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Chat read receipts (CYH_CHAT_READ_RECEIPTS). Every chat message gets an
+// id unique within its room; viewer clients acknowledge the messages they
+// render and the owner is told how many viewers saw each one.
+const (
+	MsgTypeChatSeen    = "chat_seen"    // Viewer: {"type":"chat_seen","data":{"message_id":7}}
+	MsgTypeChatReceipt = "chat_receipt" // Owner: {"type":"chat_receipt","data":{"message_id":7,"seen":3,"viewers":5}}
+)
+
+// maxTrackedChatMessages is how many of a room's latest chat messages keep
+// receipts; acknowledging older ones does nothing
+const maxTrackedChatMessages = 50
+
+// chatReceipts tracks who saw a room's recent chat messages. The room's mu
+// guards it.
+type chatReceipts struct {
+	lastID  uint64
+	senders map[uint64]string
+	seen    map[uint64]map[string]bool
+}
+
+// track numbers a chat message and starts tracking its receipts, forgetting
+// the message that falls out of the tracked window
+func (c *chatReceipts) track(msg *LiveMessage) {
+	if c.seen == nil {
+		c.senders = make(map[uint64]string)
+		c.seen = make(map[uint64]map[string]bool)
+	}
+	c.lastID++
+	msg.ID = c.lastID
+	c.senders[msg.ID] = msg.Sender
+	c.seen[msg.ID] = make(map[string]bool)
+
+	if c.lastID > maxTrackedChatMessages {
+		old := c.lastID - maxTrackedChatMessages
+		delete(c.senders, old)
+		delete(c.seen, old)
+	}
+}
+
+// markSeen records that a viewer saw a message, returning how many viewers
+// have. It reports false when nothing changed: the message isn't tracked,
+// the viewer wrote it, or already saw it.
+func (c *chatReceipts) markSeen(id uint64, username string) (int, bool) {
+	seen, ok := c.seen[id]
+	if !ok || username == c.senders[id] || seen[username] {
+		return 0, false
+	}
+	seen[username] = true
+	return len(seen), true
+}
+
+// chatViewers counts the viewers who can acknowledge a message from sender:
+// everyone but the owner, the sender and those without an input path
+// (mirrors, SSE viewers). Receipts are per user, so a viewer with several
+// tabs open counts once. The caller holds room.mu.
+func (room *LiveRoom) chatViewers(sender string) int {
+	users := make(map[string]bool)
+	for viewer := range room.Viewers {
+		if !viewer.IsOwner && !viewer.viewOnly && viewer.Username != sender {
+			users[viewer.Username] = true
+		}
+	}
+	return len(users)
+}
+
+// markChatSeen handles a viewer's chat_seen and reports the new seen count
+// to the owner on /ws/live and their terminals
+func (h *LiveHub) markChatSeen(v *LiveViewer, data interface{}) {
+	if !serverConfig.ChatReadReceipts {
+		return
+	}
+	fields, _ := data.(map[string]interface{})
+	id, ok := fields["message_id"].(float64)
+	if !ok || id < 1 {
+		return
+	}
+	room := h.GetRoom(v.SessionID)
+	if room == nil {
+		return
+	}
+
+	room.mu.Lock()
+	seen, changed := room.chat.markSeen(uint64(id), v.Username)
+	viewers := room.chatViewers(room.chat.senders[uint64(id)])
+	room.mu.Unlock()
+	if !changed {
+		return
+	}
+
+	receipt := &LiveMessage{
+		Type:      MsgTypeChatReceipt,
+		SessionID: v.SessionID,
+		Data: map[string]interface{}{
+			"message_id": uint64(id),
+			"seen":       seen,
+			"viewers":    viewers,
+		},
+		Timestamp: time.Now().UnixMilli(),
+	}
+	msgData, _ := json.Marshal(receipt)
+
+	room.mu.RLock()
+	for viewer := range room.Viewers {
+		if viewer.IsOwner {
+			viewer.trySend(msgData)
+		}
+	}
+	room.mu.RUnlock()
+	h.notifyOwner(receipt)
+}
@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestChatViewersCountsUsersOnce(t *testing.T) {
+	room := &LiveRoom{Viewers: map[*LiveViewer]bool{
+		{Username: "owner", IsOwner: true}:         true,
+		{Username: "alice"}:                        true,
+		{Username: "alice"}:                        true, // Second tab
+		{Username: "bob"}:                          true,
+		{Username: "guest_ab12cd", viewOnly: true}: true,
+	}}
+	if got := room.chatViewers("owner"); got != 2 {
+		t.Fatalf("chatViewers(owner) = %d, want 2", got)
+	}
+	if got := room.chatViewers("alice"); got != 1 {
+		t.Fatalf("chatViewers(alice) = %d, want 1", got)
+	}
+}
+
+func TestChatReceiptsSeenByAllWithTwoTabs(t *testing.T) {
+	room := &LiveRoom{Viewers: map[*LiveViewer]bool{
+		{Username: "alice"}: true,
+		{Username: "alice"}: true,
+		{Username: "bob"}:   true,
+	}}
+	msg := &LiveMessage{Type: MsgTypeChat, Sender: "owner"}
+	room.chat.track(msg)
+
+	room.chat.markSeen(msg.ID, "alice")
+	if _, changed := room.chat.markSeen(msg.ID, "alice"); changed {
+		t.Fatal("alice's second tab counted again")
+	}
+	seen, _ := room.chat.markSeen(msg.ID, "bob")
+	if viewers := room.chatViewers(msg.Sender); seen != viewers {
+		t.Fatalf("seen = %d, viewers = %d; want all viewers to have seen it", seen, viewers)
+	}
+}
@@ -2,16 +2,47 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 const (
 	MaxHistoryItems = 500
+
+	// Page size for /api/history when only offset is given
+	DefaultHistoryPageSize = 50
+
+	// Entries on each side of a single entry from /api/history/{index}
+	DefaultHistoryContext = 3
+	MaxHistoryContext     = 50
+
+	// Limits for uploaded history imports
+	MaxHistoryImportBytes = 2 << 20 // 2MB
+	MaxHistoryImportItems = 5000
+
+	// Appended to commands cut at the configured maximum length
+	HistoryTruncateMarker = " …[truncated]"
 )
 
+// ErrCommandTooLong is returned when long commands are rejected rather than truncated
+var ErrCommandTooLong = errors.New("command exceeds the maximum history length")
+
+// ErrHistoryIncognito is returned when importing history for a user with incognito history on
+var ErrHistoryIncognito = errors.New("incognito history is on, turn it off to import history")
+
+// historyIncognito reports whether a user turned on incognito history. Their
+// commands aren't saved, and history saved before reads as empty until they
+// turn it off; clearing it still works. Callers don't hold h.mu.
+func historyIncognito(username string) bool {
+	return username != "" && authManager.GetPreferences(username).IncognitoHistory
+}
+
 // CommandEntry represents a single command in history
 type CommandEntry struct {
 	Command   string    `json:"command"`
@@ -29,40 +60,76 @@ type CommandHistory struct {
 	mu       sync.RWMutex
 	users    map[string]*UserHistory // username -> history
 	dataDir  string
+
+	// Users with commands not yet written, saved together when saveTimer fires
+	dirty     map[string]bool
+	saveTimer *time.Timer
+
+	// Set when the data dir can't be written; history is then kept in memory only
+	persistErr error
 }
 
-var cmdHistory = &CommandHistory{
-	users: make(map[string]*UserHistory),
+// HistoryStatus reports whether command history is being persisted. It
+// leaves out host paths; the server log names the data dir.
+type HistoryStatus struct {
+	Persistent bool   `json:"persistent"`
+	Error      string `json:"error,omitempty"`
 }
 
-// getHistoryDir returns the directory for storing history
-func getHistoryDir() string {
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		homeDir = "/tmp"
-	}
-	return filepath.Join(homeDir, ".cyh_terminal")
+var cmdHistory = &CommandHistory{
+	users: make(map[string]*UserHistory),
+	dirty: make(map[string]bool),
 }
 
-// Init initializes the command history
-func (h *CommandHistory) Init() error {
+// Init initializes the command history stored under dataDir
+func (h *CommandHistory) Init(dataDir string) error {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	h.dataDir = getHistoryDir()
+	h.dataDir = dataDir
 	if err := os.MkdirAll(h.dataDir, 0755); err != nil {
+		h.setPersistError(err)
 		return err
 	}
 
 	// Also create users directory
 	usersDir := filepath.Join(h.dataDir, "users")
 	if err := os.MkdirAll(usersDir, 0755); err != nil {
+		h.setPersistError(err)
 		return err
 	}
 
 	return nil
 }
 
+// setPersistError records a write failure, warning once when persistence
+// stops working (callers hold h.mu)
+func (h *CommandHistory) setPersistError(err error) {
+	if err != nil && h.persistErr == nil {
+		logWarnf("⚠️  Command history can't be written to %s (%v). Keeping history in memory only.", h.dataDir, err)
+	} else if err == nil && h.persistErr != nil {
+		logInfof("✅ Command history persistence restored")
+	}
+	h.persistErr = err
+}
+
+// Status reports whether history is being written to disk
+func (h *CommandHistory) Status() HistoryStatus {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	status := HistoryStatus{Persistent: h.persistErr == nil}
+	if h.persistErr != nil {
+		status.Error = h.persistErr.Error()
+		// "open /data/...: read-only file system" without the path
+		var pathErr *os.PathError
+		if errors.As(h.persistErr, &pathErr) {
+			status.Error = pathErr.Err.Error()
+		}
+	}
+	return status
+}
+
 // getUserHistoryPath returns the file path for a user's history
 func (h *CommandHistory) getUserHistoryPath(username string) string {
 	if username == "" {
@@ -91,8 +158,10 @@ func (h *CommandHistory) loadUserHistory(username string) *UserHistory {
 	return uh
 }
 
-// saveUserHistory saves history for a specific user
+// saveUserHistory saves history for a specific user. Write failures fall back
+// to in-memory history rather than failing the caller.
 func (h *CommandHistory) saveUserHistory(username string) error {
+	delete(h.dirty, username)
 	uh := h.users[username]
 	if uh == nil {
 		return nil
@@ -103,23 +172,63 @@ func (h *CommandHistory) saveUserHistory(username string) error {
 		return err
 	}
 
-	return os.WriteFile(h.getUserHistoryPath(username), data, 0644)
+	// Drop the oldest entries until the file fits the size cap
+	maxBytes := serverConfig.HistoryMaxFileBytes
+	for maxBytes > 0 && len(data) > maxBytes && len(uh.Commands) > 1 {
+		drop := len(uh.Commands) / 10
+		if drop < 1 {
+			drop = 1
+		}
+		uh.Commands = uh.Commands[drop:]
+		if data, err = json.MarshalIndent(uh.Commands, "", "  "); err != nil {
+			return err
+		}
+	}
+
+	h.setPersistError(os.WriteFile(h.getUserHistoryPath(username), data, 0644))
+	return nil
 }
 
-// AddCommand adds a new command to a user's history
-func (h *CommandHistory) AddCommand(username, mode, command string) error {
+// limitCommandLength applies the configured maximum command length.
+// It returns the command to store and whether it was truncated.
+func limitCommandLength(command string) (string, bool, error) {
+	maxLen := serverConfig.HistoryMaxCommandLength
+	if maxLen <= 0 || len(command) <= maxLen {
+		return command, false, nil
+	}
+	if !serverConfig.HistoryTruncateCommands {
+		return "", false, ErrCommandTooLong
+	}
+
+	// Cut on a rune boundary
+	cut := maxLen
+	for cut > 0 && !utf8.RuneStart(command[cut]) {
+		cut--
+	}
+	return command[:cut] + HistoryTruncateMarker, true, nil
+}
+
+// AddCommand adds a new command to a user's history, unless they use
+// incognito history. It reports whether the command was truncated to the
+// configured maximum length.
+func (h *CommandHistory) AddCommand(username, mode, command string) (bool, error) {
+	if command == "" || historyIncognito(username) {
+		return false, nil
+	}
+
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	if command == "" {
-		return nil
+	command, truncated, err := limitCommandLength(command)
+	if err != nil {
+		return false, err
 	}
 
 	uh := h.loadUserHistory(username)
 
 	// Don't add duplicate consecutive commands
 	if len(uh.Commands) > 0 && uh.Commands[len(uh.Commands)-1].Command == command {
-		return nil
+		return truncated, nil
 	}
 
 	entry := CommandEntry{
@@ -135,18 +244,117 @@ func (h *CommandHistory) AddCommand(username, mode, command string) error {
 		uh.Commands = uh.Commands[len(uh.Commands)-MaxHistoryItems:]
 	}
 
-	return h.saveUserHistory(username)
+	return truncated, h.scheduleSave(username)
+}
+
+// scheduleSave marks a user's history for saving. Rapid commands are written
+// together at most once per HistorySaveInterval; with no interval the
+// history is saved right away. Callers hold h.mu.
+func (h *CommandHistory) scheduleSave(username string) error {
+	interval := serverConfig.HistorySaveInterval
+	if interval <= 0 {
+		return h.saveUserHistory(username)
+	}
+
+	h.dirty[username] = true
+	if h.saveTimer == nil {
+		h.saveTimer = time.AfterFunc(interval, h.saveDirty)
+	}
+	return nil
+}
+
+// saveDirty writes every history with unsaved commands when the save timer fires
+func (h *CommandHistory) saveDirty() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.saveTimer = nil
+	h.flushLocked()
+}
+
+// Flush writes every history with unsaved commands. It is called on shutdown
+// so commands added since the last save aren't lost.
+func (h *CommandHistory) Flush() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.saveTimer != nil {
+		h.saveTimer.Stop()
+		h.saveTimer = nil
+	}
+	return h.flushLocked()
+}
+
+// flushLocked saves the dirty histories, returning the first error. Callers hold h.mu.
+func (h *CommandHistory) flushLocked() error {
+	var firstErr error
+	for username := range h.dirty {
+		if err := h.saveUserHistory(username); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		firstErr = h.persistErr
+	}
+	return firstErr
+}
+
+// HistoryEntryContext is one history entry with the commands around it
+type HistoryEntryContext struct {
+	Index  int            `json:"index"` // Position in the user's history, newest first like /api/history
+	Entry  CommandEntry   `json:"entry"`
+	Before []CommandEntry `json:"before"` // Up to around commands run before it, newest first
+	After  []CommandEntry `json:"after"`  // Up to around commands run after it, newest first
+	Total  int            `json:"total"`
+}
+
+// GetEntryContext returns the entry at index in the user's history for mode
+// (indexed newest first, like /api/history?mode=) with up to around entries
+// on either side
+func (h *CommandHistory) GetEntryContext(username, mode string, index, around int) (HistoryEntryContext, bool) {
+	if historyIncognito(username) {
+		return HistoryEntryContext{}, false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var entries []CommandEntry
+	commands := h.loadUserHistory(username).Commands
+	for i := len(commands) - 1; i >= 0; i-- {
+		if mode == "" || commands[i].Mode == mode {
+			entries = append(entries, commands[i])
+		}
+	}
+	if index < 0 || index >= len(entries) {
+		return HistoryEntryContext{}, false
+	}
+
+	start := max(index-around, 0)
+	end := min(index+around+1, len(entries))
+	return HistoryEntryContext{
+		Index:  index,
+		Entry:  entries[index],
+		Before: append([]CommandEntry{}, entries[index+1:end]...),
+		After:  append([]CommandEntry{}, entries[start:index]...),
+		Total:  len(entries),
+	}, true
 }
 
 // GetHistory returns commands for a specific user and mode
 func (h *CommandHistory) GetHistory(username, mode string) []CommandEntry {
-	h.mu.RLock()
-	defer h.mu.RUnlock()
+	if historyIncognito(username) {
+		return []CommandEntry{}
+	}
+
+	// Lock, not RLock: loading a user's history caches it
+	h.mu.Lock()
+	defer h.mu.Unlock()
 
 	uh := h.loadUserHistory(username)
 
 	if mode == "" {
-		return uh.Commands
+		return append([]CommandEntry{}, uh.Commands...)
 	}
 
 	var filtered []CommandEntry
@@ -158,6 +366,68 @@ func (h *CommandHistory) GetHistory(username, mode string) []CommandEntry {
 	return filtered
 }
 
+// HistoryQuery narrows a history search; zero fields don't filter
+type HistoryQuery struct {
+	Mode string
+	From time.Time // Inclusive
+	To   time.Time // Inclusive
+	Text string    // Case-insensitive substring of the command
+}
+
+// SearchHistory returns a user's commands matching q, newest first (history
+// is kept in timestamp order, imports included)
+func (h *CommandHistory) SearchHistory(username string, q HistoryQuery) []CommandEntry {
+	if historyIncognito(username) {
+		return []CommandEntry{}
+	}
+
+	// Lock, not RLock: loading a user's history caches it
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	uh := h.loadUserHistory(username)
+	text := strings.ToLower(q.Text)
+
+	matches := []CommandEntry{}
+	for i := len(uh.Commands) - 1; i >= 0; i-- {
+		cmd := uh.Commands[i]
+		if q.Mode != "" && cmd.Mode != q.Mode {
+			continue
+		}
+		if !q.From.IsZero() && cmd.Timestamp.Before(q.From) {
+			continue
+		}
+		if !q.To.IsZero() && cmd.Timestamp.After(q.To) {
+			continue
+		}
+		if text != "" && !strings.Contains(strings.ToLower(cmd.Command), text) {
+			continue
+		}
+		matches = append(matches, cmd)
+	}
+	return matches
+}
+
+// HistoryPage is one page of a user's history, newest first
+type HistoryPage struct {
+	Commands []CommandEntry `json:"commands"`
+	Total    int            `json:"total"` // Matching commands across all pages
+	Offset   int            `json:"offset"`
+	Limit    int            `json:"limit"`
+}
+
+// paginateHistory returns entries[offset:offset+limit], clamped to the slice
+func paginateHistory(entries []CommandEntry, offset, limit int) []CommandEntry {
+	if offset >= len(entries) {
+		return []CommandEntry{}
+	}
+	end := len(entries)
+	if limit < end-offset {
+		end = offset + limit
+	}
+	return entries[offset:end]
+}
+
 // ClearHistory clears history for a specific user
 func (h *CommandHistory) ClearHistory(username, mode string) error {
 	h.mu.Lock()
@@ -179,3 +449,81 @@ func (h *CommandHistory) ClearHistory(username, mode string) error {
 
 	return h.saveUserHistory(username)
 }
+
+// ExportHistory returns a copy of a user's full history
+func (h *CommandHistory) ExportHistory(username string) []CommandEntry {
+	if historyIncognito(username) {
+		return []CommandEntry{}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	uh := h.loadUserHistory(username)
+	entries := make([]CommandEntry, len(uh.Commands))
+	copy(entries, uh.Commands)
+	return entries
+}
+
+// ImportHistory merges entries into a user's history in chronological order.
+// Entries already present (same command, mode and timestamp) and entries with
+// an empty command or invalid timestamp are skipped. Returns the number added.
+func (h *CommandHistory) ImportHistory(username string, entries []CommandEntry) (int, error) {
+	if historyIncognito(username) {
+		return 0, ErrHistoryIncognito
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	uh := h.loadUserHistory(username)
+
+	type entryKey struct {
+		command string
+		mode    string
+		ts      int64
+	}
+	seen := make(map[entryKey]bool, len(uh.Commands))
+	for _, e := range uh.Commands {
+		seen[entryKey{e.Command, e.Mode, e.Timestamp.UnixMilli()}] = true
+	}
+
+	// Allow a little clock skew between machines
+	latest := time.Now().Add(5 * time.Minute)
+
+	added := 0
+	merged := append([]CommandEntry{}, uh.Commands...)
+	for _, e := range entries {
+		if e.Command == "" || e.Timestamp.IsZero() || e.Timestamp.After(latest) {
+			continue
+		}
+		command, _, err := limitCommandLength(e.Command)
+		if err != nil {
+			continue
+		}
+		e.Command = command
+		key := entryKey{e.Command, e.Mode, e.Timestamp.UnixMilli()}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		merged = append(merged, e)
+		added++
+	}
+
+	if added == 0 {
+		return 0, nil
+	}
+
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].Timestamp.Before(merged[j].Timestamp)
+	})
+
+	// Keep the most recent entries
+	if len(merged) > MaxHistoryItems {
+		merged = merged[len(merged)-MaxHistoryItems:]
+	}
+	uh.Commands = merged
+
+	return added, h.saveUserHistory(username)
+}
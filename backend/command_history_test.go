@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestPaginateHistory(t *testing.T) {
+	entries := make([]CommandEntry, 5)
+	for i := range entries {
+		entries[i] = CommandEntry{Command: "cmd" + strconv.Itoa(i)}
+	}
+
+	tests := []struct {
+		name   string
+		offset int
+		limit  int
+		want   []string
+	}{
+		{name: "offset 0", offset: 0, limit: 2, want: []string{"cmd0", "cmd1"}},
+		{name: "offset 0, limit covers all", offset: 0, limit: 5, want: []string{"cmd0", "cmd1", "cmd2", "cmd3", "cmd4"}},
+		{name: "middle page", offset: 2, limit: 2, want: []string{"cmd2", "cmd3"}},
+		{name: "limit crosses the end", offset: 3, limit: 10, want: []string{"cmd3", "cmd4"}},
+		{name: "last entry", offset: 4, limit: 1, want: []string{"cmd4"}},
+		{name: "offset equals len", offset: 5, limit: 2, want: []string{}},
+		{name: "offset past len", offset: 9, limit: 2, want: []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := paginateHistory(entries, tt.offset, tt.limit)
+			if got == nil {
+				t.Fatal("got nil, want an empty slice so the page encodes as []")
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d entries, want %d", len(got), len(tt.want))
+			}
+			for i, e := range got {
+				if e.Command != tt.want[i] {
+					t.Fatalf("entry %d = %q, want %q", i, e.Command, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPaginateHistoryEmpty(t *testing.T) {
+	if got := paginateHistory(nil, 0, 10); got == nil || len(got) != 0 {
+		t.Fatalf("paginateHistory(nil) = %#v, want an empty slice", got)
+	}
+}
+
+func TestHistoryStatusHidesHostPaths(t *testing.T) {
+	h := &CommandHistory{dataDir: "/srv/cyh/data"}
+	h.persistErr = &os.PathError{Op: "open", Path: "/srv/cyh/data/users/bob.json", Err: syscall.EROFS}
+
+	status := h.Status()
+	if status.Persistent {
+		t.Fatal("status reports persistent history after a write error")
+	}
+	if strings.Contains(status.Error, "/srv") {
+		t.Fatalf("status error %q shows a host path", status.Error)
+	}
+	if status.Error != syscall.EROFS.Error() {
+		t.Fatalf("status error = %q, want %q", status.Error, syscall.EROFS.Error())
+	}
+}
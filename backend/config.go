@@ -0,0 +1,398 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServerConfig holds operator-tunable server settings.
+// Values are read from CYH_* environment variables at startup.
+type ServerConfig struct {
+	// Base directory for users, auth sessions/config and command history, and
+	// (when CYH_DATA_DIR is set) the sessions database
+	DataDir        string
+	SessionsDBPath string
+
+	// Directory the frontend is served from; paths matching no file there
+	// get its index.html so client-side routes work
+	FrontendDir string
+
+	// Rate limiting for session/container creation (token bucket per user or guest IP)
+	CreateRatePerMinute float64
+	CreateRateBurst     int
+
+	// Recording backend: "db" (default) or "file" for high-throughput sessions
+	RecordingBackend       string
+	RecordingFlushInterval time.Duration
+
+	// Default recording level for new sessions: full, input_only or none
+	RecordingLevel string
+
+	// Stop recording a session this long after it was created; the terminal
+	// stays open. Zero records for as long as the session runs.
+	MaxRecordingDuration time.Duration
+
+	// Compress recorded event data of at least EventCompressionMinBytes in
+	// the database: "none" (default) or "gzip"
+	EventCompression         string
+	EventCompressionMinBytes int
+
+	// Sessions database backups: where they're written, how often they're
+	// taken automatically (0 only on POST /api/admin/backup) and how many
+	// are kept
+	BackupDir      string
+	BackupInterval time.Duration
+	BackupKeep     int
+
+	// Redact secrets from recorded output by default (per session toggle),
+	// using the built-in patterns plus those in ScrubPatternsFile
+	ScrubOutput       bool
+	ScrubPatternsFile string
+
+	// Record "marker" events where output enters or leaves the alternate
+	// screen, so replays can handle full-screen programs
+	RecordScreenMarkers bool
+
+	// Terminal modes offered to clients, and whether docker connects may
+	// fall back to a local shell while Docker isn't ready
+	EnabledModes        map[string]bool
+	DockerFallbackLocal bool
+
+	// Command history bounds: longest stored command (truncated or rejected
+	// beyond it) and the size cap of each user's history file
+	HistoryMaxCommandLength int
+	HistoryTruncateCommands bool
+	HistoryMaxFileBytes     int
+
+	// Longest a new command waits before the user's history file is written
+	// (0 writes on every command); pending commands are flushed on shutdown
+	HistorySaveInterval time.Duration
+
+	// Remove session containers when sessions end, unless the session asked
+	// to persist its container; persisted containers are reaped once idle
+	ReapContainers   bool
+	ContainerIdleTTL time.Duration
+
+	// Whether guests share one container or get one per session, and how
+	// long a guest container may sit unused before it is removed
+	GuestContainerMode string
+	GuestContainerTTL  time.Duration
+
+	// What happens to a user's cyh_<user>_terminal container from before
+	// per-session containers: keep, remove or migrate (see legacy_containers.go)
+	LegacyContainers string
+
+	// Longest a resumed terminal waits for the shell prompt before telling
+	// the client to replay history anyway
+	ResumeReadyTimeout time.Duration
+
+	// Track the docker shell's working directory (reported by its prompt)
+	// and resume sessions there instead of the home directory
+	RestoreCwd bool
+
+	// How long stopped containers get between SIGTERM and SIGKILL
+	ContainerStopGrace time.Duration
+
+	// Open /ws/terminal and /ws/live connections allowed per guest IP and
+	// per logged-in user (0 means unlimited)
+	GuestConnsPerIP int
+	UserConns       int
+
+	// Per-connection terminal input byte rate; input beyond the burst is
+	// dropped and connections over the rate for InputAbuseTimeout are closed
+	InputBytesPerSecond int
+	InputBurstBytes     int
+	InputAbuseTimeout   time.Duration
+
+	// How duplicate session names per user are handled: allow, reject or suffix
+	SessionNameConflict string
+
+	// Longest session name accepted, in characters (0 for no limit)
+	MaxSessionNameLength int
+
+	// Admission control for new containers (0 disables each check; admins bypass)
+	MaxContainers   int
+	MinFreeMemoryMB int
+
+	// Images each user may save from their containers (0 means unlimited)
+	MaxUserImages int
+
+	// Largest file a terminal may upload into its container over the file
+	// transfer protocol (0 disables uploads)
+	MaxFileTransferMB int
+
+	// JSON file with the env, mounts, limits and entrypoint applied to every
+	// container the server creates (see ContainerProfile)
+	ContainerProfileFile string
+
+	// Extra docker run flags sessions may request, e.g. --cap-add=NET_RAW
+	// (see container_flags.go)
+	ContainerFlags []string
+
+	// Commands looked for in session containers by GET /api/sessions/{id}/tools
+	ToolProbes []string
+
+	// Permission modes live sharing may use, per terminal mode; the first
+	// is the default when a share request doesn't name one
+	ShareModesLocal  []string
+	ShareModesDocker []string
+
+	// How long a live session's owner may go without typing or acting on
+	// the share before it falls back to view only (0 disables), and how
+	// long before that the room and the owner are warned
+	ShareIdleTimeout time.Duration
+	ShareIdleWarning time.Duration
+
+	// Tell the owner how many viewers saw each live chat message
+	ChatReadReceipts bool
+
+	// Usernames granted admin rights in addition to users.json is_admin flags
+	AdminUsers map[string]bool
+
+	// Log output: text or json, and the least severe level written
+	// (debug, info, warn or error)
+	LogFormat string
+	LogLevel  string
+}
+
+var serverConfig = LoadServerConfig()
+
+// LoadServerConfig reads the server configuration from the environment
+func LoadServerConfig() *ServerConfig {
+	// The sessions DB stays in the working directory unless a data dir is configured
+	dataDir := envString("CYH_DATA_DIR", "")
+	sessionsDB := "sessions.db"
+	if dataDir != "" {
+		sessionsDB = filepath.Join(dataDir, "sessions.db")
+	} else {
+		dataDir = defaultDataDir()
+	}
+
+	return &ServerConfig{
+		DataDir:        dataDir,
+		SessionsDBPath: sessionsDB,
+
+		FrontendDir: envString("CYH_FRONTEND_DIR", "../frontend"),
+
+		CreateRatePerMinute: envFloat("CYH_CREATE_RATE_PER_MINUTE", 6),
+		CreateRateBurst:     envInt("CYH_CREATE_RATE_BURST", 5),
+
+		RecordingBackend:       envString("CYH_RECORDING_BACKEND", RecordingBackendDB),
+		RecordingFlushInterval: envDuration("CYH_RECORDING_FLUSH_INTERVAL", 500*time.Millisecond),
+		RecordingLevel:         envString("CYH_RECORDING_LEVEL", RecordingLevelFull),
+		MaxRecordingDuration:   envDuration("CYH_MAX_RECORDING_DURATION", 0),
+
+		EventCompression:         envString("CYH_EVENT_COMPRESSION", EventCompressionNone),
+		EventCompressionMinBytes: envInt("CYH_EVENT_COMPRESSION_MIN_BYTES", 1024),
+
+		BackupDir:      envString("CYH_BACKUP_DIR", filepath.Join(dataDir, "backups")),
+		BackupInterval: envDuration("CYH_BACKUP_INTERVAL", 0),
+		BackupKeep:     envInt("CYH_BACKUP_KEEP", 7),
+
+		ScrubOutput:       envBool("CYH_SCRUB_OUTPUT", false),
+		ScrubPatternsFile: envString("CYH_SCRUB_PATTERNS_FILE", ""),
+
+		RecordScreenMarkers: envBool("CYH_RECORD_SCREEN_MARKERS", true),
+
+		EnabledModes:        envSet("CYH_ENABLED_MODES", "local,docker"),
+		DockerFallbackLocal: envBool("CYH_DOCKER_FALLBACK_LOCAL", true),
+
+		HistoryMaxCommandLength: envInt("CYH_HISTORY_MAX_COMMAND_LENGTH", 4096),
+		HistoryTruncateCommands: envBool("CYH_HISTORY_TRUNCATE_COMMANDS", true),
+		HistoryMaxFileBytes:     envInt("CYH_HISTORY_MAX_FILE_BYTES", 1<<20),
+		HistorySaveInterval:     envDurationOrZero("CYH_HISTORY_SAVE_INTERVAL", 2*time.Second),
+
+		ReapContainers:   envBool("CYH_REAP_CONTAINERS", false),
+		ContainerIdleTTL: envDuration("CYH_CONTAINER_IDLE_TTL", 24*time.Hour),
+
+		GuestContainerMode: envString("CYH_GUEST_CONTAINER_MODE", GuestContainersIsolated),
+		GuestContainerTTL:  envDurationOrZero("CYH_GUEST_CONTAINER_TTL", 30*time.Minute),
+
+		LegacyContainers: envString("CYH_LEGACY_CONTAINERS", LegacyContainersKeep),
+
+		ContainerStopGrace: envDuration("CYH_CONTAINER_STOP_GRACE", 10*time.Second),
+
+		ResumeReadyTimeout: envDuration("CYH_RESUME_READY_TIMEOUT", 5*time.Second),
+		RestoreCwd:         envBool("CYH_RESTORE_CWD", true),
+
+		GuestConnsPerIP: envInt("CYH_GUEST_CONNS_PER_IP", 20),
+		UserConns:       envInt("CYH_USER_CONNS", 0),
+
+		InputBytesPerSecond: envInt("CYH_INPUT_BYTES_PER_SECOND", 16*1024),
+		InputBurstBytes:     envInt("CYH_INPUT_BURST_BYTES", 256*1024),
+		InputAbuseTimeout:   envDuration("CYH_INPUT_ABUSE_TIMEOUT", 10*time.Second),
+
+		SessionNameConflict: envString("CYH_SESSION_NAME_CONFLICT", SessionNamesAllow),
+
+		MaxSessionNameLength: envInt("CYH_MAX_SESSION_NAME_LENGTH", 100),
+
+		MaxContainers:   envInt("CYH_MAX_CONTAINERS", 0),
+		MinFreeMemoryMB: envInt("CYH_MIN_FREE_MEMORY_MB", 0),
+
+		MaxUserImages: envInt("CYH_MAX_USER_IMAGES", 5),
+
+		MaxFileTransferMB: envInt("CYH_MAX_FILE_TRANSFER_MB", 512),
+
+		ContainerProfileFile: envString("CYH_CONTAINER_PROFILE", ""),
+		ContainerFlags:       envList("CYH_CONTAINER_FLAGS", ""),
+
+		ToolProbes: envList("CYH_TOOL_PROBES", defaultToolProbes),
+
+		ShareModesLocal:  envList("CYH_SHARE_MODES_LOCAL", defaultShareModes),
+		ShareModesDocker: envList("CYH_SHARE_MODES_DOCKER", defaultShareModes),
+		ShareIdleTimeout: envDuration("CYH_SHARE_IDLE_TIMEOUT", 0),
+		ShareIdleWarning: envDurationOrZero("CYH_SHARE_IDLE_WARNING", 30*time.Second),
+		ChatReadReceipts: envBool("CYH_CHAT_READ_RECEIPTS", true),
+
+		AdminUsers: envSet("CYH_ADMIN_USERS", ""),
+
+		LogFormat: envString("CYH_LOG_FORMAT", LogFormatText),
+		LogLevel:  envString("CYH_LOG_LEVEL", "info"),
+	}
+}
+
+// IsModeEnabled reports whether a terminal mode may be used
+func (c *ServerConfig) IsModeEnabled(mode string) bool {
+	return c.EnabledModes[mode]
+}
+
+// AllowedShareModes lists the permission modes sessions of a terminal mode
+// may be shared with, default first. Unknown entries are ignored; with none
+// left, sessions can only be shared view-only.
+func (c *ServerConfig) AllowedShareModes(terminalMode string) []PermissionMode {
+	configured := c.ShareModesLocal
+	if terminalMode == "docker" {
+		configured = c.ShareModesDocker
+	}
+
+	var modes []PermissionMode
+	for _, m := range configured {
+		mode := PermissionMode(m)
+		switch mode {
+		case PermissionViewOnly, PermissionSharedControl, PermissionInstructor:
+		default:
+			continue
+		}
+		if !containsPermissionMode(modes, mode) {
+			modes = append(modes, mode)
+		}
+	}
+	if len(modes) == 0 {
+		modes = []PermissionMode{PermissionViewOnly}
+	}
+	return modes
+}
+
+// IsShareModeAllowed reports whether sessions of a terminal mode may be
+// shared with a permission mode
+func (c *ServerConfig) IsShareModeAllowed(terminalMode string, mode PermissionMode) bool {
+	return containsPermissionMode(c.AllowedShareModes(terminalMode), mode)
+}
+
+// ClampShareMode returns mode if sessions of a terminal mode may still be
+// shared with it, else view-only when that is allowed, else the default. It
+// keeps sessions shared before the operator narrowed the modes in bounds.
+func (c *ServerConfig) ClampShareMode(terminalMode string, mode PermissionMode) PermissionMode {
+	allowed := c.AllowedShareModes(terminalMode)
+	if containsPermissionMode(allowed, mode) {
+		return mode
+	}
+	if containsPermissionMode(allowed, PermissionViewOnly) {
+		return PermissionViewOnly
+	}
+	return allowed[0]
+}
+
+// CanGrantWrite reports whether viewers of sessions of a terminal mode may
+// be given write access, which only the typing modes allow
+func (c *ServerConfig) CanGrantWrite(terminalMode string) bool {
+	return c.IsShareModeAllowed(terminalMode, PermissionSharedControl) ||
+		c.IsShareModeAllowed(terminalMode, PermissionInstructor)
+}
+
+func containsPermissionMode(modes []PermissionMode, mode PermissionMode) bool {
+	for _, m := range modes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultDataDir is ~/.cyh_terminal (or /tmp/.cyh_terminal without a home directory)
+func defaultDataDir() string {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		homeDir = "/tmp"
+	}
+	return filepath.Join(homeDir, ".cyh_terminal")
+}
+
+func envString(key, def string) string {
+	if v := strings.TrimSpace(os.Getenv(key)); v != "" {
+		return v
+	}
+	return def
+}
+
+func envInt(key string, def int) int {
+	if v, err := strconv.Atoi(strings.TrimSpace(os.Getenv(key))); err == nil {
+		return v
+	}
+	return def
+}
+
+func envFloat(key string, def float64) float64 {
+	if v, err := strconv.ParseFloat(strings.TrimSpace(os.Getenv(key)), 64); err == nil {
+		return v
+	}
+	return def
+}
+
+func envBool(key string, def bool) bool {
+	if v, err := strconv.ParseBool(strings.TrimSpace(os.Getenv(key))); err == nil {
+		return v
+	}
+	return def
+}
+
+// envSet parses a comma-separated list into a set
+func envSet(key, def string) map[string]bool {
+	set := make(map[string]bool)
+	for _, item := range strings.Split(envString(key, def), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			set[item] = true
+		}
+	}
+	return set
+}
+
+// envList parses a comma-separated list, keeping its order
+func envList(key, def string) []string {
+	var list []string
+	for _, item := range strings.Split(envString(key, def), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	if v, err := time.ParseDuration(strings.TrimSpace(os.Getenv(key))); err == nil && v > 0 {
+		return v
+	}
+	return def
+}
+
+// envDurationOrZero is envDuration for settings where 0 means something
+// (off, or right away) rather than the default
+func envDurationOrZero(key string, def time.Duration) time.Duration {
+	if v, err := time.ParseDuration(strings.TrimSpace(os.Getenv(key))); err == nil && v >= 0 {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// ConnLimiter counts open WebSocket connections per key (a guest's IP or a
+// user) so one client can't hold hundreds of terminals or viewer sockets
+type ConnLimiter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// wsConnLimiter guards /ws/terminal, /ws/live, /ws/mirror, replay sockets
+// and the live event stream
+var wsConnLimiter = NewConnLimiter()
+
+func NewConnLimiter() *ConnLimiter {
+	return &ConnLimiter{counts: make(map[string]int)}
+}
+
+// Acquire takes one of key's limit connection slots (0 means unlimited). It
+// returns false when all are in use; otherwise release must be called once
+// the connection closes.
+func (cl *ConnLimiter) Acquire(key string, limit int) (release func(), ok bool) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if limit > 0 && cl.counts[key] >= limit {
+		return nil, false
+	}
+	cl.counts[key]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			cl.mu.Lock()
+			defer cl.mu.Unlock()
+			if cl.counts[key]--; cl.counts[key] <= 0 {
+				delete(cl.counts, key)
+			}
+		})
+	}, true
+}
+
+// acquireWSConn reserves a WebSocket connection (or event stream) for the
+// caller before the upgrade: guests are limited per IP (CYH_GUEST_CONNS_PER_IP), logged-in users
+// per account (CYH_USER_CONNS). Over the limit it writes a 429 and returns
+// false; otherwise release must be called when the connection closes.
+func acquireWSConn(w http.ResponseWriter, r *http.Request, username string) (release func(), ok bool) {
+	key := rateLimitKey(r, username)
+	limit := serverConfig.UserConns
+	if username == "" || username == "guest" {
+		limit = serverConfig.GuestConnsPerIP
+	}
+
+	release, ok = wsConnLimiter.Acquire(key, limit)
+	if ok {
+		return release, true
+	}
+
+	logWarnf("Rejected connect to %s from %s: %d connections open", r.URL.Path, key, limit)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": "Too many open connections, close some first",
+		"limit": limit,
+	})
+	return nil, false
+}
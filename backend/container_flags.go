@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// MaxContainerFlags caps the extra docker run flags one session may request
+const MaxContainerFlags = 10
+
+// containerFlagValues lists the docker run flags CYH_CONTAINER_FLAGS may
+// allow, and whether each takes a value. Anything else (--network, -v,
+// --pid, ...) can't be allowed, since it would reach outside the container
+// in ways the server doesn't expect.
+var containerFlagValues = map[string]bool{
+	"--cap-add":      true,
+	"--device":       true,
+	"--group-add":    true,
+	"--privileged":   false,
+	"--security-opt": true,
+	"--shm-size":     true,
+	"--sysctl":       true,
+	"--ulimit":       true,
+}
+
+var (
+	containerFlagsOnce    sync.Once
+	allowedContainerFlags map[string]bool
+)
+
+// validContainerFlag reports whether "--flag" or "--flag=value" is a flag
+// the allowlist may contain, with a value exactly when the flag takes one
+func validContainerFlag(entry string) bool {
+	flag, value, hasValue := strings.Cut(entry, "=")
+	takesValue, known := containerFlagValues[flag]
+	if !known || takesValue != hasValue || (hasValue && value == "") {
+		return false
+	}
+	return !strings.ContainsAny(value, "\x00\n\r")
+}
+
+// containerFlagAllowlist returns the flags sessions may request, read once
+// from CYH_CONTAINER_FLAGS. Each entry is a boolean flag (--privileged) or a
+// flag with one exact value (--cap-add=NET_RAW); invalid entries are logged
+// and ignored.
+func containerFlagAllowlist() map[string]bool {
+	containerFlagsOnce.Do(func() {
+		allowedContainerFlags = make(map[string]bool)
+		for _, entry := range serverConfig.ContainerFlags {
+			if !validContainerFlag(entry) {
+				logWarnf("Ignoring CYH_CONTAINER_FLAGS entry %q: use --flag or --flag=value with one of --cap-add, --device, --group-add, --privileged, --security-opt, --shm-size, --sysctl or --ulimit", entry)
+				continue
+			}
+			allowedContainerFlags[entry] = true
+		}
+	})
+	return allowedContainerFlags
+}
+
+// checkContainerFlags validates the extra docker run flags a session asks
+// for against the allowlist. It returns a message for the client when they
+// are not allowed.
+func checkContainerFlags(flags []string) string {
+	if len(flags) > MaxContainerFlags {
+		return "Too many container flags"
+	}
+	allowed := containerFlagAllowlist()
+	seen := make(map[string]bool)
+	for _, f := range flags {
+		if !allowed[f] {
+			return "Container flag " + f + " is not allowed on this server"
+		}
+		if seen[f] {
+			return "Container flag " + f + " is listed twice"
+		}
+		seen[f] = true
+	}
+	return ""
+}
+
+// sessionContainerFlags returns the session's extra docker run flags that
+// are still allowed, so flags an admin removed since are never applied
+func sessionContainerFlags(session *TermSession) []string {
+	if session == nil {
+		return nil
+	}
+	allowed := containerFlagAllowlist()
+	var flags []string
+	for _, f := range session.ContainerFlags {
+		if !allowed[f] {
+			logWarnf("Not applying container flag %s of session %s: no longer allowed", f, session.ID)
+			continue
+		}
+		flags = append(flags, f)
+	}
+	return flags
+}
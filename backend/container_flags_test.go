@@ -0,0 +1,112 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+// setContainerFlagAllowlist makes CYH_CONTAINER_FLAGS entries for one test
+func setContainerFlagAllowlist(t *testing.T, entries ...string) {
+	t.Helper()
+	saved := serverConfig.ContainerFlags
+	serverConfig.ContainerFlags = entries
+	containerFlagsOnce = sync.Once{}
+	t.Cleanup(func() {
+		serverConfig.ContainerFlags = saved
+		containerFlagsOnce = sync.Once{}
+	})
+}
+
+func TestValidContainerFlag(t *testing.T) {
+	tests := []struct {
+		entry string
+		want  bool
+	}{
+		{entry: "--privileged", want: true},
+		{entry: "--cap-add=NET_RAW", want: true},
+		{entry: "--shm-size=1g", want: true},
+		{entry: "--network=host", want: false},
+		{entry: "-v=/:/host", want: false},
+		{entry: "--pid=host", want: false},
+		{entry: "--CAP-ADD=NET_RAW", want: false},
+		{entry: "--cap-add", want: false},
+		{entry: "--cap-add=", want: false},
+		{entry: "--privileged=true", want: false},
+		{entry: "--cap-add=NET_RAW\n--privileged", want: false},
+		{entry: "--cap-add=NET_RAW\r", want: false},
+		{entry: "--cap-add=NET\x00RAW", want: false},
+		{entry: "", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := validContainerFlag(tt.entry); got != tt.want {
+			t.Errorf("validContainerFlag(%q) = %v, want %v", tt.entry, got, tt.want)
+		}
+	}
+}
+
+func TestContainerFlagAllowlistIgnoresInvalidEntries(t *testing.T) {
+	setContainerFlagAllowlist(t, "--cap-add=NET_RAW", "--network=host", "--privileged=true", "--ulimit=nofile=1024:1024\n--pid=host")
+
+	allowed := containerFlagAllowlist()
+	if len(allowed) != 1 || !allowed["--cap-add=NET_RAW"] {
+		t.Fatalf("allowlist = %v, want only --cap-add=NET_RAW", allowed)
+	}
+}
+
+func TestCheckContainerFlags(t *testing.T) {
+	setContainerFlagAllowlist(t, "--cap-add=NET_RAW", "--privileged", "--shm-size=1g")
+
+	tooMany := make([]string, MaxContainerFlags+1)
+	for i := range tooMany {
+		tooMany[i] = "--privileged"
+	}
+
+	tests := []struct {
+		name  string
+		flags []string
+		want  string // Part of the message, "" when allowed
+	}{
+		{name: "none", flags: nil},
+		{name: "allowed", flags: []string{"--cap-add=NET_RAW", "--privileged"}},
+		{name: "unknown flag", flags: []string{"--network=host"}, want: "not allowed"},
+		{name: "other value of an allowed flag", flags: []string{"--cap-add=SYS_ADMIN"}, want: "not allowed"},
+		{name: "value on a flag without one", flags: []string{"--privileged=true"}, want: "not allowed"},
+		{name: "allowed flag without its value", flags: []string{"--shm-size"}, want: "not allowed"},
+		{name: "embedded newline", flags: []string{"--cap-add=NET_RAW\n--privileged"}, want: "not allowed"},
+		{name: "duplicate", flags: []string{"--privileged", "--privileged"}, want: "listed twice"},
+		{name: "too many", flags: tooMany, want: "Too many"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := checkContainerFlags(tt.flags)
+			if tt.want == "" && got != "" {
+				t.Fatalf("checkContainerFlags(%q) = %q, want allowed", tt.flags, got)
+			}
+			if tt.want != "" && !strings.Contains(got, tt.want) {
+				t.Fatalf("checkContainerFlags(%q) = %q, want a message with %q", tt.flags, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSessionContainerFlagsDropsFlagsNoLongerAllowed(t *testing.T) {
+	setContainerFlagAllowlist(t, "--cap-add=NET_RAW", "--privileged")
+	session := &TermSession{ID: "sess1", ContainerFlags: []string{"--cap-add=NET_RAW", "--privileged"}}
+	if got := sessionContainerFlags(session); len(got) != 2 {
+		t.Fatalf("sessionContainerFlags = %q, want both flags", got)
+	}
+
+	// The admin removes --privileged after the session stored it
+	setContainerFlagAllowlist(t, "--cap-add=NET_RAW")
+	got := sessionContainerFlags(session)
+	if len(got) != 1 || got[0] != "--cap-add=NET_RAW" {
+		t.Fatalf("sessionContainerFlags = %q, want only --cap-add=NET_RAW", got)
+	}
+
+	if got := sessionContainerFlags(nil); got != nil {
+		t.Fatalf("sessionContainerFlags(nil) = %q", got)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ContainerProfile is the server-wide baseline for every container the
+// server creates, read from the JSON file named by CYH_CONTAINER_PROFILE:
+//
+//	{
+//	  "env": ["HTTP_PROXY=http://proxy:3128"],
+//	  "mounts": ["/srv/wordlists:/usr/share/wordlists:ro"],
+//	  "cpus": "2",
+//	  "memory": "2g",
+//	  "pids_limit": 512,
+//	  "entrypoint": "/usr/local/bin/cyh-init"
+//	}
+//
+// A session's template overrides the environment variables, CPU and memory
+// limits it sets; the terminal variables (see terminalContainerEnv) always
+// win. The entrypoint is given the keep-alive command as arguments and must
+// exec it.
+type ContainerProfile struct {
+	Env        []string `json:"env,omitempty"`
+	Mounts     []string `json:"mounts,omitempty"` // docker run -v
+	CPUs       string   `json:"cpus,omitempty"`
+	Memory     string   `json:"memory,omitempty"`
+	PidsLimit  int      `json:"pids_limit,omitempty"`
+	Entrypoint string   `json:"entrypoint,omitempty"`
+}
+
+// terminalContainerEnv is set on every container after the profile and
+// template, since the terminal relies on it
+var terminalContainerEnv = []string{
+	"TERM=xterm-256color",
+	"COLORTERM=truecolor",
+}
+
+// defaultLocaleEnv is set on every container unless the profile or template
+// chooses another locale
+var defaultLocaleEnv = []string{
+	"LANG=en_US.UTF-8",
+	"LC_ALL=en_US.UTF-8",
+}
+
+var containerProfile = LoadContainerProfile(serverConfig.ContainerProfileFile)
+
+// LoadContainerProfile reads a container profile, returning an empty one
+// when path is empty or unreadable. Invalid settings are logged and skipped.
+func LoadContainerProfile(path string) *ContainerProfile {
+	p := &ContainerProfile{}
+	if path == "" {
+		return p
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		logWarnf("⚠️  Can't read container profile %s: %v", path, err)
+		return p
+	}
+	if err := json.Unmarshal(data, p); err != nil {
+		logWarnf("⚠️  Invalid container profile %s: %v", path, err)
+		return &ContainerProfile{}
+	}
+
+	var env []string
+	for _, kv := range p.Env {
+		key, _, ok := strings.Cut(kv, "=")
+		if !ok || !envKeyPattern.MatchString(key) {
+			logWarnf("⚠️  Ignoring invalid environment variable %q in container profile", kv)
+			continue
+		}
+		env = append(env, kv)
+	}
+	p.Env = env
+
+	var mounts []string
+	for _, m := range p.Mounts {
+		if src, dst, ok := strings.Cut(m, ":"); !ok || src == "" || !strings.HasPrefix(dst, "/") {
+			logWarnf("⚠️  Ignoring invalid mount %q in container profile (want source:/path[:options])", m)
+			continue
+		}
+		mounts = append(mounts, m)
+	}
+	p.Mounts = mounts
+
+	if p.CPUs != "" {
+		if cpus, err := strconv.ParseFloat(p.CPUs, 64); err != nil || cpus <= 0 {
+			logWarnf("⚠️  Ignoring invalid cpus %q in container profile", p.CPUs)
+			p.CPUs = ""
+		}
+	}
+	if p.Memory != "" && !memoryPattern.MatchString(p.Memory) {
+		logWarnf("⚠️  Ignoring invalid memory %q in container profile", p.Memory)
+		p.Memory = ""
+	}
+	if p.PidsLimit < 0 {
+		logWarnf("⚠️  Ignoring invalid pids_limit %d in container profile", p.PidsLimit)
+		p.PidsLimit = 0
+	}
+
+	logInfof("Loaded container profile from %s", path)
+	return p
+}
+
+// mergeEnv combines KEY=VALUE lists; a later value for a key replaces an
+// earlier one in its original position
+func mergeEnv(lists ...[]string) []string {
+	var merged []string
+	index := make(map[string]int)
+	for _, list := range lists {
+		for _, kv := range list {
+			key, _, _ := strings.Cut(kv, "=")
+			if i, ok := index[key]; ok {
+				merged[i] = kv
+				continue
+			}
+			index[key] = len(merged)
+			merged = append(merged, kv)
+		}
+	}
+	return merged
+}
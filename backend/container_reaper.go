@@ -0,0 +1,144 @@
+package main
+
+import (
+	"time"
+)
+
+const containerReapInterval = 5 * time.Minute
+
+// SetSessionPersistContainer controls whether a session's container survives the end of the session
+func (sm *SessionManager) SetSessionPersistContainer(id string, persist bool) error {
+	_, err := sm.db.Exec(`UPDATE term_sessions SET persist_container = ? WHERE id = ?`, persist, id)
+	if err != nil {
+		return err
+	}
+
+	sm.mu.Lock()
+	if sess, ok := sm.activeSessions[id]; ok {
+		sess.Session.PersistContainer = persist
+	}
+	sm.mu.Unlock()
+	return nil
+}
+
+// isSessionOwnedContainer reports whether a session's container was created
+// for that session alone (named containers picked via ?container= are never reaped)
+func isSessionOwnedContainer(session *TermSession) bool {
+	return session.Mode == "docker" && session.ContainerName != "" &&
+		session.ContainerName == buildContainerName(session.User, session.ID)
+}
+
+// ReleaseSessionContainer applies the reaping policy once a session ends:
+// the container is removed, or marked idle when the session asked to persist it.
+// Guest containers are always marked idle and removed after CYH_GUEST_CONTAINER_TTL.
+func (sm *SessionManager) ReleaseSessionContainer(id string) {
+	session, err := sm.GetSession(id)
+	if err != nil {
+		return
+	}
+
+	if isGuestContainer(session) {
+		if serverConfig.GuestContainerTTL <= 0 {
+			go sm.reapContainer(id, session.ContainerName)
+			return
+		}
+		sm.markContainerIdle(session)
+		return
+	}
+
+	if !serverConfig.ReapContainers || !isSessionOwnedContainer(session) {
+		return
+	}
+
+	if session.PersistContainer {
+		sm.markContainerIdle(session)
+		return
+	}
+
+	go sm.reapContainer(id, session.ContainerName)
+}
+
+// markContainerIdle starts the idle clock of a session's container
+func (sm *SessionManager) markContainerIdle(session *TermSession) {
+	_, err := sm.db.Exec(`UPDATE term_sessions SET container_idle_since = ? WHERE id = ?`, time.Now(), session.ID)
+	if err != nil {
+		logErrorf("Failed to mark container %s idle: %v", session.ContainerName, err)
+	}
+}
+
+// MarkContainerActive clears the idle mark when a terminal attaches to the
+// session's container, including the marks of other sessions sharing it
+func (sm *SessionManager) MarkContainerActive(id string) {
+	_, _ = sm.db.Exec(`
+		UPDATE term_sessions SET container_idle_since = NULL
+		WHERE id = ? OR (container_name != '' AND container_name = (SELECT container_name FROM term_sessions WHERE id = ?))
+	`, id, id)
+}
+
+// reapContainer removes a session container and clears its idle mark. A
+// container another terminal still uses is left running and no longer idle.
+func (sm *SessionManager) reapContainer(id, containerName string) {
+	if sm.containerAttached(containerName) {
+		sm.MarkContainerActive(id)
+		return
+	}
+	if err := dockerMgr.RemoveContainer(containerName); err != nil {
+		logErrorf("Failed to reap container %s: %v", containerName, err)
+		return
+	}
+	sm.MarkContainerActive(id)
+	logInfof("Reaped container %s (session %s)", containerName, id)
+}
+
+// reapInterval is how often idle containers are checked; short guest TTLs
+// are checked more often so containers don't linger long past them
+func reapInterval() time.Duration {
+	if ttl := serverConfig.GuestContainerTTL; ttl > 0 && ttl < containerReapInterval {
+		return ttl
+	}
+	return containerReapInterval
+}
+
+// reapIdleContainers removes guest containers and persisted containers left
+// idle longer than their configured TTL
+func (sm *SessionManager) reapIdleContainers() {
+	ticker := time.NewTicker(reapInterval())
+	defer ticker.Stop()
+
+	for range ticker.C {
+		rows, err := sm.db.Query(`
+			SELECT id, user, mode, container_name, container_idle_since FROM term_sessions
+			WHERE container_idle_since IS NOT NULL
+		`)
+		if err != nil {
+			logErrorf("Failed to query idle containers: %v", err)
+			continue
+		}
+
+		now := time.Now()
+		type idleContainer struct{ id, name string }
+		var idle []idleContainer
+		for rows.Next() {
+			var session TermSession
+			var since time.Time
+			if err := rows.Scan(&session.ID, &session.User, &session.Mode, &session.ContainerName, &since); err != nil {
+				continue
+			}
+
+			ttl := serverConfig.ContainerIdleTTL
+			if isGuestContainer(&session) {
+				ttl = serverConfig.GuestContainerTTL
+			} else if !serverConfig.ReapContainers {
+				continue
+			}
+			if now.Sub(since) > ttl {
+				idle = append(idle, idleContainer{session.ID, session.ContainerName})
+			}
+		}
+		rows.Close()
+
+		for _, c := range idle {
+			sm.reapContainer(c.id, c.name)
+		}
+	}
+}
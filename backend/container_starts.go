@@ -0,0 +1,48 @@
+package main
+
+import (
+	"sync"
+)
+
+// containerStart is an attempt in progress to get a container running
+type containerStart struct {
+	done chan struct{}
+	err  error
+}
+
+// containerStarter serializes attempts to start or create the same container.
+// Without it, connects arriving together (startup, reconnect storms) each see
+// the container missing and race docker run, failing with "container name
+// already in use".
+type containerStarter struct {
+	mu       sync.Mutex
+	inflight map[string]*containerStart
+}
+
+var containerStarts = &containerStarter{inflight: make(map[string]*containerStart)}
+
+// Do runs start for a container unless an attempt for the same name is
+// already running, in which case it waits for that attempt and returns its
+// result. start must be safe to run again once the previous attempt is done.
+func (cs *containerStarter) Do(containerName string, start func() error) error {
+	cs.mu.Lock()
+	if attempt, ok := cs.inflight[containerName]; ok {
+		cs.mu.Unlock()
+		logDebugf("Waiting for container %s to be started by another connection", containerName)
+		<-attempt.done
+		return attempt.err
+	}
+	attempt := &containerStart{done: make(chan struct{})}
+	cs.inflight[containerName] = attempt
+	cs.mu.Unlock()
+
+	defer func() {
+		cs.mu.Lock()
+		delete(cs.inflight, containerName)
+		cs.mu.Unlock()
+		close(attempt.done)
+	}()
+
+	attempt.err = start()
+	return attempt.err
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultToolProbes are the commands looked for unless CYH_TOOL_PROBES is set
+const defaultToolProbes = "nmap,nc,tcpdump,nikto,sqlmap,dirb,gobuster,hydra,john,hashcat,msfconsole,curl,wget,git,python3,gcc"
+
+// toolProbeCacheTTL is how long a container's probe results are reused
+const toolProbeCacheTTL = 10 * time.Minute
+
+// toolNamePattern matches the command names that may be probed
+var toolNamePattern = regexp.MustCompile(`^[A-Za-z0-9._+-]+$`)
+
+// toolVersionPattern finds a version number in a tool's --version output
+var toolVersionPattern = regexp.MustCompile(`\d+(\.\d+)+[0-9A-Za-z.+~-]*`)
+
+// toolProbeScript prints "name<TAB>path<TAB>first line of --version" for each
+// command given as an argument, with an empty path when it isn't installed.
+// Each version check gets 3 seconds and no stdin.
+const toolProbeScript = `for t in "$@"; do
+  p=$(command -v "$t") || { printf '%s\t\t\n' "$t"; continue; }
+  v=$(timeout 3 "$t" --version </dev/null 2>&1 | head -n 1)
+  printf '%s\t%s\t%s\n' "$t" "$p" "$v"
+done`
+
+// ToolInfo is whether one probed command is available in a container
+type ToolInfo struct {
+	Name      string `json:"name"`
+	Installed bool   `json:"installed"`
+	Path      string `json:"path,omitempty"`
+	Version   string `json:"version,omitempty"` // Empty when the tool doesn't report one
+}
+
+// ToolReport is the result of probing a container
+type ToolReport struct {
+	Container string     `json:"container"`
+	Tools     []ToolInfo `json:"tools"`
+	ProbedAt  int64      `json:"probed_at"` // UnixMilli
+}
+
+// toolCache holds probe results by container ID and exec user, so a
+// recreated container with the same name is probed again
+var toolCache = struct {
+	sync.Mutex
+	entries map[string]cachedTools
+}{entries: make(map[string]cachedTools)}
+
+type cachedTools struct {
+	report    *ToolReport
+	expiresAt time.Time
+}
+
+// ProbeTools looks for each of tools in a running container with one docker
+// exec as user (empty for root), reporting its path and version
+func (dm *DockerManager) ProbeTools(idOrName, user string, tools []string) ([]ToolInfo, error) {
+	var names []string
+	for _, name := range tools {
+		if toolNamePattern.MatchString(name) {
+			names = append(names, name)
+		} else {
+			logWarnf("Skipping invalid tool probe %q", name)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "docker", toolProbeArgs(idOrName, user, names)...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to probe container: %w", err)
+	}
+
+	found := make(map[string]ToolInfo)
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) < 3 || fields[1] == "" {
+			continue
+		}
+		found[fields[0]] = ToolInfo{
+			Name:      fields[0],
+			Installed: true,
+			Path:      fields[1],
+			Version:   toolVersionPattern.FindString(fields[2]),
+		}
+	}
+
+	infos := make([]ToolInfo, 0, len(names))
+	for _, name := range names {
+		info, ok := found[name]
+		if !ok {
+			info = ToolInfo{Name: name}
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// toolProbeArgs is the docker command line that runs toolProbeScript for
+// names in a container as user (empty for root)
+func toolProbeArgs(idOrName, user string, names []string) []string {
+	args := []string{"exec"}
+	if user != "" {
+		args = append(args, "-u", user)
+	}
+	args = append(args, idOrName, "sh", "-c", toolProbeScript, "sh")
+	return append(args, names...)
+}
+
+// handleSessionTools reports which of the configured tools the session's
+// container has: GET /api/sessions/{id}/tools[?refresh=true]
+func handleSessionTools(w http.ResponseWriter, r *http.Request, sessionID, username string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, err := sessionMgr.GetSession(sessionID)
+	if err != nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	if session.User != username {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	if session.Mode != "docker" {
+		http.Error(w, "Session has no container", http.StatusBadRequest)
+		return
+	}
+
+	// Sessions from before per-session containers use the user's container
+	containerName := session.ContainerName
+	if containerName == "" {
+		containerName = legacyContainerName(session.User)
+	}
+
+	state, err := dockerMgr.InspectContainer(containerName)
+	if err != nil {
+		http.Error(w, "Container not found", http.StatusNotFound)
+		return
+	}
+	if !state.Running {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Container is not running"})
+		return
+	}
+
+	cacheKey := state.ID + "/" + session.ContainerUser
+
+	toolCache.Lock()
+	entry, ok := toolCache.entries[cacheKey]
+	toolCache.Unlock()
+
+	cached := ok && time.Now().Before(entry.expiresAt) && r.URL.Query().Get("refresh") != "true"
+	report := entry.report
+	if !cached {
+		// Probe as the user the session's shell runs as, falling back to
+		// root like the terminal does when that user doesn't exist
+		execUser := session.ContainerUser
+		if execUser != "" && !dockerMgr.ContainerUserExists(state.ID, execUser) {
+			execUser = ""
+		}
+		tools, err := dockerMgr.ProbeTools(state.ID, execUser, serverConfig.ToolProbes)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		report = &ToolReport{Container: state.Name, Tools: tools, ProbedAt: time.Now().UnixMilli()}
+
+		toolCache.Lock()
+		for key, e := range toolCache.entries {
+			if time.Now().After(e.expiresAt) {
+				delete(toolCache.entries, key)
+			}
+		}
+		toolCache.entries[cacheKey] = cachedTools{report: report, expiresAt: time.Now().Add(toolProbeCacheTTL)}
+		toolCache.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"session_id": sessionID,
+		"container":  report.Container,
+		"tools":      report.Tools,
+		"probed_at":  report.ProbedAt,
+		"cached":     cached,
+	})
+}
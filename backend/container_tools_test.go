@@ -0,0 +1,26 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestToolProbeArgsRunAsTheExecUser(t *testing.T) {
+	tests := []struct {
+		name string
+		user string
+		want []string
+	}{
+		{name: "session user", user: "user", want: []string{"exec", "-u", "user", "abc123", "sh", "-c", toolProbeScript, "sh", "nmap", "git"}},
+		{name: "root", want: []string{"exec", "abc123", "sh", "-c", toolProbeScript, "sh", "nmap", "git"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := toolProbeArgs("abc123", tt.user, []string{"nmap", "git"})
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("toolProbeArgs = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// diagnoseTimeout bounds each docker command so a wedged daemon can't stall the endpoint
+const diagnoseTimeout = 3 * time.Second
+
+// DockerDiagnostics is the result of GET /api/docker/diagnose
+type DockerDiagnostics struct {
+	BinaryFound     bool                 `json:"binary_found"`
+	BinaryPath      string               `json:"binary_path,omitempty"`
+	DaemonReachable bool                 `json:"daemon_reachable"`
+	ServerVersion   string               `json:"server_version,omitempty"`
+	DaemonError     string               `json:"daemon_error,omitempty"`
+	ImageBuilt      bool                 `json:"image_built"`
+	ImageName       string               `json:"image_name"`
+	MainContainer   string               `json:"main_container_state"` // running, exited, ..., or missing
+	UserContainers  []DiagnosedContainer `json:"user_containers"`
+	LastBuildError  string               `json:"last_build_error,omitempty"`
+	Hints           []string             `json:"hints"`
+}
+
+// DiagnosedContainer is one of the caller's containers
+type DiagnosedContainer struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+// runDockerCheck runs a docker command with the diagnose timeout
+func runDockerCheck(args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), diagnoseTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "docker", args...).CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", ctx.Err()
+	}
+	return strings.TrimSpace(string(output)), err
+}
+
+// DiagnoseDocker runs the docker checks in order, stopping once a check makes the rest meaningless
+func (dm *DockerManager) DiagnoseDocker(username string) *DockerDiagnostics {
+	diag := &DockerDiagnostics{
+		ImageName:      DockerImageName,
+		MainContainer:  "unknown",
+		UserContainers: []DiagnosedContainer{},
+		LastBuildError: dm.LastBuildError(),
+		Hints:          []string{},
+	}
+
+	path, err := exec.LookPath("docker")
+	if err != nil {
+		diag.Hints = append(diag.Hints, "Docker is not installed or not on PATH. Install Docker and restart the server.")
+		return diag
+	}
+	diag.BinaryFound = true
+	diag.BinaryPath = path
+
+	version, err := runDockerCheck("version", "--format", "{{.Server.Version}}")
+	if err != nil {
+		diag.DaemonError = err.Error()
+		if version != "" {
+			diag.DaemonError = version
+		}
+		diag.Hints = append(diag.Hints, "The Docker daemon is not reachable. Start Docker (or Docker Desktop) and check that this user can access the Docker socket.")
+		return diag
+	}
+	diag.DaemonReachable = true
+	diag.ServerVersion = version
+
+	if images, err := runDockerCheck("images", "-q", DockerImageName); err == nil && images != "" {
+		diag.ImageBuilt = true
+	} else {
+		diag.Hints = append(diag.Hints, "The terminal image is not built yet. Wait for the build to finish or trigger one via POST /api/docker/rebuild.")
+	}
+
+	if state, err := runDockerCheck("inspect", "--type", "container", "--format", "{{.State.Status}}", DockerContainerName); err == nil {
+		diag.MainContainer = state
+	} else {
+		diag.MainContainer = "missing"
+	}
+
+	if list, err := runDockerCheck("ps", "-a", "--format", "{{.Names}}|{{.Status}}"); err == nil {
+		for _, line := range strings.Split(list, "\n") {
+			parts := strings.SplitN(line, "|", 2)
+			if len(parts) == 2 && userOwnsContainer(username, parts[0]) {
+				diag.UserContainers = append(diag.UserContainers, DiagnosedContainer{Name: parts[0], Status: parts[1]})
+			}
+		}
+	}
+
+	if diag.LastBuildError != "" {
+		diag.Hints = append(diag.Hints, "The last image build failed. Check the server log for [DOCKER BUILD] output.")
+	}
+
+	return diag
+}
+
+// handleDockerDiagnose reports docker connectivity and state for self-diagnosis
+func handleDockerDiagnose(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := ""
+	if cookie, err := r.Cookie("cyh_session"); err == nil {
+		if user, valid := authManager.ValidateSession(cookie.Value); valid {
+			username = user
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dockerMgr.DiagnoseDocker(username))
+}
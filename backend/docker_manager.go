@@ -2,11 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -18,10 +20,15 @@ const (
 )
 
 type DockerManager struct {
-	mu             sync.Mutex
+	mu       sync.Mutex // Held for the whole image build
+	buildLog strings.Builder
+
+	stateMu        sync.RWMutex // guards imageReady and containerReady
 	imageReady     bool
 	containerReady bool
-	buildLog       strings.Builder
+
+	errMu        sync.Mutex // guards lastBuildErr (mu is held for the whole build)
+	lastBuildErr string
 }
 
 var dockerMgr = &DockerManager{}
@@ -69,11 +76,11 @@ func isMacOS() bool {
 
 // InstallDockerLinux installs Docker on Linux systems
 func InstallDockerLinux() error {
-	log.Println("🐳 Attempting to install Docker on Linux...")
+	logInfof("🐳 Attempting to install Docker on Linux...")
 
 	// Check if running as root or with sudo
 	if os.Geteuid() != 0 {
-		log.Println("⚠️  Docker installation requires root privileges. Please run with sudo or install Docker manually.")
+		logWarnf("⚠️  Docker installation requires root privileges. Please run with sudo or install Docker manually.")
 		return fmt.Errorf("root privileges required")
 	}
 
@@ -130,7 +137,7 @@ fi
 		return fmt.Errorf("failed to install Docker: %w", err)
 	}
 
-	log.Println("✅ Docker installed successfully on Linux!")
+	logInfof("✅ Docker installed successfully on Linux!")
 	return nil
 }
 
@@ -154,17 +161,17 @@ func StartDockerWindows() error {
 		return fmt.Errorf("Docker Desktop executable not found")
 	}
 
-	log.Printf("🚀 Starting Docker Desktop from %s...", dockerPath)
+	logInfof("🚀 Starting Docker Desktop from %s...", dockerPath)
 	cmd := exec.Command(dockerPath)
 	if err := cmd.Start(); err != nil {
 		return fmt.Errorf("failed to start Docker Desktop: %w", err)
 	}
 
 	// Wait for Docker to be ready
-	log.Println("⏳ Waiting for Docker to start (this may take a minute)...")
+	logInfof("⏳ Waiting for Docker to start (this may take a minute)...")
 	for i := 0; i < 60; i++ {
 		if CheckDockerInstalled() {
-			log.Println("✅ Docker started successfully!")
+			logInfof("✅ Docker started successfully!")
 			return nil
 		}
 		time.Sleep(2 * time.Second)
@@ -177,12 +184,12 @@ func StartDockerWindows() error {
 
 // InstallDockerWindows provides instructions for Windows Docker installation
 func InstallDockerWindows() error {
-	log.Println("🐳 Docker installation on Windows...")
-	log.Println("📋 Windows Docker Desktop installation requires manual steps:")
-	log.Println("   1. Download Docker Desktop from https://www.docker.com/products/docker-desktop")
-	log.Println("   2. Run the installer")
-	log.Println("   3. Restart your computer if prompted")
-	log.Println("   4. Start Docker Desktop")
+	logInfof("🐳 Docker installation on Windows...")
+	logInfof("📋 Windows Docker Desktop installation requires manual steps:")
+	logInfof("   1. Download Docker Desktop from https://www.docker.com/products/docker-desktop")
+	logInfof("   2. Run the installer")
+	logInfof("   3. Restart your computer if prompted")
+	logInfof("   4. Start Docker Desktop")
 
 	// Try to open Docker download page
 	cmd := exec.Command("cmd", "/c", "start", "https://www.docker.com/products/docker-desktop")
@@ -194,7 +201,7 @@ func InstallDockerWindows() error {
 // TryInstallDocker attempts to install Docker based on the platform
 func TryInstallDocker() bool {
 	platform := GetPlatform()
-	log.Printf("🔍 Detected platform: %s", platform)
+	logInfof("🔍 Detected platform: %s", platform)
 
 	var err error
 	switch platform {
@@ -203,18 +210,18 @@ func TryInstallDocker() bool {
 	case "windows":
 		err = InstallDockerWindows()
 	default:
-		log.Printf("⚠️  Docker auto-install not supported on %s. Please install manually.", platform)
+		logWarnf("⚠️  Docker auto-install not supported on %s. Please install manually.", platform)
 		return false
 	}
 
 	if err != nil {
-		log.Printf("⚠️  Docker installation failed: %v", err)
+		logWarnf("⚠️  Docker installation failed: %v", err)
 		return false
 	}
 
 	// Verify installation
 	if CheckDockerInstalled() {
-		log.Println("✅ Docker is now available!")
+		logInfof("✅ Docker is now available!")
 		return true
 	}
 
@@ -256,7 +263,7 @@ func (dm *DockerManager) BuildDockerImage() error {
 	dm.mu.Lock()
 	defer dm.mu.Unlock()
 
-	if dm.imageReady {
+	if dm.IsImageReady() {
 		return nil
 	}
 
@@ -272,11 +279,12 @@ func (dm *DockerManager) BuildDockerImage() error {
 		// Try current directory structure
 		dockerDir = "../docker"
 		if _, err := os.Stat(filepath.Join(dockerDir, "Dockerfile")); os.IsNotExist(err) {
+			dm.setBuildError("Dockerfile not found")
 			return fmt.Errorf("Dockerfile not found")
 		}
 	}
 
-	log.Println("🐧 Building Ubuntu Docker image... This may take a few minutes.")
+	logInfof("🐧 Building Ubuntu Docker image... This may take a few minutes.")
 	dm.buildLog.Reset()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
@@ -287,110 +295,599 @@ func (dm *DockerManager) BuildDockerImage() error {
 	cmd.Stderr = &logWriter{prefix: "[DOCKER BUILD] "}
 
 	if err := cmd.Run(); err != nil {
+		dm.setBuildError(err.Error())
 		return fmt.Errorf("failed to build Docker image: %w", err)
 	}
 
-	dm.imageReady = true
-	log.Println("✅ Ubuntu Docker image built successfully!")
+	dm.setBuildError("")
+	dm.SetImageReady(true)
+	logInfof("✅ Ubuntu Docker image built successfully!")
 	return nil
 }
 
-// StartContainer starts the Ubuntu container
+func (dm *DockerManager) setBuildError(msg string) {
+	dm.errMu.Lock()
+	dm.lastBuildErr = msg
+	dm.errMu.Unlock()
+}
+
+// LastBuildError returns the error from the most recent failed image build ("" if none)
+func (dm *DockerManager) LastBuildError() string {
+	dm.errMu.Lock()
+	defer dm.errMu.Unlock()
+	return dm.lastBuildErr
+}
+
+// StartContainer starts the Ubuntu container. Concurrent calls share one
+// attempt (see containerStarts).
 func (dm *DockerManager) StartContainer() error {
+	return containerStarts.Do(DockerContainerName, dm.startContainer)
+}
+
+func (dm *DockerManager) startContainer() error {
 	// Check if container is already running
 	if dm.IsContainerRunning() {
-		log.Println("✅ Ubuntu container already running.")
-		dm.containerReady = true
+		logInfof("✅ Ubuntu container already running.")
+		dm.SetContainerReady(true)
 		return nil
 	}
 
 	// Check if container exists but stopped - just start it
 	if dm.IsContainerExists() {
-		log.Println("🔄 Starting existing Ubuntu container...")
+		logInfof("🔄 Starting existing Ubuntu container...")
 		cmd := exec.Command("docker", "start", DockerContainerName)
 		if err := cmd.Run(); err != nil {
 			// If start fails, remove and recreate
 			exec.Command("docker", "rm", "-f", DockerContainerName).Run()
 		} else {
-			dm.containerReady = true
-			log.Println("✅ CYH container started!")
+			dm.SetContainerReady(true)
+			logInfof("✅ CYH container started!")
 			return nil
 		}
 	}
 
-	log.Println("🚀 Creating new CYH Hacking container...")
+	logInfof("🚀 Creating new CYH Hacking container...")
 
-	cmd := exec.Command("docker", "run",
-		"-d",
-		"--name", DockerContainerName,
-		"--hostname", "canyouhack",
-		"-e", "TERM=xterm-256color",
-		"-e", "COLORTERM=truecolor",
-		"-e", "LANG=en_US.UTF-8",
-		"-e", "LC_ALL=en_US.UTF-8",
-		DockerImageName,
-		"tail", "-f", "/dev/null", // Keep container running
-	)
+	cmd := exec.Command("docker", defaultContainerSpec().RunArgs(DockerContainerName)...)
 
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		log.Printf("Docker run error: %s", string(output))
+		logErrorf("Docker run error: %s", string(output))
 		return fmt.Errorf("failed to start container: %w", err)
 	}
 
-	dm.containerReady = true
-	log.Println("✅ CYH Hacking container created and started!")
+	dm.SetContainerReady(true)
+	logInfof("✅ CYH Hacking container created and started!")
 	return nil
 }
 
 // StopContainer stops and removes the container
 func (dm *DockerManager) StopContainer() error {
-	log.Println("🛑 Stopping CYH container...")
-	cmd := exec.Command("docker", "rm", "-f", DockerContainerName)
-	if err := cmd.Run(); err != nil {
+	logInfof("🛑 Stopping CYH container...")
+	if err := dm.RemoveContainer(DockerContainerName); err != nil {
 		return fmt.Errorf("failed to stop container: %w", err)
 	}
-	dm.containerReady = false
-	log.Println("✅ Container stopped!")
+	dm.SetContainerReady(false)
+	logInfof("✅ Container stopped!")
+	return nil
+}
+
+// containerUserPattern matches portable POSIX user names
+var containerUserPattern = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+
+// IsValidContainerUser reports whether name is safe to pass to docker exec -u
+func IsValidContainerUser(name string) bool {
+	return containerUserPattern.MatchString(name)
+}
+
+// containerHomeDir returns the working directory for a container user
+func containerHomeDir(user string) string {
+	if user == "" || user == "root" {
+		return "/root"
+	}
+	return "/home/" + user
+}
+
+// cwdReportPS1 is put before the docker shell prompt with CYH_RESTORE_CWD so
+// the shell reports its working directory (OSC 7) every time it shows the
+// prompt; terminals ignore it
+const cwdReportPS1 = `\[\e]7;file://\h${PWD}\a\]`
+
+// containerPromptPS1 builds the classic docker shell prompt, showing root in red
+func containerPromptPS1(user string) string {
+	if user == "" || user == "root" {
+		return `\[\e[32m\]canyouhack\[\e[0m\]@\[\e[31m\]root\[\e[0m\]:\[\e[36m\]\w\[\e[0m\]$ `
+	}
+	return `\[\e[32m\]canyouhack\[\e[0m\]@\[\e[34m\]` + user + `\[\e[0m\]:\[\e[36m\]\w\[\e[0m\]$ `
+}
+
+// ContainerUserExists probes a running container for the given user
+func (dm *DockerManager) ContainerUserExists(containerName, user string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "docker", "exec", containerName, "id", "-u", user)
+	return cmd.Run() == nil
+}
+
+// ContainerDirExists probes a running container for a directory the given
+// user (empty for root) can exec in
+func (dm *DockerManager) ContainerDirExists(containerName, user, dir string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	args := []string{"exec", "-w", dir}
+	if user != "" {
+		args = append(args, "-u", user)
+	}
+	cmd := exec.CommandContext(ctx, "docker", append(args, containerName, "true")...)
+	return cmd.Run() == nil
+}
+
+// ErrContainerNotRunning is returned by probes that need a running container
+var ErrContainerNotRunning = errors.New("container is not running")
+
+// userOwnsContainer reports whether a container name carries the user's prefix.
+// Guests all share one identity, so the only container a guest owns is the
+// shared guest container; per-session guest containers are reachable only
+// through their session (see canResumeSession).
+func userOwnsContainer(username, containerName string) bool {
+	containerName = strings.TrimPrefix(containerName, "/")
+	if isGuestUser(username) {
+		return containerName == legacyContainerName("guest")
+	}
+	return strings.HasPrefix(containerName, containerUserPrefix(username)) ||
+		strings.HasPrefix(containerName, "cyh_"+username+"_")
+}
+
+// ContainerState is the subset of docker inspect output used by handlers
+type ContainerState struct {
+	ID      string
+	Name    string
+	Image   string
+	Running bool
+}
+
+// InspectContainer looks up a container by ID or name
+func (dm *DockerManager) InspectContainer(idOrName string) (*ContainerState, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "docker", "inspect", "--type", "container",
+		"--format", "{{.Id}}|{{.Name}}|{{.Config.Image}}|{{.State.Running}}", idOrName).Output()
+	if err != nil {
+		return nil, fmt.Errorf("container not found: %s", idOrName)
+	}
+
+	parts := strings.Split(strings.TrimSpace(string(output)), "|")
+	if len(parts) < 4 {
+		return nil, fmt.Errorf("unexpected inspect output for %s", idOrName)
+	}
+	return &ContainerState{
+		ID:      parts[0],
+		Name:    strings.TrimPrefix(parts[1], "/"),
+		Image:   parts[2],
+		Running: parts[3] == "true",
+	}, nil
+}
+
+// ContainerSummary is a container as docker ps lists it
+type ContainerSummary struct {
+	Name    string `json:"name"`
+	State   string `json:"state"` // running, exited, created, ...
+	Status  string `json:"status"`
+	Created string `json:"created"`
+}
+
+// ListContainers returns the containers, running or stopped, whose name
+// matches a docker name filter such as "^cyh_"
+func (dm *DockerManager) ListContainers(name string) ([]ContainerSummary, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "docker", "ps", "-a", "--filter", "name="+name,
+		"--format", "{{.Names}}|{{.State}}|{{.Status}}|{{.CreatedAt}}").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	containers := []ContainerSummary{}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		parts := strings.Split(line, "|")
+		if len(parts) < 4 {
+			continue
+		}
+		containers = append(containers, ContainerSummary{
+			Name:    parts[0],
+			State:   parts[1],
+			Status:  parts[2],
+			Created: parts[3],
+		})
+	}
+	return containers, nil
+}
+
+// ContainerDiskUsage reports filesystem usage inside a container and its layer sizes
+type ContainerDiskUsage struct {
+	FilesystemSize      int64  `json:"filesystem_size_bytes"`
+	FilesystemUsed      int64  `json:"filesystem_used_bytes"`
+	FilesystemAvailable int64  `json:"filesystem_available_bytes"`
+	FilesystemUsePct    string `json:"filesystem_use_percent"`
+	WritableLayerBytes  int64  `json:"writable_layer_bytes"`
+	ImageBytes          int64  `json:"image_bytes"`
+	Image               string `json:"image"`
+}
+
+// GetContainerDiskUsage runs df inside the container and reads layer sizes via docker inspect
+func (dm *DockerManager) GetContainerDiskUsage(idOrName string) (*ContainerDiskUsage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	// Layer sizes (SizeRootFs includes the image, SizeRw is the writable layer)
+	output, err := exec.CommandContext(ctx, "docker", "inspect", "--size", "--type", "container",
+		"--format", "{{.State.Running}}|{{.SizeRw}}|{{.SizeRootFs}}|{{.Config.Image}}", idOrName).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect container: %w", err)
+	}
+	parts := strings.Split(strings.TrimSpace(string(output)), "|")
+	if len(parts) < 4 {
+		return nil, fmt.Errorf("unexpected inspect output")
+	}
+	if parts[0] != "true" {
+		return nil, ErrContainerNotRunning
+	}
+
+	usage := &ContainerDiskUsage{Image: parts[3]}
+	usage.WritableLayerBytes, _ = strconv.ParseInt(parts[1], 10, 64)
+	rootFs, _ := strconv.ParseInt(parts[2], 10, 64)
+	usage.ImageBytes = rootFs - usage.WritableLayerBytes
+
+	// Filesystem usage as seen from inside the container (POSIX format, 1K blocks)
+	output, err = exec.CommandContext(ctx, "docker", "exec", idOrName, "df", "-P", "-k", "/").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run df in container: %w", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	if len(lines) < 2 {
+		return nil, fmt.Errorf("unexpected df output")
+	}
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) < 5 {
+		return nil, fmt.Errorf("unexpected df output")
+	}
+	size, _ := strconv.ParseInt(fields[1], 10, 64)
+	used, _ := strconv.ParseInt(fields[2], 10, 64)
+	avail, _ := strconv.ParseInt(fields[3], 10, 64)
+	usage.FilesystemSize = size * 1024
+	usage.FilesystemUsed = used * 1024
+	usage.FilesystemAvailable = avail * 1024
+	usage.FilesystemUsePct = fields[4]
+
+	return usage, nil
+}
+
+// ErrHostAtCapacity is returned when starting another container would overload the host
+var ErrHostAtCapacity = errors.New("host at capacity, please try again later")
+
+// CheckCapacity applies the configured admission limits before a container
+// is created or started: the number of running cyh_* containers and the
+// host's available memory
+func (dm *DockerManager) CheckCapacity() error {
+	if limit := serverConfig.MaxContainers; limit > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		output, err := exec.CommandContext(ctx, "docker", "ps", "-q", "--filter", "name=^cyh_").Output()
+		if running := len(strings.Fields(string(output))); err == nil && running >= limit {
+			logWarnf("Refusing container start: %d running containers (limit %d)", running, limit)
+			return ErrHostAtCapacity
+		}
+	}
+
+	if minFree := serverConfig.MinFreeMemoryMB; minFree > 0 {
+		if available, ok := hostAvailableMemoryMB(); ok && available < minFree {
+			logWarnf("Refusing container start: %d MB memory available (minimum %d MB)", available, minFree)
+			return ErrHostAtCapacity
+		}
+	}
+
+	return nil
+}
+
+// hostAvailableMemoryMB reads MemAvailable from /proc/meminfo (Linux only)
+func hostAvailableMemoryMB() (int, bool) {
+	data, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "MemAvailable:" {
+			kb, err := strconv.Atoi(fields[1])
+			if err != nil {
+				return 0, false
+			}
+			return kb / 1024, true
+		}
+	}
+	return 0, false
+}
+
+// stopGraceSeconds is the docker stop --time value for CYH_CONTAINER_STOP_GRACE
+func stopGraceSeconds() string {
+	grace := serverConfig.ContainerStopGrace
+	if grace < 0 {
+		grace = 0
+	}
+	return strconv.Itoa(int((grace + time.Second - 1) / time.Second))
+}
+
+// RemoveContainer stops a container, giving its processes the configured
+// grace period after SIGTERM, then removes it
+func (dm *DockerManager) RemoveContainer(name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), serverConfig.ContainerStopGrace+30*time.Second)
+	defer cancel()
+
+	// A failed stop (already stopped, or gone) still falls through to rm -f
+	exec.CommandContext(ctx, "docker", "stop", "--time", stopGraceSeconds(), name).Run()
+
+	output, err := exec.CommandContext(ctx, "docker", "rm", "-f", name).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// RenameContainer gives an existing container a new name
+func (dm *DockerManager) RenameContainer(idOrName, newName string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "docker", "rename", idOrName, newName).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// ContainerExists reports whether a container (running or stopped) exists
+func (dm *DockerManager) ContainerExists(idOrName string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return exec.CommandContext(ctx, "docker", "inspect", "--type", "container", idOrName).Run() == nil
+}
+
+// ImageExists reports whether an image is available locally
+func (dm *DockerManager) ImageExists(image string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return exec.CommandContext(ctx, "docker", "image", "inspect", image).Run() == nil
+}
+
+// CommitContainer saves a container's filesystem as an image
+func (dm *DockerManager) CommitContainer(idOrName, image string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "docker", "commit", idOrName, image).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// CopyToContainer copies a host file into a container as dest. For a
+// non-root user the file is copied to a fresh temporary path, handed to the
+// user and moved into place as that user, so it lands only where the user
+// may write and never replaces a file the user couldn't.
+func (dm *DockerManager) CopyToContainer(containerName, src, dest, user string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	if user == "" {
+		output, err := exec.CommandContext(ctx, "docker", "cp", src, containerName+":"+dest).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+		}
+		return nil
+	}
+
+	tmp := "/tmp/.cyh-upload-" + GenerateID()
+	output, err := exec.CommandContext(ctx, "docker", "cp", src, containerName+":"+tmp).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	output, err = exec.CommandContext(ctx, "docker", "exec", containerName, "chown", "-h", user+":", tmp).CombinedOutput()
+	if err == nil {
+		output, err = exec.CommandContext(ctx, "docker", "exec", "-u", user, containerName, "mv", "-f", "--", tmp, dest).CombinedOutput()
+	}
+	if err != nil {
+		exec.CommandContext(ctx, "docker", "exec", containerName, "rm", "-f", "--", tmp).Run()
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
 	return nil
 }
 
+// ListImages returns the images whose reference matches a docker
+// reference filter such as "repo/*"
+func (dm *DockerManager) ListImages(reference string) ([]UserImage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "docker", "images", "--filter", "reference="+reference,
+		"--format", "{{.Repository}}|{{.ID}}|{{.CreatedAt}}|{{.Size}}").Output()
+	if err != nil {
+		return nil, err
+	}
+
+	images := []UserImage{}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		parts := strings.Split(line, "|")
+		if len(parts) < 4 {
+			continue
+		}
+		images = append(images, UserImage{
+			Image:   parts[0],
+			ID:      parts[1],
+			Created: parts[2],
+			Size:    parts[3],
+		})
+	}
+	return images, nil
+}
+
+// RemoveImage deletes an image
+func (dm *DockerManager) RemoveImage(image string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, "docker", "rmi", image).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// ContainerSpec describes how a session container is created
+type ContainerSpec struct {
+	Image        string
+	Env          []string
+	Mounts       []string // docker run -v
+	WorkingDir   string
+	CPUs         string
+	Memory       string
+	PidsLimit    int
+	Entrypoint   string
+	InitCommands []string // Run via docker exec once the container is created
+	ExtraFlags   []string // Allowlisted docker run flags the session asked for, see container_flags.go
+}
+
+// defaultContainerSpec is the spec used for sessions without a template: the
+// default image with the container profile applied
+func defaultContainerSpec() ContainerSpec {
+	return ContainerSpec{
+		Image:      DockerImageName,
+		Env:        mergeEnv(defaultLocaleEnv, containerProfile.Env),
+		Mounts:     containerProfile.Mounts,
+		CPUs:       containerProfile.CPUs,
+		Memory:     containerProfile.Memory,
+		PidsLimit:  containerProfile.PidsLimit,
+		Entrypoint: containerProfile.Entrypoint,
+	}
+}
+
+// RunArgs builds the docker run arguments for a detached container. The
+// terminal environment is always added last.
+func (s ContainerSpec) RunArgs(containerName string) []string {
+	args := []string{"run", "-d", "--name", containerName, "--hostname", "canyouhack"}
+	for _, v := range mergeEnv(s.Env, terminalContainerEnv) {
+		args = append(args, "-e", v)
+	}
+	for _, m := range s.Mounts {
+		args = append(args, "-v", m)
+	}
+	if s.WorkingDir != "" {
+		args = append(args, "-w", s.WorkingDir)
+	}
+	if s.CPUs != "" {
+		args = append(args, "--cpus", s.CPUs)
+	}
+	if s.Memory != "" {
+		args = append(args, "--memory", s.Memory)
+	}
+	if s.PidsLimit > 0 {
+		args = append(args, "--pids-limit", strconv.Itoa(s.PidsLimit))
+	}
+	if s.Entrypoint != "" {
+		args = append(args, "--entrypoint", s.Entrypoint)
+	}
+	args = append(args, s.ExtraFlags...)
+	return append(args, s.Image, "tail", "-f", "/dev/null")
+}
+
+// RunInitCommands executes a spec's init commands inside a freshly created container
+func (dm *DockerManager) RunInitCommands(containerName string, spec ContainerSpec) {
+	for _, command := range spec.InitCommands {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+		args := []string{"exec"}
+		if spec.WorkingDir != "" {
+			args = append(args, "-w", spec.WorkingDir)
+		}
+		args = append(args, containerName, "/bin/bash", "-lc", command)
+		output, err := exec.CommandContext(ctx, "docker", args...).CombinedOutput()
+		cancel()
+		if err != nil {
+			logErrorf("Init command %q failed in %s: %v: %s", command, containerName, err, strings.TrimSpace(string(output)))
+		}
+	}
+}
+
 // GetContainerName returns the container name for exec
 func (dm *DockerManager) GetContainerName() string {
 	return DockerContainerName
 }
 
+// IsImageReady reports whether the image is built
+func (dm *DockerManager) IsImageReady() bool {
+	dm.stateMu.RLock()
+	defer dm.stateMu.RUnlock()
+	return dm.imageReady
+}
+
+// SetImageReady records whether the image is built
+func (dm *DockerManager) SetImageReady(ready bool) {
+	dm.stateMu.Lock()
+	dm.imageReady = ready
+	dm.stateMu.Unlock()
+}
+
+// IsContainerReady reports whether the main container is running
+func (dm *DockerManager) IsContainerReady() bool {
+	dm.stateMu.RLock()
+	defer dm.stateMu.RUnlock()
+	return dm.containerReady
+}
+
+// SetContainerReady records whether the main container is running
+func (dm *DockerManager) SetContainerReady(ready bool) {
+	dm.stateMu.Lock()
+	dm.containerReady = ready
+	dm.stateMu.Unlock()
+}
+
 // IsReady returns if Docker environment is ready
 func (dm *DockerManager) IsReady() bool {
+	dm.stateMu.RLock()
+	defer dm.stateMu.RUnlock()
 	return dm.imageReady && dm.containerReady
 }
 
 // InitializeDocker builds image and starts container if Docker is available
 func InitializeDocker() bool {
 	if !CheckDockerInstalled() {
-		log.Println("⚠️  Docker not detected.")
+		logWarnf("⚠️  Docker not detected.")
 
 		// On Windows, try to start it first before assuming it's not installed
 		if isWindows() {
-			log.Println("🔄 Attempting to start Docker Desktop...")
+			logInfof("🔄 Attempting to start Docker Desktop...")
 			if err := StartDockerWindows(); err == nil {
 				// Docker started successfully
 				goto DockerReady
 			} else {
-				log.Printf("⚠️  Could not start Docker Desktop: %v", err)
+				logWarnf("⚠️  Could not start Docker Desktop: %v", err)
 			}
 		}
 
-		log.Println("⚠️  Docker not installed or not running. Attempting auto-installation...")
+		logWarnf("⚠️  Docker not installed or not running. Attempting auto-installation...")
 		
 		// Try to install Docker
 		if TryInstallDocker() {
-			log.Println("✅ Docker installed successfully!")
+			logInfof("✅ Docker installed successfully!")
 		} else {
-			log.Println("⚠️  Docker auto-installation failed. Only local shell will be available.")
-			log.Println("📋 Please install Docker manually:")
-			log.Println("   Linux:   sudo apt install docker.io")
-			log.Println("   Windows: https://www.docker.com/products/docker-desktop")
+			logWarnf("⚠️  Docker auto-installation failed. Only local shell will be available.")
+			logInfof("📋 Please install Docker manually:")
+			logInfof("   Linux:   sudo apt install docker.io")
+			logInfof("   Windows: https://www.docker.com/products/docker-desktop")
 			return false
 		}
 	}
@@ -400,23 +897,23 @@ DockerReady:
 	go func() {
 		// Check if image already exists
 		if dockerMgr.IsDockerImageBuilt() {
-			log.Println("✅ CYH Docker image already exists. Skipping build.")
-			dockerMgr.imageReady = true
+			logInfof("✅ CYH Docker image already exists. Skipping build.")
+			dockerMgr.SetImageReady(true)
 		} else {
-			log.Println("📦 CYH Docker image not found. Building...")
+			logInfof("📦 CYH Docker image not found. Building...")
 			if err := dockerMgr.BuildDockerImage(); err != nil {
-				log.Printf("❌ Failed to build Docker image: %v", err)
+				logErrorf("❌ Failed to build Docker image: %v", err)
 				return
 			}
 		}
 
 		// Start container (will reuse existing if available)
 		if err := dockerMgr.StartContainer(); err != nil {
-			log.Printf("❌ Failed to start container: %v", err)
+			logErrorf("❌ Failed to start container: %v", err)
 			return
 		}
 
-		log.Println("🎉 CYH Terminal Docker environment is ready!")
+		logInfof("🎉 CYH Terminal Docker environment is ready!")
 	}()
 
 	return true
@@ -431,7 +928,7 @@ func (lw *logWriter) Write(p []byte) (n int, err error) {
 	lines := strings.Split(strings.TrimSpace(string(p)), "\n")
 	for _, line := range lines {
 		if line != "" {
-			log.Printf("%s%s", lw.prefix, line)
+			logInfof("%s%s", lw.prefix, line)
 		}
 	}
 	return len(p), nil
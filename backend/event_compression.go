@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Event compression (CYH_EVENT_COMPRESSION). terminal_logs.compression says
+// how a row's data is stored; rows written before the column existed, or
+// below CYH_EVENT_COMPRESSION_MIN_BYTES, have none.
+const (
+	EventCompressionNone = "none"
+	EventCompressionGzip = "gzip"
+)
+
+// gzipWriters reuses gzip writers, which allocate a lot each
+var gzipWriters = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(io.Discard) },
+}
+
+var warnEventCompressionOnce sync.Once
+
+// compressEventData prepares an event's data for terminal_logs, returning
+// the value to store and its compression. Data is compressed when enabled,
+// at least CYH_EVENT_COMPRESSION_MIN_BYTES long and actually smaller
+// compressed. Callers run off the PTY goroutines, so the CPU isn't spent
+// while the terminal waits.
+func compressEventData(data string) (interface{}, string) {
+	switch serverConfig.EventCompression {
+	case "", EventCompressionNone:
+		return data, ""
+	case EventCompressionGzip:
+	default:
+		warnEventCompressionOnce.Do(func() {
+			logWarnf("Unknown CYH_EVENT_COMPRESSION %q (use none or gzip), storing events uncompressed", serverConfig.EventCompression)
+		})
+		return data, ""
+	}
+	if len(data) < serverConfig.EventCompressionMinBytes {
+		return data, ""
+	}
+
+	var buf bytes.Buffer
+	zw := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(zw)
+	zw.Reset(&buf)
+	if _, err := zw.Write([]byte(data)); err != nil {
+		return data, ""
+	}
+	if err := zw.Close(); err != nil || buf.Len() >= len(data) {
+		return data, ""
+	}
+	return buf.Bytes(), EventCompressionGzip
+}
+
+// decompressEventData restores an event's data read from terminal_logs
+func decompressEventData(data []byte, compression string) (string, error) {
+	switch compression {
+	case "", EventCompressionNone:
+		return string(data), nil
+	case EventCompressionGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return "", err
+		}
+		defer zr.Close()
+		plain, err := io.ReadAll(zr)
+		if err != nil {
+			return "", err
+		}
+		return string(plain), nil
+	default:
+		return "", fmt.Errorf("unknown event compression %q", compression)
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// File transfer protocol. A docker terminal uploads a file into its container
+// in chunks over the terminal WebSocket:
+//
+//	client: {"type":"file_transfer_begin","data":{"id":"t1","name":"dump.tar","size":314572800,"dest":"/root"}}
+//	server: {"type":"file_transfer_progress","id":"t1","received":0,"size":314572800}
+//	client: {"type":"file_transfer_chunk","data":{"id":"t1","offset":0,"chunk":"<base64>"}}
+//	server: {"type":"file_transfer_progress","id":"t1","received":1048576,"size":314572800}
+//	...
+//	client: {"type":"file_transfer_end","data":{"id":"t1"}}
+//	server: {"type":"file_transfer_done","id":"t1","path":"/root/dump.tar"}
+//
+// Chunks are written to a temporary file on the server, which is copied
+// into the container once complete. Each chunk must start at the received
+// offset in the last progress message; a chunk at another offset gets the
+// current progress back instead, so the client continues from there. A
+// transfer outlives its connection for fileTransferIdleTTL: beginning it
+// again with the same id, name and size resumes it. Chunks bypass the
+// terminal input rate limit; the transfer size limit applies instead.
+const (
+	MsgTypeFileTransferBegin    = "file_transfer_begin"
+	MsgTypeFileTransferChunk    = "file_transfer_chunk"
+	MsgTypeFileTransferEnd      = "file_transfer_end"
+	MsgTypeFileTransferAbort    = "file_transfer_abort"    // Client: {"id":"t1"}, drops the transfer
+	MsgTypeFileTransferProgress = "file_transfer_progress" // Server
+	MsgTypeFileTransferDone     = "file_transfer_done"     // Server
+	MsgTypeFileTransferError    = "file_transfer_error"    // Server: {"id":"t1","message":"..."}, the transfer is dropped
+)
+
+const (
+	// maxFileTransferChunk caps the decoded bytes of one chunk
+	maxFileTransferChunk = 1 << 20
+
+	// maxFileTransfersPerUser caps a user's unfinished transfers
+	maxFileTransfersPerUser = 4
+
+	// fileTransferIdleTTL is how long an unfinished transfer without chunks
+	// is kept for resuming
+	fileTransferIdleTTL = 15 * time.Minute
+)
+
+// fileTransferMessagePrefix starts every client file transfer message
+var fileTransferMessagePrefix = []byte(`"type":"file_transfer_`)
+
+// fileTransferMessage is a client file transfer message
+type fileTransferMessage struct {
+	Type string `json:"type"`
+	Data struct {
+		ID     string `json:"id"`
+		Name   string `json:"name"`
+		Size   int64  `json:"size"`
+		Dest   string `json:"dest"` // Directory in the container, the exec user's home by default
+		Offset int64  `json:"offset"`
+		Chunk  []byte `json:"chunk"` // Base64 in JSON
+	} `json:"data"`
+}
+
+// fileTransfer is an upload being assembled in a temporary file
+type fileTransfer struct {
+	user      string
+	name      string
+	size      int64
+	dest      string // Full path in the container
+	mu        sync.Mutex
+	file      *os.File
+	received  int64
+	finishing bool // Copying into the container; no more chunks
+	touched   time.Time
+}
+
+// fileTransfers holds unfinished transfers by "<user>\x00<session>\x00<id>"
+var fileTransfers = struct {
+	sync.Mutex
+	entries map[string]*fileTransfer
+}{entries: make(map[string]*fileTransfer)}
+
+var fileTransferSweeper sync.Once
+
+// fileTransferChannel handles the file transfer messages of one terminal
+type fileTransferChannel struct {
+	conn      *safeConn
+	username  string
+	sessionID string
+	container string // Empty outside docker mode
+	execUser  string
+}
+
+func newFileTransferChannel(conn *safeConn, username, sessionID, container, execUser string) *fileTransferChannel {
+	return &fileTransferChannel{
+		conn:      conn,
+		username:  username,
+		sessionID: sessionID,
+		container: container,
+		execUser:  execUser,
+	}
+}
+
+// HandleFrame handles a text frame if it is a file transfer message,
+// reporting false for anything else. Only the input goroutine calls it,
+// before input limiting.
+func (fc *fileTransferChannel) HandleFrame(data []byte) bool {
+	if !bytes.Contains(data, fileTransferMessagePrefix) {
+		return false
+	}
+	var msg fileTransferMessage
+	if err := json.Unmarshal(data, &msg); err != nil || !strings.HasPrefix(msg.Type, "file_transfer_") {
+		return false
+	}
+
+	id := msg.Data.ID
+	if id == "" || len(id) > 64 {
+		fc.conn.WriteJSON(map[string]interface{}{"type": MsgTypeFileTransferError, "id": id, "message": "Transfer ids must be 1 to 64 bytes"})
+		return true
+	}
+	if fc.container == "" || serverConfig.MaxFileTransferMB <= 0 {
+		fc.fail(id, "File transfers need a docker session on a server that allows them", nil)
+		return true
+	}
+	key := fc.username + "\x00" + fc.sessionID + "\x00" + id
+
+	switch msg.Type {
+	case MsgTypeFileTransferBegin:
+		fc.begin(key, id, msg.Data.Name, msg.Data.Dest, msg.Data.Size)
+	case MsgTypeFileTransferChunk:
+		fc.chunk(key, id, msg.Data.Offset, msg.Data.Chunk)
+	case MsgTypeFileTransferEnd:
+		fc.end(key, id)
+	case MsgTypeFileTransferAbort:
+		if t := takeFileTransfer(key); t != nil {
+			t.discard()
+			logInfof("File transfer %s of %s aborted at %d of %d bytes", t.dest, fc.username, t.received, t.size)
+		}
+	default:
+		fc.fail(id, "Unknown file transfer message "+msg.Type, nil)
+	}
+	return true
+}
+
+// checkFileTransfer validates a new transfer's name, size and destination
+// directory. It returns a message for the client when they are invalid.
+func (fc *fileTransferChannel) checkFileTransfer(name, dest string, size int64) string {
+	if name == "" || name == "." || name == ".." || len(name) > 255 ||
+		strings.ContainsAny(name, `/\`) || strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return "File names must be 1 to 255 bytes without slashes or control characters"
+	}
+	if size < 0 || size > int64(serverConfig.MaxFileTransferMB)<<20 {
+		return "Files can be at most " + strconv.Itoa(serverConfig.MaxFileTransferMB) + " MB"
+	}
+	if dest != "" && (!path.IsAbs(dest) || strings.IndexFunc(dest, unicode.IsControl) >= 0) {
+		return "The destination must be an absolute directory in the container"
+	}
+	return ""
+}
+
+func (fc *fileTransferChannel) begin(key, id, name, dest string, size int64) {
+	fileTransferSweeper.Do(func() { go sweepFileTransfers() })
+
+	if msg := fc.checkFileTransfer(name, dest, size); msg != "" {
+		fc.fail(id, msg, takeFileTransfer(key))
+		return
+	}
+	if dest == "" {
+		dest = containerHomeDir(fc.execUser)
+	}
+	dest = path.Join(dest, name)
+
+	fileTransfers.Lock()
+	t := fileTransfers.entries[key]
+	if t != nil && (t.name != name || t.size != size || t.dest != dest) {
+		// Same id for another file: start over
+		delete(fileTransfers.entries, key)
+		go t.discard()
+		t = nil
+	}
+	if t == nil {
+		count := 0
+		for _, other := range fileTransfers.entries {
+			if other.user == fc.username {
+				count++
+			}
+		}
+		if count >= maxFileTransfersPerUser {
+			fileTransfers.Unlock()
+			fc.fail(id, "At most "+strconv.Itoa(maxFileTransfersPerUser)+" file transfers can be unfinished at a time", nil)
+			return
+		}
+
+		file, err := os.CreateTemp("", "cyh-transfer-*")
+		if err != nil {
+			fileTransfers.Unlock()
+			logErrorf("Failed to create file transfer buffer: %v", err)
+			fc.fail(id, "The server couldn't store the file", nil)
+			return
+		}
+		t = &fileTransfer{user: fc.username, name: name, size: size, dest: dest, file: file, touched: time.Now()}
+		fileTransfers.entries[key] = t
+		logInfof("File transfer started: %s into %s (%d bytes, user %s)", dest, fc.container, size, fc.username)
+	}
+	fileTransfers.Unlock()
+
+	t.mu.Lock()
+	t.touched = time.Now()
+	received := t.received
+	t.mu.Unlock()
+	fc.progress(id, received, size)
+}
+
+func (fc *fileTransferChannel) chunk(key, id string, offset int64, chunk []byte) {
+	t := getFileTransfer(key)
+	if t == nil {
+		fc.fail(id, "Unknown file transfer; begin it again", nil)
+		return
+	}
+
+	t.mu.Lock()
+	t.touched = time.Now()
+	if t.finishing || offset != t.received {
+		// Resend from where the server is
+		received := t.received
+		t.mu.Unlock()
+		fc.progress(id, received, t.size)
+		return
+	}
+	if len(chunk) > maxFileTransferChunk || t.received+int64(len(chunk)) > t.size {
+		t.mu.Unlock()
+		fc.fail(id, "Chunks must be at most "+strconv.Itoa(maxFileTransferChunk)+" bytes and stay within the file size", takeFileTransfer(key))
+		return
+	}
+	if _, err := t.file.Write(chunk); err != nil {
+		t.mu.Unlock()
+		logErrorf("Failed to buffer file transfer %s: %v", t.dest, err)
+		fc.fail(id, "The server couldn't store the file", takeFileTransfer(key))
+		return
+	}
+	t.received += int64(len(chunk))
+	received := t.received
+	t.mu.Unlock()
+	fc.progress(id, received, t.size)
+}
+
+func (fc *fileTransferChannel) end(key, id string) {
+	t := getFileTransfer(key)
+	if t == nil {
+		fc.fail(id, "Unknown file transfer; begin it again", nil)
+		return
+	}
+
+	t.mu.Lock()
+	if t.finishing {
+		t.mu.Unlock()
+		return
+	}
+	if t.received != t.size {
+		received := t.received
+		t.mu.Unlock()
+		fc.progress(id, received, t.size)
+		return
+	}
+	t.finishing = true
+	t.mu.Unlock()
+	takeFileTransfer(key)
+
+	// docker cp of a large file takes a while; keep the terminal responsive
+	go func() {
+		defer t.discard()
+
+		if err := t.file.Close(); err != nil {
+			logErrorf("Failed to buffer file transfer %s: %v", t.dest, err)
+			fc.fail(id, "The server couldn't store the file", nil)
+			return
+		}
+		if err := dockerMgr.CopyToContainer(fc.container, t.file.Name(), t.dest, fc.execUser); err != nil {
+			logWarnf("Failed to copy file transfer %s into %s: %v", t.dest, fc.container, err)
+			fc.fail(id, "Couldn't copy the file into the container: "+err.Error(), nil)
+			return
+		}
+		logInfof("File transfer finished: %s into %s (%d bytes, user %s)", t.dest, fc.container, t.size, fc.username)
+		fc.conn.WriteJSON(map[string]interface{}{"type": MsgTypeFileTransferDone, "id": id, "path": t.dest})
+	}()
+}
+
+func (fc *fileTransferChannel) progress(id string, received, size int64) {
+	fc.conn.WriteJSON(map[string]interface{}{"type": MsgTypeFileTransferProgress, "id": id, "received": received, "size": size})
+}
+
+// fail tells the client a transfer failed, dropping it if given
+func (fc *fileTransferChannel) fail(id, message string, t *fileTransfer) {
+	if t != nil {
+		t.discard()
+	}
+	fc.conn.WriteJSON(map[string]interface{}{"type": MsgTypeFileTransferError, "id": id, "message": message})
+}
+
+func getFileTransfer(key string) *fileTransfer {
+	fileTransfers.Lock()
+	defer fileTransfers.Unlock()
+	return fileTransfers.entries[key]
+}
+
+// takeFileTransfer removes a transfer from the registry, returning it
+func takeFileTransfer(key string) *fileTransfer {
+	fileTransfers.Lock()
+	defer fileTransfers.Unlock()
+	t := fileTransfers.entries[key]
+	delete(fileTransfers.entries, key)
+	return t
+}
+
+// discard removes a transfer's temporary file
+func (t *fileTransfer) discard() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.file.Close()
+	os.Remove(t.file.Name())
+}
+
+// sweepFileTransfers drops transfers nobody resumed within fileTransferIdleTTL
+func sweepFileTransfers() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var stale []*fileTransfer
+		fileTransfers.Lock()
+		for key, t := range fileTransfers.entries {
+			t.mu.Lock()
+			if !t.finishing && time.Since(t.touched) > fileTransferIdleTTL {
+				stale = append(stale, t)
+				delete(fileTransfers.entries, key)
+			}
+			t.mu.Unlock()
+		}
+		fileTransfers.Unlock()
+
+		for _, t := range stale {
+			logInfof("Dropped unfinished file transfer %s of %s (%d of %d bytes)", t.dest, t.user, t.received, t.size)
+			t.discard()
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"net/http"
+)
+
+// Guest container modes (CYH_GUEST_CONTAINER_MODE)
+const (
+	GuestContainersIsolated = "isolated" // Each guest session gets its own container
+	GuestContainersShared   = "shared"   // All guests share cyh_guest_terminal
+)
+
+// isGuestUser reports whether a session owner is an unauthenticated guest
+func isGuestUser(user string) bool {
+	return user == "" || user == "guest"
+}
+
+// sessionContainerName is the container a new docker session is bound to.
+// In shared guest mode every guest session uses the one guest container.
+func sessionContainerName(user, sessionID string) string {
+	if isGuestUser(user) && serverConfig.GuestContainerMode == GuestContainersShared {
+		return legacyContainerName("guest")
+	}
+	return buildContainerName(user, sessionID)
+}
+
+// isGuestContainer reports whether a session runs in a container created for
+// guests, which is removed once unused for CYH_GUEST_CONTAINER_TTL
+func isGuestContainer(session *TermSession) bool {
+	if session.Mode != "docker" || !isGuestUser(session.User) || session.ContainerName == "" {
+		return false
+	}
+	return session.ContainerName == buildContainerName(session.User, session.ID) ||
+		session.ContainerName == legacyContainerName("guest")
+}
+
+// containerAttached reports whether an open terminal is using a container.
+// A shared guest container stays up while any guest is connected to it.
+func (sm *SessionManager) containerAttached(containerName string) bool {
+	for _, id := range terminals.SessionIDs() {
+		if session, err := sm.GetSession(id); err == nil && session.ContainerName == containerName {
+			return true
+		}
+	}
+	return false
+}
+
+// guestKeyParam is the /ws/terminal query parameter a guest resumes a
+// session with. Every guest has the same identity, so the key handed to the
+// connection that created a guest session is what makes the session, and
+// its isolated container, that guest's.
+const guestKeyParam = "guest_key"
+
+// SetSessionGuestKey stores the key a guest must present to resume a session
+func (sm *SessionManager) SetSessionGuestKey(id, key string) error {
+	_, err := sm.db.Exec(`UPDATE term_sessions SET guest_key = ? WHERE id = ?`, key, id)
+	return err
+}
+
+// CheckSessionGuestKey reports whether key is the one issued for a guest
+// session. Sessions without a key can't be resumed by a guest.
+func (sm *SessionManager) CheckSessionGuestKey(id, key string) bool {
+	var stored sql.NullString
+	if err := sm.db.QueryRow(`SELECT guest_key FROM term_sessions WHERE id = ?`, id).Scan(&stored); err != nil {
+		return false
+	}
+	return key != "" && stored.String != "" && subtle.ConstantTimeCompare([]byte(key), []byte(stored.String)) == 1
+}
+
+// issueGuestKey gives a new guest session its resume key, returning "" for
+// other users' sessions or when it can't be stored
+func issueGuestKey(session *TermSession) string {
+	if !isGuestUser(session.User) {
+		return ""
+	}
+	key := generateToken()
+	if err := sessionMgr.SetSessionGuestKey(session.ID, key); err != nil {
+		logErrorf("Failed to store guest key for session %s: %v", session.ID, err)
+		return ""
+	}
+	return key
+}
+
+// canResumeSession reports whether a terminal connect may resume a session:
+// users resume their own sessions, guests only those they hold the key for
+func canResumeSession(r *http.Request, session *TermSession, username string) bool {
+	if session.User != username {
+		return false
+	}
+	if isGuestUser(username) {
+		return sessionMgr.CheckSessionGuestKey(session.ID, r.URL.Query().Get(guestKeyParam))
+	}
+	return true
+}
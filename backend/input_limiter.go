@@ -0,0 +1,114 @@
+package main
+
+import (
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// inputVerdict is what the terminal input loop should do with a message
+type inputVerdict int
+
+const (
+	inputAllow      inputVerdict = iota
+	inputDrop                    // Over the byte rate: discard the message
+	inputDisconnect              // Over the rate for too long: close the connection
+)
+
+// inputQuietPeriod is how long a connection must go without dropped input
+// before an abuse episode is considered over
+const inputQuietPeriod = time.Second
+
+// inputLimiter is a per-connection byte-rate token bucket for terminal input.
+// The burst lets ordinary pastes through; sustained floods are dropped and
+// eventually disconnected.
+type inputLimiter struct {
+	rate         float64 // bytes refilled per second
+	burst        float64
+	tokens       float64
+	last         time.Time
+	abuseSince   time.Time // Start of the current run of dropped input (zero if none)
+	lastDrop     time.Time
+	abuseTimeout time.Duration
+	now          func() time.Time
+}
+
+// newInputLimiter creates a limiter from the server config, or nil when input limiting is disabled
+func newInputLimiter() *inputLimiter {
+	if serverConfig.InputBytesPerSecond <= 0 {
+		return nil
+	}
+	burst := serverConfig.InputBurstBytes
+	if burst < serverConfig.InputBytesPerSecond {
+		burst = serverConfig.InputBytesPerSecond
+	}
+	return &inputLimiter{
+		rate:         float64(serverConfig.InputBytesPerSecond),
+		burst:        float64(burst),
+		tokens:       float64(burst),
+		last:         time.Now(),
+		abuseTimeout: serverConfig.InputAbuseTimeout,
+		now:          time.Now,
+	}
+}
+
+// Check accounts for n input bytes. A nil limiter allows everything.
+func (l *inputLimiter) Check(n int) inputVerdict {
+	if l == nil {
+		return inputAllow
+	}
+
+	now := l.now()
+	if elapsed := now.Sub(l.last).Seconds(); elapsed > 0 {
+		l.tokens += elapsed * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.last = now
+	}
+
+	if l.tokens >= float64(n) {
+		l.tokens -= float64(n)
+		if !l.abuseSince.IsZero() && now.Sub(l.lastDrop) >= inputQuietPeriod {
+			l.abuseSince = time.Time{}
+		}
+		return inputAllow
+	}
+
+	l.lastDrop = now
+	if l.abuseSince.IsZero() {
+		l.abuseSince = now
+	}
+	if now.Sub(l.abuseSince) >= l.abuseTimeout {
+		return inputDisconnect
+	}
+	return inputDrop
+}
+
+// Abusing reports whether the connection is currently in a run of dropped input
+func (l *inputLimiter) Abusing() bool {
+	return l != nil && !l.abuseSince.IsZero()
+}
+
+// applyInputLimit runs the limiter for one input message, warning the client the
+// first time input is dropped and closing the connection on sustained abuse.
+// It returns false when the message must not be written to the terminal.
+func applyInputLimit(conn *safeConn, limiter *inputLimiter, n int) bool {
+	wasAbusing := limiter.Abusing()
+
+	switch limiter.Check(n) {
+	case inputDrop:
+		if !wasAbusing {
+			conn.WriteMessage(websocket.BinaryMessage, []byte(
+				"\r\n\x1b[33m[CYH] Input rate limit exceeded, input is being dropped.\x1b[0m\r\n"))
+		}
+		return false
+	case inputDisconnect:
+		logWarnf("Terminal disconnected: input rate limit exceeded for too long")
+		conn.WriteMessage(websocket.BinaryMessage, []byte(
+			"\r\n\x1b[31m[CYH] Disconnected: terminal input rate limit exceeded for too long\x1b[0m\r\n"))
+		closeTerminal(conn, CloseInputLimited, "Input rate limit exceeded")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Legacy container policies (CYH_LEGACY_CONTAINERS): what happens to a
+// user's cyh_<user>_terminal container from before per-session containers
+// the first time they open a docker terminal after the server starts
+const (
+	LegacyContainersKeep    = "keep"    // Leave it alone
+	LegacyContainersRemove  = "remove"  // Remove it when unused
+	LegacyContainersMigrate = "migrate" // Save it as the user's "legacy" image, then remove it
+)
+
+// legacyImageTag is the tag a migrated container is saved under in the
+// user's image namespace
+const legacyImageTag = "legacy"
+
+// Why a legacy container is still needed (LegacyContainer.InUse)
+const (
+	LegacyInUseTerminal = "terminal" // An open terminal runs in it
+	LegacyInUseSession  = "session"  // A session is bound to it and may be resumed
+)
+
+// LegacyContainer is a legacy-named container as GET
+// /api/admin/legacy-containers lists it
+type LegacyContainer struct {
+	ContainerSummary
+	InUse string `json:"in_use,omitempty"`
+}
+
+// legacyChecked tracks users whose legacy container was looked at since the
+// server started
+var legacyChecked = struct {
+	sync.Mutex
+	users map[string]bool
+}{users: make(map[string]bool)}
+
+var warnLegacyPolicyOnce sync.Once
+
+// isLegacyContainerName reports whether a container is named like a legacy
+// per-user container. The shared guest container has the same shape but is
+// still in use (CYH_GUEST_CONTAINERS=shared).
+func isLegacyContainerName(name string) bool {
+	return strings.HasPrefix(name, "cyh_") && strings.HasSuffix(name, "_terminal") && len(name) > len("cyh__terminal") &&
+		name != legacyContainerName("guest")
+}
+
+// legacyContainerUse reports why a legacy container is still needed, or ""
+// when it can go. Sessions from before per-session containers have no
+// container name and fall back to their user's legacy container.
+func legacyContainerUse(name string) string {
+	for _, id := range terminals.SessionIDs() {
+		session, err := sessionMgr.GetSession(id)
+		if err != nil || session.Mode != "docker" {
+			continue
+		}
+		if session.ContainerName == name || (session.ContainerName == "" && legacyContainerName(session.User) == name) {
+			return LegacyInUseTerminal
+		}
+	}
+	if _, err := sessionMgr.GetSessionByContainer(name); err == nil {
+		return LegacyInUseSession
+	}
+	user := strings.TrimSuffix(strings.TrimPrefix(name, "cyh_"), "_terminal")
+	if _, err := sessionMgr.GetUnboundDockerSession(user); err == nil {
+		return LegacyInUseSession
+	}
+	return ""
+}
+
+// checkLegacyContainer applies CYH_LEGACY_CONTAINERS to a user's legacy
+// container on their first docker terminal since the server started. The
+// work runs in the background; the terminal is told when the container was
+// removed or migrated. A container still in use is looked at again on the
+// next connect.
+func checkLegacyContainer(conn *safeConn, username string) {
+	policy := serverConfig.LegacyContainers
+	switch policy {
+	case "", LegacyContainersKeep:
+		return
+	case LegacyContainersRemove, LegacyContainersMigrate:
+	default:
+		warnLegacyPolicyOnce.Do(func() {
+			logWarnf("Unknown CYH_LEGACY_CONTAINERS %q (use keep, remove or migrate), keeping legacy containers", policy)
+		})
+		return
+	}
+
+	// Guests share one legacy name and can't save images
+	if isGuestUser(username) {
+		return
+	}
+
+	legacyChecked.Lock()
+	if legacyChecked.users[username] {
+		legacyChecked.Unlock()
+		return
+	}
+	legacyChecked.users[username] = true
+	legacyChecked.Unlock()
+
+	go func() {
+		name := legacyContainerName(username)
+		if !dockerMgr.ContainerExists(name) {
+			return
+		}
+		if use := legacyContainerUse(name); use != "" {
+			logDebugf("Legacy container %s is in use (%s), keeping it", name, use)
+			legacyChecked.Lock()
+			delete(legacyChecked.users, username)
+			legacyChecked.Unlock()
+			return
+		}
+
+		image := ""
+		if policy == LegacyContainersMigrate {
+			var err error
+			if image, err = saveLegacyContainer(username, name); err != nil {
+				logWarnf("Keeping legacy container %s, saving it as an image failed: %v", name, err)
+				return
+			}
+		}
+		if err := dockerMgr.RemoveContainer(name); err != nil {
+			logErrorf("Failed to remove legacy container %s: %v", name, err)
+			return
+		}
+
+		if image != "" {
+			logInfof("Migrated legacy container %s to image %s", name, image)
+			terminalNotice(conn, "Your old container "+name+" was saved as the image "+image+" and removed. Start a session from that image to get its files back.")
+		} else {
+			logInfof("Removed unused legacy container %s", name)
+			terminalNotice(conn, "Your old container "+name+" from before per-session containers was removed.")
+		}
+	}()
+}
+
+// saveLegacyContainer commits a user's legacy container as their "legacy"
+// image, within their saved image limit, and returns the image
+func saveLegacyContainer(username, name string) (string, error) {
+	imageCommits.Lock()
+	if imageCommits.active[username] {
+		imageCommits.Unlock()
+		return "", errors.New("an image is already being saved")
+	}
+	imageCommits.active[username] = true
+	imageCommits.Unlock()
+	defer func() {
+		imageCommits.Lock()
+		delete(imageCommits.active, username)
+		imageCommits.Unlock()
+	}()
+
+	// Overwriting an earlier legacy image doesn't count against the cap
+	if limit := serverConfig.MaxUserImages; limit > 0 {
+		images, err := listUserImages(username)
+		if err != nil {
+			return "", err
+		}
+		exists := false
+		for _, img := range images {
+			if img.Tag == legacyImageTag {
+				exists = true
+				break
+			}
+		}
+		if !exists && len(images) >= limit {
+			return "", errors.New("saved image limit reached")
+		}
+	}
+
+	image := userImageRepo(username) + "/" + legacyImageTag
+	if err := dockerMgr.CommitContainer(name, image); err != nil {
+		return "", err
+	}
+	return image, nil
+}
+
+// listLegacyContainers returns every legacy-named container with what still
+// uses it
+func listLegacyContainers() ([]LegacyContainer, error) {
+	found, err := dockerMgr.ListContainers("^cyh_.+_terminal$")
+	if err != nil {
+		return nil, err
+	}
+	containers := []LegacyContainer{}
+	for _, c := range found {
+		if !isLegacyContainerName(c.Name) {
+			continue
+		}
+		containers = append(containers, LegacyContainer{ContainerSummary: c, InUse: legacyContainerUse(c.Name)})
+	}
+	return containers, nil
+}
+
+// handleAdminLegacyContainers lists or removes legacy per-user containers:
+// GET /api/admin/legacy-containers, DELETE /api/admin/legacy-containers?name=&force=true.
+// DELETE removes every unused one, or only ?name=; force=true also removes
+// those bound to sessions, but never one an open terminal runs in.
+func handleAdminLegacyContainers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !CheckDockerInstalled() {
+		http.Error(w, "Docker is not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	containers, err := listLegacyContainers()
+	if err != nil {
+		http.Error(w, "Failed to list containers", http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"policy":     serverConfig.LegacyContainers,
+			"containers": containers,
+		})
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	force := r.URL.Query().Get("force") == "true"
+	if name != "" && !isLegacyContainerName(name) {
+		http.Error(w, "Not a legacy container name", http.StatusBadRequest)
+		return
+	}
+
+	removed := []string{}
+	kept := []LegacyContainer{}
+	failed := map[string]string{}
+	for _, c := range containers {
+		if name != "" && c.Name != name {
+			continue
+		}
+		if c.InUse == LegacyInUseTerminal || (c.InUse == LegacyInUseSession && !force) {
+			kept = append(kept, c)
+			continue
+		}
+		if err := dockerMgr.RemoveContainer(c.Name); err != nil {
+			failed[c.Name] = err.Error()
+			continue
+		}
+		logInfof("Removed legacy container %s", c.Name)
+		removed = append(removed, c.Name)
+	}
+	if name != "" && len(removed)+len(kept)+len(failed) == 0 {
+		http.Error(w, "Container not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"removed": removed,
+		"kept":    kept,
+		"failed":  failed,
+	})
+}
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestIsLegacyContainerName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "cyh_bob_terminal", want: true},
+		{name: "cyh_bob_smith_terminal", want: true},
+		{name: "cyh_guest_terminal", want: false},
+		{name: "cyh__terminal", want: false},
+		{name: "cyh_bob_sess_1234", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := isLegacyContainerName(tt.name); got != tt.want {
+			t.Errorf("isLegacyContainerName(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLegacyContainerUseUnboundSession(t *testing.T) {
+	newTestSessionManager(t)
+	session, err := sessionMgr.CreateSession("bob", "Old", "docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if use := legacyContainerUse("cyh_bob_terminal"); use != "" {
+		t.Fatalf("legacyContainerUse with only a per-session container = %q, want unused", use)
+	}
+
+	// A session from before per-session containers has no container name
+	if err := sessionMgr.SetSessionContainerName(session.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+	if use := legacyContainerUse("cyh_bob_terminal"); use != LegacyInUseSession {
+		t.Fatalf("legacyContainerUse = %q, want %q", use, LegacyInUseSession)
+	}
+	if use := legacyContainerUse("cyh_alice_terminal"); use != "" {
+		t.Fatalf("another user's legacy container = %q, want unused", use)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxEditorLine caps the logical line so a client can't grow it without bound
+const maxEditorLine = 16 * 1024
+
+// lineEditor models readline-style editing on raw terminal input so the
+// command a user actually submitted can be recovered from keystrokes.
+// Edits the server can't see the result of (history recall, tab completion,
+// reverse search) mark the line as unknown and it is not reported.
+type lineEditor struct {
+	line    []rune
+	cursor  int
+	unknown bool
+	esc     []byte // Escape sequence in progress
+	partial []byte // Incomplete UTF-8 sequence split across reads
+}
+
+// Feed processes a chunk of terminal input and returns the commands submitted in it
+func (e *lineEditor) Feed(data []byte) []string {
+	var submitted []string
+
+	if len(e.partial) > 0 {
+		data = append(e.partial, data...)
+		e.partial = nil
+	}
+
+	for i := 0; i < len(data); {
+		b := data[i]
+
+		if len(e.esc) > 0 {
+			e.esc = append(e.esc, b)
+			i++
+			if e.escComplete() {
+				e.applyEscape()
+				e.esc = nil
+			}
+			continue
+		}
+
+		if b < 0x20 || b == 0x7f {
+			i++
+			if b == '\r' || b == '\n' {
+				if cmd := e.submit(); cmd != "" {
+					submitted = append(submitted, cmd)
+				}
+				continue
+			}
+			e.applyControl(b)
+			continue
+		}
+
+		if !utf8.FullRune(data[i:]) {
+			e.partial = append([]byte(nil), data[i:]...)
+			break
+		}
+		r, size := utf8.DecodeRune(data[i:])
+		i += size
+		e.insert(r)
+	}
+
+	return submitted
+}
+
+// submit ends the current line and returns it unless its contents are unknown
+func (e *lineEditor) submit() string {
+	cmd := strings.TrimSpace(string(e.line))
+	if e.unknown {
+		cmd = ""
+	}
+	e.reset()
+	return cmd
+}
+
+func (e *lineEditor) reset() {
+	e.line = e.line[:0]
+	e.cursor = 0
+	e.unknown = false
+}
+
+func (e *lineEditor) insert(r rune) {
+	if len(e.line) >= maxEditorLine {
+		e.unknown = true
+		return
+	}
+	e.line = append(e.line, 0)
+	copy(e.line[e.cursor+1:], e.line[e.cursor:])
+	e.line[e.cursor] = r
+	e.cursor++
+}
+
+// deleteRange removes line[from:to] and leaves the cursor at from
+func (e *lineEditor) deleteRange(from, to int) {
+	if from < 0 {
+		from = 0
+	}
+	if to > len(e.line) {
+		to = len(e.line)
+	}
+	if from >= to {
+		return
+	}
+	e.line = append(e.line[:from], e.line[to:]...)
+	e.cursor = from
+}
+
+// wordStart returns the start of the word before the cursor
+func (e *lineEditor) wordStart() int {
+	i := e.cursor
+	for i > 0 && unicode.IsSpace(e.line[i-1]) {
+		i--
+	}
+	for i > 0 && !unicode.IsSpace(e.line[i-1]) {
+		i--
+	}
+	return i
+}
+
+// wordEnd returns the end of the word after the cursor
+func (e *lineEditor) wordEnd() int {
+	i := e.cursor
+	for i < len(e.line) && unicode.IsSpace(e.line[i]) {
+		i++
+	}
+	for i < len(e.line) && !unicode.IsSpace(e.line[i]) {
+		i++
+	}
+	return i
+}
+
+func (e *lineEditor) applyControl(b byte) {
+	switch b {
+	case 0x1b: // ESC starts a sequence
+		e.esc = append(e.esc, b)
+	case 0x7f, 0x08: // Backspace
+		if e.cursor > 0 {
+			e.deleteRange(e.cursor-1, e.cursor)
+		}
+	case 0x04: // Ctrl-D deletes under the cursor
+		e.deleteRange(e.cursor, e.cursor+1)
+	case 0x15: // Ctrl-U
+		e.deleteRange(0, e.cursor)
+	case 0x0b: // Ctrl-K
+		e.deleteRange(e.cursor, len(e.line))
+	case 0x17: // Ctrl-W
+		e.deleteRange(e.wordStart(), e.cursor)
+	case 0x01: // Ctrl-A
+		e.cursor = 0
+	case 0x05: // Ctrl-E
+		e.cursor = len(e.line)
+	case 0x02: // Ctrl-B
+		if e.cursor > 0 {
+			e.cursor--
+		}
+	case 0x06: // Ctrl-F
+		if e.cursor < len(e.line) {
+			e.cursor++
+		}
+	case 0x03: // Ctrl-C abandons the line
+		e.reset()
+	case '\t', 0x10, 0x0e, 0x12, 0x19: // Completion, history, reverse search, yank
+		e.unknown = true
+	}
+}
+
+// escComplete reports whether the buffered escape sequence is finished
+func (e *lineEditor) escComplete() bool {
+	if len(e.esc) < 2 {
+		return false
+	}
+	switch e.esc[1] {
+	case '[': // CSI ends with a byte in 0x40-0x7e
+		last := e.esc[len(e.esc)-1]
+		return len(e.esc) > 2 && last >= 0x40 && last <= 0x7e
+	case 'O': // SS3 has exactly one more byte
+		return len(e.esc) == 3
+	default: // Alt+key
+		return true
+	}
+}
+
+func (e *lineEditor) applyEscape() {
+	seq := string(e.esc[1:])
+	switch seq {
+	case "[C", "OC": // Right
+		if e.cursor < len(e.line) {
+			e.cursor++
+		}
+	case "[D", "OD": // Left
+		if e.cursor > 0 {
+			e.cursor--
+		}
+	case "[H", "OH", "[1~", "[7~": // Home
+		e.cursor = 0
+	case "[F", "OF", "[4~", "[8~": // End
+		e.cursor = len(e.line)
+	case "[3~": // Delete
+		e.deleteRange(e.cursor, e.cursor+1)
+	case "[A", "OA", "[B", "OB": // History up/down
+		e.unknown = true
+	case "b", "[1;5D", "[1;3D": // Word left
+		e.cursor = e.wordStart()
+	case "f", "[1;5C", "[1;3C": // Word right
+		e.cursor = e.wordEnd()
+	case "d": // Delete word forward
+		e.deleteRange(e.cursor, e.wordEnd())
+	case "\x7f", "\x08": // Delete word backward
+		e.deleteRange(e.wordStart(), e.cursor)
+	}
+}
@@ -2,8 +2,8 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
-	"log"
 	"sync"
 	"time"
 
@@ -22,6 +22,8 @@ const (
 	MsgTypePermissionGrant = "permission_grant"
 	MsgTypePermissionDeny  = "permission_deny"
 	MsgTypeChat            = "chat"
+	MsgTypeSessionEnded    = "session_ended"
+	MsgTypeBell            = "bell"
 )
 
 // LiveMessage represents a message in a live session
@@ -30,9 +32,18 @@ type LiveMessage struct {
 	SessionID string      `json:"session_id"`
 	Data      interface{} `json:"data"`
 	Sender    string      `json:"sender,omitempty"`
+	Reason    string      `json:"reason,omitempty"` // Why the session ended (session_ended) or the mode changed (permission_mode_change)
+	Seq       uint64      `json:"seq,omitempty"`    // Output sequence number for resuming viewers
+	ID        uint64      `json:"id,omitempty"`     // Chat message id for chat_seen receipts
 	Timestamp int64       `json:"timestamp"`
 }
 
+// roomClosure asks the hub to close a room
+type roomClosure struct {
+	sessionID string
+	reason    string
+}
+
 // LiveViewer represents a viewer in a live session
 type LiveViewer struct {
 	Conn      *websocket.Conn
@@ -42,9 +53,66 @@ type LiveViewer struct {
 	CanWrite  bool // Can send input to terminal
 	Hub       *LiveHub
 	send      chan []byte
+	visitID   int64 // viewer_sessions row for analytics (0 for the owner)
+	viewOnly  bool  // No input path (SSE viewers), never granted write
+	mirror    bool  // The owner's own read-only view, hidden from viewers (see terminal_mirror.go)
+	plain     bool  // Low-bandwidth mode: colors stripped from output
+	stripper  sgrStripper
+	token     string // viewer_token for reconnecting with the same identity
+	resume    bool   // Reconnecting with last_seq
+	lastSeq   uint64
+	joinedAt  time.Time
+	counters  viewerCounters // Bandwidth and drops, see viewer_stats.go
 	mu        sync.Mutex
 }
 
+// outputMessagePrefix starts every marshaled output LiveMessage
+var outputMessagePrefix = []byte(`{"type":"output"`)
+
+// prepare adapts a broadcast message for this viewer. Plain viewers get
+// output without color sequences. Only the viewer's writer may call it.
+func (v *LiveViewer) prepare(message []byte) []byte {
+	if !v.plain || !bytes.HasPrefix(message, outputMessagePrefix) {
+		return message
+	}
+
+	var msg LiveMessage
+	if err := json.Unmarshal(message, &msg); err != nil {
+		return message
+	}
+	data, ok := msg.Data.(string)
+	if !ok {
+		return message
+	}
+	msg.Data = v.stripper.Strip(data)
+
+	stripped, err := json.Marshal(&msg)
+	if err != nil {
+		return message
+	}
+	return stripped
+}
+
+// flushPlain returns an output message with what a plain viewer's stripper
+// held back, or nil, for when the viewer's stream ends. Only the viewer's
+// writer may call it.
+func (v *LiveViewer) flushPlain() []byte {
+	rest := v.stripper.Flush()
+	if rest == "" {
+		return nil
+	}
+	msg, err := json.Marshal(&LiveMessage{
+		Type:      MsgTypeOutput,
+		SessionID: v.SessionID,
+		Data:      rest,
+		Timestamp: time.Now().UnixMilli(),
+	})
+	if err != nil {
+		return nil
+	}
+	return msg
+}
+
 // LiveRoom represents a live session room
 type LiveRoom struct {
 	SessionID      string
@@ -53,16 +121,50 @@ type LiveRoom struct {
 	PermissionMode PermissionMode
 	Session        *TermSession
 	OutputBuffer   string
+	seq            uint64            // Latest output sequence number
+	seqFloor       uint64            // History holds every output after this seq
+	history        []sequencedOutput // Recent output messages by seq
+	historyBytes   int
+	chat           chatReceipts // Chat message ids and who saw them, see chat_receipts.go
+	idleWarning    *time.Timer  // Countdown before an idle owner's share goes view only, see share_watchdog.go
 	mu             sync.RWMutex
 }
 
+// audience counts the room's viewers, not counting the owner's mirrors.
+// The caller holds room.mu.
+func (room *LiveRoom) audience() int {
+	n := 0
+	for viewer := range room.Viewers {
+		if !viewer.mirror {
+			n++
+		}
+	}
+	return n
+}
+
+// newLiveRoom creates an empty room. Its output is numbered after every seq
+// handed out so far.
+func newLiveRoom(sessionID string, mode PermissionMode) *LiveRoom {
+	start := liveOutputSeq.Load()
+	return &LiveRoom{
+		SessionID:      sessionID,
+		Viewers:        make(map[*LiveViewer]bool),
+		PermissionMode: mode,
+		seq:            start,
+		seqFloor:       start,
+	}
+}
+
 // LiveHub manages all live rooms
 type LiveHub struct {
-	rooms      map[string]*LiveRoom
-	register   chan *LiveViewer
-	unregister chan *LiveViewer
-	broadcast  chan *LiveMessage
-	mu         sync.RWMutex
+	rooms        map[string]*LiveRoom
+	viewerTokens map[string]viewerIdentity
+	register     chan *LiveViewer
+	unregister   chan *LiveViewer
+	broadcast    chan *LiveMessage
+	closeRoom    chan roomClosure
+	ownerEvents  chan *LiveMessage // Events for the owner's terminals, see owner_events.go
+	mu           sync.RWMutex
 }
 
 var liveHub *LiveHub
@@ -70,12 +172,19 @@ var liveHub *LiveHub
 // NewLiveHub creates a new live hub
 func NewLiveHub() *LiveHub {
 	hub := &LiveHub{
-		rooms:      make(map[string]*LiveRoom),
-		register:   make(chan *LiveViewer, 256),
-		unregister: make(chan *LiveViewer, 256),
-		broadcast:  make(chan *LiveMessage, 1024),
+		rooms:        make(map[string]*LiveRoom),
+		viewerTokens: make(map[string]viewerIdentity),
+		register:     make(chan *LiveViewer, 256),
+		unregister:   make(chan *LiveViewer, 256),
+		broadcast:    make(chan *LiveMessage, 1024),
+		closeRoom:    make(chan roomClosure, 64),
+		ownerEvents:  make(chan *LiveMessage, 256),
 	}
 	go hub.run()
+	go hub.forwardOwnerEvents()
+	if serverConfig.ShareIdleTimeout > 0 {
+		go hub.watchIdleOwners()
+	}
 	return hub
 }
 
@@ -89,6 +198,8 @@ func (h *LiveHub) run() {
 			h.handleUnregister(viewer)
 		case msg := <-h.broadcast:
 			h.handleBroadcast(msg)
+		case closure := <-h.closeRoom:
+			h.handleCloseRoom(closure.sessionID, closure.reason)
 		}
 	}
 }
@@ -102,20 +213,17 @@ func (h *LiveHub) handleRegister(viewer *LiveViewer) {
 		// Create new room
 		session, err := sessionMgr.GetSession(viewer.SessionID)
 		if err != nil {
-			log.Printf("Failed to get session for room: %v", err)
+			logErrorf("Failed to get session for room: %v", err)
 			return
 		}
 
-		room = &LiveRoom{
-			SessionID:      viewer.SessionID,
-			Viewers:        make(map[*LiveViewer]bool),
-			PermissionMode: session.PermissionMode,
-			Session:        session,
-		}
+		room = newLiveRoom(viewer.SessionID, session.PermissionMode)
+		room.Session = session
 		h.rooms[viewer.SessionID] = room
 	}
 
 	room.mu.Lock()
+	viewer.joinedAt = time.Now()
 	if viewer.IsOwner {
 		room.Owner = viewer
 		viewer.CanWrite = true
@@ -129,12 +237,28 @@ func (h *LiveHub) handleRegister(viewer *LiveViewer) {
 		case PermissionInstructor:
 			viewer.CanWrite = false // Will be granted by owner
 		}
+		if viewer.viewOnly {
+			viewer.CanWrite = false
+		}
 	}
 	room.Viewers[viewer] = true
-	viewerCount := len(room.Viewers)
+	viewerCount := room.audience()
+	// Welcome and missed output go out before any later broadcast
+	room.queueCatchUp(viewer)
 	room.mu.Unlock()
 
-	log.Printf("Viewer joined room %s: %s (owner: %v, canWrite: %v)",
+	// Mirrors are private to the owner
+	if viewer.mirror {
+		logDebugf("Mirror attached to %s: %s", viewer.SessionID, viewer.Username)
+		return
+	}
+
+	// Persist attendance for viewer analytics
+	if !viewer.IsOwner {
+		viewer.visitID = sessionMgr.RecordViewerJoin(viewer.SessionID, viewer.Username, time.Now())
+	}
+
+	logDebugf("Viewer joined room %s: %s (owner: %v, canWrite: %v)",
 		viewer.SessionID, viewer.Username, viewer.IsOwner, viewer.CanWrite)
 
 	// If viewer has write permission (e.g. Shared Control), notify them immediately
@@ -148,25 +272,7 @@ func (h *LiveHub) handleRegister(viewer *LiveViewer) {
 			Timestamp: time.Now().UnixMilli(),
 		}
 		data, _ := json.Marshal(msg)
-		select {
-		case viewer.send <- data:
-		default:
-		}
-	}
-
-	// Send initial buffer (Fix for race condition)
-	if len(room.OutputBuffer) > 0 {
-		msg := &LiveMessage{
-			Type:      MsgTypeOutput,
-			SessionID: viewer.SessionID,
-			Data:      room.OutputBuffer,
-			Timestamp: time.Now().UnixMilli(),
-		}
-		data, _ := json.Marshal(msg)
-		select {
-		case viewer.send <- data:
-		default:
-		}
+		viewer.trySend(data)
 	}
 
 	// Notify all viewers about new viewer
@@ -191,23 +297,30 @@ func (h *LiveHub) handleUnregister(viewer *LiveViewer) {
 	}
 
 	room.mu.Lock()
+	if !room.Viewers[viewer] {
+		// Already removed (e.g. the room was closed and re-created)
+		room.mu.Unlock()
+		return
+	}
 	delete(room.Viewers, viewer)
 	if room.Owner == viewer {
 		room.Owner = nil
 	}
-	viewerCount := len(room.Viewers)
+	remaining := len(room.Viewers)
+	viewerCount := room.audience()
 	room.mu.Unlock()
 
 	close(viewer.send)
+	sessionMgr.RecordViewerLeave(viewer.visitID, time.Now())
 
-	log.Printf("Viewer left room %s: %s (remaining: %d)",
-		viewer.SessionID, viewer.Username, viewerCount)
+	logDebugf("Viewer left room %s: %s (remaining: %d)",
+		viewer.SessionID, viewer.Username, remaining)
 
-	if viewerCount == 0 {
+	if remaining == 0 {
 		// Remove empty room
 		delete(h.rooms, viewer.SessionID)
-		log.Printf("Room closed: %s", viewer.SessionID)
-	} else {
+		logInfof("Room closed: %s", viewer.SessionID)
+	} else if !viewer.mirror {
 		// Notify remaining viewers
 		h.broadcast <- &LiveMessage{
 			Type:      MsgTypeViewerLeave,
@@ -221,6 +334,50 @@ func (h *LiveHub) handleUnregister(viewer *LiveViewer) {
 	}
 }
 
+func (h *LiveHub) handleCloseRoom(sessionID, reason string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	room, exists := h.rooms[sessionID]
+	if !exists {
+		return
+	}
+
+	// Stopping sharing leaves the owner's mirrors attached
+	keepMirrors := reason == SessionEndedSharingStopped
+
+	msg := &LiveMessage{
+		Type:      MsgTypeSessionEnded,
+		SessionID: sessionID,
+		Reason:    reason,
+		Timestamp: time.Now().UnixMilli(),
+	}
+	data, _ := json.Marshal(msg)
+
+	// Tell every viewer the session ended, then close their send channel so
+	// WritePump flushes the notice and closes the socket. The viewer's
+	// ReadPump unregister afterwards finds no room and is a no-op.
+	room.mu.Lock()
+	viewerCount := 0
+	for viewer := range room.Viewers {
+		if keepMirrors && viewer.mirror {
+			continue
+		}
+		viewer.trySend(data)
+		delete(room.Viewers, viewer)
+		close(viewer.send)
+		sessionMgr.RecordViewerLeave(viewer.visitID, time.Now())
+		viewerCount++
+	}
+	room.Owner = nil
+	if len(room.Viewers) == 0 {
+		delete(h.rooms, sessionID)
+	}
+	room.mu.Unlock()
+
+	logInfof("Room closed: %s (%d viewers disconnected)", sessionID, viewerCount)
+}
+
 func (h *LiveHub) handleBroadcast(msg *LiveMessage) {
 	h.mu.RLock()
 	room, exists := h.rooms[msg.SessionID]
@@ -230,6 +387,12 @@ func (h *LiveHub) handleBroadcast(msg *LiveMessage) {
 		return
 	}
 
+	if msg.Type == MsgTypeChat {
+		room.mu.Lock()
+		room.chat.track(msg)
+		room.mu.Unlock()
+	}
+
 	data, err := json.Marshal(msg)
 	if err != nil {
 		return
@@ -237,13 +400,11 @@ func (h *LiveHub) handleBroadcast(msg *LiveMessage) {
 
 	room.mu.RLock()
 	for viewer := range room.Viewers {
-		select {
-		case viewer.send <- data:
-		default:
-			// Buffer full, skip
-		}
+		viewer.trySend(data)
 	}
 	room.mu.RUnlock()
+
+	h.notifyOwner(msg)
 }
 
 // GetRoom returns a room by session ID
@@ -265,7 +426,7 @@ func (h *LiveHub) GetViewerCount(sessionID string) int {
 
 	room.mu.RLock()
 	defer room.mu.RUnlock()
-	return len(room.Viewers)
+	return room.audience()
 }
 
 // BroadcastOutput sends terminal output to all viewers
@@ -279,37 +440,58 @@ func (h *LiveHub) BroadcastOutput(sessionID string, data string) {
 		return
 	}
 
-	// Create JSON message once
+	// Lock room for broadcasting and buffer update
+	room.mu.Lock()
+
+	// Create JSON message once, numbered for resuming viewers
+	room.seq = liveOutputSeq.Add(1)
 	msg := &LiveMessage{
 		Type:      MsgTypeOutput,
 		SessionID: sessionID,
 		Data:      data,
+		Seq:       room.seq,
 		Timestamp: time.Now().UnixMilli(),
 	}
 	jsonMsg, err := json.Marshal(msg)
 	if err != nil {
+		room.mu.Unlock()
 		return
 	}
+	room.appendOutput(room.seq, jsonMsg, len(data))
 
-	// Lock room for broadcasting and buffer update
-	room.mu.Lock()
 	// Update buffer efficiently
 	room.OutputBuffer += data
-	if len(room.OutputBuffer) > 50000 { // Keep last 50KB
-		room.OutputBuffer = room.OutputBuffer[len(room.OutputBuffer)-50000:]
+	if len(room.OutputBuffer) > liveOutputBufferBytes { // Keep last 50KB
+		room.OutputBuffer = room.OutputBuffer[len(room.OutputBuffer)-liveOutputBufferBytes:]
 	}
 
 	// Direct broadcast to viewers (skips main hub channel)
 	for viewer := range room.Viewers {
-		select {
-		case viewer.send <- jsonMsg:
-		default:
-			// Buffer full, skip to avoid blocking the hub/session
-		}
+		viewer.trySend(jsonMsg)
 	}
 	room.mu.Unlock()
 }
 
+// CloseRoom ends live viewing for a session, telling all viewers why
+// before disconnecting them
+func (h *LiveHub) CloseRoom(sessionID, reason string) {
+	h.closeRoom <- roomClosure{sessionID: sessionID, reason: reason}
+}
+
+// BroadcastEvent sends a control event to all viewers of a session without
+// blocking the caller (events are dropped if the hub is backed up)
+func (h *LiveHub) BroadcastEvent(sessionID string, msgType string, data interface{}) {
+	select {
+	case h.broadcast <- &LiveMessage{
+		Type:      msgType,
+		SessionID: sessionID,
+		Data:      data,
+		Timestamp: time.Now().UnixMilli(),
+	}:
+	default:
+	}
+}
+
 // GrantPermission grants write permission to a viewer
 func (h *LiveHub) GrantPermission(sessionID string, username string) bool {
 	h.mu.RLock()
@@ -323,8 +505,13 @@ func (h *LiveHub) GrantPermission(sessionID string, username string) bool {
 	room.mu.Lock()
 	defer room.mu.Unlock()
 
+	// The share policy may forbid typing viewers (websocket grants skip the API's check)
+	if room.Session != nil && !serverConfig.CanGrantWrite(room.Session.Mode) {
+		return false
+	}
+
 	for viewer := range room.Viewers {
-		if viewer.Username == username {
+		if viewer.Username == username && !viewer.viewOnly {
 			viewer.CanWrite = true
 
 			// Notify the viewer
@@ -337,10 +524,7 @@ func (h *LiveHub) GrantPermission(sessionID string, username string) bool {
 				Timestamp: time.Now().UnixMilli(),
 			}
 			data, _ := json.Marshal(msg)
-			select {
-			case viewer.send <- data:
-			default:
-			}
+			viewer.trySend(data)
 			return true
 		}
 	}
@@ -374,10 +558,7 @@ func (h *LiveHub) RevokePermission(sessionID string, username string) bool {
 				Timestamp: time.Now().UnixMilli(),
 			}
 			data, _ := json.Marshal(msg)
-			select {
-			case viewer.send <- data:
-			default:
-			}
+			viewer.trySend(data)
 			return true
 		}
 	}
@@ -386,14 +567,16 @@ func (h *LiveHub) RevokePermission(sessionID string, username string) bool {
 
 // UpdatePermissionMode updates the permission mode for a room
 func (h *LiveHub) UpdatePermissionMode(sessionID string, mode PermissionMode) {
+	h.setPermissionMode(sessionID, mode, "")
+}
+
+// setPermissionMode updates the permission mode for a room, telling viewers
+// why when the owner didn't change it
+func (h *LiveHub) setPermissionMode(sessionID string, mode PermissionMode, reason string) {
 	h.mu.Lock()
 	room, exists := h.rooms[sessionID]
 	if !exists {
-		room = &LiveRoom{
-			SessionID:      sessionID,
-			Viewers:        make(map[*LiveViewer]bool),
-			PermissionMode: mode,
-		}
+		room = newLiveRoom(sessionID, mode)
 		h.rooms[sessionID] = room
 	}
 	h.mu.Unlock()
@@ -403,7 +586,7 @@ func (h *LiveHub) UpdatePermissionMode(sessionID string, mode PermissionMode) {
 
 	// Update all viewers' permissions
 	for viewer := range room.Viewers {
-		if viewer.IsOwner {
+		if viewer.IsOwner || viewer.viewOnly {
 			continue
 		}
 
@@ -425,6 +608,7 @@ func (h *LiveHub) UpdatePermissionMode(sessionID string, mode PermissionMode) {
 		Data: map[string]interface{}{
 			"mode": mode,
 		},
+		Reason:    reason,
 		Timestamp: time.Now().UnixMilli(),
 	}
 }
@@ -441,17 +625,24 @@ func (v *LiveViewer) WritePump() {
 		select {
 		case message, ok := <-v.send:
 			if !ok {
+				if rest := v.flushPlain(); rest != nil {
+					v.mu.Lock()
+					v.Conn.WriteMessage(websocket.TextMessage, rest)
+					v.mu.Unlock()
+				}
 				v.Conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
 
+			prepared := v.prepare(message)
 			v.mu.Lock()
-			err := v.Conn.WriteMessage(websocket.TextMessage, message)
+			err := v.Conn.WriteMessage(websocket.TextMessage, prepared)
 			v.mu.Unlock()
 
 			if err != nil {
 				return
 			}
+			v.recordSent(len(prepared))
 
 		case <-ticker.C:
 			v.mu.Lock()
@@ -478,11 +669,20 @@ func (v *LiveViewer) ReadPump(inputChan chan<- []byte) {
 			return
 		}
 
+		// Mirrors are read-only; reading only notices the close
+		if v.mirror {
+			continue
+		}
+
 		var msg LiveMessage
 		if err := json.Unmarshal(data, &msg); err != nil {
 			continue
 		}
 
+		if v.IsOwner {
+			markOwnerActive(v.SessionID)
+		}
+
 		switch msg.Type {
 		case MsgTypeInput:
 			// Forward to owner if viewer has write permission
@@ -498,32 +698,27 @@ func (v *LiveViewer) ReadPump(inputChan chan<- []byte) {
 						Timestamp: time.Now().UnixMilli(),
 					}
 					data, _ := json.Marshal(fwdMsg)
-					select {
-					case room.Owner.send <- data:
-					default:
-					}
+					room.Owner.trySend(data)
 				}
 			}
 
 		case MsgTypePermissionReq:
-			// Forward permission request to owner
+			// Forward permission request to owner, on /ws/live and their terminals
+			reqMsg := &LiveMessage{
+				Type:      MsgTypePermissionReq,
+				SessionID: v.SessionID,
+				Data: map[string]interface{}{
+					"username": v.Username,
+				},
+				Sender:    v.Username,
+				Timestamp: time.Now().UnixMilli(),
+			}
 			room := v.Hub.GetRoom(v.SessionID)
 			if room != nil && room.Owner != nil {
-				reqMsg := &LiveMessage{
-					Type:      MsgTypePermissionReq,
-					SessionID: v.SessionID,
-					Data: map[string]interface{}{
-						"username": v.Username,
-					},
-					Sender:    v.Username,
-					Timestamp: time.Now().UnixMilli(),
-				}
 				msgData, _ := json.Marshal(reqMsg)
-				select {
-				case room.Owner.send <- msgData:
-				default:
-				}
+				room.Owner.trySend(msgData)
 			}
+			v.Hub.notifyOwner(reqMsg)
 
 		case MsgTypePermissionGrant:
 			if v.IsOwner {
@@ -544,14 +739,23 @@ func (v *LiveViewer) ReadPump(inputChan chan<- []byte) {
 			}
 
 		case MsgTypeChat:
-			// Broadcast chat message to all viewers
+			// Broadcast chat message to all viewers, as plain text
+			text, ok := cleanChatText(msg.Data)
+			if !ok {
+				continue
+			}
 			v.Hub.broadcast <- &LiveMessage{
 				Type:      MsgTypeChat,
 				SessionID: v.SessionID,
-				Data:      msg.Data,
-				Sender:    v.Username,
+				Data:      text,
+				Sender:    plainChatText(v.Username),
 				Timestamp: time.Now().UnixMilli(),
 			}
+
+		case MsgTypeChatSeen:
+			if !v.IsOwner {
+				v.Hub.markChatSeen(v, msg.Data)
+			}
 		}
 	}
 }
@@ -571,10 +775,15 @@ func (h *LiveHub) GetViewerList(sessionID string) []map[string]interface{} {
 
 	viewers := make([]map[string]interface{}, 0, len(room.Viewers))
 	for viewer := range room.Viewers {
+		if viewer.mirror {
+			continue
+		}
 		viewers = append(viewers, map[string]interface{}{
-			"username":  viewer.Username,
-			"is_owner":  viewer.IsOwner,
-			"can_write": viewer.CanWrite,
+			"username":   viewer.Username,
+			"is_owner":   viewer.IsOwner,
+			"can_write":  viewer.CanWrite,
+			"sent_bytes": viewer.counters.sentBytes.Load(),
+			"dropped":    viewer.counters.dropped.Load(),
 		})
 	}
 
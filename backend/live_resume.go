@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Live viewer reconnect protocol
+//
+// Every output message carries a seq, increasing across all rooms so a seq
+// from a closed room never matches output in its replacement. On connect a
+// viewer receives viewer_welcome with a viewer_token. To reconnect, the
+// viewer opens /ws/live?token=<share>&viewer_token=<token>&last_seq=<seq>,
+// keeps its identity and receives only the output it missed. If that output
+// is no longer buffered the viewer gets resync, then the full buffer.
+//
+// Tokens only restore guest identities. Anyone holding a token can use it,
+// so a token for the owner or a logged-in viewer would hand out their
+// rights; those reconnect with their cookie instead and get no token.
+const (
+	MsgTypeViewerWelcome = "viewer_welcome"
+	MsgTypeResync        = "resync"
+
+	// liveOutputBufferBytes bounds the output kept per room for late joiners
+	// and resuming viewers
+	liveOutputBufferBytes = 50000
+
+	// viewerTokenTTL is how long a viewer token can restore an identity
+	viewerTokenTTL = 24 * time.Hour
+
+	// guestViewerPrefix starts the generated names of viewers without a login
+	guestViewerPrefix = "guest_"
+)
+
+// isGuestViewer reports whether a live viewer name was generated for a
+// viewer without a login
+func isGuestViewer(username string) bool {
+	return strings.HasPrefix(username, guestViewerPrefix)
+}
+
+// liveOutputSeq numbers output messages across all rooms
+var liveOutputSeq atomic.Uint64
+
+// viewerIdentity is what a viewer token restores on reconnect
+type viewerIdentity struct {
+	sessionID string
+	username  string
+	expiresAt time.Time
+}
+
+// sequencedOutput is a marshaled output message kept for resuming viewers
+type sequencedOutput struct {
+	seq     uint64
+	message []byte
+	size    int // Output bytes, counted against liveOutputBufferBytes
+}
+
+// ResolveViewerToken returns the username a viewer token was issued for in a
+// session, refreshing the token's expiry
+func (h *LiveHub) ResolveViewerToken(sessionID, token string) (string, bool) {
+	if token == "" {
+		return "", false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	identity, ok := h.viewerTokens[token]
+	if !ok || identity.sessionID != sessionID || time.Now().After(identity.expiresAt) || !isGuestViewer(identity.username) {
+		return "", false
+	}
+	identity.expiresAt = time.Now().Add(viewerTokenTTL)
+	h.viewerTokens[token] = identity
+	return identity.username, true
+}
+
+// IssueViewerToken creates a token that restores a guest username in a
+// session, or returns "" for any other identity
+func (h *LiveHub) IssueViewerToken(sessionID, username string) string {
+	if !isGuestViewer(username) {
+		return ""
+	}
+	token := generateToken()
+	now := time.Now()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for t, identity := range h.viewerTokens {
+		if now.After(identity.expiresAt) {
+			delete(h.viewerTokens, t)
+		}
+	}
+	h.viewerTokens[token] = viewerIdentity{
+		sessionID: sessionID,
+		username:  username,
+		expiresAt: now.Add(viewerTokenTTL),
+	}
+	return token
+}
+
+// appendOutput records a sequenced output message, dropping the oldest
+// beyond the buffer size. The caller holds room.mu.
+func (room *LiveRoom) appendOutput(seq uint64, message []byte, size int) {
+	room.history = append(room.history, sequencedOutput{seq: seq, message: message, size: size})
+	room.historyBytes += size
+	for len(room.history) > 1 && room.historyBytes > liveOutputBufferBytes {
+		room.historyBytes -= room.history[0].size
+		room.seqFloor = room.history[0].seq
+		room.history = room.history[1:]
+	}
+}
+
+// queueCatchUp sends a newly registered viewer the welcome message and the
+// output it hasn't seen: only what it missed when resuming from a buffered
+// seq, otherwise the whole buffer. The caller holds room.mu so no broadcast
+// can slip in ahead of it.
+func (room *LiveRoom) queueCatchUp(viewer *LiveViewer) {
+	queue := func(msg *LiveMessage) {
+		data, _ := json.Marshal(msg)
+		viewer.trySend(data)
+	}
+
+	queue(&LiveMessage{
+		Type:      MsgTypeViewerWelcome,
+		SessionID: room.SessionID,
+		Data: map[string]interface{}{
+			"username":     viewer.Username,
+			"viewer_token": viewer.token,
+			"seq":          room.seq,
+		},
+		Timestamp: time.Now().UnixMilli(),
+	})
+
+	if viewer.resume {
+		// Resumable when everything after last_seq is still in history
+		if viewer.lastSeq >= room.seqFloor && viewer.lastSeq <= room.seq {
+			for _, out := range room.history {
+				if out.seq > viewer.lastSeq {
+					viewer.trySend(out.message)
+				}
+			}
+			return
+		}
+		queue(&LiveMessage{Type: MsgTypeResync, SessionID: room.SessionID, Timestamp: time.Now().UnixMilli()})
+	}
+
+	if len(room.OutputBuffer) > 0 {
+		queue(&LiveMessage{
+			Type:      MsgTypeOutput,
+			SessionID: room.SessionID,
+			Data:      room.OutputBuffer,
+			Seq:       room.seq,
+			Timestamp: time.Now().UnixMilli(),
+		})
+	}
+}
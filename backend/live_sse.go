@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// sseKeepaliveInterval is how often an idle stream gets a comment line so
+// proxies don't time it out
+const sseKeepaliveInterval = 30 * time.Second
+
+// handleLiveStream relays a live session to a view-only viewer over
+// server-sent events, for networks that block WebSockets:
+// GET /api/live/{token}/stream
+//
+// Each frame's data is the same JSON LiveMessage the WebSocket sends, and
+// ?plain=true strips colors from output as it does there.
+// Viewers on this transport can't send input, chat or permission requests.
+func handleLiveStream(w http.ResponseWriter, r *http.Request, session *TermSession) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// The stream outlives the server's write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// Ensure room exists with correct mode
+	liveHub.UpdatePermissionMode(session.ID, PermissionMode(session.PermissionMode))
+
+	// Get viewer username
+	username := ""
+	if cookie, err := r.Cookie("cyh_session"); err == nil {
+		if user, valid := authManager.ValidateSession(cookie.Value); valid {
+			username = user
+		}
+	}
+
+	// A stream takes a connection slot like a viewer socket
+	releaseConn, ok := acquireWSConn(w, r, username)
+	if !ok {
+		return
+	}
+	defer releaseConn()
+	if username == "" {
+		username = guestViewerPrefix + GenerateID()[:6]
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // Disable nginx response buffering
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	// Never the owner, even for the owner's own account: the owner viewer
+	// receives forwarded input, which this transport can't act on
+	viewer := &LiveViewer{
+		Username:  username,
+		SessionID: session.ID,
+		Hub:       liveHub,
+		send:      make(chan []byte, 2048),
+		viewOnly:  true,
+		plain:     r.URL.Query().Get("plain") == "true",
+	}
+	liveHub.register <- viewer
+	defer func() {
+		liveHub.unregister <- viewer
+	}()
+
+	logDebugf("SSE viewer connected to %s: %s", session.ID, username)
+
+	ticker := time.NewTicker(sseKeepaliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case message, ok := <-viewer.send:
+			if !ok {
+				// Room closed (session ended) or viewer removed
+				if rest := viewer.flushPlain(); rest != nil {
+					fmt.Fprintf(w, "data: %s\n\n", rest)
+					rc.Flush()
+				}
+				return
+			}
+			n, err := fmt.Fprintf(w, "data: %s\n\n", viewer.prepare(message))
+			if err != nil {
+				return
+			}
+			viewer.recordSent(n)
+			if err := rc.Flush(); err != nil {
+				return
+			}
+
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
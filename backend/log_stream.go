@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// logBacklogLines is how many recent log lines late-joining admins receive
+const logBacklogLines = 200
+
+// sensitiveLogPattern matches key=value style secrets and long hex tokens
+// (auth and share tokens); session IDs are shorter and left intact
+var sensitiveLogPattern = regexp.MustCompile(`(?i)((?:token|password|secret|cyh_session)["']?\s*[=:]\s*["']?)[^\s"',&]+|\b[0-9a-f]{32,}\b`)
+
+// redactLogLine masks secrets before a line leaves the server
+func redactLogLine(line string) string {
+	return sensitiveLogPattern.ReplaceAllStringFunc(line, func(match string) string {
+		if sub := sensitiveLogPattern.FindStringSubmatch(match); sub[1] != "" {
+			return sub[1] + "[REDACTED]"
+		}
+		return "[REDACTED]"
+	})
+}
+
+// LogBroadcaster is the standard logger's output: it writes to stderr and
+// fans each line out to connected admin log viewers
+type LogBroadcaster struct {
+	out         io.Writer
+	mu          sync.Mutex
+	backlog     []string
+	subscribers map[chan string]bool
+}
+
+var logStream = &LogBroadcaster{
+	out:         os.Stderr,
+	subscribers: make(map[chan string]bool),
+}
+
+// Write implements io.Writer. The standard logger calls it once per line.
+func (lb *LogBroadcaster) Write(p []byte) (int, error) {
+	n, err := lb.out.Write(p)
+
+	line := redactLogLine(string(p))
+	lb.mu.Lock()
+	lb.backlog = append(lb.backlog, line)
+	if len(lb.backlog) > logBacklogLines {
+		lb.backlog = lb.backlog[len(lb.backlog)-logBacklogLines:]
+	}
+	for ch := range lb.subscribers {
+		select {
+		case ch <- line:
+		default: // Slow viewer, drop the line rather than block logging
+		}
+	}
+	lb.mu.Unlock()
+
+	return n, err
+}
+
+// Subscribe returns the current backlog and a channel of new lines
+func (lb *LogBroadcaster) Subscribe() ([]string, chan string) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	ch := make(chan string, 256)
+	lb.subscribers[ch] = true
+	return append([]string(nil), lb.backlog...), ch
+}
+
+// Unsubscribe stops delivering lines to ch
+func (lb *LogBroadcaster) Unsubscribe(ch chan string) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	delete(lb.subscribers, ch)
+}
+
+// handleAdminLogs streams server log lines to an admin: /ws/admin/logs
+func handleAdminLogs(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logWarnf("WebSocket upgrade error: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	backlog, lines := logStream.Subscribe()
+	defer logStream.Unsubscribe(lines)
+
+	for _, line := range backlog {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(line)); err != nil {
+			return
+		}
+	}
+
+	// Detect the client going away
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case line := <-lines:
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(line)); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// Log output formats (CYH_LOG_FORMAT)
+const (
+	LogFormatText = "text" // Human-readable lines from the standard logger
+	LogFormatJSON = "json" // One JSON object per line with time, level and msg
+)
+
+// logLevel is the least severe level written (CYH_LOG_LEVEL)
+var logLevel = new(slog.LevelVar)
+
+// jsonLogger writes records in JSON mode; nil in text mode
+var jsonLogger *slog.Logger
+
+// initLogging applies the configured log format and level. It must run after
+// the standard logger's output is set: in JSON mode the log package (and so
+// anything still calling log.Printf, like library code) is routed through
+// the JSON handler at info level.
+func initLogging(format, level string) {
+	levelErr := logLevel.UnmarshalText([]byte(level))
+	if levelErr != nil {
+		logLevel.Set(slog.LevelInfo)
+	}
+
+	if format == LogFormatJSON {
+		jsonLogger = slog.New(slog.NewJSONHandler(log.Writer(), &slog.HandlerOptions{Level: logLevel}))
+		slog.SetDefault(jsonLogger)
+	} else if format != LogFormatText {
+		logWarnf("⚠️  Unknown CYH_LOG_FORMAT %q, using text", format)
+	}
+
+	if levelErr != nil {
+		logWarnf("⚠️  Unknown CYH_LOG_LEVEL %q, using info", level)
+	}
+}
+
+// logJSON reports whether logs are written as JSON
+func logJSON() bool {
+	return jsonLogger != nil
+}
+
+func logf(level slog.Level, format string, args ...interface{}) {
+	if level < logLevel.Level() {
+		return
+	}
+
+	msg := fmt.Sprintf(format, args...)
+	if jsonLogger != nil {
+		jsonLogger.Log(context.Background(), level, plainLogMessage(msg))
+		return
+	}
+	log.Output(3, msg)
+}
+
+// logDebugf logs routine per-connection detail, hidden unless CYH_LOG_LEVEL=debug
+func logDebugf(format string, args ...interface{}) { logf(slog.LevelDebug, format, args...) }
+
+// logInfof logs normal operation
+func logInfof(format string, args ...interface{}) { logf(slog.LevelInfo, format, args...) }
+
+// logWarnf logs problems the server works around
+func logWarnf(format string, args ...interface{}) { logf(slog.LevelWarn, format, args...) }
+
+// logErrorf logs failed operations
+func logErrorf(format string, args ...interface{}) { logf(slog.LevelError, format, args...) }
+
+// logFatalf logs an error and exits
+func logFatalf(format string, args ...interface{}) {
+	logf(slog.LevelError, format, args...)
+	os.Exit(1)
+}
+
+// plainLogMessage drops the emoji and spacing that start human-oriented
+// messages, and trailing newlines, for JSON records
+func plainLogMessage(msg string) string {
+	msg = strings.TrimLeftFunc(msg, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.In(r, unicode.So, unicode.Sk, unicode.Mn) || r == '\u200d'
+	})
+	return strings.TrimRight(msg, "\n")
+}
@@ -2,11 +2,15 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -48,9 +52,13 @@ type HistoryRequest struct {
 	Command string `json:"command"`
 }
 
-// handleHistoryGet returns command history
+// handleHistoryGet returns command history. With from/to (RFC 3339 or Unix
+// ms) or q, matching commands are returned newest first. With limit and/or
+// offset, one page of the (filtered) history is returned newest first,
+// wrapped with the total count.
 func handleHistoryGet(w http.ResponseWriter, r *http.Request) {
-	mode := r.URL.Query().Get("mode")
+	query := r.URL.Query()
+	mode := query.Get("mode")
 	
 	// Get username from session
 	username := ""
@@ -60,10 +68,108 @@ func handleHistoryGet(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	
-	history := cmdHistory.GetHistory(username, mode)
+	paged := query.Has("limit") || query.Has("offset")
+	if !paged && query.Get("from") == "" && query.Get("to") == "" && query.Get("q") == "" {
+		history := cmdHistory.GetHistory(username, mode)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(history)
+		return
+	}
+
+	search := HistoryQuery{Mode: mode, Text: query.Get("q")}
+	if v := query.Get("from"); v != "" {
+		from, err := parseTimeParam(v)
+		if err != nil {
+			http.Error(w, "Invalid from time", http.StatusBadRequest)
+			return
+		}
+		search.From = from
+	}
+	if v := query.Get("to"); v != "" {
+		to, err := parseTimeParam(v)
+		if err != nil {
+			http.Error(w, "Invalid to time", http.StatusBadRequest)
+			return
+		}
+		search.To = to
+	}
+
+	if !paged {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cmdHistory.SearchHistory(username, search))
+		return
+	}
+
+	offset, limit := 0, DefaultHistoryPageSize
+	if v := query.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "offset must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > MaxHistoryItems {
+			http.Error(w, "limit must be between 1 and 500", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	history := cmdHistory.SearchHistory(username, search)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(HistoryPage{
+		Commands: paginateHistory(history, offset, limit),
+		Total:    len(history),
+		Offset:   offset,
+		Limit:    limit,
+	})
+}
+
+// handleHistoryEntry returns one history entry with the commands around it:
+// GET /api/history/{index}?mode=docker&context=3
+func handleHistoryEntry(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := ""
+	if cookie, err := r.Cookie("cyh_session"); err == nil {
+		if user, valid := authManager.ValidateSession(cookie.Value); valid {
+			username = user
+		}
+	}
+
+	index, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/history/"))
+	if err != nil || index < 0 {
+		http.Error(w, "History index must be a non-negative integer", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	around := DefaultHistoryContext
+	if v := query.Get("context"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > MaxHistoryContext {
+			http.Error(w, "context must be between 0 and 50", http.StatusBadRequest)
+			return
+		}
+		around = n
+	}
+
+	entry, ok := cmdHistory.GetEntryContext(username, query.Get("mode"), index, around)
+	if !ok {
+		http.Error(w, "History entry not found", http.StatusNotFound)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(history)
+	json.NewEncoder(w).Encode(entry)
 }
 
 // handleHistorySave saves a command to history
@@ -87,13 +193,37 @@ func handleHistorySave(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if err := cmdHistory.AddCommand(username, req.Mode, req.Command); err != nil {
+	// Incognito history saves nothing; the client keeps the command for
+	// this session's up-arrow
+	if historyIncognito(username) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "skipped", "incognito": true})
+		return
+	}
+
+	truncated, err := cmdHistory.AddCommand(username, req.Mode, req.Command)
+	if err == ErrCommandTooLong {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":      err.Error(),
+			"max_length": serverConfig.HistoryMaxCommandLength,
+		})
+		return
+	}
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	response := map[string]interface{}{"status": "saved"}
+	if truncated {
+		response["truncated"] = true
+		response["max_length"] = serverConfig.HistoryMaxCommandLength
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "saved"})
+	json.NewEncoder(w).Encode(response)
 }
 
 // handleHistoryClear clears command history
@@ -122,23 +252,117 @@ func handleHistoryClear(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"status": "cleared"})
 }
 
-// GetTerminalModes returns available terminal modes
+// handleHistoryExport downloads the user's full command history as JSON
+func handleHistoryExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Get username from session
+	username := ""
+	if cookie, err := r.Cookie("cyh_session"); err == nil {
+		if user, valid := authManager.ValidateSession(cookie.Value); valid {
+			username = user
+		}
+	}
+
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	history := cmdHistory.ExportHistory(username)
+
+	filename := "cyh_history_" + time.Now().Format("20060102-150405") + ".json"
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(history)
+}
+
+// handleHistoryImport merges an uploaded history export into the user's history
+func handleHistoryImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Get username from session
+	username := ""
+	if cookie, err := r.Cookie("cyh_session"); err == nil {
+		if user, valid := authManager.ValidateSession(cookie.Value); valid {
+			username = user
+		}
+	}
+
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var entries []CommandEntry
+	r.Body = http.MaxBytesReader(w, r.Body, MaxHistoryImportBytes)
+	if err := json.NewDecoder(r.Body).Decode(&entries); err != nil {
+		http.Error(w, "Invalid history file", http.StatusBadRequest)
+		return
+	}
+
+	if len(entries) > MaxHistoryImportItems {
+		http.Error(w, "History file has too many entries", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	added, err := cmdHistory.ImportHistory(username, entries)
+	if err == ErrHistoryIncognito {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   "imported",
+		"imported": added,
+		"skipped":  len(entries) - added,
+	})
+}
+
+// handleHistoryStatus reports whether command history is persisted to disk
+func handleHistoryStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cmdHistory.Status())
+}
+
+// GetTerminalModes returns available terminal modes (disabled modes are omitted)
 func handleTerminalModes(w http.ResponseWriter, r *http.Request) {
-	modes := []TerminalMode{
-		{
+	modes := []TerminalMode{}
+	if serverConfig.IsModeEnabled("local") {
+		modes = append(modes, TerminalMode{
 			ID:          "local",
 			Name:        "Local Shell",
 			Description: "Use local system shell (bash/sh)",
 			Available:   true,
 			Icon:        "💻",
-		},
-		{
+		})
+	}
+	if serverConfig.IsModeEnabled("docker") {
+		modes = append(modes, TerminalMode{
 			ID:          "docker",
 			Name:        "CYH Hacking Terminal",
 			Description: "Professional hacking environment",
 			Available:   CheckDockerInstalled() && dockerMgr.IsReady(),
 			Icon:        "🔐",
-		},
+		})
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -149,8 +373,8 @@ func handleTerminalModes(w http.ResponseWriter, r *http.Request) {
 func handleDockerStatus(w http.ResponseWriter, r *http.Request) {
 	status := map[string]interface{}{
 		"docker_installed": CheckDockerInstalled(),
-		"image_ready":      dockerMgr.imageReady,
-		"container_ready":  dockerMgr.containerReady,
+		"image_ready":      dockerMgr.IsImageReady(),
+		"container_ready":  dockerMgr.IsContainerReady(),
 		"container_name":   DockerContainerName,
 	}
 
@@ -166,20 +390,20 @@ func handleDockerRebuild(w http.ResponseWriter, r *http.Request) {
 	}
 
 	go func() {
-		dockerMgr.imageReady = false
-		dockerMgr.containerReady = false
+		dockerMgr.SetImageReady(false)
+		dockerMgr.SetContainerReady(false)
 		
 		if err := dockerMgr.StopContainer(); err != nil {
-			log.Printf("Warning: %v", err)
+			logWarnf("Warning: %v", err)
 		}
 		
 		if err := dockerMgr.BuildDockerImage(); err != nil {
-			log.Printf("Rebuild failed: %v", err)
+			logErrorf("Rebuild failed: %v", err)
 			return
 		}
 		
 		if err := dockerMgr.StartContainer(); err != nil {
-			log.Printf("Container start failed: %v", err)
+			logErrorf("Container start failed: %v", err)
 		}
 	}()
 
@@ -299,7 +523,7 @@ func handleContainerStop(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cmd := exec.Command("docker", "stop", req.ContainerID)
+	cmd := exec.Command("docker", "stop", "--time", stopGraceSeconds(), req.ContainerID)
 	if err := cmd.Run(); err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusInternalServerError)
@@ -343,7 +567,7 @@ func handleContainerDelete(w http.ResponseWriter, r *http.Request) {
 
 	// Update dockerMgr if we deleted the main container
 	if req.ContainerID == DockerContainerName {
-		dockerMgr.containerReady = false
+		dockerMgr.SetContainerReady(false)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -365,6 +589,20 @@ func handleContainerCreate(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if !checkCreateRateLimit(w, r, username) {
+		return
+	}
+
+	// Admission control: refuse new containers while the host is overloaded
+	if !authManager.IsAdmin(username) {
+		if err := dockerMgr.CheckCapacity(); err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+	}
+
 	var req struct {
 		Name string `json:"name"`
 	}
@@ -390,17 +628,7 @@ func handleContainerCreate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	cmd := exec.Command("docker", "run",
-		"-d",
-		"--name", containerName,
-		"--hostname", "canyouhack",
-		"-e", "TERM=xterm-256color",
-		"-e", "COLORTERM=truecolor",
-		"-e", "LANG=en_US.UTF-8",
-		"-e", "LC_ALL=en_US.UTF-8",
-		DockerImageName,
-		"tail", "-f", "/dev/null",
-	)
+	cmd := exec.Command("docker", defaultContainerSpec().RunArgs(containerName)...)
 
 	output, err := cmd.CombinedOutput()
 	if err != nil {
@@ -423,6 +651,74 @@ func handleContainerCreate(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// handleContainerByID routes per-container endpoints: /api/containers/{id}/{action}
+func handleContainerByID(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/containers/")
+	parts := strings.Split(path, "/")
+	if len(parts) < 2 || parts[0] == "" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	containerID := parts[0]
+
+	// Get username from session
+	username := ""
+	if cookie, err := r.Cookie("cyh_session"); err == nil {
+		if user, valid := authManager.ValidateSession(cookie.Value); valid {
+			username = user
+		}
+	}
+
+	switch parts[1] {
+	case "disk":
+		handleContainerDisk(w, r, containerID, username)
+	case "commit":
+		handleContainerCommit(w, r, containerID, username)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// handleContainerDisk reports filesystem and layer usage for one of the user's containers
+func handleContainerDisk(w http.ResponseWriter, r *http.Request, containerID, username string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	state, err := dockerMgr.InspectContainer(containerID)
+	if err != nil {
+		http.Error(w, "Container not found", http.StatusNotFound)
+		return
+	}
+
+	if !userOwnsContainer(username, state.Name) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	usage, err := dockerMgr.GetContainerDiskUsage(state.ID)
+	if err == ErrContainerNotRunning {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Container is not running"})
+		return
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"container_id": state.ID[:12],
+		"name":         state.Name,
+		"disk":         usage,
+	})
+}
+
 // Restart the main Ubuntu container
 func handleContainerRestart(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -431,9 +727,9 @@ func handleContainerRestart(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Stop and start the container
-	dockerMgr.containerReady = false
+	dockerMgr.SetContainerReady(false)
 	
-	exec.Command("docker", "rm", "-f", DockerContainerName).Run()
+	dockerMgr.StopContainer()
 	
 	if err := dockerMgr.StartContainer(); err != nil {
 		w.Header().Set("Content-Type", "application/json")
@@ -446,17 +742,59 @@ func handleContainerRestart(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"status": "restarted"})
 }
 
+// serverAddr is the address the server listens on
+const serverAddr = ":3333"
+
+// resetAdminAndExit handles -reset-admin: it gives the user admin rights and
+// a new password, prints the password once to stdout and exits without
+// starting the server. Used to get back in when no admin can log in. A
+// running server keeps its users in memory and would write them back over
+// the reset, so it refuses while something listens on serverAddr.
+func resetAdminAndExit(username string) {
+	ln, err := net.Listen("tcp", serverAddr)
+	if err != nil {
+		logFatalf("Can't reset admin %s while %s is in use: stop the running server first (%v)", username, serverAddr, err)
+	}
+	ln.Close()
+
+	if err := os.MkdirAll(serverConfig.DataDir, 0700); err != nil {
+		logFatalf("Failed to create data directory %s: %v", serverConfig.DataDir, err)
+	}
+	if err := authManager.Init(serverConfig.DataDir); err != nil {
+		logFatalf("Failed to initialize auth manager: %v", err)
+	}
+
+	password, err := authManager.ResetAdmin(username)
+	if err != nil {
+		logFatalf("Failed to reset admin %s: %v", username, err)
+	}
+
+	// Printed, never logged: the log is mirrored to admins tailing it
+	fmt.Printf("Admin %s reset; their other logins were signed out. New password (shown once):\n%s\n", username, password)
+	os.Exit(0)
+}
+
 func main() {
+	resetAdmin := flag.String("reset-admin", "", "make `username` an admin with a new random password (created if missing), print it and exit")
+	flag.Parse()
+	if *resetAdmin != "" {
+		resetAdminAndExit(*resetAdmin)
+	}
+
+	// Mirror log output to admins tailing /ws/admin/logs
+	log.SetOutput(logStream)
+	initLogging(serverConfig.LogFormat, serverConfig.LogLevel)
+
 	mux := http.NewServeMux()
 
-	// Static files for frontend
-	fs := http.FileServer(http.Dir("../frontend"))
-	mux.Handle("/", fs)
+	// Static files for frontend, with index.html for client-side routes
+	mux.Handle("/", newFrontendHandler(serverConfig.FrontendDir))
 
 	// API endpoints
 	mux.HandleFunc("/api/modes", handleTerminalModes)
 	mux.HandleFunc("/api/docker/status", handleDockerStatus)
 	mux.HandleFunc("/api/docker/rebuild", handleDockerRebuild)
+	mux.HandleFunc("/api/docker/diagnose", handleDockerDiagnose)
 
 	// Container management endpoints
 	mux.HandleFunc("/api/containers", handleContainerList)
@@ -465,11 +803,18 @@ func main() {
 	mux.HandleFunc("/api/containers/delete", handleContainerDelete)
 	mux.HandleFunc("/api/containers/create", handleContainerCreate)
 	mux.HandleFunc("/api/containers/restart", handleContainerRestart)
+	mux.HandleFunc("/api/containers/", handleContainerByID)
+	mux.HandleFunc("/api/images", handleImages)
+	mux.HandleFunc("/api/images/", handleImageByTag)
 
 	// Command history endpoints
 	mux.HandleFunc("/api/history", handleHistoryGet)
 	mux.HandleFunc("/api/history/save", handleHistorySave)
 	mux.HandleFunc("/api/history/clear", handleHistoryClear)
+	mux.HandleFunc("/api/history/export", handleHistoryExport)
+	mux.HandleFunc("/api/history/import", handleHistoryImport)
+	mux.HandleFunc("/api/history/status", handleHistoryStatus)
+	mux.HandleFunc("/api/history/", handleHistoryEntry)
 
 	// Authentication endpoints
 	mux.HandleFunc("/api/auth/login", handleAuthLogin)
@@ -477,29 +822,47 @@ func main() {
 	mux.HandleFunc("/api/auth/logout", handleAuthLogout)
 	mux.HandleFunc("/api/auth/status", handleAuthStatus)
 	mux.HandleFunc("/api/auth/settings", handleAuthSettings)
+	mux.HandleFunc("/api/preferences", handlePreferences)
 
 	// Terminal WebSocket endpoint
 	mux.HandleFunc("/ws/terminal", handleTerminal)
+	mux.HandleFunc("/ws/mirror", handleMirrorWebSocket)
+	mux.HandleFunc("/ws/sessions/", handleSessionReplayWebSocket)
+	mux.HandleFunc("/ws/admin/logs", requireAdmin(handleAdminLogs))
 
 	// Session management endpoints
 	mux.HandleFunc("/api/sessions", handleSessions)
 	mux.HandleFunc("/api/sessions/last", handleSessionLast)
+	mux.HandleFunc("/api/sessions/usage", handleSessionUsage)
+	mux.HandleFunc("/api/sessions/adopt", handleSessionAdopt)
 	mux.HandleFunc("/api/sessions/", handleSessionByID)
 
+	// Admin endpoints
+	mux.HandleFunc("/api/admin/sessions", requireAdmin(handleAdminSessions))
+	mux.HandleFunc("/api/admin/usage", requireAdmin(handleAdminUsage))
+	mux.HandleFunc("/api/admin/backup", requireAdmin(handleAdminBackup))
+	mux.HandleFunc("/api/admin/maintenance", requireAdmin(handleAdminMaintenance))
+	mux.HandleFunc("/api/admin/legacy-containers", requireAdmin(handleAdminLegacyContainers))
+
+	// Session template endpoints
+	mux.HandleFunc("/api/templates", handleTemplates)
+	mux.HandleFunc("/api/templates/", handleTemplateByID)
+	mux.HandleFunc("/api/workspaces", handleWorkspaces)
+	mux.HandleFunc("/api/workspaces/", handleWorkspaceByName)
+	mux.HandleFunc("/api/prompt_themes", handlePromptThemes)
+
 	// Live collaboration endpoints
 	mux.HandleFunc("/api/live/", handleJoinLiveSession)
 	mux.HandleFunc("/ws/live", handleLiveWebSocket)
 
 	// Live viewer page route (serves live.html)
 	mux.HandleFunc("/live/", func(w http.ResponseWriter, r *http.Request) {
-		http.ServeFile(w, r, "../frontend/live.html")
+		serveFrontendFile(w, r, "live.html")
 	})
 
-	// Health check endpoint
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
-	})
+	// Health check and metrics endpoints
+	mux.HandleFunc("/health", handleHealth)
+	mux.HandleFunc("/metrics", handleMetrics)
 
 	// CORS configuration
 	c := cors.New(cors.Options{
@@ -513,54 +876,68 @@ func main() {
 	handler := c.Handler(authMiddleware(mux))
 
 	server := &http.Server{
-		Addr:         ":3333",
+		Addr:         serverAddr,
 		Handler:      handler,
 		ReadTimeout:  60 * time.Second,
 		WriteTimeout: 60 * time.Second,
 		IdleTimeout:  120 * time.Second,
 	}
 
+	// Create the data directory (private: it holds password hashes and tokens)
+	if err := os.MkdirAll(serverConfig.DataDir, 0700); err != nil {
+		logErrorf("⚠️  Failed to create data directory %s: %v", serverConfig.DataDir, err)
+	}
+
 	// Initialize authentication
-	if err := authManager.Init(); err != nil {
-		log.Printf("⚠️  Failed to initialize auth manager: %v", err)
+	if err := authManager.Init(serverConfig.DataDir); err != nil {
+		logErrorf("⚠️  Failed to initialize auth manager: %v", err)
 	}
+	go authManager.sessionSweepLoop()
 
 	// Initialize command history
-	if err := cmdHistory.Init(); err != nil {
-		log.Printf("⚠️  Failed to initialize command history: %v", err)
+	if err := cmdHistory.Init(serverConfig.DataDir); err != nil {
+		logErrorf("⚠️  Failed to initialize command history: %v", err)
 	}
 
 	// Initialize session manager
 	var sessErr error
-	sessionMgr, sessErr = NewSessionManager("sessions.db")
+	sessionMgr, sessErr = NewSessionManager(serverConfig.SessionsDBPath)
 	if sessErr != nil {
-		log.Printf("⚠️  Failed to initialize session manager: %v", sessErr)
+		logErrorf("⚠️  Failed to initialize session manager: %v", sessErr)
 	} else {
-		log.Println("✓ Session manager initialized")
+		logInfof("✓ Session manager initialized")
 	}
 
 	// Initialize live hub
 	liveHub = NewLiveHub()
-	log.Println("✓ Live collaboration hub initialized")
+	logInfof("✓ Live collaboration hub initialized")
+
+	// Warn when terminal PTY goroutines leak (counters in /metrics)
+	go monitorTerminalLeaks()
 
 	// Initialize Docker in background
 	dockerAvailable := InitializeDocker()
 
-	log.Println("╔══════════════════════════════════════════════════════════════╗")
-	log.Println("║         >_ CYH | CanYouHack Terminal Server                  ║")
-	log.Println("╠══════════════════════════════════════════════════════════════╣")
-	log.Println("║  🌐 Server:     http://localhost:3333                        ║")
-	log.Println("║  🔌 WebSocket:  ws://localhost:3333/ws/terminal              ║")
-	log.Println("╠══════════════════════════════════════════════════════════════╣")
-	log.Println("║  📋 Terminal Modes:                                          ║")
-	log.Println("║     • CYH Local    - ws://localhost:3333/ws/terminal?mode=local")
-	log.Println("║     • CYH Hacking  - ws://localhost:3333/ws/terminal?mode=docker")
-	if dockerAvailable {
-		log.Println("║  🔐 Docker: Ready (CYH Hacking environment available)        ║")
+	// The banner is for people; JSON logs get a single record
+	if logJSON() {
+		logInfof("Server listening on http://localhost:3333 (docker available: %v)", dockerAvailable)
 	} else {
-		log.Println("║  ⚠️  Docker: Not installed (only local shell available)       ║")
+		log.Println("╔══════════════════════════════════════════════════════════════╗")
+		log.Println("║         >_ CYH | CanYouHack Terminal Server                  ║")
+		log.Println("╠══════════════════════════════════════════════════════════════╣")
+		log.Println("║  🌐 Server:     http://localhost:3333                        ║")
+		log.Println("║  🔌 WebSocket:  ws://localhost:3333/ws/terminal              ║")
+		log.Println("╠══════════════════════════════════════════════════════════════╣")
+		log.Println("║  📋 Terminal Modes:                                          ║")
+		log.Println("║     • CYH Local    - ws://localhost:3333/ws/terminal?mode=local")
+		log.Println("║     • CYH Hacking  - ws://localhost:3333/ws/terminal?mode=docker")
+		if dockerAvailable {
+			log.Println("║  🔐 Docker: Ready (CYH Hacking environment available)        ║")
+		} else {
+			log.Println("║  ⚠️  Docker: Not installed (only local shell available)       ║")
+		}
+		log.Println("╚══════════════════════════════════════════════════════════════╝")
 	}
-	log.Println("╚══════════════════════════════════════════════════════════════╝")
 
 	// Graceful shutdown
 	go func() {
@@ -568,12 +945,21 @@ func main() {
 		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 		<-sigChan
 		
-		log.Println("\n🛑 Shutting down server...")
+		logInfof("\n🛑 Shutting down server...")
+
+		// Commands are saved in batches; write any still pending
+		if err := cmdHistory.Flush(); err != nil {
+			logErrorf("⚠️  Failed to save command history: %v", err)
+		}
+		// The sessions database may have failed to open
+		if sessionMgr != nil {
+			sessionMgr.FlushIO()
+		}
 		
 		os.Exit(0)
 	}()
 
 	if err := server.ListenAndServe(); err != nil {
-		log.Fatalf("❌ Could not start server: %s\n", err)
+		logFatalf("❌ Could not start server: %s\n", err)
 	}
 }
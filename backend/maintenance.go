@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultMaintenanceMessage is shown when maintenance is turned on without one
+const defaultMaintenanceMessage = "The server is in maintenance, try again in a few minutes"
+
+// maintenanceState blocks new terminals and sessions while the server drains
+// for an upgrade. Open terminals keep running.
+type maintenanceState struct {
+	mu      sync.RWMutex
+	enabled bool
+	since   time.Time
+	message string
+}
+
+var maintenance = &maintenanceState{}
+
+// MaintenanceStatus is what /api/admin/maintenance and /health?verbose report
+type MaintenanceStatus struct {
+	Enabled   bool       `json:"enabled"`
+	Since     *time.Time `json:"since,omitempty"`
+	Message   string     `json:"message,omitempty"`
+	Terminals int64      `json:"terminals"` // Terminals still open
+}
+
+// Set turns maintenance mode on or off. Turning it on again only replaces
+// the message.
+func (m *maintenanceState) Set(enabled bool, message string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !enabled {
+		m.enabled, m.since, m.message = false, time.Time{}, ""
+		return
+	}
+	if !m.enabled {
+		m.since = time.Now()
+	}
+	if message == "" {
+		message = defaultMaintenanceMessage
+	}
+	m.enabled, m.message = true, message
+}
+
+// Active reports whether new terminals and sessions are blocked, and why
+func (m *maintenanceState) Active() (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.message, m.enabled
+}
+
+func (m *maintenanceState) Status() MaintenanceStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	status := MaintenanceStatus{
+		Enabled:   m.enabled,
+		Message:   m.message,
+		Terminals: termStats.Snapshot().Connections,
+	}
+	if m.enabled {
+		since := m.since
+		status.Since = &since
+	}
+	return status
+}
+
+// checkMaintenance writes a 503 and returns false while maintenance mode is
+// on. Handlers that start terminals or create sessions call it first.
+func checkMaintenance(w http.ResponseWriter, r *http.Request) bool {
+	message, active := maintenance.Active()
+	if !active {
+		return true
+	}
+
+	logDebugf("Rejected %s %s: maintenance mode", r.Method, r.URL.Path)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":   "maintenance",
+		"message": message,
+	})
+	return false
+}
+
+// handleAdminMaintenance shows or toggles maintenance mode:
+// GET /api/admin/maintenance, POST /api/admin/maintenance {"enabled": true, "message": "..."}
+func handleAdminMaintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			Enabled bool   `json:"enabled"`
+			Message string `json:"message"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		maintenance.Set(req.Enabled, req.Message)
+		if req.Enabled {
+			logInfof("Maintenance mode on: new terminals and sessions are refused, %d terminal(s) still open", termStats.Snapshot().Connections)
+		} else {
+			logInfof("Maintenance mode off")
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(maintenance.Status())
+}
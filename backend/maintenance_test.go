@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMaintenanceIsReported(t *testing.T) {
+	maintenance.Set(true, "Back at 14:00")
+	t.Cleanup(func() { maintenance.Set(false, "") })
+
+	w := httptest.NewRecorder()
+	handleHealth(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "MAINTENANCE" {
+		t.Fatalf("/health = %d %q, want 200 \"MAINTENANCE\"", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	handleAuthStatus(w, httptest.NewRequest(http.MethodGet, "/api/auth/status", nil))
+	var status struct {
+		Maintenance        bool   `json:"maintenance"`
+		MaintenanceMessage string `json:"maintenance_message"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if !status.Maintenance || status.MaintenanceMessage != "Back at 14:00" {
+		t.Fatalf("/api/auth/status maintenance = %v %q", status.Maintenance, status.MaintenanceMessage)
+	}
+
+	maintenance.Set(false, "")
+	w = httptest.NewRecorder()
+	handleHealth(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if w.Body.String() != "OK" {
+		t.Fatalf("/health after maintenance = %q, want \"OK\"", w.Body.String())
+	}
+}
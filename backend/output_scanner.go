@@ -0,0 +1,273 @@
+package main
+
+import (
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Output scanner states
+const (
+	scanNormal    = iota
+	scanEscape    // after ESC
+	scanOSC       // inside an OSC string (ESC ])
+	scanOSCEscape // ESC inside an OSC string (possible ST terminator)
+)
+
+// outputScanner inspects PTY output for terminal events. It tracks escape
+// sequence state across chunks so a BEL terminating an OSC sequence
+// (e.g. a window title) is not mistaken for a terminal bell.
+type outputScanner struct {
+	state int
+}
+
+// step advances the state machine by one byte and reports whether the byte
+// is a standalone BEL
+func (s *outputScanner) step(b byte) bool {
+	switch s.state {
+	case scanNormal:
+		if b == 0x1b {
+			s.state = scanEscape
+		} else if b == 0x07 {
+			return true
+		}
+	case scanEscape:
+		if b == ']' {
+			s.state = scanOSC
+		} else {
+			s.state = scanNormal
+		}
+	case scanOSC:
+		if b == 0x07 {
+			s.state = scanNormal // BEL terminates the OSC string
+		} else if b == 0x1b {
+			s.state = scanOSCEscape
+		}
+	case scanOSCEscape:
+		if b == '\\' {
+			s.state = scanNormal // ST terminator
+		} else {
+			s.state = scanOSC
+		}
+	}
+	return false
+}
+
+// ScanBell reports whether data contains a standalone BEL. When strip is set
+// those BEL bytes are removed from the returned slice.
+func (s *outputScanner) ScanBell(data []byte, strip bool) ([]byte, bool) {
+	var out []byte
+	if strip {
+		out = make([]byte, 0, len(data))
+	}
+
+	found := false
+	for _, b := range data {
+		if s.step(b) {
+			found = true
+			if strip {
+				continue
+			}
+		}
+		if strip {
+			out = append(out, b)
+		}
+	}
+
+	if strip {
+		return out, found
+	}
+	return data, found
+}
+
+// MsgTypeTitle tells the client the shell set the window title:
+// {"type":"title","data":"user@host: ~/src"}
+const MsgTypeTitle = "title"
+
+// maxTitleLength caps a reported title; longer OSC strings are ignored
+const maxTitleLength = 256
+
+// maxCwdLength caps a reported working directory (PATH_MAX)
+const maxCwdLength = 4096
+
+// oscScanner finds OSC strings (ESC ] ... ended by BEL or ST) in PTY output,
+// tracking sequences split across chunks
+type oscScanner struct {
+	state    int
+	payload  []byte // The OSC string so far
+	overflow bool   // The OSC string is longer than the caller's limit
+}
+
+// Scan calls done with each OSC string in data that is at most limit bytes
+func (s *oscScanner) Scan(data []byte, limit int, done func(payload string)) {
+	for _, b := range data {
+		switch s.state {
+		case scanNormal:
+			if b == 0x1b {
+				s.state = scanEscape
+			}
+		case scanEscape:
+			if b == ']' {
+				s.state = scanOSC
+				s.payload = s.payload[:0]
+				s.overflow = false
+			} else if b != 0x1b {
+				s.state = scanNormal
+			}
+		case scanOSC:
+			switch {
+			case b == 0x07:
+				s.state = scanNormal
+				s.finish(done)
+			case b == 0x1b:
+				s.state = scanOSCEscape
+			case len(s.payload) < limit:
+				s.payload = append(s.payload, b)
+			default:
+				s.overflow = true
+			}
+		case scanOSCEscape:
+			if b == '\\' {
+				s.state = scanNormal
+				s.finish(done)
+			} else {
+				s.state = scanOSC
+			}
+		}
+	}
+}
+
+func (s *oscScanner) finish(done func(payload string)) {
+	if !s.overflow {
+		done(string(s.payload))
+	}
+}
+
+// stripControl removes control characters from text reported by the shell
+func stripControl(text string) string {
+	text = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, text)
+	return strings.ToValidUTF8(text, "")
+}
+
+// titleScanner finds window title changes (OSC 0 and OSC 2) in PTY output
+type titleScanner struct {
+	osc oscScanner
+}
+
+// Scan returns the last title data sets, if it sets one. The title has no
+// control characters; an empty title resets it.
+func (s *titleScanner) Scan(data []byte) (title string, found bool) {
+	s.osc.Scan(data, maxTitleLength, func(payload string) {
+		code, text, ok := strings.Cut(payload, ";")
+		if ok && (code == "0" || code == "2") {
+			title, found = stripControl(text), true
+		}
+	})
+	return title, found
+}
+
+// cwdScanner finds working directory reports (OSC 7, "7;file://host/path"
+// with the path URL-encoded) in PTY output
+type cwdScanner struct {
+	osc oscScanner
+}
+
+// Scan returns the last absolute directory data reports, if it reports one
+func (s *cwdScanner) Scan(data []byte) (cwd string, found bool) {
+	s.osc.Scan(data, maxCwdLength, func(payload string) {
+		rest, ok := strings.CutPrefix(payload, "7;file://")
+		if !ok {
+			return
+		}
+		// Skip the host; the path starts at its first '/'
+		slash := strings.IndexByte(rest, '/')
+		if slash < 0 {
+			return
+		}
+		dir := rest[slash:]
+		if unescaped, err := url.PathUnescape(dir); err == nil {
+			dir = unescaped
+		}
+		if dir = stripControl(dir); path.IsAbs(dir) {
+			cwd, found = path.Clean(dir), true
+		}
+	})
+	return cwd, found
+}
+
+// Markers recorded as "marker" events where output switches screen buffers
+const (
+	MarkerAltScreenEnter = "alt_screen_enter"
+	MarkerAltScreenLeave = "alt_screen_leave"
+)
+
+// altScreenSequences switch to and from the alternate screen buffer used by
+// full-screen programs like vim and less
+var altScreenSequences = map[string]string{
+	"\x1b[?1049h": MarkerAltScreenEnter,
+	"\x1b[?1049l": MarkerAltScreenLeave,
+	"\x1b[?1047h": MarkerAltScreenEnter,
+	"\x1b[?1047l": MarkerAltScreenLeave,
+	"\x1b[?47h":   MarkerAltScreenEnter,
+	"\x1b[?47l":   MarkerAltScreenLeave,
+}
+
+// screenMarker is a screen switch found in a chunk of output. Offset is just
+// past the switching sequence.
+type screenMarker struct {
+	Offset int
+	Marker string
+}
+
+// screenScanner finds alternate screen switches in output. A sequence split
+// across chunks is reported in the chunk that completes it, and repeated
+// switches to the screen already shown are ignored.
+type screenScanner struct {
+	pending []byte // Start of a possible switch sequence
+	alt     bool   // Alternate screen is showing
+}
+
+// Scan returns the screen switches in data, in order
+func (s *screenScanner) Scan(data string) []screenMarker {
+	var markers []screenMarker
+	for i := 0; i < len(data); i++ {
+		b := data[i]
+		if b == 0x1b {
+			s.pending = append(s.pending[:0], b)
+			continue
+		}
+		if len(s.pending) == 0 {
+			continue
+		}
+
+		s.pending = append(s.pending, b)
+		marker, complete := altScreenSequences[string(s.pending)]
+		if complete {
+			s.pending = s.pending[:0]
+			if enter := marker == MarkerAltScreenEnter; enter != s.alt {
+				s.alt = enter
+				markers = append(markers, screenMarker{Offset: i + 1, Marker: marker})
+			}
+			continue
+		}
+		if !s.isPrefix() {
+			s.pending = s.pending[:0]
+		}
+	}
+	return markers
+}
+
+// isPrefix reports whether pending could still become a switch sequence
+func (s *screenScanner) isPrefix() bool {
+	for seq := range altScreenSequences {
+		if strings.HasPrefix(seq, string(s.pending)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// RedactedMarker replaces secrets in recorded output
+const RedactedMarker = "[REDACTED]"
+
+const (
+	// scrubCarryBytes is the longest unfinished word held back from a chunk
+	// so a secret split across reads is scrubbed whole
+	scrubCarryBytes = 256
+
+	// scrubContextBytes of already recorded output are kept so patterns
+	// with a prefix (e.g. "Bearer ") still match a secret in the next chunk
+	scrubContextBytes = 64
+)
+
+// defaultScrubPatterns are always applied when scrubbing is enabled. When a
+// pattern has a capture group only the first group is redacted.
+var defaultScrubPatterns = []string{
+	`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`,                                   // AWS access key IDs
+	`(?i)aws_secret_access_key\s*[=:]\s*["']?([A-Za-z0-9/+=]{40})`,    // AWS secret keys
+	`(?i)\bbearer\s+([A-Za-z0-9\-._~+/]{16,}=*)`,                      // Bearer tokens
+	`\bgh[pousr]_[A-Za-z0-9]{36,}\b`,                                  // GitHub tokens
+	`\bxox[abprs]-[A-Za-z0-9-]{10,}`,                                  // Slack tokens
+	`\beyJ[A-Za-z0-9_-]{8,}\.eyJ[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]{8,}`, // JWTs
+}
+
+// OutputScrubber redacts secrets from terminal output before it is recorded
+type OutputScrubber struct {
+	patterns []*regexp.Regexp
+}
+
+var outputScrubber = NewOutputScrubber(serverConfig.ScrubPatternsFile)
+
+// NewOutputScrubber compiles the default patterns plus those in patternsFile
+// (one regular expression per line, # for comments). Invalid patterns are
+// logged and skipped.
+func NewOutputScrubber(patternsFile string) *OutputScrubber {
+	sources := append([]string{}, defaultScrubPatterns...)
+	if patternsFile != "" {
+		file, err := os.Open(patternsFile)
+		if err != nil {
+			logWarnf("⚠️  Can't read scrub patterns from %s: %v", patternsFile, err)
+		} else {
+			scanner := bufio.NewScanner(file)
+			for scanner.Scan() {
+				line := strings.TrimSpace(scanner.Text())
+				if line != "" && !strings.HasPrefix(line, "#") {
+					sources = append(sources, line)
+				}
+			}
+			file.Close()
+		}
+	}
+
+	s := &OutputScrubber{}
+	for _, src := range sources {
+		re, err := regexp.Compile(src)
+		if err != nil {
+			logWarnf("⚠️  Ignoring invalid scrub pattern %q: %v", src, err)
+			continue
+		}
+		s.patterns = append(s.patterns, re)
+	}
+	return s
+}
+
+// Scrub redacts secrets in a complete piece of text
+func (s *OutputScrubber) Scrub(text string) string {
+	return s.scrubAfter(text, 0)
+}
+
+// scrubAfter redacts matches in text, leaving text[:from] (context that has
+// already been recorded) untouched
+func (s *OutputScrubber) scrubAfter(text string, from int) string {
+	for _, re := range s.patterns {
+		matches := re.FindAllStringSubmatchIndex(text, -1)
+		if len(matches) == 0 {
+			continue
+		}
+
+		var b strings.Builder
+		last := from
+		b.WriteString(text[:from])
+		for _, m := range matches {
+			start, end := m[0], m[1]
+			if len(m) >= 4 && m[2] >= 0 {
+				start, end = m[2], m[3]
+			}
+			if end <= last {
+				continue
+			}
+			if start < last {
+				start = last
+			}
+			b.WriteString(text[last:start])
+			b.WriteString(RedactedMarker)
+			last = end
+		}
+		b.WriteString(text[last:])
+		text = b.String()
+	}
+	return text
+}
+
+// scrubStream scrubs a session's output chunk by chunk. The caller
+// serializes calls (ActiveSession.mu).
+type scrubStream struct {
+	scrubber *OutputScrubber
+	carry    string // Unfinished word from the previous chunk
+	context  string // Tail of the scrubbed output already returned
+}
+
+func newScrubStream(scrubber *OutputScrubber) *scrubStream {
+	return &scrubStream{scrubber: scrubber}
+}
+
+// Write returns the scrubbed output that can be recorded now. A trailing
+// unfinished word is held back until the next chunk or Flush.
+func (st *scrubStream) Write(data string) string {
+	text := st.carry + data
+	st.carry = ""
+
+	if i := strings.LastIndexAny(text, " \t\r\n"); i < len(text)-1 && len(text)-(i+1) <= scrubCarryBytes {
+		st.carry = text[i+1:]
+		text = text[:i+1]
+	}
+	if text == "" {
+		return ""
+	}
+
+	scrubbed := st.scrubber.scrubAfter(st.context+text, len(st.context))
+	out := scrubbed[len(st.context):]
+	if len(scrubbed) > scrubContextBytes {
+		scrubbed = scrubbed[len(scrubbed)-scrubContextBytes:]
+	}
+	st.context = scrubbed
+	return out
+}
+
+// Flush scrubs and returns any held back output
+func (st *scrubStream) Flush() string {
+	if st.carry == "" {
+		return ""
+	}
+	scrubbed := st.scrubber.scrubAfter(st.context+st.carry, len(st.context))
+	out := scrubbed[len(st.context):]
+	st.carry, st.context = "", ""
+	return out
+}
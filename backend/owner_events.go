@@ -0,0 +1,119 @@
+package main
+
+import (
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ownerTerminalEvents are the live events also sent to the owner's open
+// terminals (see terminal_registry.go). Owners rarely open their own
+// /ws/live, so viewer joins, permission requests, chat and chat receipts
+// reach them as control messages on the terminal socket, where they answer
+// requests with permission_grant / permission_deny {"username": "..."}.
+var ownerTerminalEvents = map[string]bool{
+	MsgTypeViewerJoin:    true,
+	MsgTypeViewerLeave:   true,
+	MsgTypePermissionReq: true,
+	MsgTypeChat:          true,
+	MsgTypeChatReceipt:   true,
+
+	MsgTypeOwnerIdleWarning:   true,
+	MsgTypeOwnerIdleCancelled: true,
+}
+
+// notifyOwner queues a live event for the session's open terminals. It never
+// blocks the hub; events are dropped if the terminals are backed up.
+func (h *LiveHub) notifyOwner(msg *LiveMessage) {
+	if !ownerTerminalEvents[msg.Type] {
+		return
+	}
+	select {
+	case h.ownerEvents <- msg:
+	default:
+	}
+}
+
+// forwardOwnerEvents writes queued events to the owner's terminals in order
+func (h *LiveHub) forwardOwnerEvents() {
+	for msg := range h.ownerEvents {
+		terminals.Notify(msg.SessionID, msg)
+	}
+}
+
+// cleanChatText reduces a chat message ({"data":"..."} or {"data":{"text":
+// "..."}}) to its text without control characters, so viewers can't send
+// escape sequences into the terminals it is written to. It reports false
+// when nothing is left.
+func cleanChatText(data interface{}) (string, bool) {
+	text, _ := data.(string)
+	if fields, ok := data.(map[string]interface{}); ok {
+		text, _ = fields["text"].(string)
+		if text == "" {
+			text, _ = fields["message"].(string)
+		}
+	}
+	text = plainChatText(text)
+	return text, text != ""
+}
+
+// plainChatText removes control characters (including ESC and the C1 range)
+// and invalid UTF-8 from chat shown in terminals, like cleanSessionName
+func plainChatText(text string) string {
+	text = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(text, ""))
+	return strings.TrimSpace(text)
+}
+
+// SendChat sends a chat message to everyone in a session's room
+func (h *LiveHub) SendChat(sessionID, sender string, data interface{}) {
+	text, ok := cleanChatText(data)
+	if !ok {
+		return
+	}
+	select {
+	case h.broadcast <- &LiveMessage{
+		Type:      MsgTypeChat,
+		SessionID: sessionID,
+		Data:      text,
+		Sender:    plainChatText(sender),
+		Timestamp: time.Now().UnixMilli(),
+	}:
+	default:
+	}
+}
+
+// handleOwnerLiveMessage handles a live control message sent on the owner's
+// terminal socket, reporting false for messages meant for the terminal.
+// Terminals only attach to sessions of the connected user, so the sender is
+// the session's owner.
+func handleOwnerLiveMessage(sessionID, username string, msg terminalMessage) bool {
+	switch msg.Type {
+	case MsgTypePermissionGrant, MsgTypePermissionDeny:
+		markOwnerActive(sessionID)
+		data, _ := msg.Data.(map[string]interface{})
+		viewer, _ := data["username"].(string)
+		if sessionID == "" || viewer == "" {
+			return true
+		}
+		if msg.Type == MsgTypePermissionGrant {
+			liveHub.GrantPermission(sessionID, viewer)
+		} else {
+			liveHub.RevokePermission(sessionID, viewer)
+		}
+	case MsgTypeOwnerActive:
+		markOwnerActive(sessionID)
+	case MsgTypeChat:
+		markOwnerActive(sessionID)
+		if sessionID != "" {
+			liveHub.SendChat(sessionID, username, msg.Data)
+		}
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestCleanChatText(t *testing.T) {
+	tests := []struct {
+		name string
+		data interface{}
+		want string
+		ok   bool
+	}{
+		{name: "plain string", data: "hello", want: "hello", ok: true},
+		{name: "text field", data: map[string]interface{}{"text": "hi"}, want: "hi", ok: true},
+		{name: "message field", data: map[string]interface{}{"message": "hey"}, want: "hey", ok: true},
+		{name: "clear screen", data: "\x1b[2J\x1b[Hfake prompt", want: "[2J[Hfake prompt", ok: true},
+		{name: "title OSC", data: "\x1b]0;owned\x07hi", want: "]0;ownedhi", ok: true},
+		{name: "C1 CSI", data: "\u009b2Jx", want: "2Jx", ok: true},
+		{name: "newlines", data: "a\r\nb", want: "ab", ok: true},
+		{name: "invalid UTF-8", data: "a\xffb", want: "ab", ok: true},
+		{name: "only control characters", data: "\x1b\x07\r\n", ok: false},
+		{name: "not text", data: 42, ok: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := cleanChatText(tt.data)
+			if got != tt.want || ok != tt.ok {
+				t.Fatalf("cleanChatText(%q) = (%q, %v), want (%q, %v)", tt.data, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
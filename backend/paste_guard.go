@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"time"
+	"unicode/utf8"
+)
+
+// Paste confirmation messages (paste_guard preference)
+const (
+	MsgTypePastePending = "paste_pending" // Server: {"type":"paste_pending","bytes":812,"lines":9,"binary":false}
+	MsgTypeConfirmPaste = "confirm_paste" // Client: write the pending paste to the shell
+	MsgTypeCancelPaste  = "cancel_paste"  // Client: drop the pending paste
+)
+
+const (
+	// pasteGuardMinBytes is the size from which an input frame with a line
+	// break or binary bytes counts as a paste. Keys arrive one per frame, so
+	// typing stays well below it.
+	pasteGuardMinBytes = 64
+
+	// pasteConfirmTimeout is how long a held paste waits for confirmation;
+	// a later confirm_paste finds nothing to write
+	pasteConfirmTimeout = time.Minute
+)
+
+// pasteGuard holds input frames that look like a risky paste (several lines,
+// or binary data) until the client confirms them, so hidden line breaks in
+// copied text can't run commands unseen. One paste is held at a time; other
+// input passes through meanwhile. Only the input goroutine uses it.
+type pasteGuard struct {
+	conn    *safeConn
+	pane    string // The extra pane guarded; empty for the main terminal
+	pending []byte
+	heldAt  time.Time
+}
+
+// newPasteGuard returns a guard for a terminal, or nil when the user hasn't
+// turned paste_guard on
+func newPasteGuard(conn *safeConn, prefs UserPreferences) *pasteGuard {
+	if !prefs.PasteGuard {
+		return nil
+	}
+	return &pasteGuard{conn: conn}
+}
+
+// riskyPaste reports whether an input frame should be confirmed before it
+// reaches the shell: two or more line breaks, or a large frame with a line
+// break or binary bytes (NUL, control characters other than tab, line
+// breaks and escape, or invalid UTF-8)
+func riskyPaste(data []byte) (lines int, binary bool, risky bool) {
+	lines = bytes.Count(data, []byte{'\n'}) + bytes.Count(data, []byte{'\r'}) - bytes.Count(data, []byte("\r\n"))
+	if len(data) < pasteGuardMinBytes {
+		return lines, false, lines >= 2
+	}
+
+	binary = !utf8.Valid(data)
+	for _, b := range data {
+		if (b < 0x20 && b != '\t' && b != '\n' && b != '\r' && b != 0x1b) || b == 0x7f {
+			binary = true
+			break
+		}
+	}
+	return lines, binary, lines >= 1 || binary
+}
+
+// Hold reports whether data must wait for confirmation. A risky paste while
+// another is pending is dropped with a notice.
+func (g *pasteGuard) Hold(data []byte) bool {
+	if g == nil {
+		return false
+	}
+	lines, binary, risky := riskyPaste(data)
+	if !risky {
+		return false
+	}
+	if g.pending != nil && time.Since(g.heldAt) < pasteConfirmTimeout {
+		terminalNotice(g.conn, "Another paste is waiting; confirm or cancel it first")
+		return true
+	}
+
+	g.pending = append([]byte(nil), data...)
+	g.heldAt = time.Now()
+	msg := map[string]interface{}{
+		"type":   MsgTypePastePending,
+		"bytes":  len(data),
+		"lines":  lines,
+		"binary": binary,
+	}
+	if g.pane != "" {
+		msg["pane"] = g.pane
+	}
+	g.conn.WriteJSON(msg)
+	return true
+}
+
+// Resolve ends the pending paste, returning it when the client confirmed it
+// in time
+func (g *pasteGuard) Resolve(confirm bool) ([]byte, bool) {
+	if g == nil || g.pending == nil {
+		return nil, false
+	}
+	data, heldAt := g.pending, g.heldAt
+	g.pending = nil
+
+	if !confirm {
+		return nil, false
+	}
+	if time.Since(heldAt) >= pasteConfirmTimeout {
+		terminalNotice(g.conn, "The paste waited too long and was dropped; paste it again")
+		return nil, false
+	}
+	return data, true
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxPromptThemeLength caps a custom PS1 template
+const MaxPromptThemeLength = 256
+
+// PromptThemeClassic is the default docker prompt: canyouhack@user:dir$
+const PromptThemeClassic = "classic"
+
+// promptThemes are the preset docker shell prompts. Each is built for the
+// user the shell runs as; root stands out in red where the theme has colors.
+var promptThemes = map[string]func(user string) string{
+	PromptThemeClassic: containerPromptPS1,
+	"minimal": func(user string) string {
+		return `\[\e[36m\]\w\[\e[0m\] \$ `
+	},
+	"plain": func(user string) string {
+		return promptUser(user) + `@\h:\w\$ `
+	},
+	"kali": func(user string) string {
+		color := `\[\e[34m\]`
+		if promptUser(user) == "root" {
+			color = `\[\e[31m\]`
+		}
+		return `\[\e[32m\]┌──(` + color + promptUser(user) + `\[\e[32m\])-[\[\e[0m\]\w\[\e[32m\]]\n└─\[\e[0m\]\$ `
+	},
+}
+
+// promptUser is the name shown for the user a shell runs as ("" is root)
+func promptUser(user string) string {
+	if user == "" {
+		return "root"
+	}
+	return user
+}
+
+// PromptThemeNames lists the preset prompt themes
+func PromptThemeNames() []string {
+	names := make([]string, 0, len(promptThemes))
+	for name := range promptThemes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// handlePromptThemes lists the preset prompt themes with their root prompt:
+// GET /api/prompt_themes
+func handlePromptThemes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	themes := []map[string]string{}
+	for _, name := range PromptThemeNames() {
+		themes = append(themes, map[string]string{"name": name, "ps1": promptThemes[name]("")})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"default": PromptThemeClassic,
+		"themes":  themes,
+	})
+}
+
+// checkPromptTheme validates a session's prompt theme: empty, a preset name
+// or a custom PS1 template. Custom templates may use {user} and bash prompt
+// escapes (\w, \e, \n, ...) but no raw control characters, which would end
+// up in the docker exec environment. It returns a message for the client
+// when the theme is invalid.
+func checkPromptTheme(theme string) string {
+	if theme == "" || promptThemes[theme] != nil {
+		return ""
+	}
+	if len(theme) > MaxPromptThemeLength {
+		return "Custom prompts must be at most " + strconv.Itoa(MaxPromptThemeLength) + " bytes"
+	}
+	if !utf8.ValidString(theme) {
+		return "Custom prompts must be valid UTF-8"
+	}
+	if strings.IndexFunc(theme, unicode.IsControl) >= 0 {
+		return `Custom prompts can't contain control characters; write escapes like \e or \n instead`
+	}
+	return ""
+}
+
+// promptPS1 builds the PS1 for a session's prompt theme and exec user,
+// falling back to the classic prompt
+func promptPS1(theme, user string) string {
+	if theme == "" || checkPromptTheme(theme) != "" {
+		theme = PromptThemeClassic
+	}
+	if preset := promptThemes[theme]; preset != nil {
+		return preset(user)
+	}
+	return strings.ReplaceAll(theme, "{user}", promptUser(user))
+}
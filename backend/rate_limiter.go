@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// tokenBucket tracks the remaining tokens for a single key
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter is a registry of token buckets keyed by username or IP
+type RateLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // tokens refilled per second
+	burst   float64
+	buckets map[string]*tokenBucket
+	now     func() time.Time
+}
+
+// createLimiter guards container-spawning endpoints (session and container creation)
+var createLimiter = NewRateLimiter(serverConfig.CreateRatePerMinute, serverConfig.CreateRateBurst)
+
+// NewRateLimiter creates a limiter allowing perMinute requests with the given burst.
+// A non-positive rate disables limiting.
+func NewRateLimiter(perMinute float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	rl := &RateLimiter{
+		rate:    perMinute / 60,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		now:     time.Now,
+	}
+	if rl.rate > 0 {
+		go rl.cleanupLoop()
+	}
+	return rl
+}
+
+// Allow consumes a token for key. When the bucket is empty it returns false
+// and the time until the next token becomes available.
+func (rl *RateLimiter) Allow(key string) (bool, time.Duration) {
+	if rl.rate <= 0 {
+		return true, 0
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	bucket, exists := rl.buckets[key]
+	if !exists {
+		bucket = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = bucket
+	}
+
+	// Refill based on elapsed time
+	elapsed := now.Sub(bucket.last).Seconds()
+	if elapsed > 0 {
+		bucket.tokens = math.Min(rl.burst, bucket.tokens+elapsed*rl.rate)
+		bucket.last = now
+	}
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - bucket.tokens) / rl.rate * float64(time.Second))
+	return false, wait
+}
+
+// cleanupLoop drops buckets that have refilled completely
+func (rl *RateLimiter) cleanupLoop() {
+	ticker := time.NewTicker(10 * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		rl.mu.Lock()
+		now := rl.now()
+		for key, bucket := range rl.buckets {
+			if bucket.tokens+now.Sub(bucket.last).Seconds()*rl.rate >= rl.burst {
+				delete(rl.buckets, key)
+			}
+		}
+		rl.mu.Unlock()
+	}
+}
+
+// clientIP returns the remote IP of a request without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimitKey keys authenticated users by name and guests by IP
+func rateLimitKey(r *http.Request, username string) string {
+	if username == "" || username == "guest" {
+		return "ip:" + clientIP(r)
+	}
+	return "user:" + username
+}
+
+// checkCreateRateLimit writes a 429 response and returns false when the caller
+// has exceeded the creation rate limit
+func checkCreateRateLimit(w http.ResponseWriter, r *http.Request, username string) bool {
+	allowed, wait := createLimiter.Allow(rateLimitKey(r, username))
+	if allowed {
+		return true
+	}
+
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	if retryAfter < 1 {
+		retryAfter = 1
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":       "Too many requests, please slow down",
+		"retry_after": retryAfter,
+	})
+	return false
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeClock is a settable time source for RateLimiter.now
+type fakeClock struct{ t time.Time }
+
+func newFakeClock() *fakeClock { return &fakeClock{t: time.Unix(1700000000, 0)} }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+// newTestLimiter is a limiter whose time only moves with clock
+func newTestLimiter(perMinute float64, burst int, clock *fakeClock) *RateLimiter {
+	rl := NewRateLimiter(perMinute, burst)
+	rl.now = clock.now
+	return rl
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	type step struct {
+		advance time.Duration
+		allowed bool
+		wait    time.Duration
+	}
+	tests := []struct {
+		name      string
+		perMinute float64
+		burst     int
+		steps     []step
+	}{
+		{
+			name:      "burst drains then refuses",
+			perMinute: 60,
+			burst:     3,
+			steps: []step{
+				{allowed: true},
+				{allowed: true},
+				{allowed: true},
+				{allowed: false, wait: time.Second},
+			},
+		},
+		{
+			name:      "refills one token per interval",
+			perMinute: 60,
+			burst:     1,
+			steps: []step{
+				{allowed: true},
+				{allowed: false, wait: time.Second},
+				{advance: 500 * time.Millisecond, allowed: false, wait: 500 * time.Millisecond},
+				{advance: 500 * time.Millisecond, allowed: true},
+				{allowed: false, wait: time.Second},
+			},
+		},
+		{
+			name:      "refill is capped at burst",
+			perMinute: 60,
+			burst:     2,
+			steps: []step{
+				{allowed: true},
+				{allowed: true},
+				{advance: time.Hour, allowed: true},
+				{allowed: true},
+				{allowed: false, wait: time.Second},
+			},
+		},
+		{
+			name:      "slow rate waits longer",
+			perMinute: 2,
+			burst:     1,
+			steps: []step{
+				{allowed: true},
+				{allowed: false, wait: 30 * time.Second},
+				{advance: 10 * time.Second, allowed: false, wait: 20 * time.Second},
+			},
+		},
+		{
+			name:      "non-positive rate disables limiting",
+			perMinute: 0,
+			burst:     1,
+			steps: []step{
+				{allowed: true},
+				{allowed: true},
+				{allowed: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			rl := newTestLimiter(tt.perMinute, tt.burst, clock)
+			for i, s := range tt.steps {
+				clock.advance(s.advance)
+				allowed, wait := rl.Allow("user:alice")
+				if allowed != s.allowed {
+					t.Fatalf("step %d: allowed = %v, want %v", i, allowed, s.allowed)
+				}
+				if diff := wait - s.wait; diff < -time.Millisecond || diff > time.Millisecond {
+					t.Fatalf("step %d: wait = %v, want %v", i, wait, s.wait)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterKeysAreIndependent(t *testing.T) {
+	rl := newTestLimiter(60, 1, newFakeClock())
+	if ok, _ := rl.Allow("user:alice"); !ok {
+		t.Fatal("first request for alice was refused")
+	}
+	if ok, _ := rl.Allow("user:alice"); ok {
+		t.Fatal("second request for alice was allowed")
+	}
+	if ok, _ := rl.Allow("user:bob"); !ok {
+		t.Fatal("bob was limited by alice's bucket")
+	}
+}
+
+func TestCheckCreateRateLimitRetryAfter(t *testing.T) {
+	tests := []struct {
+		name       string
+		perMinute  float64
+		advance    time.Duration
+		retryAfter string
+	}{
+		{name: "whole seconds", perMinute: 6, retryAfter: "10"},
+		{name: "rounds up", perMinute: 6, advance: 2500 * time.Millisecond, retryAfter: "8"},
+		{name: "never below one second", perMinute: 600, advance: 99 * time.Millisecond, retryAfter: "1"},
+	}
+
+	saved := createLimiter
+	defer func() { createLimiter = saved }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			createLimiter = newTestLimiter(tt.perMinute, 1, clock)
+			r := httptest.NewRequest(http.MethodPost, "/api/sessions", nil)
+
+			if !checkCreateRateLimit(httptest.NewRecorder(), r, "alice") {
+				t.Fatal("first request was refused")
+			}
+			clock.advance(tt.advance)
+
+			w := httptest.NewRecorder()
+			if checkCreateRateLimit(w, r, "alice") {
+				t.Fatal("request over the limit was allowed")
+			}
+			if w.Code != http.StatusTooManyRequests {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusTooManyRequests)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.retryAfter {
+				t.Fatalf("Retry-After = %q, want %q", got, tt.retryAfter)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import "time"
+
+// MsgTypeRecordingCapped tells a session's terminals that recording stopped
+// at CYH_MAX_RECORDING_DURATION; the terminal stays open
+const MsgTypeRecordingCapped = "recording_capped"
+
+// recordingCapped reports whether the session's recording was stopped
+func (a *ActiveSession) recordingCapped() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.capped
+}
+
+// stopRecordingCap cancels a pending recording cap when the session ends.
+// The caller holds a.mu.
+func (a *ActiveSession) stopRecordingCap() {
+	if a.capTimer != nil {
+		a.capTimer.Stop()
+		a.capTimer = nil
+	}
+}
+
+// capRecording stops recording a session that reached
+// CYH_MAX_RECORDING_DURATION. Events from then on are dropped, so the
+// session's duration keeps growing while its recording doesn't. Sessions
+// resumed later stay capped (see recording_capped_at).
+func (sm *SessionManager) capRecording(id string, active *ActiveSession) {
+	active.mu.Lock()
+	if active.capTimer == nil {
+		active.mu.Unlock()
+		return // The session ended first
+	}
+	active.capTimer = nil
+	active.capped = true
+
+	// Record the output the scrubber held back, so the recording ends where the cap hit
+	now := time.Now()
+	if rest := active.scrub.Flush(); rest != "" {
+		sm.persistEvent(id, active, "", "output", rest, now.UnixMilli())
+	}
+	active.mu.Unlock()
+
+	if _, err := sm.db.Exec(`UPDATE term_sessions SET recording_capped_at = ? WHERE id = ?`, now, id); err != nil {
+		logErrorf("Failed to mark recording of session %s as capped: %v", id, err)
+	}
+	logInfof("Stopped recording session %s after %s (CYH_MAX_RECORDING_DURATION)", id, serverConfig.MaxRecordingDuration)
+
+	terminals.Notify(id, map[string]interface{}{
+		"type":         MsgTypeRecordingCapped,
+		"session_id":   id,
+		"max_duration": serverConfig.MaxRecordingDuration.Milliseconds(),
+	})
+}
+
+// markRecordingCapped caps a session resumed after
+// CYH_MAX_RECORDING_DURATION before anything more is recorded. The
+// terminal handler tells the client, as for any capped session.
+func (sm *SessionManager) markRecordingCapped(session *TermSession) {
+	now := time.Now()
+	if _, err := sm.db.Exec(`UPDATE term_sessions SET recording_capped_at = ? WHERE id = ?`, now, session.ID); err != nil {
+		logErrorf("Failed to mark recording of session %s as capped: %v", session.ID, err)
+	}
+	session.RecordingCappedAt = &now
+	logInfof("Stopped recording session %s, resumed after %s (CYH_MAX_RECORDING_DURATION)", session.ID, serverConfig.MaxRecordingDuration)
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Recording backends
+const (
+	RecordingBackendDB   = "db"   // Insert every event into SQLite synchronously
+	RecordingBackendFile = "file" // Append to a per-session file, import into SQLite on end
+)
+
+const recordingBatchSize = 256
+
+// fileLogRecord is one line of a session's append-only log file
+type fileLogRecord struct {
+	Timestamp int64  `json:"t"`
+	Type      string `json:"type"`
+	Data      string `json:"data"`
+	Pane      string `json:"pane,omitempty"`
+}
+
+// sessionFileLog is an append-only event log for one active session.
+// Events are queued and written by a dedicated goroutine in batches so the
+// PTY hot path never waits on SQLite.
+type sessionFileLog struct {
+	path    string
+	file    *os.File
+	writer  *bufio.Writer
+	queue   chan *fileLogRecord
+	flushRq chan chan struct{}
+	done    chan struct{}
+	closed  bool
+	closeMu sync.Mutex // guards closed and sends on queue
+}
+
+// openSessionFileLog creates (or appends to) the log file for a session
+func openSessionFileLog(dir, sessionID string) (*sessionFileLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, sessionID+".log")
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	fl := &sessionFileLog{
+		path:    path,
+		file:    file,
+		writer:  bufio.NewWriterSize(file, 64*1024),
+		queue:   make(chan *fileLogRecord, 4096),
+		flushRq: make(chan chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go fl.run(serverConfig.RecordingFlushInterval)
+	return fl, nil
+}
+
+// Append queues an event for writing
+func (fl *sessionFileLog) Append(pane, eventType, data string, timestamp int64) {
+	fl.closeMu.Lock()
+	defer fl.closeMu.Unlock()
+	if fl.closed {
+		return
+	}
+	fl.queue <- &fileLogRecord{Timestamp: timestamp, Type: eventType, Data: data, Pane: pane}
+}
+
+// run drains the queue, flushing every batch or interval
+func (fl *sessionFileLog) run(interval time.Duration) {
+	defer close(fl.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	pending := 0
+	for {
+		select {
+		case rec, ok := <-fl.queue:
+			if !ok {
+				fl.flush()
+				return
+			}
+			fl.write(rec)
+			pending++
+			if pending >= recordingBatchSize {
+				fl.flush()
+				pending = 0
+			}
+		case ack := <-fl.flushRq:
+			// Drain whatever is queued so readers see every event so far
+			for drained := false; !drained; {
+				select {
+				case rec := <-fl.queue:
+					fl.write(rec)
+				default:
+					drained = true
+				}
+			}
+			fl.flush()
+			pending = 0
+			close(ack)
+		case <-ticker.C:
+			if pending > 0 {
+				fl.flush()
+				pending = 0
+			}
+		}
+	}
+}
+
+func (fl *sessionFileLog) write(rec *fileLogRecord) {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	fl.writer.Write(line)
+	fl.writer.WriteByte('\n')
+}
+
+func (fl *sessionFileLog) flush() {
+	if err := fl.writer.Flush(); err != nil {
+		logErrorf("Failed to flush recording log %s: %v", fl.path, err)
+	}
+}
+
+// Sync blocks until every queued event has been written to disk
+func (fl *sessionFileLog) Sync() {
+	fl.closeMu.Lock()
+	if fl.closed {
+		fl.closeMu.Unlock()
+		return
+	}
+	ack := make(chan struct{})
+	fl.flushRq <- ack
+	fl.closeMu.Unlock()
+	<-ack
+}
+
+// Close stops the writer after draining the queue and closes the file
+func (fl *sessionFileLog) Close() error {
+	fl.closeMu.Lock()
+	if fl.closed {
+		fl.closeMu.Unlock()
+		return nil
+	}
+	fl.closed = true
+	close(fl.queue)
+	fl.closeMu.Unlock()
+
+	<-fl.done
+	return fl.file.Close()
+}
+
+// readFileLog parses all events from a session log file
+func readFileLog(path string) ([]*SessionEvent, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var events []*SessionEvent
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			var rec fileLogRecord
+			if json.Unmarshal(line, &rec) == nil {
+				events = append(events, &SessionEvent{
+					Type:      rec.Type,
+					Timestamp: rec.Timestamp,
+					Data:      rec.Data,
+					Pane:      rec.Pane,
+				})
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return events, err
+		}
+	}
+	return events, nil
+}
+
+// importFileLog copies a session log file into terminal_logs and removes it
+func (sm *SessionManager) importFileLog(sessionID, path string) error {
+	events, err := readFileLog(path)
+	if err != nil && len(events) == 0 {
+		return err
+	}
+
+	tx, err := sm.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(`
+		INSERT INTO terminal_logs (session_id, event_type, data, timestamp, pane, compression)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, e := range events {
+		stored, compression := compressEventData(e.Data)
+		if _, err := stmt.Exec(sessionID, e.Type, stored, e.Timestamp, e.Pane, compression); err != nil {
+			stmt.Close()
+			tx.Rollback()
+			return err
+		}
+	}
+	stmt.Close()
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	logInfof("Imported %d recorded events for session %s", len(events), sessionID)
+	return os.Remove(path)
+}
+
+// recoverFileLogs imports logs left behind by a crash or unclean shutdown
+func (sm *SessionManager) recoverFileLogs() {
+	entries, err := os.ReadDir(sm.recordingDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".log") {
+			continue
+		}
+		sessionID := strings.TrimSuffix(name, ".log")
+		if err := sm.importFileLog(sessionID, filepath.Join(sm.recordingDir, name)); err != nil {
+			logErrorf("Failed to recover recording log %s: %v", name, err)
+		}
+	}
+}
+
+// mergeEvents combines DB and file events in timestamp order
+func mergeEvents(a, b []*SessionEvent) []*SessionEvent {
+	if len(b) == 0 {
+		return a
+	}
+	merged := append(a, b...)
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].Timestamp < merged[j].Timestamp
+	})
+	return merged
+}
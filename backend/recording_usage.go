@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// usageCacheTTL is how long a usage report is reused; each report scans
+// terminal_logs
+const usageCacheTTL = 30 * time.Second
+
+// maxUsageCacheEntries bounds the usage cache; past it reports are computed
+// without being kept
+const maxUsageCacheEntries = 1000
+
+// SessionUsage is the recorded data of one session
+type SessionUsage struct {
+	SessionID string `json:"session_id"`
+	Name      string `json:"name"`
+	Bytes     int64  `json:"bytes"`
+	Events    int64  `json:"events"`
+}
+
+// UserUsage is the recorded data of one user, per session when requested by the user
+type UserUsage struct {
+	User       string         `json:"user"`
+	TotalBytes int64          `json:"total_bytes"`
+	Events     int64          `json:"events"`
+	Sessions   []SessionUsage `json:"sessions,omitempty"`
+	Recordings int            `json:"recordings"`  // Sessions with recorded events
+	ComputedAt int64          `json:"computed_at"` // UnixMilli
+}
+
+// UsageReport is the recorded data of every user
+type UsageReport struct {
+	TotalBytes int64       `json:"total_bytes"`
+	Users      []UserUsage `json:"users"`
+	ComputedAt int64       `json:"computed_at"` // UnixMilli
+}
+
+// usageCache holds recent usage reports by key ("user:<name>" or "all")
+var usageCache = struct {
+	sync.Mutex
+	entries map[string]cachedUsage
+}{entries: make(map[string]cachedUsage)}
+
+type cachedUsage struct {
+	value     interface{}
+	expiresAt time.Time
+}
+
+// cachedUsageReport returns the cached report for key, computing it when
+// missing or older than usageCacheTTL. Expired reports are dropped whenever
+// one is stored.
+func cachedUsageReport(key string, compute func() (interface{}, error)) (interface{}, error) {
+	usageCache.Lock()
+	entry, ok := usageCache.entries[key]
+	usageCache.Unlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.value, nil
+	}
+
+	value, err := compute()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	usageCache.Lock()
+	defer usageCache.Unlock()
+	for k, e := range usageCache.entries {
+		if !now.Before(e.expiresAt) {
+			delete(usageCache.entries, k)
+		}
+	}
+	if len(usageCache.entries) < maxUsageCacheEntries {
+		usageCache.entries[key] = cachedUsage{value: value, expiresAt: now.Add(usageCacheTTL)}
+	}
+	return value, nil
+}
+
+// GetUserUsage returns the bytes of recorded event data in each of the
+// user's sessions, largest first. File-backed recordings count once imported.
+func (sm *SessionManager) GetUserUsage(user string) (*UserUsage, error) {
+	value, err := cachedUsageReport("user:"+user, func() (interface{}, error) {
+		rows, err := sm.db.Query(`
+			SELECT s.id, s.name, COALESCE(SUM(LENGTH(CAST(l.data AS BLOB))), 0), COUNT(l.id)
+			FROM term_sessions s JOIN terminal_logs l ON l.session_id = s.id
+			WHERE s.user = ?
+			GROUP BY s.id
+			ORDER BY 3 DESC
+		`, user)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		usage := &UserUsage{User: user, Sessions: []SessionUsage{}, ComputedAt: time.Now().UnixMilli()}
+		for rows.Next() {
+			var s SessionUsage
+			if err := rows.Scan(&s.SessionID, &s.Name, &s.Bytes, &s.Events); err != nil {
+				return nil, err
+			}
+			usage.TotalBytes += s.Bytes
+			usage.Events += s.Events
+			usage.Sessions = append(usage.Sessions, s)
+		}
+		usage.Recordings = len(usage.Sessions)
+		return usage, rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*UserUsage), nil
+}
+
+// GetUsageByUser returns the bytes of recorded event data per user, largest first
+func (sm *SessionManager) GetUsageByUser() (*UsageReport, error) {
+	value, err := cachedUsageReport("all", func() (interface{}, error) {
+		rows, err := sm.db.Query(`
+			SELECT s.user, COUNT(DISTINCT s.id), COALESCE(SUM(LENGTH(CAST(l.data AS BLOB))), 0), COUNT(l.id)
+			FROM term_sessions s JOIN terminal_logs l ON l.session_id = s.id
+			GROUP BY s.user
+			ORDER BY 3 DESC
+		`)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		report := &UsageReport{Users: []UserUsage{}, ComputedAt: time.Now().UnixMilli()}
+		for rows.Next() {
+			u := UserUsage{ComputedAt: report.ComputedAt}
+			if err := rows.Scan(&u.User, &u.Recordings, &u.TotalBytes, &u.Events); err != nil {
+				return nil, err
+			}
+			report.TotalBytes += u.TotalBytes
+			report.Users = append(report.Users, u)
+		}
+		return report, rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*UsageReport), nil
+}
+
+// handleSessionUsage reports how much recorded data the user's sessions
+// hold: GET /api/sessions/usage
+func handleSessionUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := ""
+	if cookie, err := r.Cookie("cyh_session"); err == nil {
+		if user, valid := authManager.ValidateSession(cookie.Value); valid {
+			username = user
+		}
+	}
+
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	usage, err := sessionMgr.GetUserUsage(username)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usage)
+}
+
+// handleAdminUsage reports recorded data per user: GET /api/admin/usage
+func handleAdminUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report, err := sessionMgr.GetUsageByUser()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestUsageCacheEvictsAndIsBounded(t *testing.T) {
+	saved := usageCache.entries
+	usageCache.entries = make(map[string]cachedUsage)
+	t.Cleanup(func() { usageCache.entries = saved })
+
+	compute := func() (interface{}, error) { return 1, nil }
+
+	usageCache.entries["user:gone"] = cachedUsage{value: 0, expiresAt: time.Now().Add(-time.Second)}
+	if _, err := cachedUsageReport("user:alice", compute); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := usageCache.entries["user:gone"]; ok {
+		t.Fatal("expired entry was kept")
+	}
+
+	for i := 0; i < maxUsageCacheEntries+10; i++ {
+		if _, err := cachedUsageReport("user:u"+strconv.Itoa(i), compute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(usageCache.entries); n > maxUsageCacheEntries {
+		t.Fatalf("cache holds %d entries, want at most %d", n, maxUsageCacheEntries)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// MsgTypeResumeReady tells a resuming client that the shell has drawn its
+// prompt, so history replayed now won't be wiped by the shell's startup clear
+const MsgTypeResumeReady = "resume_ready"
+
+// Reasons sent with resume_ready
+const (
+	ResumeReadyPrompt  = "prompt"  // A prompt was recognized in the output
+	ResumeReadyTimeout = "timeout" // No prompt within CYH_RESUME_READY_TIMEOUT
+)
+
+// promptTailBytes bounds the unfinished output line kept for prompt detection
+const promptTailBytes = 256
+
+// promptEndings are the characters a shell prompt usually ends with, before
+// its trailing space: bash/sh ($ #), zsh (%), PowerShell/cmd (>), starship (❯)
+const promptEndings = "$#%>❯"
+
+// resumeWatcher watches a resumed terminal's output for the shell prompt and
+// sends resume_ready once, when it appears or the timeout passes. Feed is
+// called from the PTY reader only.
+type resumeWatcher struct {
+	conn      *safeConn
+	sessionID string
+	line      string // Visible text of the unfinished output line
+	once      sync.Once
+	sent      atomic.Bool
+	timer     *time.Timer
+}
+
+// newResumeWatcher starts watching; after timeout resume_ready is sent anyway
+func newResumeWatcher(conn *safeConn, sessionID string, timeout time.Duration) *resumeWatcher {
+	w := &resumeWatcher{conn: conn, sessionID: sessionID}
+	w.timer = time.AfterFunc(timeout, func() { w.ready(ResumeReadyTimeout) })
+	return w
+}
+
+// Feed inspects output already sent to the client
+func (w *resumeWatcher) Feed(data []byte) {
+	if w.sent.Load() {
+		return
+	}
+
+	w.line = promptLine(w.line, data)
+	if looksLikePrompt(w.line) {
+		w.timer.Stop()
+		w.ready(ResumeReadyPrompt)
+	}
+}
+
+// Stop cancels the timeout when the terminal closes
+func (w *resumeWatcher) Stop() {
+	w.timer.Stop()
+}
+
+func (w *resumeWatcher) ready(reason string) {
+	w.once.Do(func() {
+		w.sent.Store(true)
+		w.conn.WriteJSON(map[string]interface{}{
+			"type":       MsgTypeResumeReady,
+			"session_id": w.sessionID,
+			"reason":     reason,
+		})
+	})
+}
+
+// promptLine adds output to line, the visible text of the unfinished output
+// line, and returns the text of the line unfinished now
+func promptLine(line string, data []byte) string {
+	text := line + StripANSI(string(data))
+	if i := strings.LastIndexByte(text, '\n'); i >= 0 {
+		text = text[i+1:]
+	}
+	if len(text) > promptTailBytes {
+		text = text[len(text)-promptTailBytes:]
+	}
+	return text
+}
+
+// looksLikePrompt reports whether an unfinished output line ends the way
+// shell prompts do: a prompt character followed by a space
+func looksLikePrompt(line string) bool {
+	if !strings.HasSuffix(line, " ") {
+		return false
+	}
+	trimmed := strings.TrimRight(line, " ")
+	last, _ := utf8.DecodeLastRuneInString(trimmed)
+	return trimmed != "" && strings.ContainsRune(promptEndings, last)
+}
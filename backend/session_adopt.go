@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// adoptedContainerName moves an external container name into the user's
+// cyh_<user>_ namespace, keeping names already inside it
+func adoptedContainerName(username, name string) string {
+	prefix := containerUserPrefix(username)
+	if strings.HasPrefix(name, prefix) {
+		return name
+	}
+	return prefix + "adopted_" + sanitizeContainerUser(name)
+}
+
+// handleSessionAdopt creates a session bound to an existing container:
+// POST /api/sessions/adopt {"container_id": "...", "name": "..."}
+//
+// Containers already in the caller's namespace can be adopted by their owner.
+// Containers created outside CYH can only be adopted by admins and are renamed
+// into the admin's namespace. Adopted containers are never reaped.
+func handleSessionAdopt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := ""
+	if cookie, err := r.Cookie("cyh_session"); err == nil {
+		if user, valid := authManager.ValidateSession(cookie.Value); valid {
+			username = user
+		}
+	}
+
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if !checkMaintenance(w, r) {
+		return
+	}
+	if !checkCreateRateLimit(w, r, username) {
+		return
+	}
+
+	var req struct {
+		ContainerID string `json:"container_id"`
+		Name        string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.ContainerID == "" {
+		http.Error(w, "container_id required", http.StatusBadRequest)
+		return
+	}
+
+	state, err := dockerMgr.InspectContainer(req.ContainerID)
+	if err != nil {
+		http.Error(w, "Container not found", http.StatusNotFound)
+		return
+	}
+
+	if state.Name == DockerContainerName {
+		http.Error(w, "The shared CYH container can't be adopted", http.StatusBadRequest)
+		return
+	}
+	if !strings.HasPrefix(state.Name, containerUserPrefix(username)) {
+		if strings.HasPrefix(state.Name, "cyh_") {
+			http.Error(w, "Container belongs to another user", http.StatusForbidden)
+			return
+		}
+		if !authManager.IsAdmin(username) {
+			http.Error(w, "Only admins can adopt containers created outside CYH", http.StatusForbidden)
+			return
+		}
+	}
+
+	if owner, err := sessionMgr.GetSessionByContainer(state.Name); err == nil {
+		http.Error(w, "Container is already bound to session "+owner.ID, http.StatusConflict)
+		return
+	}
+
+	containerName := adoptedContainerName(username, state.Name)
+	if containerName != state.Name {
+		if _, err := dockerMgr.InspectContainer(containerName); err == nil {
+			http.Error(w, "A container named "+containerName+" already exists", http.StatusConflict)
+			return
+		}
+		if err := dockerMgr.RenameContainer(state.ID, containerName); err != nil {
+			http.Error(w, "Failed to rename container: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logInfof("Container %s renamed to %s for adoption by %s", state.Name, containerName, username)
+	}
+
+	// Put the container back under its old name if no session ends up owning it
+	restoreName := func() {
+		if containerName != state.Name {
+			if err := dockerMgr.RenameContainer(state.ID, state.Name); err != nil {
+				logErrorf("Failed to restore container name %s: %v", state.Name, err)
+			}
+		}
+	}
+
+	if req.Name == "" {
+		req.Name = fitSessionName("Adopted " + state.Name)
+	}
+	session, err := sessionMgr.CreateSession(username, req.Name, "docker")
+	if errors.Is(err, ErrInvalidSessionName) {
+		restoreName()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err == ErrSessionNameTaken {
+		restoreName()
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		restoreName()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := sessionMgr.SetSessionContainerName(session.ID, containerName); err != nil {
+		sessionMgr.EndSession(session.ID, SessionEnd{Reason: EndReasonError})
+		restoreName()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	session.ContainerName = containerName
+
+	logInfof("Session %s adopted container %s (user: %s)", session.ID, containerName, username)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(session)
+}
@@ -2,10 +2,15 @@
 package main
 
 import (
+	"crypto/subtle"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Session API handlers
@@ -27,8 +32,15 @@ func handleSessions(w http.ResponseWriter, r *http.Request) {
 
 	switch r.Method {
 	case http.MethodGet:
-		// List sessions
-		sessions, err := sessionMgr.ListSessions(username)
+		// List sessions, optionally only those in one workspace
+		// (?workspace= with no value lists sessions in none)
+		var sessions []*TermSession
+		var err error
+		if query := r.URL.Query(); query.Has("workspace") {
+			sessions, err = sessionMgr.ListWorkspaceSessions(username, strings.TrimSpace(query.Get("workspace")))
+		} else {
+			sessions, err = sessionMgr.ListSessions(username)
+		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -46,28 +58,207 @@ func handleSessions(w http.ResponseWriter, r *http.Request) {
 
 	case http.MethodPost:
 		// Create new session
+		if !checkMaintenance(w, r) {
+			return
+		}
+
 		var req struct {
-			Name string `json:"name"`
-			Mode string `json:"mode"`
+			Name            string   `json:"name"`
+			Mode            string   `json:"mode"`
+			ContainerUser   string   `json:"container_user"`
+			TemplateID      string   `json:"template_id"`
+			Persist         bool     `json:"persist_container"`
+			Recording       string   `json:"recording_level"`
+			ScrubOutput     *bool    `json:"scrub_output"`
+			Workspace       *string  `json:"workspace"` // Defaults to the user's default workspace
+			PromptTheme     string   `json:"prompt_theme"`
+			StartupCommands []string `json:"startup_commands"`
+			ContainerFlags  []string `json:"container_flags"`
+			ClientID        string   `json:"client_id"` // Idempotency key when the header isn't set
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
 
+		// A retry with the same idempotency key gets the session the first
+		// request created, without counting against the rate limit
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			key = req.ClientID
+		}
+		if msg := checkIdempotencyKey(key); msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		createdID := ""
+		if key != "" {
+			existing, finish, err := claimCreationKey(username, key)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if existing != "" {
+				session, err := sessionMgr.GetSession(existing)
+				if err != nil {
+					http.Error(w, "The session created with this idempotency key no longer exists", http.StatusConflict)
+					return
+				}
+				if session.IsLive {
+					session.ViewerCount = liveHub.GetViewerCount(session.ID)
+				}
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(session)
+				return
+			}
+			defer func() { finish(createdID) }()
+		}
+
+		if !checkCreateRateLimit(w, r, username) {
+			return
+		}
+
 		if req.Name == "" {
 			req.Name = "Session " + GenerateID()[:6]
 		}
 		if req.Mode == "" {
 			req.Mode = "docker" // Default to docker as per user request
 		}
+		if req.ContainerUser == "root" {
+			req.ContainerUser = ""
+		}
+		if req.ContainerUser != "" {
+			if req.Mode != "docker" {
+				http.Error(w, "container_user is only supported in docker mode", http.StatusBadRequest)
+				return
+			}
+			if !IsValidContainerUser(req.ContainerUser) {
+				http.Error(w, "Invalid container user", http.StatusBadRequest)
+				return
+			}
+		}
+		if req.Recording != "" && !IsValidRecordingLevel(req.Recording) {
+			http.Error(w, "recording_level must be full, input_only or none", http.StatusBadRequest)
+			return
+		}
+		if req.TemplateID != "" {
+			if req.Mode != "docker" {
+				http.Error(w, "template_id is only supported in docker mode", http.StatusBadRequest)
+				return
+			}
+			tmpl, err := sessionMgr.GetTemplate(req.TemplateID)
+			if err != nil || !canUseTemplate(tmpl, username) {
+				http.Error(w, "Template not found", http.StatusBadRequest)
+				return
+			}
+		}
+		if msg := checkPromptTheme(req.PromptTheme); msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		if msg := checkStartupCommands(req.StartupCommands); msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+		if len(req.ContainerFlags) > 0 {
+			if req.Mode != "docker" {
+				http.Error(w, "container_flags is only supported in docker mode", http.StatusBadRequest)
+				return
+			}
+			if msg := checkContainerFlags(req.ContainerFlags); msg != "" {
+				http.Error(w, msg, http.StatusForbidden)
+				return
+			}
+		}
+		workspace := ""
+		if req.Workspace != nil {
+			var msg string
+			if workspace, msg = resolveSessionWorkspace(username, *req.Workspace); msg != "" {
+				http.Error(w, msg, http.StatusBadRequest)
+				return
+			}
+		}
 
 		session, err := sessionMgr.CreateSession(username, req.Name, req.Mode)
+		if errors.Is(err, ErrInvalidSessionName) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err == ErrSessionNameTaken {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
+		if req.ContainerUser != "" {
+			if err := sessionMgr.SetSessionContainerUser(session.ID, req.ContainerUser); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			session.ContainerUser = req.ContainerUser
+		}
+		if len(req.ContainerFlags) > 0 {
+			if err := sessionMgr.SetSessionContainerFlags(session.ID, req.ContainerFlags); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			session.ContainerFlags = req.ContainerFlags
+		}
+		if req.Persist && req.Mode == "docker" {
+			if err := sessionMgr.SetSessionPersistContainer(session.ID, true); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			session.PersistContainer = true
+		}
+		if req.TemplateID != "" {
+			if err := sessionMgr.SetSessionTemplate(session.ID, req.TemplateID); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			session.TemplateID = req.TemplateID
+		}
+		if req.Recording != "" && req.Recording != session.RecordingLevel {
+			if err := sessionMgr.SetSessionRecordingLevel(session.ID, req.Recording); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			session.RecordingLevel = req.Recording
+		}
+		if req.ScrubOutput != nil && *req.ScrubOutput != session.ScrubOutput {
+			if err := sessionMgr.SetSessionScrubOutput(session.ID, *req.ScrubOutput); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			session.ScrubOutput = *req.ScrubOutput
+		}
+		if req.Workspace != nil && workspace != session.Workspace {
+			if err := sessionMgr.SetSessionWorkspace(session.ID, username, workspace); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			session.Workspace = workspace
+		}
+		if req.PromptTheme != "" {
+			if err := sessionMgr.SetSessionPromptTheme(session.ID, username, req.PromptTheme); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			session.PromptTheme = req.PromptTheme
+		}
+		if len(req.StartupCommands) > 0 {
+			if err := sessionMgr.SetSessionStartupCommands(session.ID, username, req.StartupCommands); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			session.StartupCommands = req.StartupCommands
+		}
+		createdID = session.ID
+
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(session)
 
@@ -111,8 +302,33 @@ func handleSessionByID(w http.ResponseWriter, r *http.Request) {
 			handleSessionPermission(w, r, sessionID, username)
 			return
 		case "viewers":
+			if len(parts) > 2 && parts[2] == "stats" {
+				handleSessionViewerStats(w, r, sessionID, username)
+				return
+			}
 			handleSessionViewers(w, r, sessionID, username)
 			return
+		case "persist":
+			handleSessionPersist(w, r, sessionID, username)
+			return
+		case "scrub":
+			handleSessionScrub(w, r, sessionID, username)
+			return
+		case "output":
+			handleSessionOutput(w, r, sessionID, username)
+			return
+		case "search":
+			handleSessionSearch(w, r, sessionID, username)
+			return
+		case "stats":
+			handleSessionStats(w, r, sessionID, username)
+			return
+		case "tools":
+			handleSessionTools(w, r, sessionID, username)
+			return
+		case "viewer-analytics":
+			handleSessionViewerAnalytics(w, r, sessionID, username)
+			return
 		}
 	}
 
@@ -152,32 +368,106 @@ func handleSessionByID(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
 
 	case http.MethodPatch:
-		// Rename session
+		// Rename session, update its notes, pin it, move it to a workspace
+		// and/or change its prompt theme or startup commands
 		if username == "" {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
 		var req struct {
-			Name string `json:"name"`
+			Name            string   `json:"name"`
+			Notes           *string  `json:"notes"`
+			IsPinned        *bool    `json:"is_pinned"`
+			Workspace       *string  `json:"workspace"`        // Empty moves it out of its workspace
+			PromptTheme     *string  `json:"prompt_theme"`     // Empty restores the default prompt
+			StartupCommands []string `json:"startup_commands"` // [] clears them
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			http.Error(w, "Invalid request body", http.StatusBadRequest)
 			return
 		}
 
-		if req.Name == "" {
-			http.Error(w, "Name is required", http.StatusBadRequest)
+		if req.Name == "" && req.Notes == nil && req.IsPinned == nil && req.Workspace == nil && req.PromptTheme == nil && req.StartupCommands == nil {
+			http.Error(w, "Name, notes, is_pinned, workspace, prompt_theme or startup_commands is required", http.StatusBadRequest)
 			return
 		}
-
-		if err := sessionMgr.RenameSession(sessionID, username, req.Name); err != nil {
-			http.Error(w, err.Error(), http.StatusNotFound)
+		if req.Notes != nil && len(*req.Notes) > MaxSessionNotesLength {
+			http.Error(w, "Notes must be at most "+strconv.Itoa(MaxSessionNotesLength)+" bytes", http.StatusBadRequest)
+			return
+		}
+		if req.PromptTheme != nil {
+			if msg := checkPromptTheme(*req.PromptTheme); msg != "" {
+				http.Error(w, msg, http.StatusBadRequest)
+				return
+			}
+		}
+		if msg := checkStartupCommands(req.StartupCommands); msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
 			return
 		}
 
+		resp := map[string]interface{}{"status": "updated"}
+		if req.Name != "" {
+			name, err := sessionMgr.RenameSession(sessionID, username, req.Name)
+			if errors.Is(err, ErrInvalidSessionName) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err == ErrSessionNameTaken {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			resp["status"] = "renamed"
+			resp["name"] = name
+		}
+		if req.Notes != nil {
+			if err := sessionMgr.SetSessionNotes(sessionID, username, *req.Notes); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			resp["notes"] = *req.Notes
+		}
+		if req.IsPinned != nil {
+			if err := sessionMgr.SetSessionPinned(sessionID, username, *req.IsPinned); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			resp["is_pinned"] = *req.IsPinned
+		}
+		if req.Workspace != nil {
+			workspace, msg := resolveSessionWorkspace(username, *req.Workspace)
+			if msg != "" {
+				http.Error(w, msg, http.StatusBadRequest)
+				return
+			}
+			if err := sessionMgr.SetSessionWorkspace(sessionID, username, workspace); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			resp["workspace"] = workspace
+		}
+		if req.PromptTheme != nil {
+			if err := sessionMgr.SetSessionPromptTheme(sessionID, username, *req.PromptTheme); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			resp["prompt_theme"] = *req.PromptTheme
+		}
+		if req.StartupCommands != nil {
+			if err := sessionMgr.SetSessionStartupCommands(sessionID, username, req.StartupCommands); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			resp["startup_commands"] = req.StartupCommands
+		}
+
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]string{"status": "renamed", "name": req.Name})
+		json.NewEncoder(w).Encode(resp)
 
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -252,14 +542,21 @@ func handleSessionShare(w http.ResponseWriter, r *http.Request, sessionID, usern
 	}
 
 	if req.Enable {
-		permMode := PermissionViewOnly
+		permMode := session.AllowedModes[0]
 		switch req.Mode {
+		case "view_only":
+			permMode = PermissionViewOnly
 		case "shared_control":
 			permMode = PermissionSharedControl
 		case "instructor":
 			permMode = PermissionInstructor
 		}
 
+		if !serverConfig.IsShareModeAllowed(session.Mode, permMode) {
+			http.Error(w, "Permission mode "+string(permMode)+" is not allowed for "+session.Mode+" sessions", http.StatusForbidden)
+			return
+		}
+
 		shareToken, err := sessionMgr.StartLiveSession(sessionID, permMode)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -268,6 +565,7 @@ func handleSessionShare(w http.ResponseWriter, r *http.Request, sessionID, usern
 
 		// Ensure LiveHub has correct mode (Fix for input not working)
 		liveHub.UpdatePermissionMode(sessionID, permMode)
+		markOwnerActive(sessionID)
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]interface{}{
@@ -282,6 +580,9 @@ func handleSessionShare(w http.ResponseWriter, r *http.Request, sessionID, usern
 			return
 		}
 
+		// Disconnect current viewers so sharing actually stops
+		liveHub.CloseRoom(sessionID, SessionEndedSharingStopped)
+
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]string{"status": "stopped"})
 	}
@@ -310,7 +611,8 @@ func handleSessionEnd(w http.ResponseWriter, r *http.Request, sessionID, usernam
 		return
 	}
 
-	if err := sessionMgr.EndSession(sessionID); err != nil {
+	// Open terminals and live viewers are told before they are closed
+	if err := endSession(sessionID, SessionEndedByOwner); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -319,6 +621,114 @@ func handleSessionEnd(w http.ResponseWriter, r *http.Request, sessionID, usernam
 	json.NewEncoder(w).Encode(map[string]string{"status": "ended"})
 }
 
+// handleSessionPersist toggles whether a session's container is kept after it ends
+func handleSessionPersist(w http.ResponseWriter, r *http.Request, sessionID, username string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	session, err := sessionMgr.GetSession(sessionID)
+	if err != nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	if session.User != username {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		Persist bool `json:"persist_container"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := sessionMgr.SetSessionPersistContainer(sessionID, req.Persist); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":            "updated",
+		"persist_container": req.Persist,
+	})
+}
+
+// handleSessionScrub turns secret scrubbing of the recorded output on or off
+func handleSessionScrub(w http.ResponseWriter, r *http.Request, sessionID, username string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	session, err := sessionMgr.GetSession(sessionID)
+	if err != nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	if session.User != username {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		ScrubOutput bool `json:"scrub_output"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := sessionMgr.SetSessionScrubOutput(sessionID, req.ScrubOutput); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":       "updated",
+		"scrub_output": req.ScrubOutput,
+	})
+}
+
+// checkSessionReadAccess lets the logged-in owner read a session's
+// recording, and others only with the session's share token (?token=) while
+// it is live: knowing a session id isn't enough. Otherwise it writes a 401
+// or 403 and returns false.
+func checkSessionReadAccess(w http.ResponseWriter, r *http.Request, session *TermSession, username string) bool {
+	if username != "" && session.User == username {
+		return true
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" && username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	if token == "" || !session.IsLive || session.ShareToken == "" ||
+		subtle.ConstantTimeCompare([]byte(token), []byte(session.ShareToken)) != 1 {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
 // handleSessionData returns full session data with events
 func handleSessionData(w http.ResponseWriter, r *http.Request, sessionID, username string) {
 	if r.Method != http.MethodGet {
@@ -332,25 +742,176 @@ func handleSessionData(w http.ResponseWriter, r *http.Request, sessionID, userna
 		return
 	}
 
-	// Check access: owner or via share token
-	if session.User != username {
-		// Check if session is shared
-		if !session.IsLive {
-			http.Error(w, "Access denied", http.StatusForbidden)
+	if !checkSessionReadAccess(w, r, session, username) {
+		return
+	}
+
+	// Relative timestamps (default) suit the player; ?absolute=true returns
+	// wall-clock times for correlating with external logs
+	opts := SessionDataOptions{
+		Absolute: r.URL.Query().Get("absolute") == "true",
+	}
+
+	// ?max_gap=<ms> compresses idle stretches for a watchable replay
+	if v := r.URL.Query().Get("max_gap"); v != "" {
+		maxGap, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || maxGap <= 0 {
+			http.Error(w, "max_gap must be a positive number of milliseconds", http.StatusBadRequest)
 			return
 		}
+		opts.MaxGap = maxGap
 	}
 
-	data, err := sessionMgr.GetSessionData(sessionID)
+	// Accept: application/x-ndjson streams one JSON object per line: the
+	// session metadata, then each event as it is read
+	if strings.Contains(r.Header.Get("Accept"), "application/x-ndjson") {
+		streamSessionData(w, r, sessionID, opts)
+		return
+	}
+
+	data, err := sessionMgr.GetSessionData(sessionID, opts)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	// ?plain=true drops colors from output for low-bandwidth replay
+	if r.URL.Query().Get("plain") == "true" {
+		data.Events = stripRecordingSGR(data.Events)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(data)
 }
 
+// ndjsonFlushEvery is how many streamed events are buffered between flushes
+const ndjsonFlushEvery = 256
+
+// streamSessionData writes session data as NDJSON, flushing as it goes
+// (where the connection supports it) so a player can render long recordings
+// before the last event is read
+func streamSessionData(w http.ResponseWriter, r *http.Request, sessionID string, opts SessionDataOptions) {
+	// Large recordings take longer than the server's write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	enc := json.NewEncoder(w)
+	plain := r.URL.Query().Get("plain") == "true"
+	stripper := paneSGRStripper{}
+	sent := 0
+	var lastTimestamp int64
+
+	start := func(header *SessionData) error {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("X-Accel-Buffering", "no") // Disable nginx response buffering
+		if err := enc.Encode(header); err != nil {
+			return err
+		}
+		rc.Flush()
+		return nil
+	}
+
+	emit := func(e *SessionEvent) error {
+		if plain && e.Type == "output" {
+			e.Data = stripper.Strip(e)
+		}
+		lastTimestamp = e.Timestamp
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+		if sent++; sent%ndjsonFlushEvery == 0 {
+			rc.Flush()
+		}
+		return nil
+	}
+
+	if err := sessionMgr.StreamSessionData(sessionID, opts, start, emit); err != nil {
+		// Once the metadata line is out the status can't change; the
+		// client sees a truncated stream
+		if w.Header().Get("Content-Type") == "" {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logWarnf("Streaming session %s stopped: %v", sessionID, err)
+		return
+	}
+	// Sequences the recording's end cut off
+	for _, e := range stripper.Flush(lastTimestamp) {
+		enc.Encode(e)
+	}
+	rc.Flush()
+}
+
+// handleSessionOutput returns recorded output for a time range as plain text:
+// GET /api/sessions/{id}/output?from=<ms>&to=<ms>[&absolute=true][&strip=true]
+func handleSessionOutput(w http.ResponseWriter, r *http.Request, sessionID, username string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	session, err := sessionMgr.GetSession(sessionID)
+	if err != nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	if session.User != username {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	// Range bounds use the same timestamps as /data (relative unless absolute=true)
+	query := r.URL.Query()
+	from, to := int64(0), int64(math.MaxInt64)
+	if v := query.Get("from"); v != "" {
+		if from, err = strconv.ParseInt(v, 10, 64); err != nil {
+			http.Error(w, "Invalid from", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("to"); v != "" {
+		if to, err = strconv.ParseInt(v, 10, 64); err != nil {
+			http.Error(w, "Invalid to", http.StatusBadRequest)
+			return
+		}
+	}
+	if to < from {
+		http.Error(w, "to must not be before from", http.StatusBadRequest)
+		return
+	}
+
+	data, err := sessionMgr.GetSessionData(sessionID, SessionDataOptions{
+		Absolute: query.Get("absolute") == "true",
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var output strings.Builder
+	for _, e := range data.Events {
+		if e.Type == "output" && e.Pane == "" && e.Timestamp >= from && e.Timestamp <= to {
+			output.WriteString(e.Data)
+		}
+	}
+
+	text := output.String()
+	if query.Get("strip") == "true" {
+		text = StripANSI(text)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(text))
+}
+
 // handleSessionPermission handles permission mode changes and grants
 func handleSessionPermission(w http.ResponseWriter, r *http.Request, sessionID, username string) {
 	if r.Method != http.MethodPost {
@@ -383,6 +944,7 @@ func handleSessionPermission(w http.ResponseWriter, r *http.Request, sessionID,
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
+	markOwnerActive(sessionID)
 
 	switch req.Action {
 	case "set_mode":
@@ -399,6 +961,11 @@ func handleSessionPermission(w http.ResponseWriter, r *http.Request, sessionID,
 			return
 		}
 
+		if !serverConfig.IsShareModeAllowed(session.Mode, permMode) {
+			http.Error(w, "Permission mode "+req.Mode+" is not allowed for "+session.Mode+" sessions", http.StatusForbidden)
+			return
+		}
+
 		sessionMgr.UpdatePermissionMode(sessionID, permMode)
 		liveHub.UpdatePermissionMode(sessionID, permMode)
 
@@ -410,6 +977,10 @@ func handleSessionPermission(w http.ResponseWriter, r *http.Request, sessionID,
 			http.Error(w, "Username required", http.StatusBadRequest)
 			return
 		}
+		if !serverConfig.CanGrantWrite(session.Mode) {
+			http.Error(w, "Viewers may not type in "+session.Mode+" sessions", http.StatusForbidden)
+			return
+		}
 		liveHub.GrantPermission(sessionID, req.Username)
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]string{"status": "granted"})
@@ -457,9 +1028,10 @@ func handleSessionViewers(w http.ResponseWriter, r *http.Request, sessionID, use
 
 // handleJoinLiveSession handles joining a live session via share token
 func handleJoinLiveSession(w http.ResponseWriter, r *http.Request) {
-	// Get share token from path: /api/live/{token}
+	// Get share token from path: /api/live/{token} or /api/live/{token}/stream
 	path := strings.TrimPrefix(r.URL.Path, "/api/live/")
-	shareToken := strings.Split(path, "/")[0]
+	parts := strings.Split(path, "/")
+	shareToken := parts[0]
 
 	if shareToken == "" {
 		http.Error(w, "Share token required", http.StatusBadRequest)
@@ -477,6 +1049,11 @@ func handleJoinLiveSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if len(parts) > 1 && parts[1] == "stream" {
+		handleLiveStream(w, r, session)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"session_id":      session.ID,
@@ -510,19 +1087,40 @@ func handleLiveWebSocket(w http.ResponseWriter, r *http.Request) {
 	// Ensure room exists with correct mode (Fix for race condition)
 	liveHub.UpdatePermissionMode(session.ID, PermissionMode(session.PermissionMode))
 
-	// Get viewer username
-	username := "guest_" + GenerateID()[:6]
+	// Get viewer username: the login, else the guest identity a viewer_token
+	// was issued for (reconnecting guests keep their name), else a new guest
+	query := r.URL.Query()
+	username := ""
 	if cookie, err := r.Cookie("cyh_session"); err == nil {
 		if user, valid := authManager.ValidateSession(cookie.Value); valid {
 			username = user
 		}
 	}
 
+	// Cap open viewer sockets per guest IP or user before upgrading; the
+	// slot is held until the reader sees the socket close
+	releaseConn, ok := acquireWSConn(w, r, username)
+	if !ok {
+		return
+	}
+
+	// Logged-in viewers, the owner included, reconnect with their cookie
+	viewerToken := ""
+	if username == "" {
+		if tokenUser, ok := liveHub.ResolveViewerToken(session.ID, query.Get("viewer_token")); ok {
+			username, viewerToken = tokenUser, query.Get("viewer_token")
+		} else {
+			username = guestViewerPrefix + GenerateID()[:6]
+			viewerToken = liveHub.IssueViewerToken(session.ID, username)
+		}
+	}
+
 	// Check if this is the owner
 	isOwner := username == session.User
 
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
+		releaseConn()
 		return
 	}
 
@@ -533,11 +1131,24 @@ func handleLiveWebSocket(w http.ResponseWriter, r *http.Request) {
 		IsOwner:   isOwner,
 		Hub:       liveHub,
 		send:      make(chan []byte, 2048),
+		plain:     query.Get("plain") == "true", // Low-bandwidth mode
+		token:     viewerToken,
+	}
+
+	// Resume from the last output seen (see live_resume.go)
+	if v := query.Get("last_seq"); v != "" {
+		if lastSeq, err := strconv.ParseUint(v, 10, 64); err == nil {
+			viewer.resume = true
+			viewer.lastSeq = lastSeq
+		}
 	}
 
 	liveHub.register <- viewer
 
 	// Start reader and writer goroutines
 	go viewer.WritePump()
-	go viewer.ReadPump(nil) // No input channel for viewers (handled via permission)
+	go func() {
+		defer releaseConn()
+		viewer.ReadPump(nil) // No input channel for viewers (handled via permission)
+	}()
 }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckSessionReadAccess(t *testing.T) {
+	const shareToken = "0123456789abcdef0123456789abcdef"
+
+	tests := []struct {
+		name     string
+		username string
+		token    string
+		live     bool
+		allowed  bool
+		status   int
+	}{
+		{name: "owner", username: "alice", live: true, allowed: true},
+		{name: "owner after the session ended", username: "alice", allowed: true},
+		{name: "correct token while live", token: shareToken, live: true, allowed: true},
+		{name: "correct token while live, other user", username: "bob", token: shareToken, live: true, allowed: true},
+		{name: "correct token after the session ended", token: shareToken, status: http.StatusForbidden},
+		{name: "wrong token", token: "not-the-token", live: true, status: http.StatusForbidden},
+		{name: "other user without a token", username: "bob", live: true, status: http.StatusForbidden},
+		{name: "no credentials", live: true, status: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := &TermSession{ID: "sess1", User: "alice", IsLive: tt.live, ShareToken: shareToken}
+			target := "/api/sessions/sess1/data"
+			if tt.token != "" {
+				target += "?token=" + tt.token
+			}
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, target, nil)
+
+			if got := checkSessionReadAccess(w, r, session, tt.username); got != tt.allowed {
+				t.Fatalf("checkSessionReadAccess = %v, want %v", got, tt.allowed)
+			}
+			if !tt.allowed && w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestCheckSessionReadAccessWithoutShareToken(t *testing.T) {
+	// A live session that was never shared can't be read with any token
+	session := &TermSession{ID: "sess1", User: "alice", IsLive: true}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/api/sessions/sess1/data?token=x", nil)
+
+	if checkSessionReadAccess(w, r, session, "") {
+		t.Fatal("read allowed for a session without a share token")
+	}
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"path"
+	"strings"
+	"time"
+)
+
+// maxAutoNameArg caps the argument shown in an automatic session name
+const maxAutoNameArg = 32
+
+// autoNameSkipCommands don't say what a session is about, so naming waits
+// for a later command
+var autoNameSkipCommands = map[string]bool{
+	"cd": true, "ls": true, "ll": true, "pwd": true, "clear": true, "reset": true,
+	"exit": true, "logout": true, "history": true, "whoami": true, "id": true,
+	"echo": true, "true": true, "false": true,
+}
+
+// autoNamePrefixes run the command that follows them
+var autoNamePrefixes = map[string]bool{
+	"sudo": true, "env": true, "time": true, "nohup": true, "exec": true,
+}
+
+// commandSessionName builds a session name from a command line: the program
+// and its first argument unless that is an option, then the session's start
+// time, e.g. "nmap 10.0.0.5 — 15:04". It reports false for commands that
+// don't describe the session.
+func commandSessionName(command string, createdAt time.Time) (string, bool) {
+	fields := strings.Fields(command)
+
+	// Skip prefixes like sudo and VAR=value assignments
+	for len(fields) > 0 && (autoNamePrefixes[fields[0]] || strings.Contains(fields[0], "=")) {
+		fields = fields[1:]
+	}
+	if len(fields) == 0 {
+		return "", false
+	}
+
+	program := path.Base(fields[0])
+	if autoNameSkipCommands[program] || strings.HasPrefix(program, "#") {
+		return "", false
+	}
+
+	// An argument after an option may be the option's value (a password,
+	// say), so only one before any option is shown
+	name := program
+	if len(fields) > 1 && !strings.HasPrefix(fields[1], "-") {
+		arg := fields[1]
+		if len(arg) > maxAutoNameArg {
+			arg = strings.ToValidUTF8(arg[:maxAutoNameArg], "") + "…"
+		}
+		name += " " + arg
+	}
+	return name + " — " + createdAt.Format("15:04"), true
+}
+
+// sessionAutoNamer renames a new session after the first command that says
+// what it is about, unless the session was renamed in the meantime. It
+// renames at most once.
+type sessionAutoNamer struct {
+	sessionID     string
+	user          string
+	generatedName string // The name the session was created with
+	createdAt     time.Time
+	done          bool
+}
+
+// newSessionAutoNamer returns a namer for a session the terminal just
+// created, or nil when the user hasn't turned automatic naming on
+func newSessionAutoNamer(session *TermSession, prefs UserPreferences) *sessionAutoNamer {
+	if !prefs.AutoNameSessions {
+		return nil
+	}
+	return &sessionAutoNamer{
+		sessionID:     session.ID,
+		user:          session.User,
+		generatedName: session.Name,
+		createdAt:     session.CreatedAt,
+	}
+}
+
+// Feed looks at a submitted command. Only the input goroutine calls it.
+func (n *sessionAutoNamer) Feed(command string) {
+	if n == nil || n.done {
+		return
+	}
+	name, ok := commandSessionName(command, n.createdAt)
+	if !ok {
+		return
+	}
+	n.done = true
+
+	go func() {
+		renamed, err := sessionMgr.RenameGeneratedSession(n.sessionID, n.user, n.generatedName, name)
+		if err != nil {
+			logWarnf("Failed to name session %s after its first command: %v", n.sessionID, err)
+			return
+		}
+		if !renamed {
+			logDebugf("Session %s was renamed by its owner, keeping the name", n.sessionID)
+		}
+	}()
+}
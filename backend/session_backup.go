@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backup files are named sessions-<UTC time>.db, so sorting by name sorts by age
+const (
+	backupFilePrefix     = "sessions-"
+	backupFileSuffix     = ".db"
+	backupFileTimeFormat = "20060102-150405"
+)
+
+// backupMu keeps a scheduled and a requested backup from pruning each other's files
+var backupMu sync.Mutex
+
+// BackupResult describes a backup written by Backup
+type BackupResult struct {
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+	Pruned    []string  `json:"pruned,omitempty"` // Older backups removed to keep CYH_BACKUP_KEEP
+}
+
+// Backup writes a consistent copy of the sessions database into dir with
+// VACUUM INTO, which reads one snapshot while sessions keep recording, then
+// removes all but the newest keep backups (0 keeps every backup). Events of
+// running sessions still in file-backed logs (CYH_RECORDING_BACKEND=file)
+// aren't in the database until their sessions end.
+func (sm *SessionManager) Backup(dir string, keep int) (*BackupResult, error) {
+	backupMu.Lock()
+	defer backupMu.Unlock()
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("create backup directory: %w", err)
+	}
+
+	// VACUUM INTO refuses to overwrite, so a second backup within the same
+	// second fails instead of replacing the first
+	now := time.Now().UTC()
+	path := filepath.Join(dir, backupFilePrefix+now.Format(backupFileTimeFormat)+backupFileSuffix)
+	if _, err := sm.db.Exec(`VACUUM INTO ?`, path); err != nil {
+		return nil, fmt.Errorf("vacuum into %s: %w", path, err)
+	}
+
+	// Backups hold everything the database does, recordings included
+	os.Chmod(path, 0600)
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	result := &BackupResult{Path: path, Size: info.Size(), CreatedAt: now}
+
+	if keep > 0 {
+		result.Pruned = pruneBackups(dir, keep)
+	}
+	return result, nil
+}
+
+// pruneBackups removes the oldest backups in dir beyond keep, returning the
+// removed paths. Files not named like a backup are left alone.
+func pruneBackups(dir string, keep int) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		logWarnf("Failed to list backups in %s: %v", dir, err)
+		return nil
+	}
+
+	var backups []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.Type().IsRegular() && strings.HasPrefix(name, backupFilePrefix) && strings.HasSuffix(name, backupFileSuffix) {
+			backups = append(backups, name)
+		}
+	}
+	if len(backups) <= keep {
+		return nil
+	}
+	sort.Strings(backups)
+
+	var pruned []string
+	for _, name := range backups[:len(backups)-keep] {
+		path := filepath.Join(dir, name)
+		if err := os.Remove(path); err != nil {
+			logWarnf("Failed to remove old backup %s: %v", path, err)
+			continue
+		}
+		pruned = append(pruned, path)
+	}
+	return pruned
+}
+
+// backupLoop backs up the sessions database every CYH_BACKUP_INTERVAL
+func (sm *SessionManager) backupLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		result, err := sm.Backup(serverConfig.BackupDir, serverConfig.BackupKeep)
+		if err != nil {
+			logErrorf("Scheduled sessions database backup failed: %v", err)
+			continue
+		}
+		logInfof("Backed up sessions database to %s (%d bytes, %d old backup(s) removed)", result.Path, result.Size, len(result.Pruned))
+	}
+}
+
+// handleAdminBackup backs up the sessions database on demand: POST /api/admin/backup
+func handleAdminBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	result, err := sessionMgr.Backup(serverConfig.BackupDir, serverConfig.BackupKeep)
+	if err != nil {
+		logErrorf("Sessions database backup failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logInfof("Backed up sessions database to %s on request", result.Path)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
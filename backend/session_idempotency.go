@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	// MaxIdempotencyKeyLength caps Idempotency-Key / client_id
+	MaxIdempotencyKeyLength = 200
+
+	// idempotencyKeyTTL is how long a retried POST /api/sessions with the
+	// same key returns the session the first one created
+	idempotencyKeyTTL = 10 * time.Minute
+
+	// idempotencyWaitTimeout is how long a retry waits for the first request
+	// with its key to finish
+	idempotencyWaitTimeout = 10 * time.Second
+)
+
+// ErrIdempotencyKeyInUse is returned while another request with the same key
+// is still creating its session
+var ErrIdempotencyKeyInUse = errors.New("a request with this idempotency key is still in progress")
+
+// creationKey is a key's session, or the request still creating it
+type creationKey struct {
+	sessionID string        // "" while pending, or if the request failed
+	ready     chan struct{} // Closed when the request that claimed the key finishes
+	expiresAt time.Time
+}
+
+// creationKeys maps "<user>\x00<key>" to recent session creations, so a client
+// retrying POST /api/sessions after a dropped response doesn't create
+// duplicates. Keys are per user and kept in memory only.
+var creationKeys = struct {
+	sync.Mutex
+	entries map[string]*creationKey
+}{entries: make(map[string]*creationKey)}
+
+// checkIdempotencyKey validates a client's idempotency key. It returns a
+// message for the client when the key is invalid.
+func checkIdempotencyKey(key string) string {
+	if len(key) > MaxIdempotencyKeyLength {
+		return "Idempotency-Key must be at most " + strconv.Itoa(MaxIdempotencyKeyLength) + " bytes"
+	}
+	if strings.IndexFunc(key, unicode.IsControl) >= 0 {
+		return "Idempotency-Key can't contain control characters"
+	}
+	return ""
+}
+
+// claimCreationKey returns the session a user's key already created, or
+// claims the key for a new session. The claimer must call finish with the
+// new session's ID, or "" if creating it failed so a retry may try again.
+// While another request holds the key it waits for that one to finish.
+func claimCreationKey(user, key string) (existing string, finish func(sessionID string), err error) {
+	id := user + "\x00" + key
+	deadline := time.After(idempotencyWaitTimeout)
+
+	for {
+		now := time.Now()
+		creationKeys.Lock()
+		for k, entry := range creationKeys.entries {
+			if entry.sessionID != "" && now.After(entry.expiresAt) {
+				delete(creationKeys.entries, k)
+			}
+		}
+
+		entry, ok := creationKeys.entries[id]
+		if ok && entry.sessionID != "" {
+			creationKeys.Unlock()
+			return entry.sessionID, nil, nil
+		}
+		if !ok {
+			entry = &creationKey{ready: make(chan struct{})}
+			creationKeys.entries[id] = entry
+			creationKeys.Unlock()
+
+			return "", func(sessionID string) {
+				creationKeys.Lock()
+				if sessionID == "" {
+					delete(creationKeys.entries, id)
+				} else {
+					entry.sessionID = sessionID
+					entry.expiresAt = time.Now().Add(idempotencyKeyTTL)
+				}
+				creationKeys.Unlock()
+				close(entry.ready)
+			}, nil
+		}
+		creationKeys.Unlock()
+
+		// Another request holds the key
+		select {
+		case <-entry.ready:
+		case <-deadline:
+			return "", nil, ErrIdempotencyKeyInUse
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// sessionIOFlushInterval is how often counted terminal bytes are written to
+// term_sessions, so the PTY loops never wait on the database
+const sessionIOFlushInterval = 10 * time.Second
+
+// ioCounts is the terminal input and output of a session
+type ioCounts struct {
+	input, output int64
+}
+
+// sessionIO accumulates byte counts per session between flushes
+type sessionIO struct {
+	mu      sync.Mutex
+	pending map[string]*ioCounts
+}
+
+// CountIO adds bytes written to (input) and read from (output) a session's
+// terminal. The counts reach the database on the next flush.
+func (sm *SessionManager) CountIO(sessionID string, input, output int) {
+	sm.io.mu.Lock()
+	defer sm.io.mu.Unlock()
+
+	counts := sm.io.pending[sessionID]
+	if counts == nil {
+		counts = &ioCounts{}
+		sm.io.pending[sessionID] = counts
+	}
+	counts.input += int64(input)
+	counts.output += int64(output)
+}
+
+// takePendingIO removes and returns the counts not yet written for a session
+func (sm *SessionManager) takePendingIO(sessionID string) ioCounts {
+	sm.io.mu.Lock()
+	defer sm.io.mu.Unlock()
+
+	counts := sm.io.pending[sessionID]
+	delete(sm.io.pending, sessionID)
+	if counts == nil {
+		return ioCounts{}
+	}
+	return *counts
+}
+
+// pendingIO returns the counts not yet written for a session
+func (sm *SessionManager) pendingIO(sessionID string) ioCounts {
+	sm.io.mu.Lock()
+	defer sm.io.mu.Unlock()
+
+	if counts := sm.io.pending[sessionID]; counts != nil {
+		return *counts
+	}
+	return ioCounts{}
+}
+
+// FlushIO writes every session's pending byte counts
+func (sm *SessionManager) FlushIO() {
+	sm.io.mu.Lock()
+	pending := sm.io.pending
+	sm.io.pending = make(map[string]*ioCounts)
+	sm.io.mu.Unlock()
+
+	for id, counts := range pending {
+		_, err := sm.db.Exec(`
+			UPDATE term_sessions SET input_bytes = input_bytes + ?, output_bytes = output_bytes + ?
+			WHERE id = ?
+		`, counts.input, counts.output, id)
+		if err != nil {
+			logErrorf("Failed to save byte counts for session %s: %v", id, err)
+		}
+	}
+}
+
+// flushIOLoop writes pending byte counts every sessionIOFlushInterval
+func (sm *SessionManager) flushIOLoop() {
+	ticker := time.NewTicker(sessionIOFlushInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		sm.FlushIO()
+	}
+}
+
+// SessionStats summarizes a session's size without scanning its recording
+type SessionStats struct {
+	SessionID   string `json:"session_id"`
+	Active      bool   `json:"active"`
+	Duration    int64  `json:"duration"` // ms; running time so far while active
+	InputBytes  int64  `json:"input_bytes"`
+	OutputBytes int64  `json:"output_bytes"`
+}
+
+// GetSessionStats returns a session's byte counts including those not yet flushed
+func (sm *SessionManager) GetSessionStats(session *TermSession) SessionStats {
+	pending := sm.pendingIO(session.ID)
+	stats := SessionStats{
+		SessionID:   session.ID,
+		Duration:    session.Duration,
+		InputBytes:  session.InputBytes + pending.input,
+		OutputBytes: session.OutputBytes + pending.output,
+	}
+	if active := sm.GetActiveSession(session.ID); active != nil {
+		stats.Active = true
+		stats.Duration = time.Since(active.StartTime).Milliseconds()
+	}
+	return stats
+}
+
+// handleSessionStats returns a session's input and output byte counts:
+// GET /api/sessions/{id}/stats
+func handleSessionStats(w http.ResponseWriter, r *http.Request, sessionID, username string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, err := sessionMgr.GetSession(sessionID)
+	if err != nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	if session.User != username {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessionMgr.GetSessionStats(session))
+}
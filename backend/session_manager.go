@@ -5,10 +5,15 @@ import (
 	"crypto/rand"
 	"database/sql"
 	"encoding/hex"
-	"log"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -22,39 +27,107 @@ const (
 	PermissionInstructor    PermissionMode = "instructor"
 )
 
+// defaultShareModes are the permission modes allowed unless
+// CYH_SHARE_MODES_LOCAL or CYH_SHARE_MODES_DOCKER restrict them
+const defaultShareModes = "view_only,shared_control,instructor"
+
+// Session name conflict policies (CYH_SESSION_NAME_CONFLICT)
+const (
+	SessionNamesAllow  = "allow"  // Duplicate names are allowed
+	SessionNamesReject = "reject" // Creating or renaming to a taken name fails
+	SessionNamesSuffix = "suffix" // A taken name gets " (2)", " (3)", ... appended
+)
+
+// MaxSessionNotesLength caps a session's notes (bytes)
+const MaxSessionNotesLength = 4000
+
+// Recording levels (CYH_RECORDING_LEVEL, or per session)
+const (
+	RecordingLevelFull      = "full"       // Input, output and resize events
+	RecordingLevelInputOnly = "input_only" // Input, command and resize events, no output
+	RecordingLevelNone      = "none"       // Nothing is recorded
+)
+
+// IsValidRecordingLevel reports whether level is a known recording level
+func IsValidRecordingLevel(level string) bool {
+	return level == RecordingLevelFull || level == RecordingLevelInputOnly || level == RecordingLevelNone
+}
+
+// ErrSessionNameTaken is returned when a name collides under the reject policy
+var ErrSessionNameTaken = errors.New("a session with this name already exists")
+
+// ErrInvalidSessionName is wrapped by the errors for names that are empty or
+// longer than CYH_MAX_SESSION_NAME_LENGTH
+var ErrInvalidSessionName = errors.New("invalid session name")
+
 // TermSession represents a terminal recording session
 type TermSession struct {
-	ID             string         `json:"id"`
-	User           string         `json:"user"`
-	Name           string         `json:"name"`
-	Mode           string         `json:"mode"`
-	ContainerName  string         `json:"container_name,omitempty"`
-	CreatedAt      time.Time      `json:"created_at"`
-	EndedAt        *time.Time     `json:"ended_at,omitempty"`
-	Duration       int64          `json:"duration"`
-	IsLive         bool           `json:"is_live"`
-	ShareToken     string         `json:"share_token,omitempty"`
-	PermissionMode PermissionMode `json:"permission_mode"`
-	ViewerCount    int            `json:"viewer_count"`
+	ID                string           `json:"id"`
+	User              string           `json:"user"`
+	Name              string           `json:"name"`
+	Notes             string           `json:"notes,omitempty"`     // Free-form description set by the owner
+	IsPinned          bool             `json:"is_pinned"`           // Listed before unpinned sessions
+	Workspace         string           `json:"workspace,omitempty"` // Project the session is grouped under
+	Mode              string           `json:"mode"`
+	ContainerName     string           `json:"container_name,omitempty"`
+	ContainerUser     string           `json:"container_user,omitempty"`      // Non-root user to exec as (docker mode)
+	TemplateID        string           `json:"template_id,omitempty"`         // Session template applied on container creation
+	PersistContainer  bool             `json:"persist_container"`             // Keep the container when the session ends
+	RecordingLevel    string           `json:"recording_level"`               // full, input_only or none
+	ScrubOutput       bool             `json:"scrub_output"`                  // Redact secrets from recorded output
+	RecordingCappedAt *time.Time       `json:"recording_capped_at,omitempty"` // When recording stopped at CYH_MAX_RECORDING_DURATION
+	SnapshotImage     string           `json:"snapshot_image,omitempty"`      // Latest image committed from the session's container
+	LastCwd           string           `json:"last_cwd,omitempty"`            // Shell's last working directory (docker mode), restored on resume
+	PromptTheme       string           `json:"prompt_theme,omitempty"`        // Docker prompt: a preset from prompt_themes.go or a custom PS1 template
+	StartupCommands   []string         `json:"startup_commands,omitempty"`    // Typed into each new shell, see session_startup.go
+	ContainerFlags    []string         `json:"container_flags,omitempty"`     // Allowlisted docker run flags, see container_flags.go
+	InputBytes        int64            `json:"input_bytes"`                   // Bytes typed into the terminal, flushed periodically
+	OutputBytes       int64            `json:"output_bytes"`                  // Bytes the terminal printed, flushed periodically
+	CreatedAt         time.Time        `json:"created_at"`
+	EndedAt           *time.Time       `json:"ended_at,omitempty"`
+	EndReason         string           `json:"end_reason,omitempty"` // Why the session ended, see SessionEnd
+	ExitCode          *int             `json:"exit_code,omitempty"`  // The shell's exit status, when it exited on its own
+	Duration          int64            `json:"duration"`
+	IsLive            bool             `json:"is_live"`
+	ShareToken        string           `json:"share_token,omitempty"`
+	PermissionMode    PermissionMode   `json:"permission_mode"`
+	AllowedModes      []PermissionMode `json:"allowed_permission_modes"` // Permission modes the session may be shared with, default first
+	ViewerCount       int              `json:"viewer_count"`
 }
 
 // SessionEvent represents a recorded event in a session
 type SessionEvent struct {
-	Type      string `json:"type"` // "output", "input", "resize"
+	Type      string `json:"type"` // "output", "input", "resize", "command", "marker", "pane"
 	Timestamp int64  `json:"timestamp"`
 	Data      string `json:"data"`
+	Pane      string `json:"pane,omitempty"` // Extra pane the event happened in; empty for the main terminal
 }
 
 // SessionData represents the full session with events
 type SessionData struct {
-	Session *TermSession    `json:"session"`
-	Events  []*SessionEvent `json:"events"`
+	Session   *TermSession    `json:"session"`
+	Events    []*SessionEvent `json:"events"`
+	CreatedAt int64           `json:"created_at"`        // Session start (UnixMilli) for correlating with external logs
+	Absolute  bool            `json:"absolute"`          // True if event timestamps are wall-clock UnixMilli
+	MaxGap    int64           `json:"max_gap,omitempty"` // Longest gap between events (ms) when gaps were compressed
+}
+
+// SessionDataOptions controls how recorded events are returned
+type SessionDataOptions struct {
+	// Absolute returns the stored wall-clock timestamps instead of
+	// timestamps relative to the session start
+	Absolute bool
+	// MaxGap caps the time between consecutive events (ms) so idle stretches
+	// don't stall replay. Zero keeps the original timings. Ignored with Absolute.
+	MaxGap int64
 }
 
 // SessionManager handles session persistence and live sessions
 type SessionManager struct {
 	db             *sql.DB
 	activeSessions map[string]*ActiveSession
+	recordingDir   string // Per-session log files when using the file backend
+	io             sessionIO
 	mu             sync.RWMutex
 }
 
@@ -64,6 +137,11 @@ type ActiveSession struct {
 	Events       []*SessionEvent
 	StartTime    time.Time
 	LastActivity time.Time
+	fileLog      *sessionFileLog // nil when recording straight to the DB
+	scrub        *scrubStream    // Output held back and scrubbed when ScrubOutput is set
+	screen       screenScanner   // Alternate screen switches across output chunks
+	capTimer     *time.Timer     // Stops recording at CYH_MAX_RECORDING_DURATION; nil once stopped or ended
+	capped       bool            // Recording stopped; new events are dropped
 	mu           sync.Mutex
 }
 
@@ -111,11 +189,65 @@ func NewSessionManager(dbPath string) (*SessionManager, error) {
 
 	// Backfill schema for existing databases
 	_, _ = db.Exec(`ALTER TABLE term_sessions ADD COLUMN container_name TEXT`)
+	_, _ = db.Exec(`ALTER TABLE term_sessions ADD COLUMN container_user TEXT DEFAULT ''`)
+	_, _ = db.Exec(`ALTER TABLE term_sessions ADD COLUMN template_id TEXT DEFAULT ''`)
+	_, _ = db.Exec(`ALTER TABLE term_sessions ADD COLUMN persist_container BOOLEAN DEFAULT 0`)
+	_, _ = db.Exec(`ALTER TABLE term_sessions ADD COLUMN container_idle_since DATETIME`)
+	_, _ = db.Exec(`ALTER TABLE term_sessions ADD COLUMN recording_level TEXT DEFAULT ''`)
+	_, _ = db.Exec(`ALTER TABLE term_sessions ADD COLUMN scrub_output BOOLEAN DEFAULT 0`)
+	_, _ = db.Exec(`ALTER TABLE term_sessions ADD COLUMN snapshot_image TEXT DEFAULT ''`)
+	_, _ = db.Exec(`ALTER TABLE term_sessions ADD COLUMN input_bytes INTEGER DEFAULT 0`)
+	_, _ = db.Exec(`ALTER TABLE term_sessions ADD COLUMN output_bytes INTEGER DEFAULT 0`)
+	_, _ = db.Exec(`ALTER TABLE term_sessions ADD COLUMN notes TEXT DEFAULT ''`)
+	_, _ = db.Exec(`ALTER TABLE term_sessions ADD COLUMN is_pinned BOOLEAN DEFAULT 0`)
+	_, _ = db.Exec(`ALTER TABLE terminal_logs ADD COLUMN pane TEXT DEFAULT ''`)
+	_, _ = db.Exec(`ALTER TABLE term_sessions ADD COLUMN recording_capped_at DATETIME`)
+	_, _ = db.Exec(`ALTER TABLE term_sessions ADD COLUMN workspace TEXT DEFAULT ''`)
+	_, _ = db.Exec(`ALTER TABLE term_sessions ADD COLUMN last_cwd TEXT DEFAULT ''`)
+	_, _ = db.Exec(`ALTER TABLE term_sessions ADD COLUMN prompt_theme TEXT DEFAULT ''`)
+	_, _ = db.Exec(`ALTER TABLE term_sessions ADD COLUMN startup_commands TEXT DEFAULT ''`)
+	_, _ = db.Exec(`ALTER TABLE term_sessions ADD COLUMN exit_code INTEGER`)
+	_, _ = db.Exec(`ALTER TABLE term_sessions ADD COLUMN end_reason TEXT DEFAULT ''`)
+	_, _ = db.Exec(`ALTER TABLE term_sessions ADD COLUMN container_flags TEXT DEFAULT ''`)
+	_, _ = db.Exec(`ALTER TABLE term_sessions ADD COLUMN guest_key TEXT DEFAULT ''`)
+	_, _ = db.Exec(`ALTER TABLE terminal_logs ADD COLUMN compression TEXT DEFAULT ''`) // Existing rows are uncompressed
+
+	if err := initTemplatesTable(db); err != nil {
+		return nil, err
+	}
+	if err := initViewerSessionsTable(db); err != nil {
+		return nil, err
+	}
+	if err := initWorkspacesTable(db); err != nil {
+		return nil, err
+	}
 
-	return &SessionManager{
+	sm := &SessionManager{
 		db:             db,
 		activeSessions: make(map[string]*ActiveSession),
-	}, nil
+		recordingDir:   filepath.Join(filepath.Dir(dbPath), "recordings"),
+		io:             sessionIO{pending: make(map[string]*ioCounts)},
+	}
+
+	// Import logs from file-backed sessions that never ended cleanly
+	sm.recoverFileLogs()
+
+	// End sessions a crash left open, so they don't look active forever
+	sm.recoverUnendedSessions()
+
+	// Remove idle guest containers, and persisted session containers once
+	// they've been idle too long
+	go sm.reapIdleContainers()
+
+	// Write terminal byte counts in batches rather than per read
+	go sm.flushIOLoop()
+
+	// Back up the database on a schedule, if configured
+	if serverConfig.BackupInterval > 0 {
+		go sm.backupLoop(serverConfig.BackupInterval)
+	}
+
+	return sm, nil
 }
 
 // GenerateID generates a random session ID
@@ -158,8 +290,180 @@ func buildContainerName(user, sessionID string) string {
 	return "cyh_" + sanitizeContainerUser(user) + "_sess_" + sessionID
 }
 
-// CreateSession creates a new session
+// sessionColumns is the column list shared by all term_sessions queries
+const sessionColumns = `id, user, name, mode, container_name, created_at, ended_at, duration, is_live, share_token, permission_mode, container_user, template_id, persist_container, recording_level, scrub_output, snapshot_image, input_bytes, output_bytes, notes, is_pinned, recording_capped_at, workspace, last_cwd, prompt_theme, startup_commands, end_reason, exit_code, container_flags`
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanSession scans a row selected with sessionColumns
+func scanSession(row rowScanner) (*TermSession, error) {
+	var session TermSession
+	var endedAt sql.NullTime
+	var shareToken sql.NullString
+	var containerName sql.NullString
+	var containerUser sql.NullString
+	var templateID sql.NullString
+	var persistContainer sql.NullBool
+	var recordingLevel sql.NullString
+	var scrubOutput sql.NullBool
+	var snapshotImage sql.NullString
+	var inputBytes sql.NullInt64
+	var outputBytes sql.NullInt64
+	var notes sql.NullString
+	var isPinned sql.NullBool
+	var recordingCappedAt sql.NullTime
+	var workspace sql.NullString
+	var lastCwd sql.NullString
+	var promptTheme sql.NullString
+	var startupCommands sql.NullString
+	var endReason sql.NullString
+	var exitCode sql.NullInt64
+	var containerFlags sql.NullString
+
+	err := row.Scan(
+		&session.ID, &session.User, &session.Name, &session.Mode, &containerName,
+		&session.CreatedAt, &endedAt, &session.Duration, &session.IsLive,
+		&shareToken, &session.PermissionMode, &containerUser, &templateID,
+		&persistContainer, &recordingLevel, &scrubOutput, &snapshotImage,
+		&inputBytes, &outputBytes, &notes, &isPinned, &recordingCappedAt, &workspace, &lastCwd,
+		&promptTheme, &startupCommands, &endReason, &exitCode, &containerFlags,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if endedAt.Valid {
+		session.EndedAt = &endedAt.Time
+	}
+	if shareToken.Valid {
+		session.ShareToken = shareToken.String
+	}
+	if recordingCappedAt.Valid {
+		session.RecordingCappedAt = &recordingCappedAt.Time
+	}
+	if exitCode.Valid {
+		code := int(exitCode.Int64)
+		session.ExitCode = &code
+	}
+	session.ContainerName = containerName.String
+	session.ContainerUser = containerUser.String
+	session.TemplateID = templateID.String
+	session.PersistContainer = persistContainer.Bool
+	session.RecordingLevel = recordingLevel.String
+	session.ScrubOutput = scrubOutput.Bool
+	session.SnapshotImage = snapshotImage.String
+	session.InputBytes = inputBytes.Int64
+	session.OutputBytes = outputBytes.Int64
+	session.Notes = notes.String
+	session.IsPinned = isPinned.Bool
+	session.Workspace = workspace.String
+	session.LastCwd = lastCwd.String
+	session.PromptTheme = promptTheme.String
+	session.EndReason = endReason.String
+	if startupCommands.String != "" {
+		json.Unmarshal([]byte(startupCommands.String), &session.StartupCommands)
+	}
+	if containerFlags.String != "" {
+		json.Unmarshal([]byte(containerFlags.String), &session.ContainerFlags)
+	}
+	session.AllowedModes = serverConfig.AllowedShareModes(session.Mode)
+	session.PermissionMode = serverConfig.ClampShareMode(session.Mode, session.PermissionMode)
+	if session.RecordingLevel == "" {
+		session.RecordingLevel = RecordingLevelFull // Sessions recorded before levels existed
+	}
+
+	return &session, nil
+}
+
+// cleanSessionName trims a session name and removes control characters, so
+// a name can't carry escape sequences into terminals that show it
+func cleanSessionName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(name, ""))
+	return strings.TrimSpace(name)
+}
+
+// fitSessionName cuts a name the server made up to
+// CYH_MAX_SESSION_NAME_LENGTH; only names users pick are rejected for length
+func fitSessionName(name string) string {
+	if limit := serverConfig.MaxSessionNameLength; limit > 0 && utf8.RuneCountInString(name) > limit {
+		name = string([]rune(name)[:limit])
+	}
+	return name
+}
+
+// checkSessionName rejects a cleaned name that is empty or too long
+func checkSessionName(name string) error {
+	if name == "" {
+		return fmt.Errorf("%w: it is empty", ErrInvalidSessionName)
+	}
+	if limit := serverConfig.MaxSessionNameLength; limit > 0 && utf8.RuneCountInString(name) > limit {
+		return fmt.Errorf("%w: at most %d characters are allowed", ErrInvalidSessionName, limit)
+	}
+	return nil
+}
+
+// sessionNameExists reports whether user has another session called name
+func (sm *SessionManager) sessionNameExists(user, name, excludeID string) (bool, error) {
+	var count int
+	err := sm.db.QueryRow(`SELECT COUNT(*) FROM term_sessions WHERE user = ? AND name = ? AND id != ?`,
+		user, name, excludeID).Scan(&count)
+	return count > 0, err
+}
+
+// ResolveSessionName applies a name conflict policy among user's sessions
+// (ignoring excludeID, the session being renamed) and returns the name to use.
+// A suffixed name is cut to stay within CYH_MAX_SESSION_NAME_LENGTH.
+func (sm *SessionManager) ResolveSessionName(user, name, excludeID, policy string) (string, error) {
+	if policy != SessionNamesReject && policy != SessionNamesSuffix {
+		return name, nil
+	}
+
+	exists, err := sm.sessionNameExists(user, name, excludeID)
+	if err != nil || !exists {
+		return name, err
+	}
+	if policy == SessionNamesReject {
+		return "", ErrSessionNameTaken
+	}
+
+	for i := 2; i < 1000; i++ {
+		suffix := fmt.Sprintf(" (%d)", i)
+		base := name
+		if limit := serverConfig.MaxSessionNameLength; limit > 0 {
+			room := limit - utf8.RuneCountInString(suffix)
+			if room < 1 {
+				break
+			}
+			base = string([]rune(base)[:min(room, utf8.RuneCountInString(base))])
+		}
+		candidate := base + suffix
+		if exists, err = sm.sessionNameExists(user, candidate, excludeID); err != nil || !exists {
+			return candidate, err
+		}
+	}
+	return "", ErrSessionNameTaken
+}
+
+// CreateSession creates a new session. The name is cleaned up and checked
+// against the length limit and the configured name conflict policy.
 func (sm *SessionManager) CreateSession(user, name, mode string) (*TermSession, error) {
+	name = cleanSessionName(name)
+	if err := checkSessionName(name); err != nil {
+		return nil, err
+	}
+	name, err := sm.ResolveSessionName(user, name, "", serverConfig.SessionNameConflict)
+	if err != nil {
+		return nil, err
+	}
+
 	session := &TermSession{
 		ID:             GenerateID(),
 		User:           user,
@@ -169,32 +473,84 @@ func (sm *SessionManager) CreateSession(user, name, mode string) (*TermSession,
 		CreatedAt:      time.Now(),
 		IsLive:         false,
 		PermissionMode: PermissionViewOnly,
+		RecordingLevel: serverConfig.RecordingLevel,
+		ScrubOutput:    serverConfig.ScrubOutput,
+		Workspace:      sm.defaultWorkspace(user),
+	}
+	if !IsValidRecordingLevel(session.RecordingLevel) {
+		session.RecordingLevel = RecordingLevelFull
 	}
 	if mode == "docker" {
-		session.ContainerName = buildContainerName(user, session.ID)
+		session.ContainerName = sessionContainerName(user, session.ID)
 	}
 
-	_, err := sm.db.Exec(`
-		INSERT INTO term_sessions (id, user, name, mode, container_name, created_at, permission_mode)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
-	`, session.ID, session.User, session.Name, session.Mode, session.ContainerName, session.CreatedAt, session.PermissionMode)
+	_, err = sm.db.Exec(`
+		INSERT INTO term_sessions (id, user, name, mode, container_name, created_at, permission_mode, recording_level, scrub_output, workspace)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, session.ID, session.User, session.Name, session.Mode, session.ContainerName, session.CreatedAt, session.PermissionMode, session.RecordingLevel, session.ScrubOutput, session.Workspace)
 
 	if err != nil {
 		return nil, err
 	}
 
 	// Create active session for recording
+	active := sm.newActiveSession(session, time.Now())
 	sm.mu.Lock()
-	sm.activeSessions[session.ID] = &ActiveSession{
+	sm.activeSessions[session.ID] = active
+	sm.mu.Unlock()
+
+	logInfof("Session created: %s (user: %s, name: %s)", session.ID, user, name)
+	return session, nil
+}
+
+// newActiveSession sets up recording for a session that started at started
+func (sm *SessionManager) newActiveSession(session *TermSession, started time.Time) *ActiveSession {
+	active := &ActiveSession{
 		Session:      session,
 		Events:       make([]*SessionEvent, 0),
-		StartTime:    time.Now(),
+		StartTime:    started,
 		LastActivity: time.Now(),
+		scrub:        newScrubStream(outputScrubber),
+		capped:       session.RecordingCappedAt != nil, // Capped before it was resumed
 	}
-	sm.mu.Unlock()
+	if session.RecordingCappedAt == nil && serverConfig.MaxRecordingDuration > 0 {
+		// The cap counts from creation, so a session resumed after that long is capped right away
+		if remaining := serverConfig.MaxRecordingDuration - time.Since(session.CreatedAt); remaining > 0 {
+			active.mu.Lock()
+			active.capTimer = time.AfterFunc(remaining, func() {
+				sm.capRecording(session.ID, active)
+			})
+			active.mu.Unlock()
+		} else {
+			sm.markRecordingCapped(session)
+			active.capped = true
+		}
+	}
+	if serverConfig.RecordingBackend == RecordingBackendFile {
+		fileLog, err := openSessionFileLog(sm.recordingDir, session.ID)
+		if err != nil {
+			logErrorf("Failed to open recording log for %s, recording to DB: %v", session.ID, err)
+		} else {
+			active.fileLog = fileLog
+		}
+	}
+	return active
+}
 
-	log.Printf("Session created: %s (user: %s, name: %s)", session.ID, user, name)
-	return session, nil
+// ResumeSession makes a resumed session active again, so it is recorded
+// with its own settings (output scrubbing, screen markers) like a new one
+// and ended properly when its terminal closes. Its duration continues from
+// where it stopped. A session already active in another terminal is left
+// as it is. A session resumed past CYH_MAX_RECORDING_DURATION is capped
+// before anything is recorded, and session.RecordingCappedAt is set.
+func (sm *SessionManager) ResumeSession(session *TermSession) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if _, ok := sm.activeSessions[session.ID]; ok {
+		return
+	}
+	started := time.Now().Add(-time.Duration(session.Duration) * time.Millisecond)
+	sm.activeSessions[session.ID] = sm.newActiveSession(session, started)
 }
 
 // SetSessionContainerName updates the container name for a session
@@ -203,71 +559,207 @@ func (sm *SessionManager) SetSessionContainerName(id, containerName string) erro
 	return err
 }
 
-// GetSession retrieves a session by ID
-func (sm *SessionManager) GetSession(id string) (*TermSession, error) {
-	var session TermSession
-	var endedAt sql.NullTime
-	var shareToken sql.NullString
+// SetSessionLastCwd records the shell's working directory for resuming the session there
+func (sm *SessionManager) SetSessionLastCwd(id, cwd string) error {
+	_, err := sm.db.Exec(`UPDATE term_sessions SET last_cwd = ? WHERE id = ?`, cwd, id)
+	if err != nil {
+		return err
+	}
 
-	err := sm.db.QueryRow(`
-		SELECT id, user, name, mode, container_name, created_at, ended_at, duration, is_live, share_token, permission_mode
-		FROM term_sessions WHERE id = ?
-	`, id).Scan(
-		&session.ID, &session.User, &session.Name, &session.Mode, &session.ContainerName,
-		&session.CreatedAt, &endedAt, &session.Duration, &session.IsLive,
-		&shareToken, &session.PermissionMode,
-	)
+	sm.mu.Lock()
+	if sess, ok := sm.activeSessions[id]; ok {
+		sess.Session.LastCwd = cwd
+	}
+	sm.mu.Unlock()
+	return nil
+}
+
+// lastCwdWriter saves a terminal's working directory reports in the
+// background, one write at a time and only the latest, so directories
+// reported in quick succession can't be stored out of order
+type lastCwdWriter struct {
+	sessionID string
+
+	mu      sync.Mutex
+	pending string
+	running bool
+}
+
+// Save records dir as the session's last working directory
+func (w *lastCwdWriter) Save(dir string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.pending = dir
+	if !w.running {
+		w.running = true
+		go w.run()
+	}
+}
 
+func (w *lastCwdWriter) run() {
+	for {
+		w.mu.Lock()
+		dir := w.pending
+		w.pending = ""
+		if dir == "" {
+			w.running = false
+			w.mu.Unlock()
+			return
+		}
+		w.mu.Unlock()
+
+		if err := sessionMgr.SetSessionLastCwd(w.sessionID, dir); err != nil {
+			logErrorf("Failed to save working directory of session %s: %v", w.sessionID, err)
+		}
+	}
+}
+
+// SetSessionContainerUser sets the user a docker session execs as ("" for root)
+func (sm *SessionManager) SetSessionContainerUser(id, containerUser string) error {
+	_, err := sm.db.Exec(`UPDATE term_sessions SET container_user = ? WHERE id = ?`, containerUser, id)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if endedAt.Valid {
-		session.EndedAt = &endedAt.Time
+	sm.mu.Lock()
+	if sess, ok := sm.activeSessions[id]; ok {
+		sess.Session.ContainerUser = containerUser
 	}
-	if shareToken.Valid {
-		session.ShareToken = shareToken.String
+	sm.mu.Unlock()
+	return nil
+}
+
+// SetSessionContainerFlags stores the extra docker run flags for a session's
+// container. They apply when the container is created.
+func (sm *SessionManager) SetSessionContainerFlags(id string, flags []string) error {
+	encoded := ""
+	if len(flags) > 0 {
+		b, _ := json.Marshal(flags)
+		encoded = string(b)
+	}
+	_, err := sm.db.Exec(`UPDATE term_sessions SET container_flags = ? WHERE id = ?`, encoded, id)
+	if err != nil {
+		return err
 	}
 
-	return &session, nil
+	sm.mu.Lock()
+	if sess, ok := sm.activeSessions[id]; ok {
+		sess.Session.ContainerFlags = flags
+	}
+	sm.mu.Unlock()
+	return nil
 }
 
-// GetSessionByShareToken retrieves a session by share token
-func (sm *SessionManager) GetSessionByShareToken(token string) (*TermSession, error) {
-	var session TermSession
-	var endedAt sql.NullTime
-	var shareToken sql.NullString
+// SetSessionRecordingLevel changes what is recorded for a session
+func (sm *SessionManager) SetSessionRecordingLevel(id, level string) error {
+	_, err := sm.db.Exec(`UPDATE term_sessions SET recording_level = ? WHERE id = ?`, level, id)
+	if err != nil {
+		return err
+	}
 
-	err := sm.db.QueryRow(`
-		SELECT id, user, name, mode, container_name, created_at, ended_at, duration, is_live, share_token, permission_mode
-		FROM term_sessions WHERE share_token = ?
-	`, token).Scan(
-		&session.ID, &session.User, &session.Name, &session.Mode, &session.ContainerName,
-		&session.CreatedAt, &endedAt, &session.Duration, &session.IsLive,
-		&shareToken, &session.PermissionMode,
-	)
+	sm.mu.Lock()
+	if sess, ok := sm.activeSessions[id]; ok {
+		sess.Session.RecordingLevel = level
+	}
+	sm.mu.Unlock()
+	return nil
+}
 
+// SetSessionScrubOutput turns secret scrubbing of recorded output on or off
+func (sm *SessionManager) SetSessionScrubOutput(id string, enabled bool) error {
+	_, err := sm.db.Exec(`UPDATE term_sessions SET scrub_output = ? WHERE id = ?`, enabled, id)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if endedAt.Valid {
-		session.EndedAt = &endedAt.Time
+	sm.mu.Lock()
+	if sess, ok := sm.activeSessions[id]; ok {
+		sess.Session.ScrubOutput = enabled
 	}
-	if shareToken.Valid {
-		session.ShareToken = shareToken.String
+	sm.mu.Unlock()
+	return nil
+}
+
+// SetSessionSnapshotImage records an image committed from the session's
+// container, used to recreate the container if it is removed
+func (sm *SessionManager) SetSessionSnapshotImage(id, image string) error {
+	_, err := sm.db.Exec(`UPDATE term_sessions SET snapshot_image = ? WHERE id = ?`, image, id)
+	if err != nil {
+		return err
 	}
 
-	return &session, nil
+	sm.mu.Lock()
+	if sess, ok := sm.activeSessions[id]; ok {
+		sess.Session.SnapshotImage = image
+	}
+	sm.mu.Unlock()
+	return nil
+}
+
+// RecordsOutput reports whether terminal output is recorded for the session
+func (s *TermSession) RecordsOutput() bool {
+	return s.RecordingLevel == RecordingLevelFull
+}
+
+// RecordsInput reports whether input, command and resize events are recorded
+func (s *TermSession) RecordsInput() bool {
+	return s.RecordingLevel != RecordingLevelNone
+}
+
+// SetSessionTemplate sets the template applied when a docker session's container is created
+func (sm *SessionManager) SetSessionTemplate(id, templateID string) error {
+	_, err := sm.db.Exec(`UPDATE term_sessions SET template_id = ? WHERE id = ?`, templateID, id)
+	if err != nil {
+		return err
+	}
+
+	sm.mu.Lock()
+	if sess, ok := sm.activeSessions[id]; ok {
+		sess.Session.TemplateID = templateID
+	}
+	sm.mu.Unlock()
+	return nil
+}
+
+// GetSession retrieves a session by ID
+func (sm *SessionManager) GetSession(id string) (*TermSession, error) {
+	return scanSession(sm.db.QueryRow(`SELECT `+sessionColumns+` FROM term_sessions WHERE id = ?`, id))
+}
+
+// GetSessionByContainer retrieves the most recent session bound to a container
+func (sm *SessionManager) GetSessionByContainer(containerName string) (*TermSession, error) {
+	return scanSession(sm.db.QueryRow(`SELECT `+sessionColumns+` FROM term_sessions WHERE container_name = ? ORDER BY created_at DESC LIMIT 1`, containerName))
+}
+
+// GetUnboundDockerSession retrieves a user's most recent docker session with
+// no container name; such sessions resume in the user's legacy container
+func (sm *SessionManager) GetUnboundDockerSession(user string) (*TermSession, error) {
+	return scanSession(sm.db.QueryRow(`SELECT `+sessionColumns+` FROM term_sessions WHERE user = ? AND mode = 'docker' AND COALESCE(container_name, '') = '' ORDER BY created_at DESC LIMIT 1`, user))
 }
 
-// ListSessions lists all sessions for a user
+// GetSessionByShareToken retrieves a session by share token
+func (sm *SessionManager) GetSessionByShareToken(token string) (*TermSession, error) {
+	return scanSession(sm.db.QueryRow(`SELECT `+sessionColumns+` FROM term_sessions WHERE share_token = ?`, token))
+}
+
+// ListSessions lists all sessions for a user, pinned sessions first
 func (sm *SessionManager) ListSessions(user string) ([]*TermSession, error) {
+	return sm.listUserSessions(``, user)
+}
+
+// ListWorkspaceSessions lists a user's sessions in a workspace (or in none
+// when workspace is empty), pinned sessions first
+func (sm *SessionManager) ListWorkspaceSessions(user, workspace string) ([]*TermSession, error) {
+	return sm.listUserSessions(` AND COALESCE(workspace, '') = ?`, user, workspace)
+}
+
+// listUserSessions lists a user's sessions matching an extra WHERE clause
+func (sm *SessionManager) listUserSessions(clause string, user string, args ...interface{}) ([]*TermSession, error) {
 	rows, err := sm.db.Query(`
-		SELECT id, user, name, mode, container_name, created_at, ended_at, duration, is_live, share_token, permission_mode
-		FROM term_sessions WHERE user = ?
-		ORDER BY created_at DESC
-	`, user)
+		SELECT `+sessionColumns+`
+		FROM term_sessions WHERE user = ?`+clause+`
+		ORDER BY COALESCE(is_pinned, 0) DESC, created_at DESC
+	`, append([]interface{}{user}, args...)...)
 	if err != nil {
 		return nil, err
 	}
@@ -275,72 +767,189 @@ func (sm *SessionManager) ListSessions(user string) ([]*TermSession, error) {
 
 	var sessions []*TermSession
 	for rows.Next() {
-		var session TermSession
-		var endedAt sql.NullTime
-		var shareToken sql.NullString
-
-		err := rows.Scan(
-			&session.ID, &session.User, &session.Name, &session.Mode, &session.ContainerName,
-			&session.CreatedAt, &endedAt, &session.Duration, &session.IsLive,
-			&shareToken, &session.PermissionMode,
-		)
+		session, err := scanSession(rows)
 		if err != nil {
 			continue
 		}
+		sessions = append(sessions, session)
+	}
 
-		if endedAt.Valid {
-			session.EndedAt = &endedAt.Time
-		}
-		if shareToken.Valid {
-			session.ShareToken = shareToken.String
-		}
+	return sessions, nil
+}
+
+// SessionFilter narrows an all-users session query (zero values match everything)
+type SessionFilter struct {
+	User   string
+	Mode   string
+	Live   *bool
+	Since  time.Time
+	Limit  int
+	Offset int
+}
 
-		sessions = append(sessions, &session)
+// ListAllSessions lists sessions across all users, returning one page and the total match count
+func (sm *SessionManager) ListAllSessions(filter SessionFilter) ([]*TermSession, int, error) {
+	var where []string
+	var args []interface{}
+	if filter.User != "" {
+		where = append(where, "user = ?")
+		args = append(args, filter.User)
+	}
+	if filter.Mode != "" {
+		where = append(where, "mode = ?")
+		args = append(args, filter.Mode)
+	}
+	if filter.Live != nil {
+		where = append(where, "is_live = ?")
+		args = append(args, *filter.Live)
+	}
+	if !filter.Since.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, filter.Since)
 	}
 
-	return sessions, nil
+	clause := ""
+	if len(where) > 0 {
+		clause = " WHERE " + strings.Join(where, " AND ")
+	}
+
+	var total int
+	if err := sm.db.QueryRow(`SELECT COUNT(*) FROM term_sessions`+clause, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := sm.db.Query(`
+		SELECT `+sessionColumns+`
+		FROM term_sessions`+clause+`
+		ORDER BY created_at DESC
+		LIMIT ? OFFSET ?
+	`, append(args, filter.Limit, filter.Offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	sessions := []*TermSession{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions, total, nil
 }
 
 // GetLastActiveSession retrieves the most recent active session for a user
 func (sm *SessionManager) GetLastActiveSession(user string) (*TermSession, error) {
-	var session TermSession
-	var endedAt sql.NullTime
-	var shareToken sql.NullString
-
 	// Find the most recent session that hasn't ended (or even if ended, we might want to restart it?)
 	// For "persistence", we want the last session that was created.
 	// If we want to strictly find "active" (not ended), we check ended_at IS NULL.
 	// Let's get the absolute last session, and if it's ended, we'll see if we should create a new one or revive.
 	// For now, let's just get the last session.
-	err := sm.db.QueryRow(`
-		SELECT id, user, name, mode, container_name, created_at, ended_at, duration, is_live, share_token, permission_mode
+	return scanSession(sm.db.QueryRow(`
+		SELECT `+sessionColumns+`
 		FROM term_sessions 
 		WHERE user = ? 
 		ORDER BY created_at DESC 
 		LIMIT 1
-	`, user).Scan(
-		&session.ID, &session.User, &session.Name, &session.Mode, &session.ContainerName,
-		&session.CreatedAt, &endedAt, &session.Duration, &session.IsLive,
-		&shareToken, &session.PermissionMode,
-	)
+	`, user))
+}
 
+// DeleteSession deletes a session
+func (sm *SessionManager) DeleteSession(id, user string) error {
+	result, err := sm.db.Exec(`DELETE FROM term_sessions WHERE id = ? AND user = ?`, id, user)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if endedAt.Valid {
-		session.EndedAt = &endedAt.Time
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return sql.ErrNoRows
 	}
-	if shareToken.Valid {
-		session.ShareToken = shareToken.String
+
+	// Remove from active sessions if exists
+	sm.mu.Lock()
+	delete(sm.activeSessions, id)
+	sm.mu.Unlock()
+
+	logInfof("Session deleted: %s", id)
+	return nil
+}
+
+// RenameSession updates the name of a session and returns the name used
+// (which differs from newName when cleaned up or when the suffix conflict
+// policy applies)
+func (sm *SessionManager) RenameSession(id, user, newName string) (string, error) {
+	newName = cleanSessionName(newName)
+	if err := checkSessionName(newName); err != nil {
+		return "", err
+	}
+	newName, err := sm.ResolveSessionName(user, newName, id, serverConfig.SessionNameConflict)
+	if err != nil {
+		return "", err
 	}
 
-	return &session, nil
+	result, err := sm.db.Exec(`UPDATE term_sessions SET name = ? WHERE id = ? AND user = ?`, newName, id, user)
+	if err != nil {
+		return "", err
+	}
+
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return "", sql.ErrNoRows
+	}
+
+	// Update in memory if exists
+	sm.mu.Lock()
+	if sess, ok := sm.activeSessions[id]; ok {
+		sess.Session.Name = newName
+	}
+	sm.mu.Unlock()
+
+	logInfof("Session %s renamed to: %s", id, newName)
+	return newName, nil
 }
 
-// DeleteSession deletes a session
-func (sm *SessionManager) DeleteSession(id, user string) error {
-	result, err := sm.db.Exec(`DELETE FROM term_sessions WHERE id = ? AND user = ?`, id, user)
+// RenameGeneratedSession renames a session that still has the name it was
+// created with. It reports false, leaving the name alone, when the session
+// was renamed since. Conflicting names get a suffix whatever the policy, and
+// names over the length limit are cut.
+func (sm *SessionManager) RenameGeneratedSession(id, user, generatedName, newName string) (bool, error) {
+	newName = fitSessionName(cleanSessionName(newName))
+	if newName == "" {
+		return false, nil
+	}
+	newName, err := sm.ResolveSessionName(user, newName, id, SessionNamesSuffix)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := sm.db.Exec(`UPDATE term_sessions SET name = ? WHERE id = ? AND user = ? AND name = ?`,
+		newName, id, user, generatedName)
+	if err != nil {
+		return false, err
+	}
+
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return false, nil
+	}
+
+	sm.mu.Lock()
+	if sess, ok := sm.activeSessions[id]; ok {
+		sess.Session.Name = newName
+	}
+	sm.mu.Unlock()
+
+	logInfof("Session %s named after its first command: %s", id, newName)
+	return true, nil
+}
+
+// SetSessionNotes updates the notes of a session owned by user
+func (sm *SessionManager) SetSessionNotes(id, user, notes string) error {
+	result, err := sm.db.Exec(`UPDATE term_sessions SET notes = ? WHERE id = ? AND user = ?`, notes, id, user)
 	if err != nil {
 		return err
 	}
@@ -350,18 +959,19 @@ func (sm *SessionManager) DeleteSession(id, user string) error {
 		return sql.ErrNoRows
 	}
 
-	// Remove from active sessions if exists
+	// Update in memory if exists
 	sm.mu.Lock()
-	delete(sm.activeSessions, id)
+	if sess, ok := sm.activeSessions[id]; ok {
+		sess.Session.Notes = notes
+	}
 	sm.mu.Unlock()
 
-	log.Printf("Session deleted: %s", id)
 	return nil
 }
 
-// RenameSession updates the name of a session
-func (sm *SessionManager) RenameSession(id, user, newName string) error {
-	result, err := sm.db.Exec(`UPDATE term_sessions SET name = ? WHERE id = ? AND user = ?`, newName, id, user)
+// SetSessionPinned pins or unpins a session owned by user
+func (sm *SessionManager) SetSessionPinned(id, user string, pinned bool) error {
+	result, err := sm.db.Exec(`UPDATE term_sessions SET is_pinned = ? WHERE id = ? AND user = ?`, pinned, id, user)
 	if err != nil {
 		return err
 	}
@@ -374,11 +984,59 @@ func (sm *SessionManager) RenameSession(id, user, newName string) error {
 	// Update in memory if exists
 	sm.mu.Lock()
 	if sess, ok := sm.activeSessions[id]; ok {
-		sess.Session.Name = newName
+		sess.Session.IsPinned = pinned
+	}
+	sm.mu.Unlock()
+
+	return nil
+}
+
+// SetSessionPromptTheme sets the owner's prompt theme for a docker session;
+// shells started from then on, e.g. on resume, use it
+func (sm *SessionManager) SetSessionPromptTheme(id, user, theme string) error {
+	result, err := sm.db.Exec(`UPDATE term_sessions SET prompt_theme = ? WHERE id = ? AND user = ?`, theme, id, user)
+	if err != nil {
+		return err
+	}
+
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+
+	sm.mu.Lock()
+	if sess, ok := sm.activeSessions[id]; ok {
+		sess.Session.PromptTheme = theme
+	}
+	sm.mu.Unlock()
+
+	return nil
+}
+
+// SetSessionStartupCommands sets the owner's startup commands for a
+// session; shells started from then on run them
+func (sm *SessionManager) SetSessionStartupCommands(id, user string, commands []string) error {
+	encoded := ""
+	if len(commands) > 0 {
+		b, _ := json.Marshal(commands)
+		encoded = string(b)
+	}
+	result, err := sm.db.Exec(`UPDATE term_sessions SET startup_commands = ? WHERE id = ? AND user = ?`, encoded, id, user)
+	if err != nil {
+		return err
+	}
+
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+
+	sm.mu.Lock()
+	if sess, ok := sm.activeSessions[id]; ok {
+		sess.Session.StartupCommands = commands
 	}
 	sm.mu.Unlock()
 
-	log.Printf("Session %s renamed to: %s", id, newName)
 	return nil
 }
 
@@ -395,7 +1053,7 @@ func (sm *SessionManager) StartLiveSession(id string, mode PermissionMode) (stri
 		return "", err
 	}
 
-	log.Printf("Live session started: %s (token: %s, mode: %s)", id, shareToken[:8]+"...", mode)
+	logInfof("Live session started: %s (token: %s, mode: %s)", id, shareToken[:8]+"...", mode)
 	return shareToken, nil
 }
 
@@ -413,22 +1071,49 @@ func (sm *SessionManager) UpdatePermissionMode(id string, mode PermissionMode) e
 
 // AddEvent adds an event to an active session
 func (sm *SessionManager) AddEvent(sessionID string, eventType string, data string) {
-	// 1. Write to Database (Persistent Log)
 	timestamp := time.Now().UnixMilli()
-	_, err := sm.db.Exec(`
-		INSERT INTO terminal_logs (session_id, event_type, data, timestamp)
-		VALUES (?, ?, ?, ?)
-	`, sessionID, eventType, data, timestamp)
-	
-	if err != nil {
-		log.Printf("Failed to write log to DB: %v", err)
-	}
 
-	// 2. Update Active Session State (Active Status)
 	sm.mu.RLock()
 	active, exists := sm.activeSessions[sessionID]
+	scrub := serverConfig.ScrubOutput
+	if exists {
+		scrub = active.Session.ScrubOutput
+	}
 	sm.mu.RUnlock()
 
+	// Past CYH_MAX_RECORDING_DURATION nothing more is recorded
+	if exists && active.recordingCapped() {
+		return
+	}
+
+	// Redact secrets before output is persisted. The live terminal and
+	// viewers already received it unchanged.
+	if eventType == "output" {
+		if !exists {
+			if scrub {
+				data = outputScrubber.Scrub(data)
+			}
+		} else {
+			active.mu.Lock()
+			if scrub {
+				data = active.scrub.Write(data)
+			} else {
+				data = active.scrub.Flush() + data // Scrubbing was just turned off
+			}
+			active.mu.Unlock()
+		}
+	}
+
+	// Scrubbed output may be held back entirely until the next chunk
+	if data != "" {
+		if eventType == "output" && exists && serverConfig.RecordScreenMarkers {
+			sm.persistOutputWithMarkers(sessionID, active, data, timestamp)
+		} else {
+			sm.persistEvent(sessionID, active, "", eventType, data, timestamp)
+		}
+	}
+
+	// Update Active Session State (Active Status)
 	if exists {
 		active.mu.Lock()
 		active.LastActivity = time.Now()
@@ -438,8 +1123,88 @@ func (sm *SessionManager) AddEvent(sessionID string, eventType string, data stri
 	}
 }
 
-// EndSession ends a session
-func (sm *SessionManager) EndSession(id string) error {
+// AddPaneEvent adds an event of one of a session's extra panes (see
+// terminal_panes.go). Pane output is scrubbed chunk by chunk, without the
+// main terminal's carry-over, and gets no screen markers.
+func (sm *SessionManager) AddPaneEvent(sessionID, pane, eventType, data string) {
+	timestamp := time.Now().UnixMilli()
+
+	sm.mu.RLock()
+	active, exists := sm.activeSessions[sessionID]
+	scrub := serverConfig.ScrubOutput
+	if exists {
+		scrub = active.Session.ScrubOutput
+	}
+	sm.mu.RUnlock()
+
+	if exists && active.recordingCapped() {
+		return
+	}
+
+	if eventType == "output" && scrub {
+		data = outputScrubber.Scrub(data)
+	}
+	sm.persistEvent(sessionID, active, pane, eventType, data, timestamp)
+
+	if exists {
+		active.mu.Lock()
+		active.LastActivity = time.Now()
+		active.mu.Unlock()
+	}
+}
+
+// persistEvent writes an event to the persistent log (file backend if
+// enabled, else Database). active is nil for sessions no longer active.
+func (sm *SessionManager) persistEvent(sessionID string, active *ActiveSession, pane, eventType, data string, timestamp int64) {
+	if active != nil && active.fileLog != nil {
+		active.fileLog.Append(pane, eventType, data, timestamp)
+	} else {
+		stored, compression := compressEventData(data)
+		_, err := sm.db.Exec(`
+			INSERT INTO terminal_logs (session_id, event_type, data, timestamp, pane, compression)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, sessionID, eventType, stored, timestamp, pane, compression)
+
+		if err != nil {
+			logErrorf("Failed to write log to DB: %v", err)
+		}
+	}
+}
+
+// persistOutputWithMarkers records output, split with a "marker" event
+// after each alternate screen switch so replays see exactly where it happened
+func (sm *SessionManager) persistOutputWithMarkers(sessionID string, active *ActiveSession, data string, timestamp int64) {
+	active.mu.Lock()
+	markers := active.screen.Scan(data)
+	active.mu.Unlock()
+
+	start := 0
+	for _, m := range markers {
+		sm.persistEvent(sessionID, active, "", "output", data[start:m.Offset], timestamp)
+		sm.persistEvent(sessionID, active, "", "marker", m.Marker, timestamp)
+		start = m.Offset
+	}
+	if start < len(data) {
+		sm.persistEvent(sessionID, active, "", "output", data[start:], timestamp)
+	}
+}
+
+// Why a session ended (end_reason)
+const (
+	EndReasonNormal        = "normal"         // The shell exited, or the client disconnected
+	EndReasonKilled        = "killed"         // Ended by its owner, or the shell was killed by a signal or for input abuse
+	EndReasonError         = "error"          // The shell or its container couldn't start, or the terminal failed
+	EndReasonContainerLost = "container_lost" // The container stopped under the shell
+)
+
+// SessionEnd is how a session ended
+type SessionEnd struct {
+	Reason   string
+	ExitCode *int // The shell's exit status, nil unless it exited on its own
+}
+
+// EndSession ends a session, recording how it ended
+func (sm *SessionManager) EndSession(id string, end SessionEnd) error {
 	sm.mu.Lock()
 	active, exists := sm.activeSessions[id]
 	if !exists {
@@ -451,92 +1216,224 @@ func (sm *SessionManager) EndSession(id string) error {
 
 	active.mu.Lock()
 	defer active.mu.Unlock()
+	active.stopRecordingCap()
 
 	duration := time.Since(active.StartTime).Milliseconds()
 	endedAt := time.Now()
 
-	// Update session metadata
+	// Update session metadata, with the byte counts not yet flushed
 	// Note: We don't save 'data' blob anymore as events are in terminal_logs
+	counts := sm.takePendingIO(id)
 	_, err := sm.db.Exec(`
-		UPDATE term_sessions SET ended_at = ?, duration = ?, is_live = 0
+		UPDATE term_sessions SET ended_at = ?, duration = ?, is_live = 0,
+			input_bytes = input_bytes + ?, output_bytes = output_bytes + ?,
+			end_reason = ?, exit_code = ?
 		WHERE id = ?
-	`, endedAt, duration, id)
+	`, endedAt, duration, counts.input, counts.output, end.Reason, end.ExitCode, id)
 
 	if err != nil {
 		return err
 	}
 
-	log.Printf("Session ended: %s (duration: %dms)", id, duration)
+	// Record output held back by the scrubber
+	if rest := active.scrub.Flush(); rest != "" {
+		sm.persistEvent(id, active, "", "output", rest, endedAt.UnixMilli())
+	}
+
+	// Move the file-backed recording into SQLite
+	if active.fileLog != nil {
+		if err := active.fileLog.Close(); err != nil {
+			logErrorf("Failed to close recording log for %s: %v", id, err)
+		}
+		if err := sm.importFileLog(id, active.fileLog.path); err != nil {
+			logErrorf("Failed to import recording log for %s: %v", id, err)
+		}
+	}
+
+	// Stop/remove or mark the session container according to its persistence
+	sm.ReleaseSessionContainer(id)
+
+	logInfof("Session ended: %s (duration: %dms)", id, duration)
 	return nil
 }
 
 // GetSessionData retrieves full session data including events
-func (sm *SessionManager) GetSessionData(id string) (*SessionData, error) {
+func (sm *SessionManager) GetSessionData(id string, opts SessionDataOptions) (*SessionData, error) {
 	session, err := sm.GetSession(id)
 	if err != nil {
 		return nil, err
 	}
 
-	// Fetch logs from DB
+	var events []*SessionEvent
+	removed, err := sm.forEachSessionEvent(session, opts, func(e *SessionEvent) error {
+		events = append(events, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	data := &SessionData{
+		Session:   session,
+		Events:    events,
+		CreatedAt: session.CreatedAt.UnixMilli(),
+		Absolute:  opts.Absolute,
+	}
+
+	if opts.MaxGap > 0 && !opts.Absolute {
+		// Keep the reported duration in step with the shortened timeline
+		session.Duration -= removed
+		if n := len(events); n > 0 && session.Duration < events[n-1].Timestamp {
+			session.Duration = events[n-1].Timestamp
+		}
+		data.MaxGap = opts.MaxGap
+	}
+
+	return data, nil
+}
+
+// StreamSessionData passes a session's metadata to start, then each event to
+// emit as it is read from the database, so long recordings are never held in
+// memory. The metadata has no events and, with MaxGap, the uncompressed
+// duration.
+func (sm *SessionManager) StreamSessionData(id string, opts SessionDataOptions, start func(*SessionData) error, emit func(*SessionEvent) error) error {
+	session, err := sm.GetSession(id)
+	if err != nil {
+		return err
+	}
+
+	header := &SessionData{
+		Session:   session,
+		CreatedAt: session.CreatedAt.UnixMilli(),
+		Absolute:  opts.Absolute,
+	}
+	if opts.MaxGap > 0 && !opts.Absolute {
+		header.MaxGap = opts.MaxGap
+	}
+	if err := start(header); err != nil {
+		return err
+	}
+
+	_, err = sm.forEachSessionEvent(session, opts, emit)
+	return err
+}
+
+// forEachSessionEvent calls fn for each of the session's events in timestamp
+// order, applying opts. Events are read straight from the database cursor
+// unless a still-active file-backed recording has to be merged in. It returns
+// the total time removed by gap compression.
+func (sm *SessionManager) forEachSessionEvent(session *TermSession, opts SessionDataOptions, fn func(*SessionEvent) error) (int64, error) {
 	rows, err := sm.db.Query(`
-		SELECT event_type, data, timestamp 
+		SELECT event_type, data, timestamp, COALESCE(pane, ''), COALESCE(compression, '')
 		FROM terminal_logs 
 		WHERE session_id = ? 
-		ORDER BY timestamp ASC
-	`, id)
+		ORDER BY timestamp ASC, id ASC
+	`, session.ID)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
 	defer rows.Close()
 
-	var events []*SessionEvent
-	for rows.Next() {
-		var evtType, data string
+	// Output recorded before the level was lowered is not served
+	keepOutput := session.RecordsOutput()
+
+	// Stored timestamps are absolute UnixMilli; the player expects them
+	// relative to the session start (or the first event, if clocks disagree)
+	startTs := int64(-1)
+	var gaps gapCompressor
+
+	process := func(e *SessionEvent) error {
+		if e.Type == "output" && !keepOutput {
+			return nil
+		}
+		if e.Type == "resize" {
+			e.Data = normalizeResizeEventData(e.Data) // Rows recorded before the format changed
+		}
+		if !opts.Absolute {
+			if startTs < 0 {
+				startTs = session.CreatedAt.UnixMilli()
+				if e.Timestamp < startTs {
+					startTs = e.Timestamp
+				}
+			}
+			e.Timestamp -= startTs
+			if e.Timestamp < 0 {
+				e.Timestamp = 0
+			}
+			if opts.MaxGap > 0 {
+				gaps.Apply(e, opts.MaxGap)
+			}
+		}
+		return fn(e)
+	}
+
+	scan := func() (*SessionEvent, bool) {
+		var evtType, pane, compression string
+		var stored []byte
 		var ts int64
-		if err := rows.Scan(&evtType, &data, &ts); err != nil {
-			continue
+		if err := rows.Scan(&evtType, &stored, &ts, &pane, &compression); err != nil {
+			return nil, false
+		}
+		data, err := decompressEventData(stored, compression)
+		if err != nil {
+			logWarnf("Skipping unreadable %s event of session %s: %v", evtType, session.ID, err)
+			return nil, false
 		}
-		events = append(events, &SessionEvent{
+		return &SessionEvent{
 			Type:      evtType,
 			Data:      data,
 			Timestamp: ts, // Use absolute timestamp from DB
-		})
-	}
-
-	// Normalizing timestamps to be relative to start if needed?
-	// The frontend might expect relative time.
-	// Let's keep them absolute or calculate relative if start time known.
-	// For now returning stored timestamp (which is UnixMilli).
-	
-	// If frontend expects relative to start:
-	// But start time is session.CreatedAt?
-	// The original implementation used relative to StartTime.
-	// To maintain compatibility, let's adjust if we can, but 
-	// actually the original AddEvent used: time.Since(active.StartTime).Milliseconds()
-	// So it was relative.
-	// But our new DB schema stores absolute UnixMilli.
-	// We should probably convert back to relative for frontend compatibility 
-	// OR update frontend.
-	// Let's recalculate relative to first event or session start.
-	
-	if len(events) > 0 {
-		startTs := session.CreatedAt.UnixMilli()
-		// Adjust if first event is earlier (clocks are tricky)
-		if events[0].Timestamp < startTs {
-			startTs = events[0].Timestamp
+			Pane:      pane,
+		}, true
+	}
+
+	// Still-active file-backed sessions keep their tail on disk until EndSession
+	if active := sm.GetActiveSession(session.ID); active != nil && active.fileLog != nil {
+		active.fileLog.Sync()
+		if tail, err := readFileLog(active.fileLog.path); err == nil && len(tail) > 0 {
+			var events []*SessionEvent
+			for rows.Next() {
+				if e, ok := scan(); ok {
+					events = append(events, e)
+				}
+			}
+			for _, e := range mergeEvents(events, tail) {
+				if err := process(e); err != nil {
+					return gaps.removed, err
+				}
+			}
+			return gaps.removed, nil
+		}
+	}
+
+	for rows.Next() {
+		e, ok := scan()
+		if !ok {
+			continue
 		}
-		
-		for _, e := range events {
-			rel := e.Timestamp - startTs
-			if rel < 0 { rel = 0 }
-			e.Timestamp = rel
+		if err := process(e); err != nil {
+			return gaps.removed, err
 		}
 	}
+	return gaps.removed, rows.Err()
+}
 
-	return &SessionData{
-		Session: session,
-		Events:  events,
-	}, nil
+// gapCompressor shortens every gap between consecutive relative timestamps
+// (and before the first event) to at most maxGap, shifting later events
+// earlier
+type gapCompressor struct {
+	prev    int64 // Original timestamp of the previous event
+	removed int64 // Total time removed so far
+}
+
+// Apply rewrites e's timestamp
+func (g *gapCompressor) Apply(e *SessionEvent, maxGap int64) {
+	original := e.Timestamp
+	if gap := original - g.prev; gap > maxGap {
+		g.removed += gap - maxGap
+	}
+	g.prev = original
+	e.Timestamp = original - g.removed
 }
 
 // GetActiveSession returns an active session if it exists
@@ -554,7 +1451,8 @@ func (sm *SessionManager) IsSessionActive(id string) bool {
 	return exists
 }
 
-// Close closes the database connection
+// Close writes pending byte counts and closes the database connection
 func (sm *SessionManager) Close() error {
+	sm.FlushIO()
 	return sm.db.Close()
 }
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestResumeSessionRecordsWithItsOwnSettings(t *testing.T) {
+	newTestSessionManager(t)
+	session, err := sessionMgr.CreateSession("bob", "Resumed", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sessionMgr.SetSessionScrubOutput(session.ID, true); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err := sessionMgr.EndSession(session.ID, SessionEnd{Reason: EndReasonNormal}); err != nil {
+		t.Fatal(err)
+	}
+
+	session, err = sessionMgr.GetSession(session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstRun := session.Duration
+	sessionMgr.ResumeSession(session)
+
+	active := sessionMgr.GetActiveSession(session.ID)
+	if active == nil {
+		t.Fatal("resumed session is not active")
+	}
+	if !active.Session.ScrubOutput {
+		t.Fatal("resumed session lost its scrub_output setting")
+	}
+
+	// Resuming again from another tab keeps the running recording
+	sessionMgr.ResumeSession(session)
+	if sessionMgr.GetActiveSession(session.ID) != active {
+		t.Fatal("second resume replaced the active session")
+	}
+
+	if err := sessionMgr.EndSession(session.ID, SessionEnd{Reason: EndReasonNormal}); err != nil {
+		t.Fatalf("ending the resumed session: %v", err)
+	}
+	session, err = sessionMgr.GetSession(session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.Duration < firstRun {
+		t.Fatalf("duration = %dms after resume, want at least the first run's %dms", session.Duration, firstRun)
+	}
+}
+
+func TestResumedSessionRecordsScreenMarkers(t *testing.T) {
+	newTestSessionManager(t)
+	session, err := sessionMgr.CreateSession("bob", "Markers", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sessionMgr.EndSession(session.ID, SessionEnd{Reason: EndReasonNormal}); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := serverConfig.RecordScreenMarkers
+	serverConfig.RecordScreenMarkers = true
+	t.Cleanup(func() { serverConfig.RecordScreenMarkers = saved })
+
+	sessionMgr.ResumeSession(session)
+	sessionMgr.AddEvent(session.ID, "output", "vim\x1b[?1049h")
+	if err := sessionMgr.EndSession(session.ID, SessionEnd{Reason: EndReasonNormal}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := sessionMgr.GetSessionData(session.ID, SessionDataOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range data.Events {
+		if e.Type == "marker" && e.Data == MarkerAltScreenEnter {
+			return
+		}
+	}
+	t.Fatalf("no %s marker among the %d events recorded after resume", MarkerAltScreenEnter, len(data.Events))
+}
+
+func TestResumeSessionPastMaxRecordingDuration(t *testing.T) {
+	newTestSessionManager(t)
+	saved := serverConfig.MaxRecordingDuration
+	serverConfig.MaxRecordingDuration = time.Hour
+	t.Cleanup(func() { serverConfig.MaxRecordingDuration = saved })
+
+	session, err := sessionMgr.CreateSession("bob", "Old", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sessionMgr.EndSession(session.ID, SessionEnd{Reason: EndReasonNormal}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Resumed two hours after it was created
+	session.CreatedAt = session.CreatedAt.Add(-2 * time.Hour)
+	sessionMgr.ResumeSession(session)
+	t.Cleanup(func() { sessionMgr.EndSession(session.ID, SessionEnd{Reason: EndReasonNormal}) })
+
+	if session.RecordingCappedAt == nil {
+		t.Fatal("RecordingCappedAt not set on the resumed session")
+	}
+	if !sessionMgr.GetActiveSession(session.ID).recordingCapped() {
+		t.Fatal("resumed session is still recording")
+	}
+	stored, err := sessionMgr.GetSession(session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.RecordingCappedAt == nil {
+		t.Fatal("recording_capped_at not stored")
+	}
+}
+
+func TestLastCwdWriterKeepsTheLatestDirectory(t *testing.T) {
+	newTestSessionManager(t)
+	session, err := sessionMgr.CreateSession("bob", "Cwd", "docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sessionMgr.EndSession(session.ID, SessionEnd{Reason: EndReasonNormal}) })
+
+	w := &lastCwdWriter{sessionID: session.ID}
+	for i := 0; i < 50; i++ {
+		w.Save(fmt.Sprintf("/home/bob/dir%d", i))
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w.mu.Lock()
+		running := w.running
+		w.mu.Unlock()
+		if !running {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("writer never finished")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	stored, err := sessionMgr.GetSession(session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.LastCwd != "/home/bob/dir49" {
+		t.Fatalf("last_cwd = %q, want the last directory reported", stored.LastCwd)
+	}
+}
+
+func TestRecoverUnendedSessions(t *testing.T) {
+	dbPath := t.TempDir() + "/sessions.db"
+	sm, err := NewSessionManager(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionMgr = sm
+	session, err := sm.CreateSession("bob", "Crashed", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err = sm.GetSession(session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastEvent := session.CreatedAt.Add(1500 * time.Millisecond)
+	sm.persistEvent(session.ID, nil, "", "output", "bye", lastEvent.UnixMilli())
+
+	// The server stops without ending the session
+	sm.Close()
+	sessionMgr = nil
+
+	sm, err = NewSessionManager(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionMgr = sm
+	t.Cleanup(func() {
+		sm.Close()
+		sessionMgr = nil
+	})
+
+	recovered, err := sm.GetSession(session.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recovered.EndedAt == nil {
+		t.Fatal("ended_at still NULL after recovery")
+	}
+	if !recovered.EndedAt.Equal(time.UnixMilli(lastEvent.UnixMilli())) {
+		t.Fatalf("ended_at = %v, want the last event at %v", recovered.EndedAt, lastEvent)
+	}
+	if recovered.Duration != 1500 {
+		t.Fatalf("duration = %dms, want 1500ms", recovered.Duration)
+	}
+}
+
+func TestSessionNamesStayWithinTheLengthLimit(t *testing.T) {
+	newTestSessionManager(t)
+	savedLimit, savedPolicy := serverConfig.MaxSessionNameLength, serverConfig.SessionNameConflict
+	serverConfig.MaxSessionNameLength = 12
+	serverConfig.SessionNameConflict = SessionNamesSuffix
+	t.Cleanup(func() {
+		serverConfig.MaxSessionNameLength, serverConfig.SessionNameConflict = savedLimit, savedPolicy
+	})
+
+	// A name the user picked is rejected, not cut
+	if _, err := sessionMgr.CreateSession("bob", "A name far too long", "local"); !errors.Is(err, ErrInvalidSessionName) {
+		t.Fatalf("CreateSession with a long name: err = %v, want ErrInvalidSessionName", err)
+	}
+
+	// Generated names are cut instead, and so is a suffixed duplicate
+	generated := fitSessionName("Terminal 15:04:05")
+	want := []string{"Terminal 15:", "Terminal (2)", "Terminal (3)"}
+	for i, name := range want {
+		session, err := sessionMgr.CreateSession("bob", generated, "local")
+		if err != nil {
+			t.Fatalf("session %d: %v", i+1, err)
+		}
+		if session.Name != name {
+			t.Fatalf("session %d is named %q, want %q", i+1, session.Name, name)
+		}
+	}
+}
+
+func TestLoadedSharesKeepToTheAllowedModes(t *testing.T) {
+	newTestSessionManager(t)
+	session, err := sessionMgr.CreateSession("bob", "Shared", "docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := sessionMgr.StartLiveSession(session.ID, PermissionSharedControl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := serverConfig.ShareModesDocker
+	t.Cleanup(func() { serverConfig.ShareModesDocker = saved })
+
+	tests := []struct {
+		name    string
+		allowed []string
+		want    PermissionMode
+	}{
+		{name: "mode still allowed", allowed: []string{"view_only", "shared_control"}, want: PermissionSharedControl},
+		{name: "falls back to view-only", allowed: []string{"instructor", "view_only"}, want: PermissionViewOnly},
+		{name: "falls back to the default", allowed: []string{"instructor"}, want: PermissionInstructor},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverConfig.ShareModesDocker = tt.allowed
+			joined, err := sessionMgr.GetSessionByShareToken(token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if joined.PermissionMode != tt.want {
+				t.Fatalf("permission mode = %q, want %q", joined.PermissionMode, tt.want)
+			}
+		})
+	}
+}
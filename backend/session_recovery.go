@@ -0,0 +1,69 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// recoverUnendedSessions finalizes sessions left open by a crash or kill.
+// Nothing is active at startup, so every session without ended_at is ended
+// at its last recorded event (or its creation time when nothing was
+// recorded). Their containers start the idle clock, so the reaper removes
+// them under the usual TTLs unless the user comes back to the session.
+// Must run after recoverFileLogs so file-backed events count.
+func (sm *SessionManager) recoverUnendedSessions() {
+	rows, err := sm.db.Query(`
+		SELECT s.id, s.user, s.mode, s.container_name, s.created_at, MAX(l.timestamp)
+		FROM term_sessions s LEFT JOIN terminal_logs l ON l.session_id = s.id
+		WHERE s.ended_at IS NULL
+		GROUP BY s.id
+	`)
+	if err != nil {
+		logErrorf("Failed to find unended sessions: %v", err)
+		return
+	}
+
+	type unended struct {
+		session TermSession
+		endedAt time.Time
+	}
+	var sessions []unended
+	for rows.Next() {
+		var u unended
+		var containerName sql.NullString
+		var lastEvent sql.NullInt64
+		if err := rows.Scan(&u.session.ID, &u.session.User, &u.session.Mode, &containerName, &u.session.CreatedAt, &lastEvent); err != nil {
+			continue
+		}
+		u.session.ContainerName = containerName.String
+
+		u.endedAt = u.session.CreatedAt
+		if lastEvent.Valid && lastEvent.Int64 > u.session.CreatedAt.UnixMilli() {
+			u.endedAt = time.UnixMilli(lastEvent.Int64)
+		}
+		sessions = append(sessions, u)
+	}
+	rows.Close()
+
+	recovered := 0
+	for _, u := range sessions {
+		duration := u.endedAt.UnixMilli() - u.session.CreatedAt.UnixMilli()
+		_, err := sm.db.Exec(`
+			UPDATE term_sessions SET ended_at = ?, duration = ?, is_live = 0
+			WHERE id = ? AND ended_at IS NULL
+		`, u.endedAt, duration, u.session.ID)
+		if err != nil {
+			logErrorf("Failed to end unended session %s: %v", u.session.ID, err)
+			continue
+		}
+		recovered++
+
+		if isGuestContainer(&u.session) || (serverConfig.ReapContainers && isSessionOwnedContainer(&u.session)) {
+			sm.markContainerIdle(&u.session)
+		}
+	}
+
+	if recovered > 0 {
+		logInfof("Recovered %d session(s) left open by an unclean shutdown", recovered)
+	}
+}
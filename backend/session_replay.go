@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Messages sent on /ws/sessions/{id}/replay besides the recorded events,
+// which are sent as they appear in /data (output, resize, ...) when their
+// time comes
+const (
+	MsgTypeReplayStart = "replay_start" // Session metadata, duration, speed and start position
+	MsgTypeReplayState = "replay_state" // Playback was paused, resumed, sped up or ended
+	MsgTypeReplayReset = "replay_reset" // After a seek: clear the screen, the output up to the new position follows at once
+)
+
+// Playback states sent with replay_state
+const (
+	ReplayPlaying = "playing"
+	ReplayPaused  = "paused"
+	ReplayEnded   = "ended"
+)
+
+// maxReplaySpeed caps the speed multiplier of server-paced replay
+const maxReplaySpeed = 16
+
+// replayControl is a message from the replay client: {"type":"pause"},
+// {"type":"resume"}, {"type":"seek","position":<ms>} or {"type":"speed","speed":2}
+type replayControl struct {
+	Type     string  `json:"type"`
+	Position int64   `json:"position"`
+	Speed    float64 `json:"speed"`
+}
+
+// replayPlayer sends a recording's events to one websocket, paced by their
+// relative timestamps. Only run writes to the connection.
+type replayPlayer struct {
+	conn     *websocket.Conn
+	events   []*SessionEvent
+	duration int64   // Timestamp of the last event (ms)
+	speed    float64 // Playback speed multiplier
+	position int64   // Playback position (ms)
+	next     int     // Index of the next event to send
+	paused   bool
+	control  chan replayControl
+	done     chan struct{} // Closed when the client disconnects
+	stopped  chan struct{} // Closed when run returns
+}
+
+func newReplayPlayer(conn *websocket.Conn, events []*SessionEvent, speed float64) *replayPlayer {
+	p := &replayPlayer{
+		conn:    conn,
+		events:  events,
+		speed:   speed,
+		control: make(chan replayControl),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if n := len(events); n > 0 {
+		p.duration = events[n-1].Timestamp
+	}
+	return p
+}
+
+// readControls passes the client's control messages to run until the
+// connection closes
+func (p *replayPlayer) readControls() {
+	defer close(p.done)
+
+	for {
+		_, data, err := p.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var c replayControl
+		if err := json.Unmarshal(data, &c); err != nil {
+			continue
+		}
+		select {
+		case p.control <- c:
+		case <-p.stopped:
+			return
+		}
+	}
+}
+
+// run plays the recording from startMs until the client disconnects or a
+// write fails. At the end it waits for a seek to play again.
+func (p *replayPlayer) run(startMs int64) {
+	defer close(p.stopped)
+
+	if err := p.seek(startMs, false); err != nil {
+		return
+	}
+	if p.next >= len(p.events) {
+		if err := p.sendState(); err != nil {
+			return
+		}
+	}
+
+	for {
+		var timer *time.Timer
+		var due <-chan time.Time
+		waitStart := time.Now()
+		if !p.paused && p.next < len(p.events) {
+			delay := float64(p.events[p.next].Timestamp-p.position) / p.speed
+			timer = time.NewTimer(time.Duration(delay * float64(time.Millisecond)))
+			due = timer.C
+		}
+
+		select {
+		case <-due:
+			e := p.events[p.next]
+			p.next++
+			p.position = e.Timestamp
+			if err := p.conn.WriteJSON(e); err != nil {
+				return
+			}
+			if p.next == len(p.events) {
+				if err := p.sendState(); err != nil {
+					return
+				}
+			}
+
+		case c := <-p.control:
+			if timer != nil {
+				timer.Stop()
+				p.advance(time.Since(waitStart))
+			}
+			if err := p.apply(c); err != nil {
+				return
+			}
+
+		case <-p.done:
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		}
+	}
+}
+
+// advance moves the position by the time played while waiting for the next
+// event, so pausing between events keeps its place
+func (p *replayPlayer) advance(elapsed time.Duration) {
+	p.position += int64(float64(elapsed.Milliseconds()) * p.speed)
+	if next := p.events[p.next].Timestamp; p.position > next {
+		p.position = next
+	}
+}
+
+func (p *replayPlayer) apply(c replayControl) error {
+	switch c.Type {
+	case "pause":
+		if p.paused {
+			return nil
+		}
+		p.paused = true
+	case "resume":
+		if !p.paused {
+			return nil
+		}
+		p.paused = false
+	case "seek":
+		return p.seek(c.Position, true)
+	case "speed":
+		if c.Speed <= 0 || c.Speed > maxReplaySpeed {
+			return nil
+		}
+		p.speed = c.Speed
+	default:
+		return nil
+	}
+	return p.sendState()
+}
+
+// seek moves playback to pos (clamped to the recording) and sends everything
+// that happened before it at once, so the screen matches. Consecutive output
+// is sent as one event; input and commands are skipped.
+func (p *replayPlayer) seek(pos int64, reset bool) error {
+	if pos < 0 {
+		pos = 0
+	}
+	if pos > p.duration {
+		pos = p.duration
+	}
+
+	if reset {
+		err := p.conn.WriteJSON(map[string]interface{}{
+			"type":     MsgTypeReplayReset,
+			"position": pos,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	var output strings.Builder
+	var outputTs int64
+	flush := func() error {
+		if output.Len() == 0 {
+			return nil
+		}
+		e := &SessionEvent{Type: "output", Timestamp: outputTs, Data: output.String()}
+		output.Reset()
+		return p.conn.WriteJSON(e)
+	}
+
+	i := 0
+	for ; i < len(p.events) && p.events[i].Timestamp < pos; i++ {
+		e := p.events[i]
+		switch {
+		case e.Type == "output" && e.Pane == "":
+			output.WriteString(e.Data)
+			outputTs = e.Timestamp
+		case e.Type == "input" || e.Type == "command":
+			// Not part of the screen
+		default:
+			// Including pane output, which belongs to another screen
+			if err := flush(); err != nil {
+				return err
+			}
+			if err := p.conn.WriteJSON(e); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	p.next = i
+	p.position = pos
+	if reset {
+		return p.sendState()
+	}
+	return nil
+}
+
+func (p *replayPlayer) state() string {
+	switch {
+	case p.next >= len(p.events):
+		return ReplayEnded
+	case p.paused:
+		return ReplayPaused
+	default:
+		return ReplayPlaying
+	}
+}
+
+func (p *replayPlayer) sendState() error {
+	return p.conn.WriteJSON(map[string]interface{}{
+		"type":     MsgTypeReplayState,
+		"state":    p.state(),
+		"position": p.position,
+		"duration": p.duration,
+		"speed":    p.speed,
+	})
+}
+
+// handleSessionReplayWebSocket replays a recording in real time to a passive
+// websocket, for embeds that can't time playback themselves:
+// /ws/sessions/{id}/replay[?speed=2][&start_ms=<ms>][&max_gap=<ms>][&plain=true]
+//
+// Access and the query options match GET /api/sessions/{id}/data. The events
+// recorded when the socket opens are played; the client may send pause,
+// resume, seek and speed messages (see replayControl).
+func handleSessionReplayWebSocket(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/ws/sessions/")
+	parts := strings.Split(path, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "replay" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	sessionID := parts[0]
+
+	username := ""
+	if cookie, err := r.Cookie("cyh_session"); err == nil {
+		if user, valid := authManager.ValidateSession(cookie.Value); valid {
+			username = user
+		}
+	}
+
+	session, err := sessionMgr.GetSession(sessionID)
+	if err != nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	if !checkSessionReadAccess(w, r, session, username) {
+		return
+	}
+
+	query := r.URL.Query()
+	speed := 1.0
+	if v := query.Get("speed"); v != "" {
+		speed, err = strconv.ParseFloat(v, 64)
+		if err != nil || speed <= 0 || speed > maxReplaySpeed {
+			http.Error(w, "speed must be greater than 0 and at most "+strconv.Itoa(maxReplaySpeed), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var startMs int64
+	if v := query.Get("start_ms"); v != "" {
+		startMs, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || startMs < 0 {
+			http.Error(w, "start_ms must be a non-negative number of milliseconds", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var opts SessionDataOptions
+	if v := query.Get("max_gap"); v != "" {
+		maxGap, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || maxGap <= 0 {
+			http.Error(w, "max_gap must be a positive number of milliseconds", http.StatusBadRequest)
+			return
+		}
+		opts.MaxGap = maxGap
+	}
+
+	releaseConn, ok := acquireWSConn(w, r, username)
+	if !ok {
+		return
+	}
+	defer releaseConn()
+
+	data, err := sessionMgr.GetSessionData(sessionID, opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if query.Get("plain") == "true" {
+		data.Events = stripRecordingSGR(data.Events)
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	player := newReplayPlayer(conn, data.Events, speed)
+	if startMs > player.duration {
+		startMs = player.duration
+	}
+	err = conn.WriteJSON(map[string]interface{}{
+		"type":     MsgTypeReplayStart,
+		"session":  data.Session,
+		"duration": player.duration,
+		"speed":    speed,
+		"position": startMs,
+	})
+	if err != nil {
+		return
+	}
+
+	go player.readControls()
+	player.run(startMs)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Limits for GET /api/sessions/{id}/search
+const (
+	maxSessionSearchQuery   = 256 // Longest search term (bytes)
+	maxSessionSearchMatches = 500 // Matches returned unless ?limit= asks for fewer
+	sessionSearchContext    = 40  // Bytes of surrounding text on each side of a match
+)
+
+// SessionSearchMatch is one occurrence of the search term in a recording
+type SessionSearchMatch struct {
+	Timestamp int64  `json:"timestamp"` // Of the output event the match starts in, as in /data
+	Before    string `json:"before"`    // Text before the match on the same line
+	Match     string `json:"match"`     // The matched text as recorded
+	After     string `json:"after"`     // Text after the match on the same line
+}
+
+// searchSessionOutput finds term (case-insensitively) in a session's main
+// terminal output with escape sequences removed, so colors or cursor moves in the middle of
+// a word don't hide it. Output events are joined before stripping, so
+// matches and sequences may span events. It returns at most limit matches
+// and whether there were more.
+func searchSessionOutput(sessionID, term string, opts SessionDataOptions, limit int) ([]SessionSearchMatch, bool, error) {
+	var raw strings.Builder
+	var starts []int // Offset of each output event in raw
+	var timestamps []int64
+
+	err := sessionMgr.StreamSessionData(sessionID, opts,
+		func(*SessionData) error { return nil },
+		func(e *SessionEvent) error {
+			if e.Type != "output" || e.Pane != "" {
+				return nil
+			}
+			starts = append(starts, raw.Len())
+			timestamps = append(timestamps, e.Timestamp)
+			raw.WriteString(e.Data)
+			return nil
+		})
+	if err != nil {
+		return nil, false, err
+	}
+
+	text, textStarts := stripANSIMarked(raw.String(), starts)
+	pattern := regexp.MustCompile("(?i)" + regexp.QuoteMeta(term))
+
+	matches := []SessionSearchMatch{}
+	locs := pattern.FindAllStringIndex(text, limit+1)
+	for _, loc := range locs {
+		if len(matches) == limit {
+			return matches, true, nil
+		}
+
+		// The event holding the match's first byte: the last one starting at or before it
+		event := sort.Search(len(textStarts), func(i int) bool { return textStarts[i] > loc[0] }) - 1
+		if event < 0 {
+			event = 0
+		}
+
+		matches = append(matches, SessionSearchMatch{
+			Timestamp: timestamps[event],
+			Before:    contextBefore(text, loc[0]),
+			Match:     text[loc[0]:loc[1]],
+			After:     contextAfter(text, loc[1]),
+		})
+	}
+	return matches, false, nil
+}
+
+// contextBefore returns up to sessionSearchContext bytes of the line before
+// offset, starting on a character boundary
+func contextBefore(text string, offset int) string {
+	start := offset - sessionSearchContext
+	if start < 0 {
+		start = 0
+	}
+	for start < offset && !utf8.RuneStart(text[start]) {
+		start++
+	}
+	before := text[start:offset]
+	if i := strings.LastIndexByte(before, '\n'); i >= 0 {
+		before = before[i+1:]
+	}
+	return before
+}
+
+// contextAfter returns up to sessionSearchContext bytes of the line after
+// offset, ending on a character boundary
+func contextAfter(text string, offset int) string {
+	end := offset + sessionSearchContext
+	if end >= len(text) {
+		end = len(text)
+	} else {
+		for end > offset && !utf8.RuneStart(text[end]) {
+			end--
+		}
+	}
+	after := text[offset:end]
+	if i := strings.IndexByte(after, '\n'); i >= 0 {
+		after = after[:i]
+	}
+	return after
+}
+
+// handleSessionSearch finds a term in one recording's output, for jumping
+// between matches in the player:
+// GET /api/sessions/{id}/search?q=<term>[&limit=<n>][&absolute=true][&max_gap=<ms>]
+//
+// Timestamps follow the same options as /data, so they line up with the
+// events the player loaded.
+func handleSessionSearch(w http.ResponseWriter, r *http.Request, sessionID, username string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, err := sessionMgr.GetSession(sessionID)
+	if err != nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	if !checkSessionReadAccess(w, r, session, username) {
+		return
+	}
+
+	query := r.URL.Query()
+	term := query.Get("q")
+	if strings.TrimSpace(term) == "" {
+		http.Error(w, "q is required", http.StatusBadRequest)
+		return
+	}
+	if len(term) > maxSessionSearchQuery {
+		http.Error(w, "q must be at most "+strconv.Itoa(maxSessionSearchQuery)+" bytes", http.StatusBadRequest)
+		return
+	}
+
+	limit := maxSessionSearchMatches
+	if v := query.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxSessionSearchMatches {
+			http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxSessionSearchMatches), http.StatusBadRequest)
+			return
+		}
+	}
+
+	opts := SessionDataOptions{Absolute: query.Get("absolute") == "true"}
+	if v := query.Get("max_gap"); v != "" {
+		maxGap, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || maxGap <= 0 {
+			http.Error(w, "max_gap must be a positive number of milliseconds", http.StatusBadRequest)
+			return
+		}
+		opts.MaxGap = maxGap
+	}
+
+	matches, truncated, err := searchSessionOutput(sessionID, term, opts, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"session_id": sessionID,
+		"query":      term,
+		"matches":    matches,
+		"truncated":  truncated,
+	})
+}
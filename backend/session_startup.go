@@ -0,0 +1,160 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Startup command limits
+const (
+	MaxStartupCommands      = 20
+	MaxStartupCommandLength = 1000
+)
+
+// startupCommandTimeout is how long a startup command may run before the
+// shell shows its prompt again; the remaining commands are skipped after it,
+// since they would be typed into whatever the command is running
+const startupCommandTimeout = 30 * time.Second
+
+// checkStartupCommands validates startup commands for a session or template.
+// Each is one command line, so it can't contain line breaks or other control
+// characters. It returns a message for the client when they are invalid.
+func checkStartupCommands(commands []string) string {
+	if len(commands) > MaxStartupCommands {
+		return "At most " + strconv.Itoa(MaxStartupCommands) + " startup commands are allowed"
+	}
+	for _, c := range commands {
+		if strings.TrimSpace(c) == "" || len(c) > MaxStartupCommandLength {
+			return "Startup commands must be non-empty and at most " + strconv.Itoa(MaxStartupCommandLength) + " bytes"
+		}
+		if strings.IndexFunc(c, unicode.IsControl) >= 0 {
+			return "Startup commands must be single lines without control characters"
+		}
+	}
+	return ""
+}
+
+// sessionStartupCommands returns the commands to type into a new shell of
+// the session: its own, else those of the template it was created from
+func sessionStartupCommands(session *TermSession) []string {
+	if session == nil {
+		return nil
+	}
+	if len(session.StartupCommands) > 0 {
+		return session.StartupCommands
+	}
+	if session.TemplateID != "" {
+		if t, err := sessionMgr.GetTemplate(session.TemplateID); err == nil {
+			return t.StartupCommands
+		}
+	}
+	return nil
+}
+
+// startupRunner types a session's startup commands into a new shell, each
+// once the shell shows its prompt, as if the user typed them. The first
+// waits at most timeout for the first prompt; a command that doesn't return
+// to the prompt within startupCommandTimeout ends the run. Feed is called
+// from the PTY reader only.
+type startupRunner struct {
+	conn      *safeConn
+	sessionID string
+	commands  []string
+	write     func(data []byte) error // Types into the shell
+	record    func(command string)    // Records a command as typed input
+
+	mu    sync.Mutex
+	line  string // Visible text of the unfinished output line
+	next  int    // Index of the next command to type
+	done  bool
+	timer *time.Timer
+}
+
+// newStartupRunner starts waiting for the shell's first prompt, or returns
+// nil when there is nothing to run
+func newStartupRunner(conn *safeConn, sessionID string, commands []string, timeout time.Duration, write func([]byte) error, record func(string)) *startupRunner {
+	if len(commands) == 0 {
+		return nil
+	}
+	r := &startupRunner{
+		conn:      conn,
+		sessionID: sessionID,
+		commands:  commands,
+		write:     write,
+		record:    record,
+	}
+	r.timer = time.AfterFunc(timeout, r.timedOut)
+	return r
+}
+
+// Feed inspects output already sent to the client
+func (r *startupRunner) Feed(data []byte) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.done {
+		return
+	}
+
+	r.line = promptLine(r.line, data)
+	if looksLikePrompt(r.line) {
+		r.line = ""
+		r.typeNext()
+	}
+}
+
+// Stop gives up on the remaining commands when the terminal closes
+func (r *startupRunner) Stop() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.done = true
+	r.timer.Stop()
+}
+
+// timedOut types the first command anyway when the first prompt wasn't
+// recognized, and ends the run when a command is still running
+func (r *startupRunner) timedOut() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.done {
+		return
+	}
+
+	if r.next == 0 {
+		r.typeNext()
+		return
+	}
+	r.done = true
+	if skipped := len(r.commands) - r.next; skipped > 0 {
+		logInfof("Startup command %q of session %s is still running, skipping the %d after it", r.commands[r.next-1], r.sessionID, skipped)
+		terminalNotice(r.conn, "A startup command is still running; skipped the "+strconv.Itoa(skipped)+" after it")
+	}
+}
+
+// typeNext types the next command, or ends the run after the last. The
+// caller holds mu.
+func (r *startupRunner) typeNext() {
+	if r.next >= len(r.commands) {
+		r.done = true
+		r.timer.Stop()
+		return
+	}
+	command := r.commands[r.next]
+	r.next++
+	r.timer.Reset(startupCommandTimeout)
+
+	r.record(command)
+	if err := r.write([]byte(command + "\r")); err != nil {
+		logWarnf("Failed to type startup command %q into session %s: %v", command, r.sessionID, err)
+		r.done = true
+		r.timer.Stop()
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// PermissionChangeOwnerIdle is the reason sent with permission_mode_change
+// when the share watchdog switched an unattended session to view only
+const PermissionChangeOwnerIdle = "owner_idle"
+
+// Countdown messages sent to the room and the owner's terminals before an
+// idle owner's session is switched to view only
+const (
+	MsgTypeOwnerIdleWarning   = "owner_idle_warning"   // {"type":"owner_idle_warning","data":{"seconds":30}}
+	MsgTypeOwnerIdleCancelled = "owner_idle_cancelled" // The owner came back in time
+	MsgTypeOwnerActive        = "owner_active"         // Owner's terminal: still here, without typing into the shell
+	MsgTypeViewerInput        = "viewer_input"         // Owner's terminal: {"type":"viewer_input","data":"ls\r"}, a viewer's keystrokes forwarded by the owner's page
+)
+
+// ownerActivity records when each shared session's owner last typed into
+// their terminal or acted on the share. Only the owner's own actions count:
+// output doesn't, since viewers with write access produce it too, and
+// neither does viewer input the owner's page forwards as viewer_input. warned
+// holds the sessions with a countdown running, so activity only looks up
+// the room when there is one to cancel.
+var ownerActivity = struct {
+	sync.Mutex
+	seen   map[string]time.Time
+	warned map[string]bool
+}{seen: make(map[string]time.Time), warned: make(map[string]bool)}
+
+// markOwnerActive records activity by a session's owner, cancelling the
+// session's idle countdown
+func markOwnerActive(sessionID string) {
+	if sessionID == "" || serverConfig.ShareIdleTimeout <= 0 {
+		return
+	}
+	ownerActivity.Lock()
+	ownerActivity.seen[sessionID] = time.Now()
+	warned := ownerActivity.warned[sessionID]
+	delete(ownerActivity.warned, sessionID)
+	ownerActivity.Unlock()
+
+	if warned {
+		liveHub.cancelIdleWarning(sessionID)
+	}
+}
+
+// shareIdleWarning is how long the countdown before a downgrade runs: the
+// configured warning, at most half the idle timeout
+func shareIdleWarning() time.Duration {
+	warning := serverConfig.ShareIdleWarning
+	if limit := serverConfig.ShareIdleTimeout / 2; warning > limit {
+		warning = limit
+	}
+	return warning
+}
+
+// ownerIdleSince returns how long a session's owner has been idle. A session
+// without recorded activity starts its clock now, so a restarted server
+// doesn't take every owner for gone.
+func ownerIdleSince(sessionID string, now time.Time) time.Duration {
+	ownerActivity.Lock()
+	defer ownerActivity.Unlock()
+
+	seen, ok := ownerActivity.seen[sessionID]
+	if !ok {
+		ownerActivity.seen[sessionID] = now
+		return 0
+	}
+	return now.Sub(seen)
+}
+
+// watchIdleOwners is the dead man's switch for shared sessions
+// (CYH_SHARE_IDLE_TIMEOUT): once a session anyone else can type into has
+// had no owner activity for the timeout, it is switched to view only, which
+// also revokes granted write access. A countdown of CYH_SHARE_IDLE_WARNING
+// runs first, which any owner activity cancels. The owner can turn control
+// back on.
+func (h *LiveHub) watchIdleOwners() {
+	timeout := serverConfig.ShareIdleTimeout
+	warning := shareIdleWarning()
+	interval := timeout / 4
+	if interval > 30*time.Second {
+		interval = 30 * time.Second
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		h.mu.RLock()
+		rooms := make([]*LiveRoom, 0, len(h.rooms))
+		for _, room := range h.rooms {
+			rooms = append(rooms, room)
+		}
+		h.mu.RUnlock()
+
+		live := make(map[string]bool, len(rooms))
+		for _, room := range rooms {
+			live[room.SessionID] = true
+			if !room.writable() {
+				continue
+			}
+			idle := ownerIdleSince(room.SessionID, now)
+			switch {
+			case warning > 0 && idle >= timeout-warning:
+				h.startIdleWarning(room, warning)
+			case warning <= 0 && idle >= timeout:
+				h.downgradeIdleRoom(room.SessionID, idle)
+			}
+		}
+
+		// Forget sessions nobody watches any more
+		ownerActivity.Lock()
+		for id, seen := range ownerActivity.seen {
+			if !live[id] && now.Sub(seen) > timeout {
+				delete(ownerActivity.seen, id)
+				delete(ownerActivity.warned, id)
+			}
+		}
+		ownerActivity.Unlock()
+	}
+}
+
+// startIdleWarning starts a room's countdown, unless one is running, and
+// tells the room and the owner's terminals. When it runs out the room is
+// switched to view only, unless the owner came back or the room is gone.
+func (h *LiveHub) startIdleWarning(room *LiveRoom, warning time.Duration) {
+	room.mu.Lock()
+	if room.idleWarning != nil {
+		room.mu.Unlock()
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(warning, func() {
+		room.mu.Lock()
+		current := room.idleWarning == timer
+		if current {
+			room.idleWarning = nil
+		}
+		room.mu.Unlock()
+
+		ownerActivity.Lock()
+		delete(ownerActivity.warned, room.SessionID)
+		ownerActivity.Unlock()
+
+		idle := ownerIdleSince(room.SessionID, time.Now())
+		if current && idle >= serverConfig.ShareIdleTimeout-warning && h.GetRoom(room.SessionID) == room && room.writable() {
+			h.downgradeIdleRoom(room.SessionID, idle)
+		}
+	})
+	room.idleWarning = timer
+	room.mu.Unlock()
+
+	ownerActivity.Lock()
+	ownerActivity.warned[room.SessionID] = true
+	ownerActivity.Unlock()
+
+	logInfof("Owner of shared session %s is idle, switching it to view only in %s unless they return", room.SessionID, warning)
+	msg := &LiveMessage{
+		Type:      MsgTypeOwnerIdleWarning,
+		SessionID: room.SessionID,
+		Data: map[string]interface{}{
+			"seconds": int(warning.Round(time.Second) / time.Second),
+		},
+		Timestamp: time.Now().UnixMilli(),
+	}
+	h.broadcast <- msg
+}
+
+// cancelIdleWarning stops a session's countdown after owner activity
+func (h *LiveHub) cancelIdleWarning(sessionID string) {
+	room := h.GetRoom(sessionID)
+	if room == nil {
+		return
+	}
+	room.mu.Lock()
+	timer := room.idleWarning
+	room.idleWarning = nil
+	room.mu.Unlock()
+	if timer == nil || !timer.Stop() {
+		return
+	}
+
+	logInfof("Owner of shared session %s is back, keeping its permission mode", sessionID)
+	h.broadcast <- &LiveMessage{
+		Type:      MsgTypeOwnerIdleCancelled,
+		SessionID: sessionID,
+		Timestamp: time.Now().UnixMilli(),
+	}
+}
+
+// downgradeIdleRoom switches an idle owner's session to view only and tells
+// the owner's terminals why
+func (h *LiveHub) downgradeIdleRoom(sessionID string, idle time.Duration) {
+	logInfof("Owner of shared session %s idle for %s, switching it to view only", sessionID, idle.Round(time.Second))
+	if err := sessionMgr.UpdatePermissionMode(sessionID, PermissionViewOnly); err != nil {
+		logErrorf("Failed to switch idle shared session %s to view only: %v", sessionID, err)
+	}
+	h.setPermissionMode(sessionID, PermissionViewOnly, PermissionChangeOwnerIdle)
+	terminals.Notify(sessionID, map[string]interface{}{
+		"type":       "permission_mode_change",
+		"session_id": sessionID,
+		"data":       map[string]interface{}{"mode": PermissionViewOnly},
+		"reason":     PermissionChangeOwnerIdle,
+	})
+}
+
+// writable reports whether anyone but the owner can type into the room
+func (room *LiveRoom) writable() bool {
+	room.mu.RLock()
+	defer room.mu.RUnlock()
+
+	if room.PermissionMode == PermissionSharedControl {
+		return true
+	}
+	for viewer := range room.Viewers {
+		if !viewer.IsOwner && viewer.CanWrite {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+//go:build !windows
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ownerSeen reports whether owner activity was recorded for a session
+func ownerSeen(sessionID string) bool {
+	ownerActivity.Lock()
+	defer ownerActivity.Unlock()
+	_, ok := ownerActivity.seen[sessionID]
+	return ok
+}
+
+// readUntil reads terminal messages until one contains want
+func readUntil(t *testing.T, conn *websocket.Conn, want string) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var out strings.Builder
+	for !strings.Contains(out.String(), want) {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for %q: %v (got %q)", want, err, out.String())
+		}
+		out.Write(data)
+	}
+}
+
+func TestViewerInputIsNotOwnerActivity(t *testing.T) {
+	newTestSessionManager(t)
+	liveHub = NewLiveHub() // Without the watchdog, which would outlive the test
+	saved := serverConfig.ShareIdleTimeout
+	serverConfig.ShareIdleTimeout = time.Hour
+	t.Cleanup(func() {
+		serverConfig.ShareIdleTimeout = saved
+		liveHub = nil
+	})
+
+	srv := httptest.NewServer(http.HandlerFunc(handleTerminal))
+	t.Cleanup(srv.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws/terminal?mode=local", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		// The handler uses liveHub until it returns
+		conn.Close()
+		waitForStats(t, "the terminal to close", func(s TerminalStatsSnapshot) bool { return s.Connections == 0 })
+	})
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var hello struct {
+		Type string `json:"type"`
+		Data string `json:"data"`
+	}
+	if err := conn.ReadJSON(&hello); err != nil || hello.Type != "session_id" || hello.Data == "" {
+		t.Fatalf("first message = %+v, %v; want the session id", hello, err)
+	}
+	sessionID := hello.Data
+
+	// The shell runs what a viewer typed, without the owner looking active
+	forwarded, _ := json.Marshal(map[string]string{"type": MsgTypeViewerInput, "data": "echo viewer-$((1+1))\r"})
+	if err := conn.WriteMessage(websocket.TextMessage, forwarded); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, conn, "viewer-2")
+	if ownerSeen(sessionID) {
+		t.Fatal("viewer input counted as owner activity")
+	}
+
+	// The owner's own keystrokes do count
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("echo owner-$((2+2))\r")); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(t, conn, "owner-4")
+	if !ownerSeen(sessionID) {
+		t.Fatal("owner input wasn't counted as owner activity")
+	}
+}
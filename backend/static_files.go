@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Cache-Control for frontend files. Pages are revalidated on every load, so
+// a new deploy shows up at once (their ETag makes that a cheap 304). Assets
+// with a content hash in their name never change and are cached for a year;
+// other assets for a few minutes, so pages and scripts can't drift apart for
+// long after a deploy.
+const (
+	cacheControlPage   = "no-cache"
+	cacheControlHashed = "public, max-age=31536000, immutable"
+	cacheControlAsset  = "public, max-age=300"
+)
+
+// hashedAssetPattern matches names with a content hash as bundlers write
+// them, like app.3f9a1c2b.js or index-BzX81_q4.css; see isHashedAsset
+var hashedAssetPattern = regexp.MustCompile(`[.-]([A-Za-z0-9_]{8,})\.[A-Za-z0-9]+$`)
+
+// staticContentTypes are set explicitly, since the extension table Go falls
+// back on comes from the host and may lack or misname them
+var staticContentTypes = map[string]string{
+	".html":        "text/html; charset=utf-8",
+	".css":         "text/css; charset=utf-8",
+	".js":          "text/javascript; charset=utf-8",
+	".mjs":         "text/javascript; charset=utf-8",
+	".json":        "application/json",
+	".map":         "application/json",
+	".webmanifest": "application/manifest+json",
+	".svg":         "image/svg+xml",
+	".png":         "image/png",
+	".jpg":         "image/jpeg",
+	".webp":        "image/webp",
+	".ico":         "image/x-icon",
+	".woff":        "font/woff",
+	".woff2":       "font/woff2",
+	".wasm":        "application/wasm",
+	".txt":         "text/plain; charset=utf-8",
+}
+
+// frontendHandler serves the frontend from CYH_FRONTEND_DIR. Paths that
+// match no file and look like a page rather than an asset (no extension)
+// get index.html, so a single-page app can route them on the client.
+// Missing assets and unknown /api/ and /ws/ paths still 404. Files get
+// explicit content types, an ETag and Cache-Control (see cacheControlPage).
+type frontendHandler struct {
+	dir   string
+	files http.Handler
+}
+
+func newFrontendHandler(dir string) *frontendHandler {
+	return &frontendHandler{dir: dir, files: http.FileServer(http.Dir(dir))}
+}
+
+func (h *frontendHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	urlPath := path.Clean("/" + r.URL.Path)
+	if isBackendPath(urlPath) {
+		http.NotFound(w, r)
+		return
+	}
+
+	name, info := h.stat(urlPath)
+	if !isFrontendRoute(urlPath) || info != nil {
+		if info != nil {
+			setStaticHeaders(w, name, info)
+		}
+		h.files.ServeHTTP(w, r)
+		return
+	}
+	h.serveIndex(w, r)
+}
+
+// stat looks up a cleaned URL path in dir, returning the file that would be
+// served (a directory's index.html) or a nil info when there is none
+func (h *frontendHandler) stat(urlPath string) (string, os.FileInfo) {
+	name := filepath.Join(h.dir, filepath.FromSlash(urlPath))
+	info, err := os.Stat(name)
+	if err == nil && info.IsDir() {
+		name = filepath.Join(name, "index.html")
+		info, err = os.Stat(name)
+	}
+	if err != nil {
+		return "", nil
+	}
+	return name, info
+}
+
+// serveIndex answers a client-side route with the frontend's index.html
+func (h *frontendHandler) serveIndex(w http.ResponseWriter, r *http.Request) {
+	f, err := os.Open(filepath.Join(h.dir, "index.html"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	setStaticHeaders(w, "index.html", info)
+	http.ServeContent(w, r, "index.html", info.ModTime(), f)
+}
+
+// setStaticHeaders sets the content type, ETag and Cache-Control of a
+// frontend file before it is served. The ETag comes from the file's size and
+// modification time, which change with every deploy, so conditional
+// requests are answered without reading the file.
+func setStaticHeaders(w http.ResponseWriter, name string, info os.FileInfo) {
+	ext := strings.ToLower(filepath.Ext(name))
+	if contentType, ok := staticContentTypes[ext]; ok {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
+
+	switch {
+	case ext == ".html":
+		w.Header().Set("Cache-Control", cacheControlPage)
+	case isHashedAsset(filepath.Base(name)):
+		w.Header().Set("Cache-Control", cacheControlHashed)
+	default:
+		w.Header().Set("Cache-Control", cacheControlAsset)
+	}
+}
+
+// serveFrontendFile serves one file of the frontend, for routes like /live/
+func serveFrontendFile(w http.ResponseWriter, r *http.Request, name string) {
+	file := filepath.Join(serverConfig.FrontendDir, name)
+	if info, err := os.Stat(file); err == nil {
+		setStaticHeaders(w, file, info)
+	}
+	http.ServeFile(w, r, file)
+}
+
+// isBackendPath reports whether a path belongs to the API or the websockets,
+// which never fall back to the frontend
+func isBackendPath(urlPath string) bool {
+	return urlPath == "/api" || urlPath == "/ws" ||
+		strings.HasPrefix(urlPath, "/api/") || strings.HasPrefix(urlPath, "/ws/")
+}
+
+// isFrontendRoute reports whether a path may be a client-side route: not
+// the backend's, and without the extension an asset would have
+func isFrontendRoute(urlPath string) bool {
+	return !isBackendPath(urlPath) && path.Ext(urlPath) == ""
+}
+
+// isHashedAsset reports whether a file name carries a content hash. The hash
+// must contain a digit, so names like terminal.sessions.js don't count.
+func isHashedAsset(name string) bool {
+	m := hashedAssetPattern.FindStringSubmatch(name)
+	return m != nil && strings.ContainsAny(m[1], "0123456789")
+}
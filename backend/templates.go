@@ -0,0 +1,446 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Template limits
+const (
+	MaxTemplateNameLength  = 100
+	MaxTemplateEnvVars     = 50
+	MaxTemplateInitCmds    = 20
+	MaxTemplateInitCmdSize = 1000
+)
+
+// SessionTemplate is a reusable starting environment for docker sessions
+type SessionTemplate struct {
+	ID              string    `json:"id"`
+	Owner           string    `json:"owner"` // Empty for global (admin-managed) templates
+	Name            string    `json:"name"`
+	Image           string    `json:"image"`
+	Env             []string  `json:"env"`
+	InitCommands    []string  `json:"init_commands"`    // Run once when the container is created
+	StartupCommands []string  `json:"startup_commands"` // Typed into each new shell of sessions without their own
+	WorkingDir      string    `json:"working_dir,omitempty"`
+	CPUs            string    `json:"cpus,omitempty"`   // docker run --cpus
+	Memory          string    `json:"memory,omitempty"` // docker run --memory
+	Global          bool      `json:"global"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+var (
+	envKeyPattern     = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	imageRefPattern   = regexp.MustCompile(`^[a-z0-9][a-z0-9._/-]*(:[A-Za-z0-9._-]+)?$`)
+	workingDirPattern = regexp.MustCompile(`^/[A-Za-z0-9._/-]*$`)
+	memoryPattern     = regexp.MustCompile(`^[0-9]+[bkmgBKMG]?$`)
+)
+
+// initTemplatesTable creates the session_templates table
+func initTemplatesTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS session_templates (
+			id TEXT PRIMARY KEY,
+			owner TEXT NOT NULL DEFAULT '',
+			name TEXT NOT NULL,
+			image TEXT NOT NULL,
+			env TEXT,
+			init_commands TEXT,
+			working_dir TEXT,
+			cpus TEXT,
+			memory TEXT,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS idx_session_templates_owner ON session_templates(owner);
+	`)
+	if err != nil {
+		return err
+	}
+	_, _ = db.Exec(`ALTER TABLE session_templates ADD COLUMN startup_commands TEXT`)
+	return nil
+}
+
+// Validate checks template fields. Besides the default image, users may use
+// the images they saved; admins may use any image.
+func (t *SessionTemplate) Validate(username string, isAdmin bool) string {
+	t.Name = strings.TrimSpace(t.Name)
+	if t.Name == "" || len(t.Name) > MaxTemplateNameLength {
+		return "Template name is required (max 100 characters)"
+	}
+
+	if t.Image == "" {
+		t.Image = DockerImageName
+	}
+	if !imageRefPattern.MatchString(t.Image) {
+		return "Invalid image name"
+	}
+	if t.Image != DockerImageName && !isAdmin && !isUserImage(username, t.Image) {
+		return "You can only use the default image or your saved images"
+	}
+
+	if len(t.Env) > MaxTemplateEnvVars {
+		return "Too many environment variables"
+	}
+	for _, kv := range t.Env {
+		key, _, ok := strings.Cut(kv, "=")
+		if !ok || !envKeyPattern.MatchString(key) {
+			return "Invalid environment variable: " + kv
+		}
+	}
+
+	if len(t.InitCommands) > MaxTemplateInitCmds {
+		return "Too many init commands"
+	}
+	for _, c := range t.InitCommands {
+		if strings.TrimSpace(c) == "" || len(c) > MaxTemplateInitCmdSize {
+			return "Init commands must be non-empty and under 1000 characters"
+		}
+	}
+
+	if msg := checkStartupCommands(t.StartupCommands); msg != "" {
+		return msg
+	}
+
+	if t.WorkingDir != "" && !workingDirPattern.MatchString(t.WorkingDir) {
+		return "Working directory must be an absolute path"
+	}
+	if t.CPUs != "" {
+		if cpus, err := strconv.ParseFloat(t.CPUs, 64); err != nil || cpus <= 0 || cpus > 64 {
+			return "Invalid CPU limit"
+		}
+	}
+	if t.Memory != "" && !memoryPattern.MatchString(t.Memory) {
+		return "Invalid memory limit"
+	}
+
+	return ""
+}
+
+// ContainerSpec converts the template into a container creation spec.
+// Global and admin templates may set any CPU and memory limits; a user's
+// own template can only lower the ones the container profile sets.
+func (t *SessionTemplate) ContainerSpec() ContainerSpec {
+	spec := defaultContainerSpec()
+	spec.Image = t.Image
+	spec.Env = mergeEnv(spec.Env, t.Env)
+	spec.WorkingDir = t.WorkingDir
+	trusted := t.Global || authManager.IsAdmin(t.Owner)
+	if t.CPUs != "" {
+		if trusted || cpusWithin(t.CPUs, spec.CPUs) {
+			spec.CPUs = t.CPUs
+		} else {
+			logWarnf("Template %s asks for %s CPUs, above the profile's %s; keeping the profile limit", t.ID, t.CPUs, spec.CPUs)
+		}
+	}
+	if t.Memory != "" {
+		if trusted || memoryWithin(t.Memory, spec.Memory) {
+			spec.Memory = t.Memory
+		} else {
+			logWarnf("Template %s asks for %s of memory, above the profile's %s; keeping the profile limit", t.ID, t.Memory, spec.Memory)
+		}
+	}
+	spec.InitCommands = t.InitCommands
+	return spec
+}
+
+// cpusWithin reports whether a --cpus value doesn't exceed limit ("" for
+// no limit)
+func cpusWithin(cpus, limit string) bool {
+	if limit == "" {
+		return true
+	}
+	want, err := strconv.ParseFloat(cpus, 64)
+	most, errMost := strconv.ParseFloat(limit, 64)
+	return err == nil && errMost == nil && want <= most
+}
+
+// memoryWithin reports whether a --memory value doesn't exceed limit (""
+// for no limit)
+func memoryWithin(memory, limit string) bool {
+	if limit == "" {
+		return true
+	}
+	want, ok := memoryBytes(memory)
+	most, okMost := memoryBytes(limit)
+	return ok && okMost && want <= most
+}
+
+// memoryBytes parses a docker --memory value: a number with an optional
+// b, k, m or g unit (powers of 1024)
+func memoryBytes(s string) (int64, bool) {
+	if !memoryPattern.MatchString(s) {
+		return 0, false
+	}
+	shift := 0
+	switch s[len(s)-1] {
+	case 'k', 'K':
+		shift = 10
+	case 'm', 'M':
+		shift = 20
+	case 'g', 'G':
+		shift = 30
+	}
+	n, err := strconv.ParseInt(strings.TrimRight(s, "bkmgBKMG"), 10, 64)
+	if err != nil || n > math.MaxInt64>>shift {
+		return 0, false
+	}
+	return n << shift, true
+}
+
+func scanTemplate(row rowScanner) (*SessionTemplate, error) {
+	var t SessionTemplate
+	var env, initCmds, workingDir, cpus, memory, startupCmds sql.NullString
+
+	err := row.Scan(&t.ID, &t.Owner, &t.Name, &t.Image, &env, &initCmds, &workingDir, &cpus, &memory, &t.CreatedAt, &startupCmds)
+	if err != nil {
+		return nil, err
+	}
+
+	json.Unmarshal([]byte(env.String), &t.Env)
+	json.Unmarshal([]byte(initCmds.String), &t.InitCommands)
+	json.Unmarshal([]byte(startupCmds.String), &t.StartupCommands)
+	if t.Env == nil {
+		t.Env = []string{}
+	}
+	if t.InitCommands == nil {
+		t.InitCommands = []string{}
+	}
+	if t.StartupCommands == nil {
+		t.StartupCommands = []string{}
+	}
+	t.WorkingDir = workingDir.String
+	t.CPUs = cpus.String
+	t.Memory = memory.String
+	t.Global = t.Owner == ""
+	return &t, nil
+}
+
+const templateColumns = `id, owner, name, image, env, init_commands, working_dir, cpus, memory, created_at, startup_commands`
+
+// CreateTemplate stores a new template
+func (sm *SessionManager) CreateTemplate(t *SessionTemplate) error {
+	t.ID = GenerateID()
+	t.CreatedAt = time.Now()
+	env, _ := json.Marshal(t.Env)
+	initCmds, _ := json.Marshal(t.InitCommands)
+	startupCmds, _ := json.Marshal(t.StartupCommands)
+
+	_, err := sm.db.Exec(`
+		INSERT INTO session_templates (`+templateColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, t.ID, t.Owner, t.Name, t.Image, string(env), string(initCmds), t.WorkingDir, t.CPUs, t.Memory, t.CreatedAt, string(startupCmds))
+	return err
+}
+
+// UpdateTemplate replaces a template's settings
+func (sm *SessionManager) UpdateTemplate(t *SessionTemplate) error {
+	env, _ := json.Marshal(t.Env)
+	initCmds, _ := json.Marshal(t.InitCommands)
+	startupCmds, _ := json.Marshal(t.StartupCommands)
+
+	_, err := sm.db.Exec(`
+		UPDATE session_templates
+		SET name = ?, image = ?, env = ?, init_commands = ?, working_dir = ?, cpus = ?, memory = ?, startup_commands = ?
+		WHERE id = ?
+	`, t.Name, t.Image, string(env), string(initCmds), t.WorkingDir, t.CPUs, t.Memory, string(startupCmds), t.ID)
+	return err
+}
+
+// GetTemplate retrieves a template by ID
+func (sm *SessionManager) GetTemplate(id string) (*SessionTemplate, error) {
+	return scanTemplate(sm.db.QueryRow(`SELECT `+templateColumns+` FROM session_templates WHERE id = ?`, id))
+}
+
+// ListTemplates lists a user's templates plus all global templates
+func (sm *SessionManager) ListTemplates(user string) ([]*SessionTemplate, error) {
+	rows, err := sm.db.Query(`
+		SELECT `+templateColumns+`
+		FROM session_templates WHERE owner = ? OR owner = ''
+		ORDER BY owner = '' DESC, name ASC
+	`, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	templates := []*SessionTemplate{}
+	for rows.Next() {
+		t, err := scanTemplate(rows)
+		if err != nil {
+			continue
+		}
+		templates = append(templates, t)
+	}
+	return templates, nil
+}
+
+// DeleteTemplate removes a template
+func (sm *SessionManager) DeleteTemplate(id string) error {
+	result, err := sm.db.Exec(`DELETE FROM session_templates WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// canUseTemplate reports whether a user may apply a template
+func canUseTemplate(t *SessionTemplate, username string) bool {
+	return t.Global || t.Owner == username
+}
+
+// canEditTemplate reports whether a user may modify a template
+func canEditTemplate(t *SessionTemplate, username string) bool {
+	if t.Global {
+		return authManager.IsAdmin(username)
+	}
+	return t.Owner == username
+}
+
+// HTTP Handlers
+
+// handleTemplates lists and creates templates: /api/templates
+func handleTemplates(w http.ResponseWriter, r *http.Request) {
+	username := ""
+	if cookie, err := r.Cookie("cyh_session"); err == nil {
+		if user, valid := authManager.ValidateSession(cookie.Value); valid {
+			username = user
+		}
+	}
+
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		templates, err := sessionMgr.ListTemplates(username)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(templates)
+
+	case http.MethodPost:
+		var t SessionTemplate
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		isAdmin := authManager.IsAdmin(username)
+		if t.Global && !isAdmin {
+			http.Error(w, "Only administrators can create global templates", http.StatusForbidden)
+			return
+		}
+		if msg := t.Validate(username, isAdmin); msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		t.Owner = username
+		if t.Global {
+			t.Owner = ""
+		}
+		if err := sessionMgr.CreateTemplate(&t); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(t)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleTemplateByID reads, updates and deletes a template: /api/templates/{id}
+func handleTemplateByID(w http.ResponseWriter, r *http.Request) {
+	templateID := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/templates/"), "/")[0]
+	if templateID == "" {
+		http.Error(w, "Template ID required", http.StatusBadRequest)
+		return
+	}
+
+	username := ""
+	if cookie, err := r.Cookie("cyh_session"); err == nil {
+		if user, valid := authManager.ValidateSession(cookie.Value); valid {
+			username = user
+		}
+	}
+
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	t, err := sessionMgr.GetTemplate(templateID)
+	if err != nil || !canUseTemplate(t, username) {
+		http.Error(w, "Template not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(t)
+
+	case http.MethodPut:
+		if !canEditTemplate(t, username) {
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
+
+		var update SessionTemplate
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if msg := update.Validate(username, authManager.IsAdmin(username)); msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		update.ID = t.ID
+		update.Owner = t.Owner
+		update.Global = t.Global
+		update.CreatedAt = t.CreatedAt
+		if err := sessionMgr.UpdateTemplate(&update); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(update)
+
+	case http.MethodDelete:
+		if !canEditTemplate(t, username) {
+			http.Error(w, "Access denied", http.StatusForbidden)
+			return
+		}
+
+		if err := sessionMgr.DeleteTemplate(t.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
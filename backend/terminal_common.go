@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// safeConn serializes writes to a websocket connection, which allows only
+// one concurrent writer
+type safeConn struct {
+	*websocket.Conn
+	mu sync.Mutex
+}
+
+// WriteMessage writes a message while holding the write lock
+func (c *safeConn) WriteMessage(messageType int, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.WriteMessage(messageType, data)
+}
+
+// WriteJSON writes a JSON message while holding the write lock
+func (c *safeConn) WriteJSON(v interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Conn.WriteJSON(v)
+}
+
+// resolveTerminalMode applies the server's mode policy to a terminal connect.
+// It returns the mode to start, or an error explaining why the connect is refused.
+func resolveTerminalMode(mode string, dockerReady bool) (string, error) {
+	if mode != "docker" {
+		mode = "local"
+	}
+
+	if !serverConfig.IsModeEnabled(mode) {
+		return "", fmt.Errorf("terminal mode '%s' is disabled on this server", mode)
+	}
+
+	if mode == "docker" && !dockerReady {
+		if !serverConfig.DockerFallbackLocal || !serverConfig.IsModeEnabled("local") {
+			return "", fmt.Errorf("the Docker environment is not ready yet, please try again later")
+		}
+		logWarnf("Docker not ready, falling back to local shell")
+		return "local", nil
+	}
+
+	return mode, nil
+}
+
+// Close codes the server sends when it closes a terminal connection, in the
+// range websockets leave to applications, so clients can tell why it closed
+const (
+	CloseShellExited     = 4000 // The shell exited; the reason has its exit status
+	CloseSessionEnded    = 4001 // The session was ended elsewhere; the reason is the session_ended reason
+	CloseConnectRejected = 4002 // The connect was refused (mode disabled, capacity, container ownership, ...)
+	CloseStartFailed     = 4003 // The shell couldn't be started; the reason is the error code
+	CloseInputLimited    = 4004 // Input stayed over the rate limit too long
+	CloseContainerLost   = 4005 // The session's container stopped under the shell
+	CloseTerminalError   = 4006 // Writing to the terminal failed
+)
+
+// maxCloseReason is the longest close reason that fits in a close frame
+const maxCloseReason = 123
+
+// closeTerminal sends a close frame with code and reason, then closes the
+// connection. A code of 0 (the client already went away) just closes it.
+func closeTerminal(conn *safeConn, code int, reason string) {
+	if code != 0 {
+		if len(reason) > maxCloseReason {
+			reason = reason[:maxCloseReason]
+		}
+		conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	}
+	conn.Close()
+}
+
+// terminalCloseCause records why a terminal is closing. Its first cause
+// wins, since closing one side makes the other fail too, and causes set
+// after it has been read are ignored.
+type terminalCloseCause struct {
+	once   sync.Once
+	code   int
+	reason string
+}
+
+// Set records the cause unless one was already recorded
+func (c *terminalCloseCause) Set(code int, reason string) {
+	c.once.Do(func() {
+		c.code = code
+		c.reason = reason
+	})
+}
+
+// Get returns the recorded cause, and ok=false when nothing was recorded
+func (c *terminalCloseCause) Get() (code int, reason string, ok bool) {
+	recorded := true
+	c.once.Do(func() { recorded = false })
+	return c.code, c.reason, recorded
+}
+
+// shellExitCause is the close code and reason for a shell that exited with
+// status: when the docker exec ended because the session's container
+// stopped, the container is reported lost
+func shellExitCause(containerName, status string) (int, string) {
+	if containerName != "" {
+		if state, err := dockerMgr.InspectContainer(containerName); err != nil || !state.Running {
+			return CloseContainerLost, "Container " + containerName + " stopped"
+		}
+	}
+	if status == "" {
+		return CloseShellExited, "Shell exited"
+	}
+	return CloseShellExited, "Shell exited: " + status
+}
+
+// terminalSessionEnd describes how a terminal's session ended from the code
+// the terminal closes with and the shell's exit status (-1 unless the shell
+// exited on its own)
+func terminalSessionEnd(code, exitCode int) SessionEnd {
+	end := SessionEnd{Reason: EndReasonNormal} // The client disconnected
+	if exitCode >= 0 && (code == CloseShellExited || code == CloseContainerLost) {
+		end.ExitCode = &exitCode
+	}
+	switch code {
+	case CloseShellExited:
+		if end.ExitCode == nil {
+			end.Reason = EndReasonKilled // By a signal
+		}
+	case CloseContainerLost:
+		end.Reason = EndReasonContainerLost
+	case CloseStartFailed, CloseTerminalError:
+		end.Reason = EndReasonError
+	case CloseInputLimited, CloseSessionEnded:
+		end.Reason = EndReasonKilled
+	}
+	return end
+}
+
+// rejectTerminal shows an error in the client's terminal and closes the connection
+func rejectTerminal(conn *safeConn, reason string) {
+	logWarnf("Terminal connect rejected: %s", reason)
+	conn.WriteMessage(websocket.TextMessage, []byte("\r\n\x1b[31m[CYH] "+reason+"\x1b[0m\r\n"))
+	closeTerminal(conn, CloseConnectRejected, reason)
+}
+
+// terminalNotice shows a message in the client's terminal without closing it
+func terminalNotice(conn *safeConn, text string) {
+	conn.WriteMessage(websocket.TextMessage, []byte("\r\n\x1b[33m[CYH] "+text+"\x1b[0m\r\n"))
+}
+
+// terminalSignals lists the signals a client may send with
+// {"type":"signal","data":"SIGINT"}, mapped to the control byte the terminal
+// turns into that signal. Signals without one (0) are delivered to the
+// foreground process group directly, where the platform supports it.
+var terminalSignals = map[string]byte{
+	"SIGINT":  0x03, // Ctrl-C
+	"SIGQUIT": 0x1c, // Ctrl-\
+	"SIGTSTP": 0x1a, // Ctrl-Z
+	"SIGTERM": 0,
+	"SIGHUP":  0,
+	"SIGKILL": 0,
+}
+
+// parseSignalMessage returns the signal named by a signal message's data and
+// its control byte, or ok=false if the signal isn't allowed
+func parseSignalMessage(data interface{}) (name string, ctrl byte, ok bool) {
+	name, _ = data.(string)
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if name != "" && !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	ctrl, ok = terminalSignals[name]
+	return name, ctrl, ok
+}
+
+// Largest terminal a client may ask for; bigger resizes are clamped so
+// programs never allocate screens of absurd sizes
+const (
+	maxTerminalRows = 500
+	maxTerminalCols = 500
+)
+
+// parseResizeMessage returns the rows and cols of a resize message's data,
+// clamped to maxTerminalRows x maxTerminalCols, or ok=false unless both are
+// at least 1
+func parseResizeMessage(data interface{}) (rows, cols int, ok bool) {
+	size, isMap := data.(map[string]interface{})
+	if !isMap {
+		return 0, 0, false
+	}
+	r, _ := size["rows"].(float64)
+	c, _ := size["cols"].(float64)
+	if r < 1 || c < 1 {
+		return 0, 0, false
+	}
+	return int(min(r, maxTerminalRows)), int(min(c, maxTerminalCols)), true
+}
+
+// resizeEventData is the recorded form of a resize: {"rows":R,"cols":C}
+func resizeEventData(rows, cols int) string {
+	return fmt.Sprintf(`{"rows":%d,"cols":%d}`, rows, cols)
+}
+
+// normalizeResizeEventData converts a resize recorded in the older format,
+// the client's whole message ({"type":"resize","data":{"rows":R,"cols":C}}),
+// to the current one. Anything else is returned unchanged.
+func normalizeResizeEventData(data string) string {
+	var msg terminalMessage
+	if json.Unmarshal([]byte(data), &msg) != nil || msg.Type != "resize" {
+		return data
+	}
+	size, _ := msg.Data.(map[string]interface{})
+	rows, _ := size["rows"].(float64)
+	cols, _ := size["cols"].(float64)
+	if rows < 1 || cols < 1 {
+		return data
+	}
+	return resizeEventData(int(rows), int(cols))
+}
+
+// container_recreated tells a resuming client that its session's container
+// was gone and a new one was created, either from the session's snapshot
+// image or fresh from the session's image
+const (
+	MsgTypeContainerRecreated  = "container_recreated"
+	ContainerRecreatedSnapshot = "snapshot"
+	ContainerRecreatedFresh    = "fresh"
+)
+
+// Codes sent in terminal error messages
+const (
+	TerminalErrPtyStartFailed    = "pty_start_failed"    // The local shell's PTY couldn't be started
+	TerminalErrDockerExecFailed  = "docker_exec_failed"  // docker exec into the container couldn't be started
+	TerminalErrConPtyStartFailed = "conpty_start_failed" // The Windows pseudo console couldn't be started
+	TerminalErrContainerExited   = "container_exited"    // docker exec ended right after starting, usually because the container stopped
+)
+
+// TerminalError is sent as a text message when a terminal can't be started:
+// {"type":"error","code":"pty_start_failed","message":"..."}
+type TerminalError struct {
+	Type    string `json:"type"` // Always "error"
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// failTerminal sends a structured error to the client and closes the connection
+func failTerminal(conn *safeConn, code string, err error) {
+	logErrorf("Terminal start failed (%s): %v", code, err)
+	conn.WriteJSON(TerminalError{
+		Type:    "error",
+		Code:    code,
+		Message: "Failed to start terminal: " + err.Error(),
+	})
+	closeTerminal(conn, CloseStartFailed, code)
+}
+
+// fastExecExitWindow is how soon a docker exec must end after starting to
+// count as failing to start: the container stopped between being prepared
+// and the exec, which then died at once
+const fastExecExitWindow = 500 * time.Millisecond
+
+// maxExecStderr caps the docker exec error output kept for the client
+const maxExecStderr = 2048
+
+// execStderr keeps the start of what docker exec writes to its own stderr.
+// The shell's output goes through the PTY, so only docker's errors end up
+// here, like "container ... is not running".
+type execStderr struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (e *execStderr) Write(p []byte) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if room := maxExecStderr - len(e.buf); room > 0 {
+		e.buf = append(e.buf, p[:min(len(p), room)]...)
+	}
+	return len(p), nil
+}
+
+func (e *execStderr) String() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return strings.TrimSpace(strings.ToValidUTF8(string(e.buf), ""))
+}
+
+// reportContainerExited tells the client its docker exec ended right after
+// starting, with docker's error output or the exit status as detail. The
+// caller closes the connection with CloseStartFailed.
+func reportContainerExited(conn *safeConn, containerName, detail string) {
+	logWarnf("docker exec into %s exited right after starting: %s", containerName, detail)
+	message := "The shell exited right after starting; container " + containerName + " may have stopped"
+	if detail != "" {
+		message += ": " + detail
+	}
+	conn.WriteJSON(TerminalError{
+		Type:    "error",
+		Code:    TerminalErrContainerExited,
+		Message: message,
+	})
+}
+
+// TerminalEnv is the terminal type and locale negotiated with the client
+type TerminalEnv struct {
+	Term      string
+	ColorTerm string // Empty when the client doesn't support truecolor
+	Lang      string
+}
+
+// defaultTerminalEnv matches xterm.js in the bundled frontend
+var defaultTerminalEnv = TerminalEnv{
+	Term:      "xterm-256color",
+	ColorTerm: "truecolor",
+	Lang:      "en_US.UTF-8",
+}
+
+// allowedTerms lists TERM values clients may request
+var allowedTerms = map[string]bool{
+	"xterm-256color":  true,
+	"xterm-color":     true,
+	"xterm":           true,
+	"screen-256color": true,
+	"tmux-256color":   true,
+	"linux":           true,
+	"vt220":           true,
+	"vt100":           true,
+	"dumb":            true,
+}
+
+// langPattern accepts UTF-8 locales like de_DE.UTF-8 plus C/POSIX
+var langPattern = regexp.MustCompile(`^([a-z]{2,3}(_[A-Z]{2})?\.(UTF-8|utf8)|C\.UTF-8|C|POSIX)$`)
+
+// negotiateTerminalEnv reads ?term=, ?lang= and ?color= (truecolor, 256, 16)
+// from the connect URL. Values outside the allowlist keep the defaults.
+func negotiateTerminalEnv(r *http.Request) TerminalEnv {
+	env := defaultTerminalEnv
+	query := r.URL.Query()
+
+	if term := query.Get("term"); term != "" {
+		if allowedTerms[term] {
+			env.Term = term
+		} else {
+			logDebugf("Ignoring unsupported TERM %q from client", term)
+		}
+	}
+
+	if lang := query.Get("lang"); lang != "" {
+		if langPattern.MatchString(lang) {
+			env.Lang = lang
+		} else {
+			logDebugf("Ignoring unsupported locale %q from client", lang)
+		}
+	}
+
+	switch query.Get("color") {
+	case "truecolor", "24bit":
+		env.ColorTerm = "truecolor"
+	case "256", "16", "none":
+		env.ColorTerm = ""
+	}
+
+	return env
+}
+
+// Vars returns the environment assignments for the PTY or docker exec
+func (te TerminalEnv) Vars() []string {
+	vars := []string{"TERM=" + te.Term}
+	if te.ColorTerm != "" {
+		vars = append(vars, "COLORTERM="+te.ColorTerm)
+	}
+	return append(vars, "LANG="+te.Lang, "LC_ALL="+te.Lang)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// ensureUserContainer makes sure a user-specific container exists and is running.
+// Starting or creating a container is refused when the host is at capacity,
+// unless username is an admin. Concurrent connects for the same container
+// share one attempt, so only one of them creates it and runs the template's
+// init commands.
+func ensureUserContainer(containerName, username string, spec ContainerSpec) error {
+	return containerStarts.Do(containerName, func() error {
+		return startUserContainer(containerName, username, spec)
+	})
+}
+
+func startUserContainer(containerName, username string, spec ContainerSpec) error {
+	// Check if container is running
+	checkCmd := exec.Command("docker", "ps", "-q", "-f", "name=^"+containerName+"$")
+	output, _ := checkCmd.Output()
+	if len(output) > 0 {
+		return nil // Container is already running
+	}
+
+	if !authManager.IsAdmin(username) {
+		if err := dockerMgr.CheckCapacity(); err != nil {
+			return err
+		}
+	}
+
+	// Check if container exists but stopped
+	checkExistsCmd := exec.Command("docker", "ps", "-aq", "-f", "name=^"+containerName+"$")
+	output, _ = checkExistsCmd.Output()
+	if len(output) > 0 {
+		// Start existing container
+		if output, err := exec.Command("docker", "start", containerName).CombinedOutput(); err != nil {
+			logErrorf("Failed to start container %s: %v", containerName, err)
+			return fmt.Errorf("starting container %s: %w: %s", containerName, err, strings.TrimSpace(string(output)))
+		}
+		return nil
+	}
+
+	// Create new container for this user (a missing template image fails here)
+	logInfof("Creating new container for user: %s", containerName)
+	createCmd := exec.Command("docker", spec.RunArgs(containerName)...)
+	if output, err := createCmd.CombinedOutput(); err != nil {
+		logErrorf("Failed to create container %s: %v", containerName, err)
+		return fmt.Errorf("creating container %s: %w: %s", containerName, err, strings.TrimSpace(string(output)))
+	}
+
+	// Template setup runs before the user's terminal attaches
+	dockerMgr.RunInitCommands(containerName, spec)
+	return nil
+}
+
+func legacyContainerName(username string) string {
+	if username == "guest" {
+		return "cyh_guest_terminal"
+	}
+	return "cyh_" + username + "_terminal"
+}
+
+// checkTargetContainer applies the one-container-per-session rule to a
+// connect that asks for a specific container. A container owned by another
+// session is only reachable by resuming that session, and asking a resumed
+// session for a different container starts a new session, so input and
+// output are never recorded under the wrong session. It returns the session
+// to resume ("" for a new one), or ok=false after rejecting the connect.
+func checkTargetContainer(conn *safeConn, username, activeSessID string, session *TermSession, targetContainer string) (string, bool) {
+	// Every guest session uses the shared guest container in shared mode
+	sharedGuest := isGuestUser(username) && targetContainer == legacyContainerName("guest")
+	if owner, err := sessionMgr.GetSessionByContainer(targetContainer); err == nil && owner.ID != activeSessID && !sharedGuest {
+		logWarnf("Warning: User %s attempted to attach to container %s of session %s", username, targetContainer, owner.ID)
+		rejectTerminal(conn, "Container "+targetContainer+" belongs to another session. Switch to that session to use it.")
+		return "", false
+	}
+	if activeSessID != "" && session.ContainerName != "" && session.ContainerName != targetContainer {
+		logInfof("Session %s is bound to %s, starting a new session for %s", activeSessID, session.ContainerName, targetContainer)
+		return "", true
+	}
+	return activeSessID, true
+}
+
+// sessionContainer is the container a docker terminal attaches to
+type sessionContainer struct {
+	Name        string
+	Spec        ContainerSpec
+	ExecUser    string // Empty for root
+	ResumeDir   string // Resumed sessions start here: the shell's last working directory, if it still exists
+	PromptTheme string // The session's prompt theme, see promptPS1
+}
+
+// prepareSessionContainer picks the session's container (falling back to the
+// legacy per-user container), creates or starts it and resolves the user to
+// exec as. It returns ok=false after ending the session and rejecting the
+// connect when the container can't be started.
+func prepareSessionContainer(conn *safeConn, username, activeSessID string, session *TermSession, targetContainer string, isResuming bool) (sessionContainer, bool) {
+	// Session-specific container name (fallback to legacy per-user container)
+	userContainerName := legacyContainerName(username)
+	if session != nil && session.ContainerName != "" {
+		userContainerName = session.ContainerName
+	}
+
+	// Check if specific container requested (not bound to another session, see checkTargetContainer)
+	if targetContainer != "" {
+		// Basic security check: ensure it belongs to user (starts with prefix)
+		expectedPrefix := containerUserPrefix(username)
+		if username == "guest" {
+			expectedPrefix = "cyh_guest_"
+		}
+
+		// Allow if it matches user prefix OR if it is the expected session container
+		if strings.HasPrefix(targetContainer, expectedPrefix) || targetContainer == userContainerName {
+			userContainerName = targetContainer
+			logDebugf("Connecting to specific container: %s", userContainerName)
+			if session != nil && session.ContainerName != userContainerName {
+				_ = sessionMgr.SetSessionContainerName(session.ID, userContainerName)
+				session.ContainerName = userContainerName
+			}
+		} else {
+			logWarnf("Warning: User %s attempted to access unauthorized container %s", username, targetContainer)
+			// Fallback to default or error? Let's fallback to default for safety
+		}
+	}
+
+	logDebugf("Starting CYH Hacking Docker terminal for user: %s (container: %s)", username, userContainerName)
+
+	// Clean up the user's container from before per-session containers,
+	// unless this terminal is about to use it
+	if userContainerName != legacyContainerName(username) {
+		checkLegacyContainer(conn, username)
+	}
+
+	// Apply the session's template (if any) when creating the container
+	spec := defaultContainerSpec()
+	if session != nil && session.TemplateID != "" {
+		if tmpl, err := sessionMgr.GetTemplate(session.TemplateID); err == nil {
+			spec = tmpl.ContainerSpec()
+		} else {
+			logWarnf("Template %s for session %s not found, using defaults", session.TemplateID, session.ID)
+		}
+	}
+	spec.ExtraFlags = sessionContainerFlags(session)
+
+	// A resumed session whose container was removed gets a new one,
+	// restored from its snapshot when there is one
+	recreated := ""
+	if isResuming && session.ContainerName != "" && !dockerMgr.ContainerExists(userContainerName) {
+		recreated = ContainerRecreatedFresh
+		if session.SnapshotImage != "" && dockerMgr.ImageExists(session.SnapshotImage) {
+			spec.Image = session.SnapshotImage
+			spec.InitCommands = nil // Already applied in the snapshot
+			recreated = ContainerRecreatedSnapshot
+		}
+		logInfof("Container %s of session %s is gone, recreating (%s)", userContainerName, session.ID, recreated)
+	}
+
+	// Ensure user's container exists and is running (idempotent)
+	if err := ensureUserContainer(userContainerName, username, spec); err != nil {
+		if activeSessID != "" {
+			sessionMgr.EndSession(activeSessID, SessionEnd{Reason: EndReasonError})
+		}
+		rejectTerminal(conn, "Cannot start your container: "+err.Error())
+		return sessionContainer{}, false
+	}
+	if recreated != "" {
+		conn.WriteJSON(map[string]interface{}{
+			"type":       MsgTypeContainerRecreated,
+			"session_id": session.ID,
+			"container":  userContainerName,
+			"source":     recreated,
+			"image":      spec.Image,
+		})
+	}
+	if session != nil {
+		sessionMgr.MarkContainerActive(session.ID)
+	}
+
+	// Exec as the session's non-root user if one was chosen and exists
+	execUser := ""
+	if session != nil {
+		execUser = session.ContainerUser
+	}
+	if execUser != "" && !dockerMgr.ContainerUserExists(userContainerName, execUser) {
+		logWarnf("User %s not found in container %s, falling back to root", execUser, userContainerName)
+		conn.WriteMessage(websocket.BinaryMessage, []byte(
+			"\r\n\x1b[33m[CYH] User '"+execUser+"' does not exist in this container. Falling back to root.\x1b[0m\r\n"))
+		execUser = ""
+	}
+
+	// Resume in the shell's last working directory (CYH_RESTORE_CWD), unless
+	// it is gone, e.g. with a recreated container
+	resumeDir := ""
+	if isResuming && serverConfig.RestoreCwd && session != nil && session.LastCwd != "" {
+		if dockerMgr.ContainerDirExists(userContainerName, execUser, session.LastCwd) {
+			resumeDir = session.LastCwd
+		} else {
+			logDebugf("Last working directory %s of session %s is gone, starting in the default", session.LastCwd, session.ID)
+		}
+	}
+
+	container := sessionContainer{Name: userContainerName, Spec: spec, ExecUser: execUser, ResumeDir: resumeDir}
+	if session != nil {
+		container.PromptTheme = session.PromptTheme
+	}
+	return container, true
+}
+
+// ExecArgs builds the docker exec arguments for an interactive login shell.
+// A resumed session sets CYH_SKIP_BANNER=1 to skip the welcome banner and
+// starts in ResumeDir when there is one.
+func (c sessionContainer) ExecArgs(termEnv TerminalEnv, isResuming bool) []string {
+	// Use docker exec with -it for interactive TTY
+	dockerArgs := []string{"exec", "-it"}
+	for _, v := range termEnv.Vars() {
+		dockerArgs = append(dockerArgs, "-e", v)
+	}
+	ps1 := promptPS1(c.PromptTheme, c.ExecUser)
+	if serverConfig.RestoreCwd {
+		ps1 = cwdReportPS1 + ps1
+	}
+	dockerArgs = append(dockerArgs, "-e", "PS1="+ps1)
+	if isResuming {
+		dockerArgs = append(dockerArgs, "-e", "CYH_SKIP_BANNER=1")
+	}
+	if c.ExecUser != "" {
+		dockerArgs = append(dockerArgs, "-u", c.ExecUser)
+	}
+	workDir := containerHomeDir(c.ExecUser)
+	if c.Spec.WorkingDir != "" {
+		workDir = c.Spec.WorkingDir
+	}
+	if isResuming && c.ResumeDir != "" {
+		workDir = c.ResumeDir
+	}
+	return append(dockerArgs, "-w", workDir, c.Name, "/bin/bash", "--login")
+}
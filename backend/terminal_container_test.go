@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestSessionManager points sessionMgr at a throwaway database
+func newTestSessionManager(t *testing.T) {
+	t.Helper()
+	sm, err := NewSessionManager(t.TempDir() + "/sessions.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionMgr = sm
+	t.Cleanup(func() {
+		sm.Close()
+		sessionMgr = nil
+	})
+}
+
+// newTestTerminalConn returns the server side of a websocket connection and
+// the client dialed into it
+func newTestTerminalConn(t *testing.T) (*safeConn, *websocket.Conn) {
+	t.Helper()
+	accepted := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		accepted <- conn
+	}))
+	t.Cleanup(srv.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	select {
+	case conn := <-accepted:
+		t.Cleanup(func() { conn.Close() })
+		return &safeConn{Conn: conn}, client
+	case <-time.After(5 * time.Second):
+		t.Fatal("websocket connection was never accepted")
+		return nil, nil
+	}
+}
+
+func TestCheckTargetContainerRejectsAnotherSessionsContainer(t *testing.T) {
+	newTestSessionManager(t)
+	victim, err := sessionMgr.CreateSession("bob", "Victim", "docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	attacker, err := sessionMgr.CreateSession("bob", "Attacker", "docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		activeSessID string
+		session      *TermSession
+	}{
+		{name: "new session", activeSessID: ""},
+		{name: "resumed session", activeSessID: attacker.ID, session: attacker},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, client := newTestTerminalConn(t)
+
+			id, ok := checkTargetContainer(conn, "bob", tt.activeSessID, tt.session, victim.ContainerName)
+			if ok || id != "" {
+				t.Fatalf("checkTargetContainer = (%q, %v), want the connect rejected", id, ok)
+			}
+
+			client.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, msg, err := client.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(msg), "belongs to another session") {
+				t.Fatalf("rejection message = %q", msg)
+			}
+			_, _, err = client.ReadMessage()
+			if !websocket.IsCloseError(err, CloseConnectRejected) {
+				t.Fatalf("close = %v, want code %d", err, CloseConnectRejected)
+			}
+		})
+	}
+}
+
+func TestCheckTargetContainerAllowed(t *testing.T) {
+	newTestSessionManager(t)
+	own, err := sessionMgr.CreateSession("bob", "Own", "docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	guest, err := sessionMgr.CreateSession("guest", "Guest", "docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared := legacyContainerName("guest")
+	if err := sessionMgr.SetSessionContainerName(guest.ID, shared); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		username     string
+		activeSessID string
+		session      *TermSession
+		target       string
+		want         string
+	}{
+		{name: "resume into its own container", username: "bob", activeSessID: own.ID, session: own, target: own.ContainerName, want: own.ID},
+		{name: "new session on an unbound container", username: "bob", target: "cyh_bob_sess_unbound"},
+		{name: "resumed session asking for another container starts a new one", username: "bob", activeSessID: own.ID, session: own, target: "cyh_bob_sess_unbound"},
+		{name: "guests share the shared guest container", username: "guest", target: shared},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, _ := newTestTerminalConn(t)
+
+			id, ok := checkTargetContainer(conn, tt.username, tt.activeSessID, tt.session, tt.target)
+			if !ok || id != tt.want {
+				t.Fatalf("checkTargetContainer = (%q, %v), want (%q, true)", id, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecArgsSkipsBannerOnlyWhenResuming(t *testing.T) {
+	c := sessionContainer{Name: "cyh_bob_sess_1", ExecUser: "user"}
+
+	for _, resuming := range []bool{false, true} {
+		args := c.ExecArgs(defaultTerminalEnv, resuming)
+		skips := 0
+		for i := 0; i+1 < len(args); i++ {
+			if args[i] == "-e" && args[i+1] == "CYH_SKIP_BANNER=1" {
+				skips++
+			}
+		}
+		want := 0
+		if resuming {
+			want = 1
+		}
+		if skips != want {
+			t.Errorf("ExecArgs(resuming=%v) sets CYH_SKIP_BANNER=1 %d times, want %d: %q", resuming, skips, want, args)
+		}
+	}
+}
@@ -4,16 +4,15 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
 	"io"
-	"log"
 	"net/http"
 	"os"
 	"os/exec"
 	"sync"
 	"syscall"
 	"time"
-	"strings"
 	"github.com/creack/pty"
 	"github.com/gorilla/websocket"
 )
@@ -21,55 +20,37 @@ import (
 type terminalMessage struct {
 	Type string      `json:"type"`
 	Data interface{} `json:"data"`
+	Pane string      `json:"pane,omitempty"` // Extra pane the message is for (see terminal_panes.go)
 }
 
-// ensureUserContainer makes sure a user-specific container exists and is running
-func ensureUserContainer(containerName string) {
-	// Check if container is running
-	checkCmd := exec.Command("docker", "ps", "-q", "-f", "name=^"+containerName+"$")
-	output, _ := checkCmd.Output()
-	if len(output) > 0 {
-		return // Container is already running
+func handleTerminal(w http.ResponseWriter, r *http.Request) {
+	// Get username from session cookie
+	username := "guest"
+	if cookie, err := r.Cookie("cyh_session"); err == nil {
+		if user, valid := authManager.ValidateSession(cookie.Value); valid {
+			username = user
+		}
 	}
 
-	// Check if container exists but stopped
-	checkExistsCmd := exec.Command("docker", "ps", "-aq", "-f", "name=^"+containerName+"$")
-	output, _ = checkExistsCmd.Output()
-	if len(output) > 0 {
-		// Start existing container
-		exec.Command("docker", "start", containerName).Run()
+	// Open terminals keep running in maintenance mode, but no new ones start
+	if !checkMaintenance(w, r) {
 		return
 	}
 
-	// Create new container for this user
-	log.Printf("Creating new container for user: %s", containerName)
-	createCmd := exec.Command("docker", "run",
-		"-d",
-		"--name", containerName,
-		"--hostname", "canyouhack",
-		"-e", "TERM=xterm-256color",
-		"-e", "COLORTERM=truecolor",
-		"-e", "LANG=en_US.UTF-8",
-		"-e", "LC_ALL=en_US.UTF-8",
-		DockerImageName,
-		"tail", "-f", "/dev/null",
-	)
-	createCmd.Run()
-}
-
-func legacyContainerName(username string) string {
-	if username == "guest" {
-		return "cyh_guest_terminal"
+	// Cap open terminals per guest IP or user before upgrading
+	releaseConn, ok := acquireWSConn(w, r, username)
+	if !ok {
+		return
 	}
-	return "cyh_" + username + "_terminal"
-}
+	defer releaseConn()
 
-func handleTerminal(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	wsConn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("WebSocket upgrade error: %v", err)
+		logWarnf("WebSocket upgrade error: %v", err)
 		return
 	}
+	// Output, bell and input-limit warnings are written from different goroutines
+	conn := &safeConn{Conn: wsConn}
 
 	// Get terminal mode from query parameter
 	mode := r.URL.Query().Get("mode")
@@ -77,14 +58,16 @@ func handleTerminal(w http.ResponseWriter, r *http.Request) {
 		mode = "local"
 	}
 
-	// Get username from session cookie
-	username := "guest"
-	if cookie, err := r.Cookie("cyh_session"); err == nil {
-		if user, valid := authManager.ValidateSession(cookie.Value); valid {
-			username = user
-		}
+	// Enforce enabled modes and the docker fallback policy
+	mode, err = resolveTerminalMode(mode, mode == "docker" && dockerMgr.IsDockerImageBuilt())
+	if err != nil {
+		rejectTerminal(conn, err.Error())
+		return
 	}
 
+	prefs := authManager.GetPreferences(username)
+	termEnv := negotiateTerminalEnv(r)
+
 	// Active Session Management (Auto-Create)
 	activeSessID := r.URL.Query().Get("session_id")
 	var session *TermSession
@@ -93,123 +76,223 @@ func handleTerminal(w http.ResponseWriter, r *http.Request) {
 		// Try to resume existing session
 		session, err = sessionMgr.GetSession(activeSessID)
 		if err != nil {
-			log.Printf("Failed to resume session %s: %v", activeSessID, err)
+			logErrorf("Failed to resume session %s: %v", activeSessID, err)
 			activeSessID = "" // Create new if not found
 		} else {
-			// Resuming - verify ownership
-			if session.User != username {
+			// Resuming - verify ownership (and a guest's key)
+			if !canResumeSession(r, session, username) {
 				activeSessID = "" // Create new if owner mismatch
 			}
 		}
 	}
 
+	// Each session is bound to its own container
+	targetContainer := r.URL.Query().Get("container")
+	if mode == "docker" && targetContainer != "" {
+		var ok bool
+		if activeSessID, ok = checkTargetContainer(conn, username, activeSessID, session, targetContainer); !ok {
+			return
+		}
+	}
+
+	// Names a new session after its first command, if the user wants that
+	var namer *sessionAutoNamer
+
 	if activeSessID == "" {
 		// Auto-create new session
-		sessName := "Terminal " + time.Now().Format("15:04:05")
+		sessName := fitSessionName("Terminal " + time.Now().Format("15:04:05"))
+		// Generated names never fail the connect, even under the reject policy
+		// or a short CYH_MAX_SESSION_NAME_LENGTH
+		if unique, err := sessionMgr.ResolveSessionName(username, sessName, "", SessionNamesSuffix); err == nil {
+			sessName = unique
+		}
 		session, err = sessionMgr.CreateSession(username, sessName, mode)
 		if err != nil {
-			log.Printf("Failed to create session: %v", err)
+			logErrorf("Failed to create session: %v", err)
 			// Continue without recording if DB fails? Or fail? 
 			// Let's continue but warn
 		} else {
 			activeSessID = session.ID
-			// Notify client about new session ID
-			conn.WriteJSON(map[string]interface{}{
+			namer = newSessionAutoNamer(session, prefs)
+
+			// Optional non-root user for docker sessions
+			if containerUser := r.URL.Query().Get("container_user"); mode == "docker" && containerUser != "" && containerUser != "root" {
+				if IsValidContainerUser(containerUser) {
+					if err := sessionMgr.SetSessionContainerUser(session.ID, containerUser); err == nil {
+						session.ContainerUser = containerUser
+					}
+				} else {
+					logWarnf("Ignoring invalid container user %q for session %s", containerUser, session.ID)
+				}
+			}
+
+			// Keep the container after the session ends (when reaping is enabled)
+			if mode == "docker" && r.URL.Query().Get("persist") == "true" {
+				if err := sessionMgr.SetSessionPersistContainer(session.ID, true); err == nil {
+					session.PersistContainer = true
+				}
+			}
+
+			// Optional template for docker sessions
+			if templateID := r.URL.Query().Get("template_id"); mode == "docker" && templateID != "" {
+				if tmpl, err := sessionMgr.GetTemplate(templateID); err == nil && canUseTemplate(tmpl, username) {
+					if err := sessionMgr.SetSessionTemplate(session.ID, tmpl.ID); err == nil {
+						session.TemplateID = tmpl.ID
+					}
+				} else {
+					logWarnf("Ignoring unknown template %q for session %s", templateID, session.ID)
+				}
+			}
+
+			// Optional recording level override
+			if level := r.URL.Query().Get("recording"); level != "" && level != session.RecordingLevel {
+				if IsValidRecordingLevel(level) {
+					if err := sessionMgr.SetSessionRecordingLevel(session.ID, level); err == nil {
+						session.RecordingLevel = level
+					}
+				} else {
+					logWarnf("Ignoring invalid recording level %q for session %s", level, session.ID)
+				}
+			}
+
+			// Notify client about new session ID; a guest needs the key to resume it
+			msg := map[string]interface{}{
 				"type": "session_id",
 				"data": activeSessID,
-			})
+			}
+			if key := issueGuestKey(session); key != "" {
+				msg[guestKeyParam] = key
+			}
+			conn.WriteJSON(msg)
 		}
 	} else {
-		log.Printf("Resuming session: %s", activeSessID)
+		logDebugf("Resuming session: %s", activeSessID)
+		sessionMgr.ResumeSession(session)
 		// Notify client about resumed session ID
 		conn.WriteJSON(map[string]interface{}{
 			"type": "session_id",
 			"data": activeSessID,
 		})
 
-		// NOTE: Session replay is now handled by the frontend AFTER the shell 
-		// initializes and displays its welcome banner. The frontend calls
-		// /api/sessions/{id}/data and renders the history after a delay.
-		// This prevents the shell's 'clear' command from erasing the replay.
-		log.Printf("Session %s will be replayed by frontend after shell init", activeSessID)
+		// NOTE: Session replay is handled by the frontend AFTER the shell
+		// initializes and displays its welcome banner: it renders
+		// /api/sessions/{id}/data once we send resume_ready (see
+		// resume_ready.go), so the shell's 'clear' can't erase the replay.
+		logDebugf("Session %s will be replayed by frontend after shell init", activeSessID)
 	}
 
 	// Track if we're resuming (not creating a new session)
 	isResuming := activeSessID != "" && r.URL.Query().Get("session_id") != ""
 
-	var cmd *exec.Cmd
+	// What gets recorded for this session (CYH_RECORDING_LEVEL or per-session override)
+	recordOutput, recordInput := true, true
+	if session != nil {
+		recordOutput, recordInput = session.RecordsOutput(), session.RecordsInput()
 
-	// Start the appropriate shell
-	if mode == "docker" && dockerMgr.IsDockerImageBuilt() {
-		// Session-specific container name (fallback to legacy per-user container)
-		userContainerName := legacyContainerName(username)
-		if session != nil && session.ContainerName != "" {
-			userContainerName = session.ContainerName
+		// A session whose recording reached CYH_MAX_RECORDING_DURATION stays capped
+		if session.RecordingCappedAt != nil {
+			recordOutput, recordInput = false, false
+			conn.WriteJSON(map[string]interface{}{
+				"type":       MsgTypeRecordingCapped,
+				"session_id": session.ID,
+			})
 		}
+	}
 
-		// Check if specific container requested
-		targetContainer := r.URL.Query().Get("container")
-		if targetContainer != "" {
-			// Basic security check: ensure it belongs to user (starts with prefix)
-			expectedPrefix := containerUserPrefix(username)
-			if username == "guest" {
-				expectedPrefix = "cyh_guest_"
-			}
+	var cmd *exec.Cmd
+	containerName := "" // Docker mode only
 
-			// Allow if it matches user prefix OR if it is the expected session container
-			if strings.HasPrefix(targetContainer, expectedPrefix) || targetContainer == userContainerName {
-				userContainerName = targetContainer
-				log.Printf("Connecting to specific container: %s", userContainerName)
-				if session != nil && session.ContainerName != userContainerName {
-					_ = sessionMgr.SetSessionContainerName(session.ID, userContainerName)
-					session.ContainerName = userContainerName
-				}
-			} else {
-				log.Printf("Warning: User %s attempted to access unauthorized container %s", username, targetContainer)
-				// Fallback to default or error? Let's fallback to default for safety
-			}
-		}
-		
-		log.Printf("Starting CYH Hacking Docker terminal for user: %s (container: %s)", username, userContainerName)
-		
-		// Ensure user's container exists and is running (idempotent)
-		ensureUserContainer(userContainerName)
-		
-		// Use docker exec with -it for interactive TTY
-		// If resuming, add CYH_SKIP_BANNER=1 to skip welcome banner
-		dockerArgs := []string{"exec", "-it",
-			"-e", "TERM=xterm-256color",
-			"-e", "COLORTERM=truecolor",
-			"-e", `PS1=\[\e[32m\]canyouhack\[\e[0m\]@\[\e[31m\]root\[\e[0m\]:\[\e[36m\]\w\[\e[0m\]$ `,
-		}
-		if isResuming {
-			dockerArgs = append(dockerArgs, "-e", "CYH_SKIP_BANNER=1")
+	// Start the appropriate shell
+	var container sessionContainer // Docker mode only
+	if mode == "docker" {
+		var ok bool
+		container, ok = prepareSessionContainer(conn, username, activeSessID, session, targetContainer, isResuming)
+		if !ok {
+			return
 		}
-		dockerArgs = append(dockerArgs, "-w", "/root", userContainerName, "/bin/bash", "--login")
-		cmd = exec.Command("docker", dockerArgs...)
+		containerName = container.Name
+		cmd = exec.Command("docker", container.ExecArgs(termEnv, isResuming)...)
 	} else {
-		log.Printf("Starting local terminal...")
+		logDebugf("Starting local terminal...")
 		cmd = exec.Command("/bin/bash", "--login")
 	}
 
 	// Set environment
-	cmd.Env = append(os.Environ(),
-		"TERM=xterm-256color",
-		"COLORTERM=truecolor",
-		"LANG=en_US.UTF-8",
-		"LC_ALL=en_US.UTF-8",
-	)
+	cmd.Env = append(os.Environ(), termEnv.Vars()...)
+
+	// Keep docker's own errors apart from the shell's output, to explain an
+	// exec that dies at once
+	var execErr execStderr
+	if mode == "docker" {
+		cmd.Stderr = &execErr
+	}
+
+	// Extra panes run another shell the same way, without the welcome banner
+	startPane := func() (paneProcess, error) {
+		paneCmd := exec.Command("/bin/bash", "--login")
+		if mode == "docker" {
+			paneCmd = exec.Command("docker", container.ExecArgs(termEnv, true)...)
+		}
+		paneCmd.Env = append(os.Environ(), termEnv.Vars()...)
+		return startPtyPane(paneCmd, mode == "docker")
+	}
 
 	// Start with PTY
 	ptmx, err := pty.StartWithSize(cmd, &pty.Winsize{Rows: 30, Cols: 120})
 	if err != nil {
-		log.Printf("Failed to start PTY: %v", err)
-		conn.WriteMessage(websocket.TextMessage, []byte("Failed to start terminal"))
-		conn.Close()
+		code := TerminalErrPtyStartFailed
+		if mode == "docker" {
+			code = TerminalErrDockerExecFailed
+		}
+		failTerminal(conn, code, err)
 		return
 	}
 
-	log.Printf("Terminal session started (mode: %s, pid: %d, session: %s)", mode, cmd.Process.Pid, activeSessID)
+	started := time.Now()
+	logInfof("Terminal session started (mode: %s, pid: %d, session: %s)", mode, cmd.Process.Pid, activeSessID)
+	termStats.connectionOpened()
+	defer termStats.connectionClosed()
+
+	// Tell a resuming client when the prompt is up so it can replay history
+	var resume *resumeWatcher
+	if isResuming {
+		resume = newResumeWatcher(conn, activeSessID, serverConfig.ResumeReadyTimeout)
+		defer resume.Stop()
+	}
+
+	// Type the session's startup commands into the shell, each at a prompt,
+	// recorded like typed input
+	startup := newStartupRunner(conn, activeSessID, sessionStartupCommands(session), serverConfig.ResumeReadyTimeout,
+		func(data []byte) error {
+			_, err := ptmx.Write(data)
+			return err
+		},
+		func(command string) {
+			if activeSessID == "" {
+				return
+			}
+			sessionMgr.CountIO(activeSessID, len(command)+1, 0)
+			if recordInput {
+				go sessionMgr.AddEvent(activeSessID, "input", command+"\r")
+				go sessionMgr.AddEvent(activeSessID, "command", command)
+			}
+		})
+	defer startup.Stop()
+
+	// Why the terminal closes, sent to the client in the close frame
+	var cause terminalCloseCause
+
+	// Let a session ended elsewhere (POST /end) reach this terminal
+	var registered *terminalConn
+	if activeSessID != "" {
+		registered = terminals.Register(activeSessID, conn, func(reason string) {
+			cause.Set(CloseSessionEnded, reason)
+			ptmx.Close()
+			closeTerminal(conn, CloseSessionEnded, reason)
+		})
+	}
+
+	panes := newTerminalPanes(conn, activeSessID, recordOutput, recordInput, prefs, startPane)
 
 	var wg sync.WaitGroup
 	var closeOnce sync.Once
@@ -223,7 +306,9 @@ func handleTerminal(w http.ResponseWriter, r *http.Request) {
 
 	// Cleanup function
 	cleanup := func() {
+		ranFor := time.Since(started)
 		closeDone()
+		panes.CloseAll()
 		
 		if ptmx != nil {
 			ptmx.Close()
@@ -247,27 +332,78 @@ func handleTerminal(w http.ResponseWriter, r *http.Request) {
 				cmd.Wait()
 			}
 		}
+
+		// A docker exec that ended right after starting most likely found
+		// the container stopped; say why instead of closing on a blank terminal
+		execFailed := false
+		if code, _, _ := cause.Get(); code == CloseShellExited && containerName != "" && ranFor < fastExecExitWindow {
+			execFailed = true
+			detail := execErr.String()
+			if detail == "" && cmd.ProcessState != nil {
+				detail = cmd.ProcessState.String()
+			}
+			reportContainerExited(conn, containerName, detail)
+		}
 		
-		conn.Close()
-		
-		// End session recording
-		if activeSessID != "" {
-			sessionMgr.EndSession(activeSessID)
+		// How the terminal closes, also recorded as how its session ended
+		code, reason, _ := cause.Get()
+		if execFailed {
+			code, reason = CloseStartFailed, TerminalErrContainerExited
+		} else if code == CloseShellExited {
+			if cmd.ProcessState != nil {
+				reason = cmd.ProcessState.String()
+			}
+			code, reason = shellExitCause(containerName, reason)
+		}
+		exitCode := -1
+		if cmd != nil && cmd.ProcessState != nil {
+			exitCode = cmd.ProcessState.ExitCode()
+		}
+
+		// End session recording, unless it was already ended elsewhere
+		if activeSessID != "" && terminals.Unregister(activeSessID, registered) {
+			err := sessionMgr.EndSession(activeSessID, terminalSessionEnd(code, exitCode))
+			if err == nil {
+				conn.WriteJSON(map[string]interface{}{
+					"type":       MsgTypeSessionEnded,
+					"session_id": activeSessID,
+					"reason":     SessionEndedTerminalClosed,
+				})
+				liveHub.CloseRoom(activeSessID, SessionEndedTerminalClosed)
+			} else if err == sql.ErrNoRows {
+				// Resumed sessions aren't tracked as active, so apply the
+				// container reaping policy directly
+				sessionMgr.ReleaseSessionContainer(activeSessID)
+				if !terminals.Has(activeSessID) {
+					liveHub.CloseRoom(activeSessID, SessionEndedTerminalClosed)
+				}
+			}
 		}
+
+		closeTerminal(conn, code, reason)
 		
-		log.Printf("Terminal session ended (mode: %s)", mode)
+		logInfof("Terminal session ended (mode: %s)", mode)
 	}
 
 	// PTY -> WebSocket (terminal output to browser AND recording)
 	wg.Add(1)
+	termStats.goroutineStarted()
 	go func() {
 		defer wg.Done()
+		defer termStats.goroutineDone()
 		defer closeDone()
 		
 		buf := make([]byte, 32*1024)
+		var scanner outputScanner
+		var titles titleScanner
+		var cwds cwdScanner
+		trackCwd := mode == "docker" && serverConfig.RestoreCwd && activeSessID != ""
+		lastCwd := ""
+		cwdWriter := &lastCwdWriter{sessionID: activeSessID}
 		for {
 			n, err := ptmx.Read(buf)
 			if err != nil {
+				cause.Set(CloseShellExited, "")
 				if err != io.EOF {
 					select {
 					case <-done:
@@ -281,17 +417,54 @@ func handleTerminal(w http.ResponseWriter, r *http.Request) {
 			
 			if n > 0 {
 				data := buf[:n]
+
+				// Detect terminal bell (opt-in per user)
+				rang := false
+				if prefs.BellNotifications {
+					data, rang = scanner.ScanBell(data, prefs.StripBell)
+				}
 				
 				// Send to websocket
 				err = conn.WriteMessage(websocket.BinaryMessage, data)
 				if err != nil {
+					cause.Set(0, "") // The client is gone
 					return
 				}
+				if resume != nil {
+					resume.Feed(data)
+				}
+				startup.Feed(data)
+
+				if rang {
+					conn.WriteJSON(map[string]interface{}{"type": MsgTypeBell})
+					if activeSessID != "" {
+						liveHub.BroadcastEvent(activeSessID, MsgTypeBell, nil)
+					}
+				}
+
+				// Report window title changes (opt-in per user)
+				if prefs.TitleMessages {
+					if title, ok := titles.Scan(data); ok {
+						conn.WriteJSON(map[string]interface{}{"type": MsgTypeTitle, "data": title})
+					}
+				}
+
+				// Remember the shell's working directory to resume in (CYH_RESTORE_CWD)
+				if trackCwd {
+					if dir, ok := cwds.Scan(data); ok && dir != lastCwd {
+						lastCwd = dir
+						cwdWriter.Save(dir)
+					}
+				}
 				
 				// Record event
 				if activeSessID != "" {
+					sessionMgr.CountIO(activeSessID, 0, len(data))
+
 					// Async record to avoid blocking pty
-					go sessionMgr.AddEvent(activeSessID, "output", string(data))
+					if recordOutput {
+						go sessionMgr.AddEvent(activeSessID, "output", string(data))
+					}
 					
 					// Broadcast if live
 					// Broadcast to live hub (it handles existence check efficiently)
@@ -303,57 +476,132 @@ func handleTerminal(w http.ResponseWriter, r *http.Request) {
 
 	// WebSocket -> PTY (browser input to terminal AND recording)
 	wg.Add(1)
+	termStats.goroutineStarted()
 	go func() {
 		defer wg.Done()
+		defer termStats.goroutineDone()
 		defer closeDone()
 		
+		limiter := newInputLimiter()
+		var editor lineEditor
+		guard := newPasteGuard(conn, prefs)
+		transfers := newFileTransferChannel(conn, username, activeSessID, containerName, container.ExecUser)
 		for {
 			msgType, data, err := conn.ReadMessage()
 			if err != nil {
+				cause.Set(0, "") // The client is gone
 				return
 			}
 
-			// Check for resize message
+			// File uploads have their own size limits instead of the input rate
+			if msgType == websocket.TextMessage && transfers.HandleFrame(data) {
+				continue
+			}
+
+			// Drop input floods, disconnecting on sustained abuse
+			if !applyInputLimit(conn, limiter, len(data)) {
+				continue
+			}
+			confirmed := false  // data is a held paste the client confirmed
+			fromViewer := false // data was typed by a viewer, not the owner
+
+			// Check for resize and signal messages
 			if msgType == websocket.TextMessage {
 				var msg terminalMessage
 				if json.Unmarshal(data, &msg) == nil {
+					if panes.HandleMessage(msg) {
+						continue
+					}
+					// Answers to viewers and chat for the session's live room
+					if handleOwnerLiveMessage(activeSessID, username, msg) {
+						continue
+					}
+					// A viewer's input, forwarded by the owner's page
+					if msg.Type == MsgTypeViewerInput {
+						text, ok := msg.Data.(string)
+						if !ok {
+							continue
+						}
+						data, fromViewer = []byte(text), true
+					}
 					if msg.Type == "resize" {
-						if sizeData, ok := msg.Data.(map[string]interface{}); ok {
-							rows, _ := sizeData["rows"].(float64)
-							cols, _ := sizeData["cols"].(float64)
+						// Apply resize (clamped to the terminal limits)
+						if rows, cols, ok := parseResizeMessage(msg.Data); ok {
+							pty.Setsize(ptmx, &pty.Winsize{
+								Rows: uint16(rows),
+								Cols: uint16(cols),
+							})
 							
-							// Apply resize
-							if rows > 0 && cols > 0 {
-								pty.Setsize(ptmx, &pty.Winsize{
-									Rows: uint16(rows),
-									Cols: uint16(cols),
-								})
-								
-								// Record resize event
-								if activeSessID != "" {
-									go sessionMgr.AddEvent(activeSessID, "resize", string(data))
-								}
+							// Record resize event with the size applied
+							if activeSessID != "" && recordInput {
+								go sessionMgr.AddEvent(activeSessID, "resize", resizeEventData(rows, cols))
 							}
 						}
 						continue
 					}
+					if msg.Type == "signal" {
+						name, ctrl, ok := parseSignalMessage(msg.Data)
+						if !ok {
+							terminalNotice(conn, "Signal not allowed; use SIGINT, SIGQUIT, SIGTSTP, SIGTERM, SIGHUP or SIGKILL")
+							continue
+						}
+						if ctrl == 0 {
+							if err := signalForeground(ptmx, cmd, name, mode == "docker"); err != nil {
+								terminalNotice(conn, "Couldn't send "+name+": "+err.Error())
+							}
+							continue
+						}
+						// Control bytes go through the PTY like typed keys
+						data = []byte{ctrl}
+					}
+					if msg.Type == MsgTypeConfirmPaste || msg.Type == MsgTypeCancelPaste {
+						held, ok := guard.Resolve(msg.Type == MsgTypeConfirmPaste)
+						if !ok {
+							continue
+						}
+						data, confirmed = held, true
+					}
 				}
 			}
 			
-			// Record input event
+			// Hold multi-line and binary pastes until the client confirms them
+			if !confirmed && guard.Hold(data) {
+				continue
+			}
+
 			if activeSessID != "" {
+				sessionMgr.CountIO(activeSessID, len(data), 0)
+				if !fromViewer {
+					markOwnerActive(activeSessID)
+				}
+			}
+
+			// Record input event, plus the command line as edited when Enter is pressed
+			if activeSessID != "" && recordInput {
 				go sessionMgr.AddEvent(activeSessID, "input", string(data))
+				for _, command := range editor.Feed(data) {
+					go sessionMgr.AddEvent(activeSessID, "command", command)
+					namer.Feed(command)
+				}
 			}
 
 			// Write to PTY
 			_, err = ptmx.Write(data)
 			if err != nil {
+				cause.Set(CloseTerminalError, "Terminal write failed")
 				return
 			}
 		}
 	}()
 
-	// Wait for goroutines to finish
-	wg.Wait()
+	// Tear down as soon as either side stops: closing the PTY and the
+	// connection unblocks the other goroutine, which would otherwise wait
+	// for a shell that never exits or a client that never sends
+	<-done
 	cleanup()
+
+	drained := termStats.startDrain(activeSessID)
+	wg.Wait()
+	panes.Wait()
+	drained()
 }
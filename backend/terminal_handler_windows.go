@@ -5,12 +5,15 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"io"
-	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 
@@ -21,14 +24,48 @@ import (
 type terminalMessage struct {
 	Type string      `json:"type"`
 	Data interface{} `json:"data"`
+	Pane string      `json:"pane,omitempty"` // Extra pane the message is for (see terminal_panes.go)
+}
+
+// conptyCommandLine joins a program and its arguments into the single command
+// line ConPTY takes, quoted so the program sees each argument unchanged (the
+// PS1 passed to docker exec has spaces, quotes and backslashes)
+func conptyCommandLine(program string, args []string) string {
+	cmdLine := syscall.EscapeArg(program)
+	for _, arg := range args {
+		cmdLine += " " + syscall.EscapeArg(arg)
+	}
+	return cmdLine
 }
 
 func handleTerminal(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	// Get username from session cookie
+	username := "guest"
+	if cookie, err := r.Cookie("cyh_session"); err == nil {
+		if user, valid := authManager.ValidateSession(cookie.Value); valid {
+			username = user
+		}
+	}
+
+	// Open terminals keep running in maintenance mode, but no new ones start
+	if !checkMaintenance(w, r) {
+		return
+	}
+
+	// Cap open terminals per guest IP or user before upgrading
+	releaseConn, ok := acquireWSConn(w, r, username)
+	if !ok {
+		return
+	}
+	defer releaseConn()
+
+	wsConn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("WebSocket upgrade error: %v", err)
+		logWarnf("WebSocket upgrade error: %v", err)
 		return
 	}
+	// Output, bell and input-limit warnings are written from different goroutines
+	conn := &safeConn{Conn: wsConn}
 
 	// Get terminal mode from query parameter
 	mode := r.URL.Query().Get("mode")
@@ -36,16 +73,21 @@ func handleTerminal(w http.ResponseWriter, r *http.Request) {
 		mode = "local"
 	}
 
+	// Enforce enabled modes and the docker fallback policy
+	mode, err = resolveTerminalMode(mode, mode == "docker" && dockerMgr.IsDockerImageBuilt())
+	if err != nil {
+		rejectTerminal(conn, err.Error())
+		return
+	}
+
 	var cmdLine string
+	var paneCmdLine string // Extra panes' shell, without the welcome banner
 	var cwd string
+	containerName := "" // Docker mode only
+	execUser := ""      // The container user the shell runs as (empty for root)
 
-	// Get username from session cookie
-	username := "guest"
-	if cookie, err := r.Cookie("cyh_session"); err == nil {
-		if user, valid := authManager.ValidateSession(cookie.Value); valid {
-			username = user
-		}
-	}
+	prefs := authManager.GetPreferences(username)
+	termEnv := negotiateTerminalEnv(r)
 
 	// Active Session Management (Auto-Create)
 	activeSessID := r.URL.Query().Get("session_id")
@@ -55,34 +97,68 @@ func handleTerminal(w http.ResponseWriter, r *http.Request) {
 		// Try to resume existing session
 		s, err := sessionMgr.GetSession(activeSessID)
 		if err != nil {
-			log.Printf("Failed to resume session %s: %v", activeSessID, err)
+			logErrorf("Failed to resume session %s: %v", activeSessID, err)
 			activeSessID = "" // Create new if not found
 		} else {
 			session = s
-			// Resuming - verify ownership
-			if session.User != username {
+			// Resuming - verify ownership (and a guest's key)
+			if !canResumeSession(r, session, username) {
 				activeSessID = "" // Create new if owner mismatch
 			}
 		}
 	}
 
+	// Each session is bound to its own container
+	targetContainer := r.URL.Query().Get("container")
+	if mode == "docker" && targetContainer != "" {
+		var ok bool
+		if activeSessID, ok = checkTargetContainer(conn, username, activeSessID, session, targetContainer); !ok {
+			return
+		}
+	}
+
+	// Names a new session after its first command, if the user wants that
+	var namer *sessionAutoNamer
+
 	if activeSessID == "" {
 		// Auto-create new session
-		sessName := "Terminal " + time.Now().Format("15:04:05")
+		sessName := fitSessionName("Terminal " + time.Now().Format("15:04:05"))
+		// Generated names never fail the connect, even under the reject policy
+		// or a short CYH_MAX_SESSION_NAME_LENGTH
+		if unique, err := sessionMgr.ResolveSessionName(username, sessName, "", SessionNamesSuffix); err == nil {
+			sessName = unique
+		}
 		s, err := sessionMgr.CreateSession(username, sessName, mode)
 		if err != nil {
-			log.Printf("Failed to create session: %v", err)
+			logErrorf("Failed to create session: %v", err)
 		} else {
 			session = s
 			activeSessID = session.ID
-			// Notify client about new session ID
-			conn.WriteJSON(map[string]interface{}{
+			namer = newSessionAutoNamer(session, prefs)
+
+			// Optional recording level override
+			if level := r.URL.Query().Get("recording"); level != "" && level != session.RecordingLevel {
+				if IsValidRecordingLevel(level) {
+					if err := sessionMgr.SetSessionRecordingLevel(session.ID, level); err == nil {
+						session.RecordingLevel = level
+					}
+				} else {
+					logWarnf("Ignoring invalid recording level %q for session %s", level, session.ID)
+				}
+			}
+			// Notify client about new session ID; a guest needs the key to resume it
+			msg := map[string]interface{}{
 				"type": "session_id",
 				"data": activeSessID,
-			})
+			}
+			if key := issueGuestKey(session); key != "" {
+				msg[guestKeyParam] = key
+			}
+			conn.WriteJSON(msg)
 		}
 	} else {
-		log.Printf("Resuming session: %s", activeSessID)
+		logDebugf("Resuming session: %s", activeSessID)
+		sessionMgr.ResumeSession(session)
 		// Notify client about resumed session ID
 		conn.WriteJSON(map[string]interface{}{
 			"type": "session_id",
@@ -90,29 +166,107 @@ func handleTerminal(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
+	// Track if we're resuming (not creating a new session)
+	isResuming := activeSessID != "" && r.URL.Query().Get("session_id") != ""
+
+	// What gets recorded for this session (CYH_RECORDING_LEVEL or per-session override)
+	recordOutput, recordInput := true, true
+	if session != nil {
+		recordOutput, recordInput = session.RecordsOutput(), session.RecordsInput()
+
+		// A session whose recording reached CYH_MAX_RECORDING_DURATION stays capped
+		if session.RecordingCappedAt != nil {
+			recordOutput, recordInput = false, false
+			conn.WriteJSON(map[string]interface{}{
+				"type":       MsgTypeRecordingCapped,
+				"session_id": session.ID,
+			})
+		}
+	}
+
 	// Prepare command line
-	if mode == "docker" && dockerMgr.IsReady() {
-		log.Printf("Starting CYH Hacking Docker terminal...")
-		cmdLine = `docker exec -it -e TERM=xterm-256color -e COLORTERM=truecolor -w /root ` + DockerContainerName + ` /bin/bash --login`
+	if mode == "docker" {
+		container, ok := prepareSessionContainer(conn, username, activeSessID, session, targetContainer, isResuming)
+		if !ok {
+			return
+		}
+		containerName, execUser = container.Name, container.ExecUser
+		// Same exec as on unix: the prompt (PS1) always, CYH_SKIP_BANNER=1 on resume
+		cmdLine = conptyCommandLine("docker", container.ExecArgs(termEnv, isResuming))
+		paneCmdLine = conptyCommandLine("docker", container.ExecArgs(termEnv, true))
 		cwd = ""
 	} else {
-		log.Printf("Starting local terminal (PowerShell)...")
+		logDebugf("Starting local terminal (PowerShell)...")
 		cmdLine = "powershell.exe"
+		paneCmdLine = cmdLine
 		cwd, _ = os.Getwd()
 	}
 
 	// Create ConPTY
 	cpty, err := conpty.Start(cmdLine, conpty.ConPtyDimensions(120, 30))
 	if err != nil {
-		log.Printf("Failed to start ConPTY: %v", err)
-		conn.WriteMessage(websocket.TextMessage, []byte("Failed to start terminal: "+err.Error()))
-		conn.Close()
+		failTerminal(conn, TerminalErrConPtyStartFailed, err)
 		return
 	}
 
 	_ = cwd // cwd is not used with conpty.Start but kept for future use
 
-	log.Printf("Terminal session started (mode: %s, pid: %d)", mode, cpty.Pid())
+	started := time.Now()
+	logInfof("Terminal session started (mode: %s, pid: %d)", mode, cpty.Pid())
+	termStats.connectionOpened()
+	defer termStats.connectionClosed()
+
+	// Tell a resuming client when the prompt is up so it can replay history
+	var resume *resumeWatcher
+	if isResuming {
+		resume = newResumeWatcher(conn, activeSessID, serverConfig.ResumeReadyTimeout)
+		defer resume.Stop()
+	}
+
+	// Type the session's startup commands into the shell, each at a prompt,
+	// recorded like typed input
+	startup := newStartupRunner(conn, activeSessID, sessionStartupCommands(session), serverConfig.ResumeReadyTimeout,
+		func(data []byte) error {
+			_, err := cpty.Write(data)
+			return err
+		},
+		func(command string) {
+			if activeSessID == "" {
+				return
+			}
+			sessionMgr.CountIO(activeSessID, len(command)+1, 0)
+			if recordInput {
+				go sessionMgr.AddEvent(activeSessID, "input", command+"\r")
+				go sessionMgr.AddEvent(activeSessID, "command", command)
+			}
+		})
+	defer startup.Stop()
+
+	// The pseudo console may be closed by a session end elsewhere and by cleanup
+	closePty := sync.OnceFunc(func() {
+		cpty.Close()
+	})
+
+	// Why the terminal closes, sent to the client in the close frame
+	var cause terminalCloseCause
+
+	// The shell's exit status once it exits on its own, for the session's end
+	var shellExitCode atomic.Int64
+	shellExitCode.Store(-1)
+
+	// Let a session ended elsewhere (POST /end) reach this terminal
+	var registered *terminalConn
+	if activeSessID != "" {
+		registered = terminals.Register(activeSessID, conn, func(reason string) {
+			cause.Set(CloseSessionEnded, reason)
+			closePty()
+			closeTerminal(conn, CloseSessionEnded, reason)
+		})
+	}
+
+	panes := newTerminalPanes(conn, activeSessID, recordOutput, recordInput, prefs, func() (paneProcess, error) {
+		return startConptyPane(paneCmdLine)
+	})
 
 	var wg sync.WaitGroup
 	var closeOnce sync.Once
@@ -126,26 +280,76 @@ func handleTerminal(w http.ResponseWriter, r *http.Request) {
 
 	// Cleanup function
 	cleanup := func() {
+		ranFor := time.Since(started)
 		closeDone()
+		panes.CloseAll()
 
 		if cpty != nil {
-			cpty.Close()
+			closePty()
+		}
+
+		// A docker exec that ended right after starting most likely found
+		// the container stopped. The pseudo console merges docker's errors
+		// into the output the client already has, so only the exit status
+		// goes along.
+		execFailed := false
+		if code, status, _ := cause.Get(); code == CloseShellExited && containerName != "" && ranFor < fastExecExitWindow {
+			execFailed = true
+			reportContainerExited(conn, containerName, status)
+		}
+
+		// How the terminal closes, also recorded as how its session ended
+		code, reason, _ := cause.Get()
+		if execFailed {
+			code, reason = CloseStartFailed, TerminalErrContainerExited
+		} else if code == CloseShellExited {
+			code, reason = shellExitCause(containerName, reason)
+		}
+		exitCode := int(shellExitCode.Load())
+
+		// End session recording, unless it was already ended elsewhere
+		if activeSessID != "" && terminals.Unregister(activeSessID, registered) {
+			err := sessionMgr.EndSession(activeSessID, terminalSessionEnd(code, exitCode))
+			if err == nil {
+				conn.WriteJSON(map[string]interface{}{
+					"type":       MsgTypeSessionEnded,
+					"session_id": activeSessID,
+					"reason":     SessionEndedTerminalClosed,
+				})
+				liveHub.CloseRoom(activeSessID, SessionEndedTerminalClosed)
+			} else if err == sql.ErrNoRows {
+				// Resumed sessions aren't tracked as active, so apply the
+				// container reaping policy directly
+				sessionMgr.ReleaseSessionContainer(activeSessID)
+				if !terminals.Has(activeSessID) {
+					liveHub.CloseRoom(activeSessID, SessionEndedTerminalClosed)
+				}
+			}
 		}
 
-		conn.Close()
-		log.Printf("Terminal session ended (mode: %s)", mode)
+		closeTerminal(conn, code, reason)
+		logInfof("Terminal session ended (mode: %s)", mode)
 	}
 
 	// ConPTY -> WebSocket (terminal output to browser)
 	wg.Add(1)
+	termStats.goroutineStarted()
 	go func() {
 		defer wg.Done()
+		defer termStats.goroutineDone()
 		defer closeDone()
 
 		buf := make([]byte, 32*1024)
+		var scanner outputScanner
+		var titles titleScanner
+		var cwds cwdScanner
+		trackCwd := mode == "docker" && serverConfig.RestoreCwd && activeSessID != ""
+		lastCwd := ""
+		cwdWriter := &lastCwdWriter{sessionID: activeSessID}
 		for {
 			n, err := cpty.Read(buf)
 			if err != nil {
+				cause.Set(CloseShellExited, "")
 				if err != io.EOF {
 					select {
 					case <-done:
@@ -158,18 +362,57 @@ func handleTerminal(w http.ResponseWriter, r *http.Request) {
 			}
 
 			if n > 0 {
-				err = conn.WriteMessage(websocket.BinaryMessage, buf[:n])
+				data := buf[:n]
+
+				// Detect terminal bell (opt-in per user)
+				rang := false
+				if prefs.BellNotifications {
+					data, rang = scanner.ScanBell(data, prefs.StripBell)
+				}
+
+				err = conn.WriteMessage(websocket.BinaryMessage, data)
 				if err != nil {
+					cause.Set(0, "") // The client is gone
 					return
 				}
+				if resume != nil {
+					resume.Feed(data)
+				}
+				startup.Feed(data)
+
+				if rang {
+					conn.WriteJSON(map[string]interface{}{"type": MsgTypeBell})
+					if activeSessID != "" {
+						liveHub.BroadcastEvent(activeSessID, MsgTypeBell, nil)
+					}
+				}
+
+				// Report window title changes (opt-in per user)
+				if prefs.TitleMessages {
+					if title, ok := titles.Scan(data); ok {
+						conn.WriteJSON(map[string]interface{}{"type": MsgTypeTitle, "data": title})
+					}
+				}
+
+				// Remember the shell's working directory to resume in (CYH_RESTORE_CWD)
+				if trackCwd {
+					if dir, ok := cwds.Scan(data); ok && dir != lastCwd {
+						lastCwd = dir
+						cwdWriter.Save(dir)
+					}
+				}
 				
 				// Record event and Broadcast Live
 				if activeSessID != "" {
+					sessionMgr.CountIO(activeSessID, 0, len(data))
+
 					// Async record
-					go sessionMgr.AddEvent(activeSessID, "output", string(buf[:n]))
+					if recordOutput {
+						go sessionMgr.AddEvent(activeSessID, "output", string(data))
+					}
 					
 					// Broadcast to live hub (Unconditional for dynamic sharing)
-					liveHub.BroadcastOutput(activeSessID, string(buf[:n]))
+					liveHub.BroadcastOutput(activeSessID, string(data))
 				}
 			}
 		}
@@ -177,46 +420,114 @@ func handleTerminal(w http.ResponseWriter, r *http.Request) {
 
 	// WebSocket -> ConPTY (browser input to terminal)
 	wg.Add(1)
+	termStats.goroutineStarted()
 	go func() {
 		defer wg.Done()
+		defer termStats.goroutineDone()
 		defer closeDone()
 
+		limiter := newInputLimiter()
+		var editor lineEditor
+		guard := newPasteGuard(conn, prefs)
+		transfers := newFileTransferChannel(conn, username, activeSessID, containerName, execUser)
 		for {
 			msgType, data, err := conn.ReadMessage()
 			if err != nil {
+				cause.Set(0, "") // The client is gone
 				return
 			}
 
-			// Check for resize message
+			// File uploads have their own size limits instead of the input rate
+			if msgType == websocket.TextMessage && transfers.HandleFrame(data) {
+				continue
+			}
+
+			// Drop input floods, disconnecting on sustained abuse
+			if !applyInputLimit(conn, limiter, len(data)) {
+				continue
+			}
+			confirmed := false  // data is a held paste the client confirmed
+			fromViewer := false // data was typed by a viewer, not the owner
+
+			// Check for resize and signal messages
 			if msgType == websocket.TextMessage {
 				var msg terminalMessage
 				if json.Unmarshal(data, &msg) == nil {
+					if panes.HandleMessage(msg) {
+						continue
+					}
+					// Answers to viewers and chat for the session's live room
+					if handleOwnerLiveMessage(activeSessID, username, msg) {
+						continue
+					}
+					// A viewer's input, forwarded by the owner's page
+					if msg.Type == MsgTypeViewerInput {
+						text, ok := msg.Data.(string)
+						if !ok {
+							continue
+						}
+						data, fromViewer = []byte(text), true
+					}
 					if msg.Type == "resize" {
-						if sizeData, ok := msg.Data.(map[string]interface{}); ok {
-							rows, _ := sizeData["rows"].(float64)
-							cols, _ := sizeData["cols"].(float64)
-							if rows > 0 && cols > 0 {
-								cpty.Resize(int(cols), int(rows))
-								
-								// Record resize event
-								if activeSessID != "" {
-									go sessionMgr.AddEvent(activeSessID, "resize", string(data))
-								}
+						// Clamped to the terminal limits
+						if rows, cols, ok := parseResizeMessage(msg.Data); ok {
+							cpty.Resize(cols, rows)
+							
+							// Record resize event with the size applied
+							if activeSessID != "" && recordInput {
+								go sessionMgr.AddEvent(activeSessID, "resize", resizeEventData(rows, cols))
 							}
 						}
 						continue
 					}
+					if msg.Type == "signal" {
+						name, ctrl, ok := parseSignalMessage(msg.Data)
+						if !ok {
+							terminalNotice(conn, "Signal not allowed; use SIGINT, SIGQUIT, SIGTSTP, SIGTERM, SIGHUP or SIGKILL")
+							continue
+						}
+						// ConPTY only turns Ctrl-C into a signal
+						if ctrl != 0x03 {
+							terminalNotice(conn, name+" isn't supported on Windows")
+							continue
+						}
+						data = []byte{ctrl}
+					}
+					if msg.Type == MsgTypeConfirmPaste || msg.Type == MsgTypeCancelPaste {
+						held, ok := guard.Resolve(msg.Type == MsgTypeConfirmPaste)
+						if !ok {
+							continue
+						}
+						data, confirmed = held, true
+					}
 				}
 			}
 
-			// Record input event
+			// Hold multi-line and binary pastes until the client confirms them
+			if !confirmed && guard.Hold(data) {
+				continue
+			}
+
 			if activeSessID != "" {
+				sessionMgr.CountIO(activeSessID, len(data), 0)
+				if !fromViewer {
+					markOwnerActive(activeSessID)
+				}
+			}
+
+			// Record input event, plus the command line as edited when Enter is pressed
+			if activeSessID != "" && recordInput {
 				go sessionMgr.AddEvent(activeSessID, "input", string(data))
+				for _, command := range editor.Feed(data) {
+					go sessionMgr.AddEvent(activeSessID, "command", command)
+					namer.Feed(command)
+				}
 			}
 
 			// Write to ConPTY
 			_, err = cpty.Write(data)
 			if err != nil {
+				cause.Set(CloseTerminalError, "Terminal write failed")
 				return
 			}
 		}
@@ -226,17 +537,27 @@ func handleTerminal(w http.ResponseWriter, r *http.Request) {
 	go func() {
 		exitCode, err := cpty.Wait(context.Background())
 		if err != nil {
-			log.Printf("Process wait error: %v", err)
+			logErrorf("Process wait error: %v", err)
+			cause.Set(CloseShellExited, "")
 		} else {
-			log.Printf("Process exited with code: %d", exitCode)
+			logDebugf("Process exited with code: %d", exitCode)
+			shellExitCode.Store(int64(exitCode))
+			cause.Set(CloseShellExited, "exit status "+strconv.FormatUint(uint64(exitCode), 10))
 		}
 		closeDone()
 	}()
 
-	// Wait for goroutines to finish
-	wg.Wait()
+	// Tear down as soon as either side stops (or the process exits):
+	// closing the pseudo console and the connection unblocks the other
+	// goroutine
+	<-done
 
 	// Give a small delay for cleanup
 	time.Sleep(100 * time.Millisecond)
 	cleanup()
+
+	drained := termStats.startDrain(activeSessID)
+	wg.Wait()
+	panes.Wait()
+	drained()
 }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// terminalDrainWarnAfter is how long a closed terminal may wait for its
+	// PTY goroutines before a leak is reported
+	terminalDrainWarnAfter = time.Minute
+
+	// terminalLeakCheckInterval is how often goroutine counts are compared
+	terminalLeakCheckInterval = time.Minute
+
+	// terminalGoroutinesPerConn is the PTY read and write goroutines each
+	// terminal connection runs
+	terminalGoroutinesPerConn = 2
+)
+
+// terminalStats counts terminal connections and their PTY goroutines so
+// leaks show up in /metrics and /health?verbose
+type terminalStats struct {
+	connections atomic.Int64 // Terminal handlers running
+	goroutines  atomic.Int64 // PTY read/write goroutines running
+	panes       atomic.Int64 // Extra pane output goroutines running, see terminal_panes.go
+	draining    atomic.Int64 // Closed terminals still waiting for their goroutines
+	leaked      atomic.Int64 // Terminals that took longer than terminalDrainWarnAfter to drain
+}
+
+var termStats = &terminalStats{}
+
+func (s *terminalStats) connectionOpened() { s.connections.Add(1) }
+func (s *terminalStats) connectionClosed() { s.connections.Add(-1) }
+func (s *terminalStats) goroutineStarted() { s.goroutines.Add(1) }
+func (s *terminalStats) goroutineDone()    { s.goroutines.Add(-1) }
+func (s *terminalStats) paneStarted()      { s.panes.Add(1) }
+func (s *terminalStats) paneDone()         { s.panes.Add(-1) }
+
+// startDrain marks a terminal as torn down but still waiting for its PTY
+// goroutines. The returned func is called once they have exited; until then
+// a warning is logged every terminalDrainWarnAfter.
+func (s *terminalStats) startDrain(label string) func() {
+	s.draining.Add(1)
+	started := time.Now()
+	stop := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(terminalDrainWarnAfter)
+		defer ticker.Stop()
+		counted := false
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if !counted {
+					s.leaked.Add(1)
+					counted = true
+				}
+				logWarnf("⚠️  Terminal %s closed %s ago but its PTY goroutines are still running", label, time.Since(started).Round(time.Second))
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		s.draining.Add(-1)
+	}
+}
+
+// TerminalStatsSnapshot is a point-in-time copy of the terminal counters
+type TerminalStatsSnapshot struct {
+	Connections int64 `json:"connections"`
+	Goroutines  int64 `json:"pty_goroutines"`
+	Panes       int64 `json:"pane_goroutines"`
+	Draining    int64 `json:"draining"`
+	Leaked      int64 `json:"leaked_total"`
+}
+
+// Snapshot returns the current counters
+func (s *terminalStats) Snapshot() TerminalStatsSnapshot {
+	return TerminalStatsSnapshot{
+		Connections: s.connections.Load(),
+		Goroutines:  s.goroutines.Load(),
+		Panes:       s.panes.Load(),
+		Draining:    s.draining.Load(),
+		Leaked:      s.leaked.Load(),
+	}
+}
+
+// monitorTerminalLeaks warns while more PTY goroutines run than the open
+// connections account for, and while the count keeps growing. Pane
+// goroutines come and go with panes, so they are only orphans once no
+// terminal is open.
+func monitorTerminalLeaks() {
+	ticker := time.NewTicker(terminalLeakCheckInterval)
+	defer ticker.Stop()
+
+	var last int64
+	for range ticker.C {
+		snap := termStats.Snapshot()
+		if orphans := snap.Goroutines - terminalGoroutinesPerConn*snap.Connections; orphans > 0 {
+			logWarnf("⚠️  %d PTY goroutine(s) outlived their terminal connections", orphans)
+		} else if snap.Connections == 0 && snap.Panes > 0 {
+			logWarnf("⚠️  %d pane goroutine(s) outlived their terminal connections", snap.Panes)
+		} else if snap.Draining > 0 && snap.Goroutines > last {
+			logWarnf("⚠️  PTY goroutines grew to %d with %d terminal(s) stuck closing", snap.Goroutines, snap.Draining)
+		}
+		last = snap.Goroutines
+	}
+}
+
+// handleMetrics exposes server counters in the Prometheus text format: /metrics
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	snap := termStats.Snapshot()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics := []struct {
+		name, kind, help string
+		value            int64
+	}{
+		{"cyh_terminal_connections", "gauge", "Terminal connections being served.", snap.Connections},
+		{"cyh_terminal_pty_goroutines", "gauge", "PTY read/write goroutines running.", snap.Goroutines},
+		{"cyh_terminal_pane_goroutines", "gauge", "Output goroutines of extra terminal panes running.", snap.Panes},
+		{"cyh_terminal_draining", "gauge", "Closed terminals still waiting for their PTY goroutines.", snap.Draining},
+		{"cyh_terminal_leaked_total", "counter", "Terminals whose PTY goroutines outlived the drain timeout.", snap.Leaked},
+		{"cyh_goroutines", "gauge", "Goroutines in the server process.", int64(runtime.NumGoroutine())},
+	}
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.kind, m.name, m.value)
+	}
+}
+
+// handleHealth reports liveness: /health, with terminal counters as JSON
+// when ?verbose is set. In maintenance mode the plain check answers
+// "MAINTENANCE", still with 200: the server is alive, and a liveness probe
+// restarting it would kill the terminals it is draining.
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	if !r.URL.Query().Has("verbose") {
+		w.WriteHeader(http.StatusOK)
+		if _, on := maintenance.Active(); on {
+			w.Write([]byte("MAINTENANCE"))
+			return
+		}
+		w.Write([]byte("OK"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":      "ok",
+		"terminals":   termStats.Snapshot(),
+		"goroutines":  runtime.NumGoroutine(),
+		"maintenance": maintenance.Status(),
+	})
+}
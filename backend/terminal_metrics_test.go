@@ -0,0 +1,81 @@
+//go:build !windows
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// waitForStats polls the terminal counters until ok accepts them
+func waitForStats(t *testing.T, what string, ok func(TerminalStatsSnapshot) bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		snap := termStats.Snapshot()
+		if ok(snap) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s: %+v", what, snap)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStartDrain(t *testing.T) {
+	before := termStats.Snapshot()
+
+	drained := termStats.startDrain("test")
+	if got := termStats.Snapshot().Draining; got != before.Draining+1 {
+		t.Fatalf("draining = %d while draining, want %d", got, before.Draining+1)
+	}
+	drained()
+
+	after := termStats.Snapshot()
+	if after.Draining != before.Draining {
+		t.Fatalf("draining = %d after drain, want %d", after.Draining, before.Draining)
+	}
+	if after.Leaked != before.Leaked {
+		t.Fatalf("leaked = %d after a prompt drain, want %d", after.Leaked, before.Leaked)
+	}
+}
+
+func TestTerminalCountersReturnToZeroAfterDisconnect(t *testing.T) {
+	var err error
+	if sessionMgr, err = NewSessionManager(t.TempDir() + "/sessions.db"); err != nil {
+		t.Fatal(err)
+	}
+	liveHub = NewLiveHub()
+	t.Cleanup(func() {
+		sessionMgr.Close()
+		sessionMgr, liveHub = nil, nil
+	})
+
+	srv := httptest.NewServer(http.HandlerFunc(handleTerminal))
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws/terminal?mode=local"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForStats(t, "the terminal to start", func(s TerminalStatsSnapshot) bool {
+		return s.Connections == 1 && s.Goroutines == terminalGoroutinesPerConn
+	})
+
+	// Drop the connection without a close handshake, like a lost client
+	conn.NetConn().Close()
+
+	waitForStats(t, "the counters to return to zero", func(s TerminalStatsSnapshot) bool {
+		return s.Connections == 0 && s.Goroutines == 0 && s.Panes == 0 && s.Draining == 0
+	})
+	if leaked := termStats.Snapshot().Leaked; leaked != 0 {
+		t.Fatalf("leaked = %d, want 0", leaked)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// handleMirrorWebSocket attaches a read-only copy of the user's own open
+// terminal, e.g. for a second monitor: /ws/mirror?session_id=...
+//
+// The mirror joins the session's live room so it receives the same output
+// messages as live viewers (and ?plain=true and last_seq work the same), but
+// no share token is needed, other viewers never see it and it stays attached
+// when sharing stops. Anything the mirror sends is ignored.
+func handleMirrorWebSocket(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	sessionID := query.Get("session_id")
+	if sessionID == "" {
+		http.Error(w, "Session ID required", http.StatusBadRequest)
+		return
+	}
+
+	username := ""
+	if cookie, err := r.Cookie("cyh_session"); err == nil {
+		if user, valid := authManager.ValidateSession(cookie.Value); valid {
+			username = user
+		}
+	}
+
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	session, err := sessionMgr.GetSession(sessionID)
+	if err != nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	if session.User != username {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	if !terminals.Has(sessionID) {
+		http.Error(w, "Session has no open terminal", http.StatusGone)
+		return
+	}
+
+	// Held until the reader sees the socket close
+	releaseConn, ok := acquireWSConn(w, r, username)
+	if !ok {
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		releaseConn()
+		return
+	}
+
+	viewer := &LiveViewer{
+		Conn:      conn,
+		Username:  username,
+		SessionID: sessionID,
+		Hub:       liveHub,
+		send:      make(chan []byte, 2048),
+		viewOnly:  true,
+		mirror:    true,
+		plain:     query.Get("plain") == "true",
+	}
+
+	// Resume from the last output seen (see live_resume.go)
+	if v := query.Get("last_seq"); v != "" {
+		if lastSeq, err := strconv.ParseUint(v, 10, 64); err == nil {
+			viewer.resume = true
+			viewer.lastSeq = lastSeq
+		}
+	}
+
+	liveHub.register <- viewer
+
+	go viewer.WritePump()
+	go func() {
+		defer releaseConn()
+		viewer.ReadPump(nil)
+	}()
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+	"unicode/utf8"
+)
+
+// Messages for a terminal's extra panes. The main terminal keeps using binary
+// frames; each extra pane runs its own shell in the same session (and, in
+// docker mode, the same container) and is addressed by the id the client
+// picks when opening it.
+const (
+	MsgTypePaneOpen   = "pane_open"   // Client: {"type":"pane_open","pane":"p1"}
+	MsgTypePaneClose  = "pane_close"  // Client: {"type":"pane_close","pane":"p1"}
+	MsgTypePaneInput  = "pane_input"  // Client: {"type":"pane_input","pane":"p1","data":"ls\r"}
+	MsgTypePaneOpened = "pane_opened" // Server: the pane's shell started
+	MsgTypePaneOutput = "pane_output" // Server: {"type":"pane_output","pane":"p1","data":"..."}
+	MsgTypePaneClosed = "pane_closed" // Server: the pane is gone, with a reason and an optional message
+)
+
+// Reasons sent in pane_closed messages
+const (
+	PaneClosedByClient = "closed"   // The client closed it
+	PaneClosedExited   = "exited"   // Its shell exited
+	PaneClosedRejected = "rejected" // It couldn't be opened; message says why
+)
+
+// maxTerminalPanes caps the extra panes of one terminal connection
+const maxTerminalPanes = 4
+
+// paneIDPattern is what a client may use as a pane id
+var paneIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// paneProcess is the shell running in an extra pane
+type paneProcess interface {
+	Read(p []byte) (int, error)
+	Write(p []byte) (int, error)
+	Resize(rows, cols int) error
+	Signal(name string) error // For signals without a control byte
+	Close() error             // Stops the shell; Read fails afterwards
+}
+
+type terminalPane struct {
+	id     string
+	proc   paneProcess
+	editor lineEditor  // Only the input goroutine uses it
+	guard  *pasteGuard // Likewise; nil unless the user turned paste_guard on
+}
+
+// terminalPanes runs the extra panes of one terminal connection. Pane events
+// are recorded with the pane's id; live viewers only see the main terminal.
+type terminalPanes struct {
+	conn         *safeConn
+	sessionID    string // Empty when the session isn't recorded
+	recordOutput bool
+	recordInput  bool
+	prefs        UserPreferences
+	start        func() (paneProcess, error)
+
+	mu     sync.Mutex
+	panes  map[string]*terminalPane
+	closed bool
+	wg     sync.WaitGroup
+}
+
+func newTerminalPanes(conn *safeConn, sessionID string, recordOutput, recordInput bool, prefs UserPreferences, start func() (paneProcess, error)) *terminalPanes {
+	return &terminalPanes{
+		conn:         conn,
+		sessionID:    sessionID,
+		recordOutput: recordOutput,
+		recordInput:  recordInput,
+		prefs:        prefs,
+		start:        start,
+		panes:        make(map[string]*terminalPane),
+	}
+}
+
+// HandleMessage handles a pane message from the client, reporting false for
+// messages meant for the main terminal. Only the input goroutine calls it.
+func (tp *terminalPanes) HandleMessage(msg terminalMessage) bool {
+	switch msg.Type {
+	case MsgTypePaneOpen:
+		tp.open(msg.Pane)
+	case MsgTypePaneClose:
+		tp.closePane(msg.Pane, nil, PaneClosedByClient)
+	case MsgTypePaneInput:
+		text, _ := msg.Data.(string)
+		// Risky pastes wait for confirmation as in the main terminal
+		if pane := tp.get(msg.Pane); pane != nil && pane.guard.Hold([]byte(text)) {
+			return true
+		}
+		tp.input(msg.Pane, []byte(text))
+	case MsgTypeConfirmPaste, MsgTypeCancelPaste:
+		if msg.Pane == "" {
+			return false
+		}
+		if pane := tp.get(msg.Pane); pane != nil {
+			if held, ok := pane.guard.Resolve(msg.Type == MsgTypeConfirmPaste); ok {
+				tp.input(pane.id, held)
+			}
+		}
+	case "resize":
+		if msg.Pane == "" {
+			return false
+		}
+		if pane := tp.get(msg.Pane); pane != nil {
+			if rows, cols, ok := parseResizeMessage(msg.Data); ok {
+				pane.proc.Resize(rows, cols)
+				tp.record(pane.id, "resize", resizeEventData(rows, cols), tp.recordInput)
+			}
+		}
+	case "signal":
+		if msg.Pane == "" {
+			return false
+		}
+		name, ctrl, ok := parseSignalMessage(msg.Data)
+		if !ok {
+			terminalNotice(tp.conn, "Signal not allowed; use SIGINT, SIGQUIT, SIGTSTP, SIGTERM, SIGHUP or SIGKILL")
+			return true
+		}
+		if ctrl != 0 {
+			// Control bytes go through the PTY like typed keys
+			tp.input(msg.Pane, []byte{ctrl})
+			return true
+		}
+		if pane := tp.get(msg.Pane); pane != nil {
+			if err := pane.proc.Signal(name); err != nil {
+				terminalNotice(tp.conn, "Couldn't send "+name+" to pane "+pane.id+": "+err.Error())
+			}
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+func (tp *terminalPanes) get(id string) *terminalPane {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	return tp.panes[id]
+}
+
+// open starts a pane's shell and its output goroutine
+func (tp *terminalPanes) open(id string) {
+	if !paneIDPattern.MatchString(id) {
+		tp.reject(id, "Pane ids are 1-32 letters, digits, '-' or '_'")
+		return
+	}
+
+	tp.mu.Lock()
+	_, exists := tp.panes[id]
+	full := len(tp.panes) >= maxTerminalPanes
+	tp.mu.Unlock()
+	if exists {
+		tp.reject(id, "Pane "+id+" is already open")
+		return
+	}
+	if full {
+		tp.reject(id, fmt.Sprintf("At most %d panes can be open", maxTerminalPanes))
+		return
+	}
+
+	proc, err := tp.start()
+	if err != nil {
+		logWarnf("Failed to start pane %s of session %s: %v", id, tp.sessionID, err)
+		tp.reject(id, "Couldn't start the pane's shell")
+		return
+	}
+
+	pane := &terminalPane{id: id, proc: proc, guard: newPasteGuard(tp.conn, tp.prefs)}
+	if pane.guard != nil {
+		pane.guard.pane = id
+	}
+	tp.mu.Lock()
+	if tp.closed {
+		tp.mu.Unlock()
+		proc.Close()
+		return
+	}
+	tp.panes[id] = pane
+	tp.wg.Add(1)
+	tp.mu.Unlock()
+
+	logDebugf("Opened pane %s of session %s", id, tp.sessionID)
+	tp.conn.WriteJSON(map[string]interface{}{"type": MsgTypePaneOpened, "pane": id})
+	tp.record(id, "pane", "open", tp.recordInput)
+
+	termStats.paneStarted()
+	go tp.pump(pane)
+}
+
+// pump sends a pane's output to the client until its shell exits
+func (tp *terminalPanes) pump(pane *terminalPane) {
+	defer tp.wg.Done()
+	defer termStats.paneDone()
+
+	buf := make([]byte, 32*1024)
+	carry := 0 // Start of a UTF-8 sequence the last read cut off, kept at the front of buf
+	for {
+		n, err := pane.proc.Read(buf[carry:])
+		if err != nil {
+			tp.closePane(pane.id, pane, PaneClosedExited)
+			return
+		}
+		if n == 0 {
+			continue
+		}
+		n += carry
+		complete := n - incompleteUTF8Suffix(buf[:n])
+		carry = n - complete
+		if complete == 0 {
+			continue
+		}
+		data := string(buf[:complete])
+		copy(buf, buf[complete:n])
+
+		err = tp.conn.WriteJSON(map[string]interface{}{
+			"type": MsgTypePaneOutput,
+			"pane": pane.id,
+			"data": data,
+		})
+		if err != nil {
+			return // The client is gone; CloseAll stops the shell
+		}
+
+		if tp.sessionID != "" {
+			sessionMgr.CountIO(tp.sessionID, 0, len(data))
+		}
+		tp.record(pane.id, "output", data, tp.recordOutput)
+	}
+}
+
+// incompleteUTF8Suffix returns how many bytes at the end of b start a UTF-8
+// sequence that isn't complete yet. Output is sent as JSON strings, which
+// would turn a character split across two reads into two U+FFFD.
+func incompleteUTF8Suffix(b []byte) int {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if utf8.FullRune(b[i:]) {
+				return 0
+			}
+			return len(b) - i
+		}
+	}
+	return 0
+}
+
+// input writes to a pane's shell, recording it like main terminal input
+func (tp *terminalPanes) input(id string, data []byte) {
+	pane := tp.get(id)
+	if pane == nil || len(data) == 0 {
+		return
+	}
+
+	if tp.sessionID != "" {
+		sessionMgr.CountIO(tp.sessionID, len(data), 0)
+		markOwnerActive(tp.sessionID)
+	}
+	if tp.sessionID != "" && tp.recordInput {
+		tp.record(id, "input", string(data), true)
+		for _, command := range pane.editor.Feed(data) {
+			tp.record(id, "command", command, true)
+		}
+	}
+
+	if _, err := pane.proc.Write(data); err != nil {
+		tp.closePane(id, pane, PaneClosedExited)
+	}
+}
+
+// closePane stops a pane and tells the client. With only set, the pane is
+// closed only if it is still that pane, so an exiting shell can't close a
+// newer pane that reused its id.
+func (tp *terminalPanes) closePane(id string, only *terminalPane, reason string) {
+	tp.mu.Lock()
+	pane := tp.panes[id]
+	if pane == nil || (only != nil && pane != only) {
+		tp.mu.Unlock()
+		return
+	}
+	delete(tp.panes, id)
+	tp.mu.Unlock()
+
+	pane.proc.Close()
+	logDebugf("Closed pane %s of session %s (%s)", id, tp.sessionID, reason)
+	tp.conn.WriteJSON(map[string]interface{}{"type": MsgTypePaneClosed, "pane": id, "reason": reason})
+	tp.record(id, "pane", reason, tp.recordInput)
+}
+
+// reject tells the client a pane couldn't be opened
+func (tp *terminalPanes) reject(id, message string) {
+	tp.conn.WriteJSON(map[string]interface{}{
+		"type":    MsgTypePaneClosed,
+		"pane":    id,
+		"reason":  PaneClosedRejected,
+		"message": message,
+	})
+}
+
+// record adds a pane event to the session's recording when enabled
+func (tp *terminalPanes) record(id, eventType, data string, enabled bool) {
+	if tp.sessionID != "" && enabled {
+		go sessionMgr.AddPaneEvent(tp.sessionID, id, eventType, data)
+	}
+}
+
+// CloseAll stops every pane when the terminal closes; no more can be opened
+func (tp *terminalPanes) CloseAll() {
+	tp.mu.Lock()
+	tp.closed = true
+	panes := tp.panes
+	tp.panes = make(map[string]*terminalPane)
+	tp.mu.Unlock()
+
+	for _, pane := range panes {
+		pane.proc.Close()
+	}
+}
+
+// Wait waits for the panes' output goroutines after CloseAll
+func (tp *terminalPanes) Wait() {
+	tp.wg.Wait()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestIncompleteUTF8Suffix(t *testing.T) {
+	euro := "€" // 3 bytes
+	tests := []struct {
+		name string
+		data string
+		want int
+	}{
+		{name: "empty", data: "", want: 0},
+		{name: "ascii", data: "ls -l\r\n", want: 0},
+		{name: "complete character", data: "price " + euro, want: 0},
+		{name: "one byte of three", data: "price " + euro[:1], want: 1},
+		{name: "two bytes of three", data: "price " + euro[:2], want: 2},
+		{name: "three bytes of four", data: "\U0001F600"[:3], want: 3},
+		{name: "stray continuation byte", data: "a\x80", want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := incompleteUTF8Suffix([]byte(tt.data)); got != tt.want {
+				t.Fatalf("incompleteUTF8Suffix(%q) = %d, want %d", tt.data, got, tt.want)
+			}
+		})
+	}
+}
+
+// fakePane is a pane shell whose output is fed by the test
+type fakePane struct {
+	output chan []byte
+	mu     sync.Mutex
+	input  []byte
+}
+
+func newFakePane() *fakePane { return &fakePane{output: make(chan []byte, 8)} }
+
+func (p *fakePane) Read(b []byte) (int, error) {
+	data, ok := <-p.output
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(b, data), nil
+}
+
+func (p *fakePane) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.input = append(p.input, b...)
+	return len(b), nil
+}
+
+func (p *fakePane) written() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return string(p.input)
+}
+
+func (p *fakePane) Resize(rows, cols int) error { return nil }
+func (p *fakePane) Signal(name string) error    { return nil }
+
+func (p *fakePane) Close() error {
+	close(p.output)
+	return nil
+}
+
+// readPaneMessage reads client messages until one of the given type
+func readPaneMessage(t *testing.T, client *websocket.Conn, msgType string) map[string]interface{} {
+	t.Helper()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, data, err := client.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for %s: %v", msgType, err)
+		}
+		var msg map[string]interface{}
+		if json.Unmarshal(data, &msg) == nil && msg["type"] == msgType {
+			return msg
+		}
+	}
+}
+
+func openTestPane(t *testing.T, prefs UserPreferences) (*terminalPanes, *fakePane, *websocket.Conn) {
+	t.Helper()
+	conn, client := newTestTerminalConn(t)
+	proc := newFakePane()
+	panes := newTerminalPanes(conn, "", false, false, prefs, func() (paneProcess, error) { return proc, nil })
+	t.Cleanup(func() {
+		panes.CloseAll()
+		panes.Wait()
+	})
+
+	panes.HandleMessage(terminalMessage{Type: MsgTypePaneOpen, Pane: "p1"})
+	readPaneMessage(t, client, MsgTypePaneOpened)
+	return panes, proc, client
+}
+
+func TestPaneOutputKeepsSplitCharacters(t *testing.T) {
+	_, proc, client := openTestPane(t, UserPreferences{})
+
+	euro := "€"
+	proc.output <- []byte("price " + euro[:1])
+	proc.output <- []byte(euro[1:] + " total")
+
+	var got string
+	for got != "price "+euro+" total" {
+		msg := readPaneMessage(t, client, MsgTypePaneOutput)
+		got += msg["data"].(string)
+		if strings.ContainsRune(got, utf8.RuneError) {
+			t.Fatalf("pane output %q has a replacement character", got)
+		}
+	}
+}
+
+func TestPanePasteGuard(t *testing.T) {
+	panes, proc, client := openTestPane(t, UserPreferences{PasteGuard: true})
+
+	paste := "echo one\recho two\r"
+	panes.HandleMessage(terminalMessage{Type: MsgTypePaneInput, Pane: "p1", Data: paste})
+	msg := readPaneMessage(t, client, MsgTypePastePending)
+	if msg["pane"] != "p1" {
+		t.Fatalf("paste_pending pane = %v, want p1", msg["pane"])
+	}
+	if got := proc.written(); got != "" {
+		t.Fatalf("held paste reached the shell: %q", got)
+	}
+
+	// The main terminal's answer doesn't release a pane's paste
+	if panes.HandleMessage(terminalMessage{Type: MsgTypeConfirmPaste}) {
+		t.Fatal("confirm_paste without a pane was handled as a pane message")
+	}
+
+	panes.HandleMessage(terminalMessage{Type: MsgTypeConfirmPaste, Pane: "p1"})
+	if got := proc.written(); got != paste {
+		t.Fatalf("shell got %q after confirm, want %q", got, paste)
+	}
+}
@@ -0,0 +1,65 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/creack/pty"
+)
+
+// ptyPane is a pane's shell on its own PTY
+type ptyPane struct {
+	cmd       *exec.Cmd
+	ptmx      *os.File
+	docker    bool
+	closeOnce sync.Once
+}
+
+// startPtyPane starts cmd on a new PTY sized like a new terminal
+func startPtyPane(cmd *exec.Cmd, docker bool) (paneProcess, error) {
+	ptmx, err := pty.StartWithSize(cmd, &pty.Winsize{Rows: 30, Cols: 120})
+	if err != nil {
+		return nil, err
+	}
+	return &ptyPane{cmd: cmd, ptmx: ptmx, docker: docker}, nil
+}
+
+func (p *ptyPane) Read(b []byte) (int, error)  { return p.ptmx.Read(b) }
+func (p *ptyPane) Write(b []byte) (int, error) { return p.ptmx.Write(b) }
+
+func (p *ptyPane) Resize(rows, cols int) error {
+	return pty.Setsize(p.ptmx, &pty.Winsize{Rows: uint16(rows), Cols: uint16(cols)})
+}
+
+func (p *ptyPane) Signal(name string) error {
+	return signalForeground(p.ptmx, p.cmd, name, p.docker)
+}
+
+// Close hangs up the shell like the main terminal's cleanup, killing it if it
+// hasn't exited after 500ms. It doesn't wait for that.
+func (p *ptyPane) Close() error {
+	p.closeOnce.Do(func() {
+		p.ptmx.Close()
+		p.cmd.Process.Signal(syscall.SIGHUP)
+
+		go func() {
+			exited := make(chan struct{})
+			go func() {
+				p.cmd.Wait()
+				close(exited)
+			}()
+			select {
+			case <-exited:
+			case <-time.After(500 * time.Millisecond):
+				p.cmd.Process.Kill()
+			}
+		}()
+	})
+	return nil
+}
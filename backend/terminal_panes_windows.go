@@ -0,0 +1,39 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+
+	"github.com/UserExistsError/conpty"
+)
+
+// conptyPane is a pane's shell on its own ConPTY
+type conptyPane struct {
+	cpty *conpty.ConPty
+}
+
+// startConptyPane starts cmdLine on a new ConPTY sized like a new terminal
+func startConptyPane(cmdLine string) (paneProcess, error) {
+	cpty, err := conpty.Start(cmdLine, conpty.ConPtyDimensions(120, 30))
+	if err != nil {
+		return nil, err
+	}
+	return &conptyPane{cpty: cpty}, nil
+}
+
+func (p *conptyPane) Read(b []byte) (int, error)  { return p.cpty.Read(b) }
+func (p *conptyPane) Write(b []byte) (int, error) { return p.cpty.Write(b) }
+
+func (p *conptyPane) Resize(rows, cols int) error {
+	return p.cpty.Resize(cols, rows)
+}
+
+func (p *conptyPane) Signal(name string) error {
+	return errors.New(name + " isn't supported on Windows")
+}
+
+func (p *conptyPane) Close() error {
+	return p.cpty.Close()
+}
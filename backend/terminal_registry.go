@@ -0,0 +1,120 @@
+package main
+
+import (
+	"sync"
+)
+
+// Reasons sent with session_ended messages
+const (
+	SessionEndedByOwner        = "ended"           // POST /api/sessions/{id}/end
+	SessionEndedTerminalClosed = "terminal_closed" // The owner's shell exited or its connection closed
+	SessionEndedSharingStopped = "sharing_stopped" // Live sharing was turned off (viewers only)
+)
+
+// terminalConn is an owner's open terminal connection for a session
+type terminalConn struct {
+	conn *safeConn
+	kill func(reason string) // Stops the shell so the terminal handler tears down
+}
+
+// TerminalRegistry tracks open terminal connections by session so that a
+// session ended elsewhere can tell its terminals before closing them
+type TerminalRegistry struct {
+	mu    sync.Mutex
+	conns map[string]map[*terminalConn]bool
+}
+
+var terminals = &TerminalRegistry{conns: make(map[string]map[*terminalConn]bool)}
+
+// Register records an open terminal for a session
+func (tr *TerminalRegistry) Register(sessionID string, conn *safeConn, kill func(reason string)) *terminalConn {
+	tc := &terminalConn{conn: conn, kill: kill}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.conns[sessionID] == nil {
+		tr.conns[sessionID] = make(map[*terminalConn]bool)
+	}
+	tr.conns[sessionID][tc] = true
+	return tc
+}
+
+// Unregister forgets a terminal. It reports false if the terminal was
+// already closed by NotifyEnded.
+func (tr *TerminalRegistry) Unregister(sessionID string, tc *terminalConn) bool {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	if !tr.conns[sessionID][tc] {
+		return false
+	}
+	delete(tr.conns[sessionID], tc)
+	if len(tr.conns[sessionID]) == 0 {
+		delete(tr.conns, sessionID)
+	}
+	return true
+}
+
+// Has reports whether a session has an open terminal
+func (tr *TerminalRegistry) Has(sessionID string) bool {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return len(tr.conns[sessionID]) > 0
+}
+
+// SessionIDs returns the sessions that have an open terminal
+func (tr *TerminalRegistry) SessionIDs() []string {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+
+	ids := make([]string, 0, len(tr.conns))
+	for id := range tr.conns {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Notify sends a message to every open terminal of a session
+func (tr *TerminalRegistry) Notify(sessionID string, msg interface{}) {
+	tr.mu.Lock()
+	conns := make([]*terminalConn, 0, len(tr.conns[sessionID]))
+	for tc := range tr.conns[sessionID] {
+		conns = append(conns, tc)
+	}
+	tr.mu.Unlock()
+
+	for _, tc := range conns {
+		tc.conn.WriteJSON(msg)
+	}
+}
+
+// NotifyEnded sends session_ended with the reason to every open terminal of
+// a session, then closes them
+func (tr *TerminalRegistry) NotifyEnded(sessionID, reason string) {
+	tr.mu.Lock()
+	conns := tr.conns[sessionID]
+	delete(tr.conns, sessionID)
+	tr.mu.Unlock()
+
+	for tc := range conns {
+		tc.conn.WriteJSON(map[string]interface{}{
+			"type":       MsgTypeSessionEnded,
+			"session_id": sessionID,
+			"reason":     reason,
+		})
+		tc.kill(reason)
+	}
+	if len(conns) > 0 {
+		logInfof("Closed %d terminal(s) for ended session %s (%s)", len(conns), sessionID, reason)
+	}
+}
+
+// endSession ends a session and tells its open terminals and live viewers why
+func endSession(sessionID, reason string) error {
+	if err := sessionMgr.EndSession(sessionID, SessionEnd{Reason: EndReasonKilled}); err != nil {
+		return err
+	}
+	terminals.NotifyEnded(sessionID, reason)
+	liveHub.CloseRoom(sessionID, reason)
+	return nil
+}
@@ -0,0 +1,63 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"unsafe"
+)
+
+// directSignals are the allowed signals delivered with kill(2) rather than
+// as a control byte through the PTY
+var directSignals = map[string]syscall.Signal{
+	"SIGTERM": syscall.SIGTERM,
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGKILL": syscall.SIGKILL,
+}
+
+// foregroundProcessGroup returns the process group in the foreground of the
+// PTY, falling back to the shell's own group
+func foregroundProcessGroup(ptmx *os.File, cmd *exec.Cmd) (int, error) {
+	pgrp := 0
+	// SyscallConn leaves the PTY non-blocking, unlike Fd
+	if rc, err := ptmx.SyscallConn(); err == nil {
+		rc.Control(func(fd uintptr) {
+			var id int32
+			if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCGPGRP, uintptr(unsafe.Pointer(&id))); errno == 0 {
+				pgrp = int(id)
+			}
+		})
+	}
+	if pgrp > 0 {
+		return pgrp, nil
+	}
+
+	// The shell is started in its own session, so it leads its group
+	if cmd.Process == nil {
+		return 0, fmt.Errorf("shell is not running")
+	}
+	return cmd.Process.Pid, nil
+}
+
+// signalForeground sends an allowed direct signal to the PTY's foreground
+// process group. In docker mode that group is the docker CLI, not the
+// process in the container, so direct signals are refused.
+func signalForeground(ptmx *os.File, cmd *exec.Cmd, name string, dockerMode bool) error {
+	sig, ok := directSignals[name]
+	if !ok {
+		return fmt.Errorf("%s can't be sent directly", name)
+	}
+	if dockerMode {
+		return fmt.Errorf("%s isn't supported in docker mode", name)
+	}
+
+	pgrp, err := foregroundProcessGroup(ptmx, cmd)
+	if err != nil {
+		return err
+	}
+	return syscall.Kill(-pgrp, sig)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// MaxImageTagLength bounds the sanitized tag of a saved image
+const MaxImageTagLength = 64
+
+// UserImage is an image a user saved from one of their containers
+type UserImage struct {
+	Tag     string `json:"tag"`
+	Image   string `json:"image"` // Reference to use as a template image
+	ID      string `json:"id"`
+	Created string `json:"created"`
+	Size    string `json:"size"`
+}
+
+// imageCommits tracks users with a docker commit in progress, so concurrent
+// commits can't slip past the image cap
+var imageCommits = struct {
+	sync.Mutex
+	active map[string]bool
+}{active: make(map[string]bool)}
+
+// imageNameComponent reduces s to a valid docker repository path component:
+// lowercase letters and digits joined by dashes
+func imageNameComponent(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('-')
+		}
+	}
+	return strings.Trim(b.String(), "-")
+}
+
+// userImageRepo is the image namespace for a user's saved images. The
+// readable part folds case and punctuation (Alice and alice, bob.x and bob_x
+// look the same), so a hash of the exact username keeps namespaces apart.
+func userImageRepo(username string) string {
+	user := imageNameComponent(username)
+	if user == "" {
+		user = "user"
+	}
+	sum := sha256.Sum256([]byte(username))
+	return "cyh-user-" + user + "-" + hex.EncodeToString(sum[:6])
+}
+
+// sanitizeImageTag turns a requested tag into a path component, or "" if
+// nothing usable is left
+func sanitizeImageTag(tag string) string {
+	tag = imageNameComponent(tag)
+	if len(tag) > MaxImageTagLength {
+		tag = strings.TrimRight(tag[:MaxImageTagLength], "-")
+	}
+	return tag
+}
+
+// isUserImage reports whether an image reference is in the user's namespace
+func isUserImage(username, image string) bool {
+	return username != "" && strings.HasPrefix(image, userImageRepo(username)+"/")
+}
+
+// listUserImages returns the user's saved images
+func listUserImages(username string) ([]UserImage, error) {
+	repo := userImageRepo(username)
+	images, err := dockerMgr.ListImages(repo + "/*")
+	if err != nil {
+		return nil, err
+	}
+	for i := range images {
+		images[i].Tag = strings.TrimPrefix(images[i].Image, repo+"/")
+	}
+	return images, nil
+}
+
+// handleContainerCommit saves one of the user's containers as an image:
+// POST /api/containers/{id}/commit {"tag":"my-env"}
+func handleContainerCommit(w http.ResponseWriter, r *http.Request, containerID, username string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Guests share a namespace, so only accounts can save images
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Tag string `json:"tag"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	tag := sanitizeImageTag(req.Tag)
+	if tag == "" {
+		http.Error(w, "Image tag must contain letters or digits", http.StatusBadRequest)
+		return
+	}
+
+	state, err := dockerMgr.InspectContainer(containerID)
+	if err != nil {
+		http.Error(w, "Container not found", http.StatusNotFound)
+		return
+	}
+	if !userOwnsContainer(username, state.Name) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	imageCommits.Lock()
+	if imageCommits.active[username] {
+		imageCommits.Unlock()
+		http.Error(w, "An image is already being saved", http.StatusConflict)
+		return
+	}
+	imageCommits.active[username] = true
+	imageCommits.Unlock()
+	defer func() {
+		imageCommits.Lock()
+		delete(imageCommits.active, username)
+		imageCommits.Unlock()
+	}()
+
+	image := userImageRepo(username) + "/" + tag
+
+	// Overwriting an existing tag doesn't count against the cap
+	if limit := serverConfig.MaxUserImages; limit > 0 {
+		images, err := listUserImages(username)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		exists := false
+		for _, img := range images {
+			if img.Tag == tag {
+				exists = true
+				break
+			}
+		}
+		if !exists && len(images) >= limit {
+			http.Error(w, "Saved image limit reached; delete an image first", http.StatusConflict)
+			return
+		}
+	}
+
+	if err := dockerMgr.CommitContainer(state.ID, image); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	// A session whose container is later removed is recreated from its snapshot
+	sessionID := ""
+	if session, err := sessionMgr.GetSessionByContainer(state.Name); err == nil && session.User == username {
+		if err := sessionMgr.SetSessionSnapshotImage(session.ID, image); err == nil {
+			sessionID = session.ID
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":       "committed",
+		"container_id": state.ID[:12],
+		"tag":          tag,
+		"image":        image,
+		"session_id":   sessionID,
+	})
+}
+
+// handleImages lists the images a user can start sessions from: GET /api/images
+func handleImages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := ""
+	if cookie, err := r.Cookie("cyh_session"); err == nil {
+		if user, valid := authManager.ValidateSession(cookie.Value); valid {
+			username = user
+		}
+	}
+
+	images := []UserImage{}
+	if username != "" {
+		saved, err := listUserImages(username)
+		if err != nil {
+			http.Error(w, "Failed to list images", http.StatusInternalServerError)
+			return
+		}
+		images = saved
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"default": DockerImageName,
+		"images":  images,
+		"limit":   serverConfig.MaxUserImages,
+	})
+}
+
+// handleImageByTag deletes a saved image: DELETE /api/images/{tag}
+func handleImageByTag(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	username := ""
+	if cookie, err := r.Cookie("cyh_session"); err == nil {
+		if user, valid := authManager.ValidateSession(cookie.Value); valid {
+			username = user
+		}
+	}
+
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	tag := strings.TrimPrefix(r.URL.Path, "/api/images/")
+	if tag == "" || sanitizeImageTag(tag) != tag {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+
+	if err := dockerMgr.RemoveImage(userImageRepo(username) + "/" + tag); err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "deleted", "tag": tag})
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// ViewerSummary is one viewer's attendance in a live session
+type ViewerSummary struct {
+	Username     string `json:"username"`
+	Visits       int    `json:"visits"`
+	FirstJoined  int64  `json:"first_joined"` // UnixMilli
+	LastLeft     int64  `json:"last_left"`    // UnixMilli
+	TotalWatchMs int64  `json:"total_watch_ms"`
+}
+
+// ViewerAnalytics summarizes engagement for a live session
+type ViewerAnalytics struct {
+	SessionID       string           `json:"session_id"`
+	UniqueViewers   int              `json:"unique_viewers"`
+	TotalVisits     int              `json:"total_visits"`
+	PeakConcurrency int              `json:"peak_concurrency"`
+	AverageWatchMs  int64            `json:"average_watch_ms"` // Per unique viewer
+	AverageVisitMs  int64            `json:"average_visit_ms"`
+	Viewers         []*ViewerSummary `json:"viewers"`
+}
+
+// initViewerSessionsTable creates the viewer_sessions table
+func initViewerSessionsTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS viewer_sessions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			session_id TEXT NOT NULL,
+			username TEXT NOT NULL,
+			joined_at INTEGER NOT NULL,
+			left_at INTEGER
+		);
+		CREATE INDEX IF NOT EXISTS idx_viewer_sessions_session ON viewer_sessions(session_id);
+	`)
+	return err
+}
+
+// RecordViewerJoin stores a viewer joining a live session and returns the visit ID
+func (sm *SessionManager) RecordViewerJoin(sessionID, username string, joinedAt time.Time) int64 {
+	result, err := sm.db.Exec(`
+		INSERT INTO viewer_sessions (session_id, username, joined_at) VALUES (?, ?, ?)
+	`, sessionID, username, joinedAt.UnixMilli())
+	if err != nil {
+		logErrorf("Failed to record viewer join for %s: %v", sessionID, err)
+		return 0
+	}
+	id, _ := result.LastInsertId()
+	return id
+}
+
+// RecordViewerLeave closes a viewer visit
+func (sm *SessionManager) RecordViewerLeave(visitID int64, leftAt time.Time) {
+	if visitID == 0 {
+		return
+	}
+	_, err := sm.db.Exec(`UPDATE viewer_sessions SET left_at = ? WHERE id = ? AND left_at IS NULL`, leftAt.UnixMilli(), visitID)
+	if err != nil {
+		logErrorf("Failed to record viewer leave: %v", err)
+	}
+}
+
+// GetViewerAnalytics summarizes viewer visits for a session. Visits still open
+// are counted up to the session's end (or now if it's still running).
+func (sm *SessionManager) GetViewerAnalytics(session *TermSession) (*ViewerAnalytics, error) {
+	rows, err := sm.db.Query(`
+		SELECT username, joined_at, left_at FROM viewer_sessions
+		WHERE session_id = ? ORDER BY joined_at ASC
+	`, session.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	openUntil := time.Now().UnixMilli()
+	if session.EndedAt != nil {
+		openUntil = session.EndedAt.UnixMilli()
+	}
+
+	type edge struct {
+		at    int64
+		delta int
+	}
+	var edges []edge
+	var totalWatch int64
+	analytics := &ViewerAnalytics{SessionID: session.ID, Viewers: []*ViewerSummary{}}
+	byUser := make(map[string]*ViewerSummary)
+
+	for rows.Next() {
+		var username string
+		var joinedAt int64
+		var leftAt sql.NullInt64
+		if err := rows.Scan(&username, &joinedAt, &leftAt); err != nil {
+			continue
+		}
+
+		left := openUntil
+		if leftAt.Valid {
+			left = leftAt.Int64
+		}
+		if left < joinedAt {
+			left = joinedAt
+		}
+
+		summary, exists := byUser[username]
+		if !exists {
+			summary = &ViewerSummary{Username: username, FirstJoined: joinedAt}
+			byUser[username] = summary
+			analytics.Viewers = append(analytics.Viewers, summary)
+		}
+		summary.Visits++
+		summary.TotalWatchMs += left - joinedAt
+		if left > summary.LastLeft {
+			summary.LastLeft = left
+		}
+
+		analytics.TotalVisits++
+		totalWatch += left - joinedAt
+		edges = append(edges, edge{joinedAt, 1}, edge{left, -1})
+	}
+
+	// Peak concurrency: sweep joins and leaves in time order (leaves first on ties)
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].at != edges[j].at {
+			return edges[i].at < edges[j].at
+		}
+		return edges[i].delta < edges[j].delta
+	})
+	current := 0
+	for _, e := range edges {
+		current += e.delta
+		if current > analytics.PeakConcurrency {
+			analytics.PeakConcurrency = current
+		}
+	}
+
+	analytics.UniqueViewers = len(analytics.Viewers)
+	if analytics.UniqueViewers > 0 {
+		analytics.AverageWatchMs = totalWatch / int64(analytics.UniqueViewers)
+		analytics.AverageVisitMs = totalWatch / int64(analytics.TotalVisits)
+	}
+	return analytics, nil
+}
+
+// handleSessionViewerAnalytics returns viewer engagement for a session's owner
+func handleSessionViewerAnalytics(w http.ResponseWriter, r *http.Request, sessionID, username string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	session, err := sessionMgr.GetSession(sessionID)
+	if err != nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	if session.User != username {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	analytics, err := sessionMgr.GetViewerAnalytics(session)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(analytics)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// viewerCounters tracks what a live viewer was sent and what was dropped
+// because its send buffer was full
+type viewerCounters struct {
+	sentBytes    atomic.Int64
+	sentMessages atomic.Int64
+	dropped      atomic.Int64
+	droppedBytes atomic.Int64
+	lastDrop     atomic.Int64 // UnixMilli of the latest drop, 0 if none
+}
+
+// trySend queues a message for the viewer without blocking. A viewer whose
+// buffer is full misses the message rather than stalling the room; the drop
+// is counted so the owner can see who is struggling.
+func (v *LiveViewer) trySend(data []byte) bool {
+	select {
+	case v.send <- data:
+		return true
+	default:
+	}
+
+	if v.counters.dropped.Add(1) == 1 {
+		logWarnf("Live viewer %s in %s is falling behind, dropping messages", v.Username, v.SessionID)
+	}
+	v.counters.droppedBytes.Add(int64(len(data)))
+	v.counters.lastDrop.Store(time.Now().UnixMilli())
+	return false
+}
+
+// recordSent counts a message written to the viewer's connection
+func (v *LiveViewer) recordSent(n int) {
+	v.counters.sentBytes.Add(int64(n))
+	v.counters.sentMessages.Add(1)
+}
+
+// ViewerStats is one viewer's share of a room's broadcast
+type ViewerStats struct {
+	Username       string  `json:"username"`
+	IsOwner        bool    `json:"is_owner"`
+	Transport      string  `json:"transport"` // "websocket", "sse" or "mirror"
+	Plain          bool    `json:"plain"`
+	ConnectedAt    int64   `json:"connected_at"` // UnixMilli
+	SentBytes      int64   `json:"sent_bytes"`
+	SentMessages   int64   `json:"sent_messages"`
+	BytesPerSecond float64 `json:"bytes_per_second"` // Average since connecting
+	Dropped        int64   `json:"dropped"`
+	DroppedBytes   int64   `json:"dropped_bytes"`
+	LastDropAt     int64   `json:"last_drop_at,omitempty"` // UnixMilli
+	Queued         int     `json:"queued"`                 // Messages waiting in the send buffer
+	QueueCapacity  int     `json:"queue_capacity"`
+}
+
+// Stats returns the viewer's counters
+func (v *LiveViewer) Stats() ViewerStats {
+	stats := ViewerStats{
+		Username:      v.Username,
+		IsOwner:       v.IsOwner,
+		Transport:     "websocket",
+		Plain:         v.plain,
+		ConnectedAt:   v.joinedAt.UnixMilli(),
+		SentBytes:     v.counters.sentBytes.Load(),
+		SentMessages:  v.counters.sentMessages.Load(),
+		Dropped:       v.counters.dropped.Load(),
+		DroppedBytes:  v.counters.droppedBytes.Load(),
+		LastDropAt:    v.counters.lastDrop.Load(),
+		Queued:        len(v.send),
+		QueueCapacity: cap(v.send),
+	}
+	if v.Conn == nil {
+		stats.Transport = "sse"
+	} else if v.mirror {
+		stats.Transport = "mirror"
+	}
+	if elapsed := time.Since(v.joinedAt).Seconds(); elapsed > 0 {
+		stats.BytesPerSecond = float64(stats.SentBytes) / elapsed
+	}
+	return stats
+}
+
+// GetViewerStats returns the counters of every viewer in a room
+func (h *LiveHub) GetViewerStats(sessionID string) []ViewerStats {
+	h.mu.RLock()
+	room, exists := h.rooms[sessionID]
+	h.mu.RUnlock()
+
+	if !exists {
+		return nil
+	}
+
+	room.mu.RLock()
+	defer room.mu.RUnlock()
+
+	stats := make([]ViewerStats, 0, len(room.Viewers))
+	for viewer := range room.Viewers {
+		stats = append(stats, viewer.Stats())
+	}
+	return stats
+}
+
+// handleSessionViewerStats returns per-viewer bandwidth and drop counts for
+// the owner: GET /api/sessions/{id}/viewers/stats
+func handleSessionViewerStats(w http.ResponseWriter, r *http.Request, sessionID, username string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, err := sessionMgr.GetSession(sessionID)
+	if err != nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	if session.User != username {
+		http.Error(w, "Access denied", http.StatusForbidden)
+		return
+	}
+
+	stats := liveHub.GetViewerStats(sessionID)
+	if stats == nil {
+		stats = []ViewerStats{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
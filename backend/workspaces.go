@@ -0,0 +1,405 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// MaxWorkspaceNameLength caps a workspace name (bytes)
+const MaxWorkspaceNameLength = 64
+
+// ErrWorkspaceExists is returned when a user already has a workspace by that name
+var ErrWorkspaceExists = errors.New("a workspace with this name already exists")
+
+// workspaceNamePattern allows '/'-separated names like "clients/acme" so
+// workspaces read as a hierarchy; segments can't be empty or hold control
+// characters
+var workspaceNamePattern = regexp.MustCompile(`^[^\x00-\x1f\x7f/]+(/[^\x00-\x1f\x7f/]+)*$`)
+
+// Workspace groups a user's sessions by project. A session is in at most one
+// workspace; sessions in none have an empty workspace.
+type Workspace struct {
+	Name         string    `json:"name"`
+	IsDefault    bool      `json:"is_default"` // New sessions are created in it
+	SessionCount int       `json:"session_count"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// initWorkspacesTable creates the workspaces table. It runs after the
+// term_sessions.workspace column is backfilled, which its index needs.
+func initWorkspacesTable(db *sql.DB) error {
+	_, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS workspaces (
+			user TEXT NOT NULL,
+			name TEXT NOT NULL,
+			is_default BOOLEAN DEFAULT 0,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (user, name)
+		);
+		CREATE INDEX IF NOT EXISTS idx_sessions_workspace ON term_sessions(user, workspace);
+	`)
+	return err
+}
+
+// normalizeWorkspaceName trims a workspace name and checks it, returning a
+// message for the client when it is invalid
+func normalizeWorkspaceName(name string) (string, string) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > MaxWorkspaceNameLength {
+		return "", "Workspace name is required (max 64 bytes)"
+	}
+	if !workspaceNamePattern.MatchString(name) {
+		return "", "Workspace names can't contain control characters or empty '/' segments"
+	}
+	return name, ""
+}
+
+// ListWorkspaces lists a user's workspaces by name with their session counts
+func (sm *SessionManager) ListWorkspaces(user string) ([]*Workspace, error) {
+	rows, err := sm.db.Query(`
+		SELECT w.name, COALESCE(w.is_default, 0), w.created_at,
+			(SELECT COUNT(*) FROM term_sessions s WHERE s.user = w.user AND s.workspace = w.name)
+		FROM workspaces w WHERE w.user = ?
+		ORDER BY w.name ASC
+	`, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	workspaces := []*Workspace{}
+	for rows.Next() {
+		var ws Workspace
+		if err := rows.Scan(&ws.Name, &ws.IsDefault, &ws.CreatedAt, &ws.SessionCount); err != nil {
+			continue
+		}
+		workspaces = append(workspaces, &ws)
+	}
+	return workspaces, nil
+}
+
+// WorkspaceExists reports whether user has a workspace called name
+func (sm *SessionManager) WorkspaceExists(user, name string) (bool, error) {
+	var count int
+	err := sm.db.QueryRow(`SELECT COUNT(*) FROM workspaces WHERE user = ? AND name = ?`, user, name).Scan(&count)
+	return count > 0, err
+}
+
+// CreateWorkspace adds a workspace for user
+func (sm *SessionManager) CreateWorkspace(user, name string) (*Workspace, error) {
+	ws := &Workspace{Name: name, CreatedAt: time.Now()}
+	result, err := sm.db.Exec(`INSERT OR IGNORE INTO workspaces (user, name, created_at) VALUES (?, ?, ?)`, user, name, ws.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return nil, ErrWorkspaceExists
+	}
+	return ws, nil
+}
+
+// RenameWorkspace renames a workspace of user, moving its sessions along
+func (sm *SessionManager) RenameWorkspace(user, name, newName string) error {
+	if name == newName {
+		exists, err := sm.WorkspaceExists(user, name)
+		if err == nil && !exists {
+			err = sql.ErrNoRows
+		}
+		return err
+	}
+
+	tx, err := sm.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var taken int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM workspaces WHERE user = ? AND name = ?`, user, newName).Scan(&taken); err != nil {
+		return err
+	}
+	if taken > 0 {
+		return ErrWorkspaceExists
+	}
+
+	result, err := tx.Exec(`UPDATE workspaces SET name = ? WHERE user = ? AND name = ?`, newName, user, name)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
+	if _, err := tx.Exec(`UPDATE term_sessions SET workspace = ? WHERE user = ? AND workspace = ?`, newName, user, name); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	sm.moveActiveWorkspace(user, name, newName)
+	return nil
+}
+
+// DeleteWorkspace removes a workspace of user. Its sessions are kept and
+// end up in no workspace.
+func (sm *SessionManager) DeleteWorkspace(user, name string) error {
+	tx, err := sm.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM workspaces WHERE user = ? AND name = ?`, user, name)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
+	if _, err := tx.Exec(`UPDATE term_sessions SET workspace = '' WHERE user = ? AND workspace = ?`, user, name); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	sm.moveActiveWorkspace(user, name, "")
+	return nil
+}
+
+// SetDefaultWorkspace makes a workspace of user the one new sessions are
+// created in, or clears the default
+func (sm *SessionManager) SetDefaultWorkspace(user, name string, isDefault bool) error {
+	tx, err := sm.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if isDefault {
+		if _, err := tx.Exec(`UPDATE workspaces SET is_default = 0 WHERE user = ?`, user); err != nil {
+			return err
+		}
+	}
+	result, err := tx.Exec(`UPDATE workspaces SET is_default = ? WHERE user = ? AND name = ?`, isDefault, user, name)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
+	return tx.Commit()
+}
+
+// defaultWorkspace returns the workspace new sessions of user go in, if any
+func (sm *SessionManager) defaultWorkspace(user string) string {
+	var name string
+	sm.db.QueryRow(`SELECT name FROM workspaces WHERE user = ? AND is_default = 1`, user).Scan(&name)
+	return name
+}
+
+// moveActiveWorkspace updates the in-memory workspace of user's active sessions
+func (sm *SessionManager) moveActiveWorkspace(user, name, newName string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	for _, sess := range sm.activeSessions {
+		if sess.Session.User == user && sess.Session.Workspace == name {
+			sess.Session.Workspace = newName
+		}
+	}
+}
+
+// SetSessionWorkspace moves a session owned by user into a workspace, or out
+// of any with an empty name
+func (sm *SessionManager) SetSessionWorkspace(id, user, workspace string) error {
+	result, err := sm.db.Exec(`UPDATE term_sessions SET workspace = ? WHERE id = ? AND user = ?`, workspace, id, user)
+	if err != nil {
+		return err
+	}
+
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+
+	// Update in memory if exists
+	sm.mu.Lock()
+	if sess, ok := sm.activeSessions[id]; ok {
+		sess.Session.Workspace = workspace
+	}
+	sm.mu.Unlock()
+
+	return nil
+}
+
+// resolveSessionWorkspace checks a workspace a session is being put in,
+// returning a message for the client when user doesn't have it. An empty
+// name (no workspace) is always fine.
+func resolveSessionWorkspace(user, name string) (string, string) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", ""
+	}
+	exists, err := sessionMgr.WorkspaceExists(user, name)
+	if err != nil || !exists {
+		return "", "Workspace not found"
+	}
+	return name, ""
+}
+
+// HTTP Handlers
+
+// handleWorkspaces lists and creates workspaces: /api/workspaces
+func handleWorkspaces(w http.ResponseWriter, r *http.Request) {
+	username := ""
+	if cookie, err := r.Cookie("cyh_session"); err == nil {
+		if user, valid := authManager.ValidateSession(cookie.Value); valid {
+			username = user
+		}
+	}
+
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		workspaces, err := sessionMgr.ListWorkspaces(username)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(workspaces)
+
+	case http.MethodPost:
+		var req struct {
+			Name      string `json:"name"`
+			IsDefault bool   `json:"is_default"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		name, msg := normalizeWorkspaceName(req.Name)
+		if msg != "" {
+			http.Error(w, msg, http.StatusBadRequest)
+			return
+		}
+
+		ws, err := sessionMgr.CreateWorkspace(username, name)
+		if err == ErrWorkspaceExists {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if req.IsDefault {
+			if err := sessionMgr.SetDefaultWorkspace(username, name, true); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			ws.IsDefault = true
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(ws)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleWorkspaceByName renames, (un)defaults and deletes a workspace:
+// /api/workspaces/{name}. The name is the rest of the path, so it may
+// contain '/'.
+func handleWorkspaceByName(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/api/workspaces/")
+	if name == "" {
+		http.Error(w, "Workspace name required", http.StatusBadRequest)
+		return
+	}
+
+	username := ""
+	if cookie, err := r.Cookie("cyh_session"); err == nil {
+		if user, valid := authManager.ValidateSession(cookie.Value); valid {
+			username = user
+		}
+	}
+
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPatch:
+		var req struct {
+			Name      string `json:"name"`
+			IsDefault *bool  `json:"is_default"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		if req.Name == "" && req.IsDefault == nil {
+			http.Error(w, "Name or is_default is required", http.StatusBadRequest)
+			return
+		}
+
+		resp := map[string]interface{}{"status": "updated", "name": name}
+		if req.Name != "" {
+			newName, msg := normalizeWorkspaceName(req.Name)
+			if msg != "" {
+				http.Error(w, msg, http.StatusBadRequest)
+				return
+			}
+			err := sessionMgr.RenameWorkspace(username, name, newName)
+			if err == ErrWorkspaceExists {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				http.Error(w, "Workspace not found", http.StatusNotFound)
+				return
+			}
+			name = newName
+			resp["status"] = "renamed"
+			resp["name"] = name
+		}
+		if req.IsDefault != nil {
+			if err := sessionMgr.SetDefaultWorkspace(username, name, *req.IsDefault); err != nil {
+				http.Error(w, "Workspace not found", http.StatusNotFound)
+				return
+			}
+			resp["is_default"] = *req.IsDefault
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+
+	case http.MethodDelete:
+		if err := sessionMgr.DeleteWorkspace(username, name); err != nil {
+			http.Error(w, "Workspace not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "deleted"})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
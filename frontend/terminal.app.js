@@ -21,9 +21,12 @@ class TerminalApp {
         this.isConnecting = false;
         this.isReconnecting = false;
         this.intentionalDisconnect = false;
+        this.startFailed = false;
         this.connectionId = 0;
         this.activeSessionId = '';
         this.outputSeen = false;
+        this.pendingReplay = ''; // Session to replay once the server sends resume_ready
+        this.uploads = {}; // File transfers in progress by id, resumed on reconnect
 
         // Command history tracking
         this.commandBuffer = '';
@@ -43,6 +46,7 @@ class TerminalApp {
         this.playbackIndex = 0;
         this.playbackSpeed = 1;
         this.playbackTimeout = null;
+        this.playbackAltScreen = false; // Recording is inside a full-screen program
 
         this.init();
     }
@@ -212,7 +216,8 @@ class TerminalApp {
 
             if (isSessionView && urlSessionId) {
                 setTimeout(() => {
-                    if (!this.outputSeen) {
+                    // A connected terminal replays on resume_ready instead
+                    if (!this.outputSeen && !this.pendingReplay) {
                         this.replaySessionFallback(urlSessionId);
                     }
                 }, 1200);
@@ -278,6 +283,13 @@ class TerminalApp {
         const terminalBody = document.getElementById('terminalBody');
         this.terminal.open(terminalBody);
 
+        // Files dropped on the terminal are uploaded into the container
+        terminalBody.addEventListener('dragover', (e) => e.preventDefault());
+        terminalBody.addEventListener('drop', (e) => {
+            e.preventDefault();
+            Array.from(e.dataTransfer.files).forEach(file => this.uploadFile(file));
+        });
+
         // Block browser shortcuts when terminal is focused
         this.terminal.attachCustomKeyEventHandler((e) => {
             // List of Ctrl+key combinations to block from browser
@@ -869,6 +881,7 @@ class TerminalApp {
         // Generate unique connection ID to track this attempt
         const currentConnectionId = ++this.connectionId;
         this.isConnecting = true;
+        this.startFailed = false;
 
         // Clean up any existing socket
         this.cleanupSocket();
@@ -904,6 +917,12 @@ class TerminalApp {
 
         let socketURL = `${protocol}//${window.location.host}/ws/terminal?mode=${this.currentMode}&session_id=${sessionId}`;
 
+        // Guests resume their sessions with the key the server issued for them
+        const guestKey = sessionId ? sessionStorage.getItem(`guestKey:${sessionId}`) : null;
+        if (guestKey) {
+            socketURL += `&guest_key=${encodeURIComponent(guestKey)}`;
+        }
+
         // Append specific container target if set (from session or explicit target)
         if (this.currentMode === 'docker' && sessionContainerName) {
             socketURL += `&container=${encodeURIComponent(sessionContainerName)}`;
@@ -933,13 +952,13 @@ class TerminalApp {
                 }, 100);
 
                 // If resuming a session WITH session_id in URL, replay history AFTER shell initializes
-                // Only replay if session_id was explicitly passed in URL (not auto-created)
+                // Only replay if session_id was explicitly passed in URL (not auto-created).
+                // The server sends resume_ready once the shell's clear + welcome banner are done.
                 const urlHasSessionId = new URLSearchParams(window.location.search).get('session_id');
-                if (urlHasSessionId && sessionId) {
-                    setTimeout(() => {
-                        this.replaySessionHistory(sessionId);
-                    }, 1500); // Wait for shell to finish clear + welcome banner
-                }
+                this.pendingReplay = urlHasSessionId && sessionId ? sessionId : '';
+
+                // Continue uploads the dropped connection interrupted
+                Object.keys(this.uploads).forEach(id => this.beginUpload(id));
             };
 
             this.socket.onmessage = async (event) => {
@@ -957,6 +976,9 @@ class TerminalApp {
                             if (msg.type === 'session_id') {
                                 this.activeSessionId = msg.data;
                                 sessionStorage.setItem('activeSessionId', msg.data);
+                                if (msg.guest_key) {
+                                    sessionStorage.setItem(`guestKey:${msg.data}`, msg.guest_key);
+                                }
 
                                 // Update current session global
                                 if (!currentSession || currentSession.id !== msg.data) {
@@ -970,6 +992,9 @@ class TerminalApp {
                                 }
                                 return; // Don't write to terminal
                             }
+                            if (this.handleControlMessage(msg)) {
+                                return;
+                            }
                         } catch (e) {
                             // Not a valid JSON control message, ignore
                         }
@@ -1005,7 +1030,8 @@ class TerminalApp {
                 if (currentConnectionId !== this.connectionId) return;
 
                 this.isConnecting = false;
-                this.updateConnectionStatus('disconnected');
+                this.handleCloseCode(event);
+                this.updateConnectionStatus(this.startFailed ? 'error' : 'disconnected');
 
                 // Only auto-reconnect if not an intentional disconnect
                 if (!this.intentionalDisconnect && !this.isReconnecting && this.reconnectAttempts < this.maxReconnectAttempts) {
@@ -1095,13 +1121,24 @@ class TerminalApp {
             this.terminal.write(`${DARK_GREEN}━━━━━━━━━━━━━━━━━━━━━━━━━ ${WHITE}Session History${RESET} ${DARK_GREEN}━━━━━━━━━━━━━━━━━━━━━━━━━${RESET}\r\n`);
             this.terminal.write('\r\n');
 
-            // Replay all output events
+            // Replay all output events (extra panes' output isn't part of this screen)
+            let altScreen = false;
             for (const event of data.events) {
-                if (event.type === 'output' && event.data) {
+                if (event.pane) {
+                    continue;
+                } else if (event.type === 'output' && event.data) {
                     this.terminal.write(event.data);
+                } else if (event.type === 'marker') {
+                    altScreen = event.data === 'alt_screen_enter';
                 }
             }
 
+            // History ended inside a full-screen program (vim, less); return
+            // to the normal screen so the history and prompt stay visible
+            if (altScreen) {
+                this.terminal.write('\x1b[?1049l');
+            }
+
             // End separator
             this.terminal.write('\r\n');
             this.terminal.write(`${DARK_GREEN}━━━━━━━━━━━━━━━━━━━━━━━ ${WHITE}Session Continues${RESET} ${DARK_GREEN}━━━━━━━━━━━━━━━━━━━━━━━━━${RESET}\r\n`);
@@ -1114,7 +1151,8 @@ class TerminalApp {
     }
 
     async replaySessionFallback(sessionId) {
-        // Fallback - just call replaySessionHistory
+        // Fallback - just call replaySessionHistory, once
+        this.pendingReplay = '';
         await this.replaySessionHistory(sessionId);
     }
 
@@ -1165,6 +1203,9 @@ class TerminalApp {
             dot.classList.add('connecting');
             text.textContent = 'Connecting...';
             wsStatus.textContent = 'Connecting...';
+        } else if (status === 'error') {
+            text.textContent = 'Error';
+            wsStatus.textContent = 'Terminal failed to start';
         } else {
             text.textContent = 'Disconnected';
             wsStatus.textContent = 'Disconnected';
@@ -1428,6 +1469,22 @@ class TerminalApp {
         if (this.terminal) this.terminal.clear();
     }
 
+    // Ask the server to signal the foreground process, for touch devices
+    // that can't type Ctrl-C
+    sendSignal(name) {
+        if (this.socket && this.socket.readyState === WebSocket.OPEN) {
+            this.socket.send(JSON.stringify({ type: 'signal', data: name }));
+            this.terminal.focus();
+        }
+    }
+
+    // Open a read-only copy of this terminal in another tab, e.g. for a
+    // second monitor
+    openMirror() {
+        if (!this.activeSessionId) return;
+        window.open(`/live/?mirror=${encodeURIComponent(this.activeSessionId)}`, '_blank');
+    }
+
     toggleFullscreen() {
         const container = document.querySelector('.main-content');
         if (document.fullscreenElement) {
@@ -1441,6 +1498,337 @@ class TerminalApp {
         }
     }
 
+    // Handle server control messages; returns true if the message was consumed
+    handleControlMessage(msg) {
+        switch (msg.type) {
+            case 'bell':
+                this.flashBell();
+                return true;
+            case 'session_ended':
+                this.handleSessionEnded(msg.reason);
+                return true;
+            case 'error':
+                this.handleTerminalError(msg);
+                return true;
+            case 'container_recreated':
+                this.handleContainerRecreated(msg);
+                return true;
+            case 'resume_ready':
+                this.handleResumeReady();
+                return true;
+            case 'recording_capped':
+                this.handleRecordingCapped();
+                return true;
+            case 'title':
+                // xterm.js already applies titles from the output (onTitleChange)
+                return true;
+            case 'paste_pending':
+                this.handlePastePending(msg);
+                return true;
+            case 'viewer_join':
+            case 'viewer_leave':
+            case 'chat':
+                this.handleLiveEvent(msg);
+                return true;
+            case 'permission_request':
+                this.handlePermissionRequest(msg);
+                return true;
+            case 'permission_mode_change':
+                this.handleShareIdle(msg);
+                return true;
+            case 'chat_receipt':
+                this.handleChatReceipt(msg);
+                return true;
+            case 'owner_idle_warning':
+                this.handleShareIdleWarning(msg);
+                return true;
+            case 'owner_idle_cancelled':
+                // Our activity reached the server in time; the prompt is moot
+                if (this.shareIdlePrompt) this.shareIdlePrompt.remove();
+                this.shareIdlePrompt = null;
+                this.shareIdle = null;
+                return true;
+            case 'file_transfer_progress':
+                this.handleUploadProgress(msg);
+                return true;
+            case 'file_transfer_done':
+            case 'file_transfer_error':
+                this.handleUploadFinished(msg);
+                return true;
+        }
+        return false;
+    }
+
+    // The resumed shell has drawn its prompt; history replayed now stays visible
+    handleResumeReady() {
+        const sessionId = this.pendingReplay;
+        this.pendingReplay = '';
+        if (sessionId) {
+            this.replaySessionHistory(sessionId);
+        }
+    }
+
+    // The server ended this terminal's session; don't resume it on reconnect
+    handleSessionEnded(reason) {
+        const reasons = {
+            'ended': 'Session ended',
+            'terminal_closed': 'Session ended: the shell exited'
+        };
+        this.intentionalDisconnect = true;
+        this.activeSessionId = '';
+        sessionStorage.removeItem('activeSessionId');
+        this.terminal.write(`\r\n\x1b[33m■ ${reasons[reason] || 'Session ended'}. Switch mode or refresh to start a new session.\x1b[0m\r\n`);
+    }
+
+    // Explain why the server closed the terminal (see the Close* codes in
+    // terminal_common.go). Messages sent before the close (session_ended,
+    // error) already cover ended sessions and failed starts.
+    handleCloseCode(event) {
+        switch (event.code) {
+            case 4000: // Shell exited
+                this.terminal.write(`\r\n\x1b[90m■ ${event.reason || 'Shell exited'}\x1b[0m\r\n`);
+                break;
+            case 4002: // Connect rejected; retrying would be rejected again
+            case 4004: // Input rate limit
+                this.intentionalDisconnect = true;
+                this.terminal.write('\r\n\x1b[90mSwitch mode or refresh to reconnect.\x1b[0m\r\n');
+                break;
+            case 4005: // Container stopped; reconnecting starts it again
+                this.terminal.write(`\r\n\x1b[33m⚠ ${event.reason || 'Your container stopped'}.\x1b[0m\r\n`);
+                break;
+            case 4006: // Terminal I/O error
+                this.terminal.write(`\r\n\x1b[38;2;255;71;87m✗ ${event.reason || 'Terminal error'}\x1b[0m\r\n`);
+                break;
+        }
+    }
+
+    // The server stopped recording this session (CYH_MAX_RECORDING_DURATION);
+    // the terminal keeps working
+    handleRecordingCapped() {
+        this.terminal.write('\r\n\x1b[90m■ Session recording stopped: it reached the server\'s maximum recording time. The terminal keeps working.\x1b[0m\r\n');
+    }
+
+    // The server holds a multi-line or binary paste until we confirm it (paste_guard)
+    handlePastePending(msg) {
+        const what = msg.binary ? 'binary data' : `${msg.lines} lines`;
+        const ok = window.confirm(`Paste ${msg.bytes} bytes (${what}) into the shell? Each line break runs a command.`);
+        if (this.socket && this.socket.readyState === WebSocket.OPEN) {
+            this.socket.send(JSON.stringify({ type: ok ? 'confirm_paste' : 'cancel_paste' }));
+        }
+    }
+
+    // Someone joined or left this session's live view, or wrote in its chat
+    handleLiveEvent(msg) {
+        const data = msg.data || {};
+        let text;
+        if (msg.type === 'chat') {
+            const body = typeof data === 'string' ? data : (data.text || data.message || '');
+            text = `${msg.sender || 'viewer'}: ${body}`;
+            if (msg.id) this.rememberChat(msg.id, body);
+        } else {
+            text = `${data.username} ${msg.type === 'viewer_join' ? 'joined' : 'left'} (${data.count || 0} watching)`;
+        }
+        this.terminal.write(`\r\n\x1b[90m■ ${text}\x1b[0m\r\n`);
+    }
+
+    // Keep recent chat messages so receipts can name them
+    rememberChat(id, body) {
+        if (!this.chatMessages) this.chatMessages = new Map();
+        this.chatMessages.set(id, body);
+        if (this.chatMessages.size > 50) {
+            this.chatMessages.delete(this.chatMessages.keys().next().value);
+        }
+    }
+
+    // Viewers saw a chat message; say so once all of them have
+    handleChatReceipt(msg) {
+        const data = msg.data || {};
+        if (!this.chatMessages || !this.chatMessages.has(data.message_id)) return;
+        if (!data.viewers || data.seen < data.viewers) return;
+        const body = this.chatMessages.get(data.message_id);
+        this.chatMessages.delete(data.message_id);
+        const preview = body.length > 40 ? body.slice(0, 40) + '…' : body;
+        this.terminal.write(`\r\n\x1b[90m■ Seen by all ${data.viewers} viewer${data.viewers === 1 ? '' : 's'}: ${preview}\x1b[0m\r\n`);
+    }
+
+    // A viewer asks to type in this session (instructor mode)
+    handlePermissionRequest(msg) {
+        const username = (msg.data && msg.data.username) || msg.sender;
+        const ok = window.confirm(`${username} asks to type in your terminal. Allow it?`);
+        if (this.socket && this.socket.readyState === WebSocket.OPEN) {
+            this.socket.send(JSON.stringify({ type: ok ? 'permission_grant' : 'permission_deny', data: { username } }));
+        }
+    }
+
+    // The share is about to switch to view only because we seem to be away.
+    // The prompt doesn't block the page, so output keeps rendering, and an
+    // answer after the switch turns the previous mode back on.
+    handleShareIdleWarning(msg) {
+        const seconds = (msg.data && msg.data.seconds) || 0;
+        this.terminal.write(`\r\n\x1b[90m■ You seem to be away: viewers lose control of this session in ${seconds} seconds.\x1b[0m\r\n`);
+
+        const session = typeof currentSession !== 'undefined' && currentSession && currentSession.id === msg.session_id ? currentSession : null;
+        this.shareIdle = { sessionId: msg.session_id, mode: session ? session.permission_mode : '', switched: false };
+        if (this.shareIdlePrompt) this.shareIdlePrompt.remove();
+
+        const prompt = document.createElement('div');
+        prompt.className = 'live-toast request';
+        prompt.innerHTML = `
+            <div class="toast-content">
+                <div class="toast-title">Are you still there?</div>
+                <div class="toast-msg"></div>
+            </div>
+            <div class="toast-actions">
+                <button class="btn-xs accept">Keep sharing</button>
+                <button class="btn-xs deny">Dismiss</button>
+            </div>
+        `;
+        prompt.querySelector('.toast-msg').textContent = `Viewers lose control of this session in ${seconds} seconds because you seem to be away.`;
+        prompt.querySelector('.accept').onclick = () => {
+            prompt.remove();
+            this.keepSharing();
+        };
+        prompt.querySelector('.deny').onclick = () => prompt.remove();
+        document.body.appendChild(prompt);
+        this.shareIdlePrompt = prompt;
+    }
+
+    // Answer to the idle prompt: we're here. Before the switch that cancels
+    // the countdown; after it, the permission mode from before is restored.
+    async keepSharing() {
+        const idle = this.shareIdle;
+        this.shareIdle = null;
+        this.shareIdlePrompt = null;
+        if (this.socket && this.socket.readyState === WebSocket.OPEN) {
+            this.socket.send(JSON.stringify({ type: 'owner_active' }));
+        }
+        if (!idle || !idle.switched || !idle.mode || idle.mode === 'view_only') return;
+
+        try {
+            const response = await fetch(`/api/sessions/${idle.sessionId}/permission`, {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ action: 'set_mode', mode: idle.mode })
+            });
+            if (!response.ok) throw new Error(await response.text());
+            if (typeof currentSession !== 'undefined' && currentSession && currentSession.id === idle.sessionId) {
+                currentSession.permission_mode = idle.mode;
+                const select = document.getElementById('permissionMode');
+                if (select) select.value = idle.mode;
+            }
+            this.terminal.write(`\r\n\x1b[90m■ Sharing is back to ${idle.mode.replace('_', ' ')}. Viewers you had let type need to ask again.\x1b[0m\r\n`);
+        } catch (e) {
+            this.terminal.write('\r\n\x1b[90m■ Couldn\'t restore the permission mode; change it to let viewers type again.\x1b[0m\r\n');
+        }
+    }
+
+    // The server switched this session's share to view only while we were away
+    handleShareIdle(msg) {
+        if (msg.reason !== 'owner_idle') return;
+        if (typeof currentSession !== 'undefined' && currentSession && currentSession.id === msg.session_id) {
+            currentSession.permission_mode = 'view_only';
+            const select = document.getElementById('permissionMode');
+            if (select) select.value = 'view_only';
+        }
+        if (this.shareIdle && this.shareIdle.sessionId === msg.session_id) {
+            this.shareIdle.switched = true;
+        }
+        const hint = this.shareIdlePrompt ? 'Choose "Keep sharing" to turn it back on.' : 'Change the permission mode to let them type again.';
+        this.terminal.write(`\r\n\x1b[90m■ You were away, so viewers can no longer type in this session. ${hint}\x1b[0m\r\n`);
+    }
+
+    // ==================== FILE UPLOADS ====================
+
+    // Upload a file into the container's home directory in 1 MB chunks
+    uploadFile(file) {
+        if (this.currentMode !== 'docker') {
+            this.terminal.write('\r\n\x1b[33m■ Files can only be uploaded into docker sessions.\x1b[0m\r\n');
+            return;
+        }
+        const id = `${Date.now().toString(36)}-${Math.random().toString(36).slice(2, 8)}`;
+        this.uploads[id] = { file, lastPercent: -1 };
+        this.terminal.write(`\r\n\x1b[90m■ Uploading ${file.name} (${file.size} bytes)...\x1b[0m\r\n`);
+        this.beginUpload(id);
+    }
+
+    beginUpload(id) {
+        const upload = this.uploads[id];
+        if (!upload || !this.socket || this.socket.readyState !== WebSocket.OPEN) return;
+        this.socket.send(JSON.stringify({
+            type: 'file_transfer_begin',
+            data: { id, name: upload.file.name, size: upload.file.size }
+        }));
+    }
+
+    // The server has `received` bytes; send the next chunk, or finish
+    async handleUploadProgress(msg) {
+        const upload = this.uploads[msg.id];
+        if (!upload || !this.socket || this.socket.readyState !== WebSocket.OPEN) return;
+
+        const percent = msg.size ? Math.floor(msg.received * 100 / msg.size) : 100;
+        if (percent >= upload.lastPercent + 10) {
+            upload.lastPercent = percent;
+            document.getElementById('wsStatus').textContent = `Uploading ${upload.file.name}: ${percent}%`;
+        }
+
+        if (msg.received >= upload.file.size) {
+            this.socket.send(JSON.stringify({ type: 'file_transfer_end', data: { id: msg.id } }));
+            return;
+        }
+        const slice = upload.file.slice(msg.received, msg.received + 1024 * 1024);
+        const bytes = new Uint8Array(await slice.arrayBuffer());
+        let binary = '';
+        for (let i = 0; i < bytes.length; i += 0x8000) {
+            binary += String.fromCharCode.apply(null, bytes.subarray(i, i + 0x8000));
+        }
+        if (!this.socket || this.socket.readyState !== WebSocket.OPEN) return;
+        this.socket.send(JSON.stringify({
+            type: 'file_transfer_chunk',
+            data: { id: msg.id, offset: msg.received, chunk: btoa(binary) }
+        }));
+    }
+
+    handleUploadFinished(msg) {
+        const upload = this.uploads[msg.id];
+        if (!upload) return;
+        delete this.uploads[msg.id];
+        this.updateConnectionStatus('connected');
+        if (msg.type === 'file_transfer_done') {
+            this.terminal.write(`\r\n\x1b[90m■ Uploaded ${upload.file.name} to ${msg.path}\x1b[0m\r\n`);
+        } else {
+            this.terminal.write(`\r\n\x1b[33m■ Upload of ${upload.file.name} failed: ${msg.message}\x1b[0m\r\n`);
+        }
+    }
+
+    // The session's container was removed while we were away
+    handleContainerRecreated(msg) {
+        const text = msg.source === 'snapshot'
+            ? `Your container was removed. It was restored from your saved image ${msg.image}; changes made after saving it are lost.`
+            : 'Your container was removed. A fresh one was created; files and tools installed in the old container are gone.';
+        this.terminal.write(`\r\n\x1b[33m⚠ ${text}\x1b[0m\r\n`);
+    }
+
+    // The server couldn't start the shell; retrying immediately would fail the same way
+    handleTerminalError(msg) {
+        const hints = {
+            'docker_exec_failed': 'Check that Docker is running, then switch mode or refresh to retry.',
+            'container_exited': 'Your container stopped as the shell started. Refresh to start it again.',
+            'pty_start_failed': 'Refresh to retry.',
+            'conpty_start_failed': 'Refresh to retry.'
+        };
+        this.startFailed = true;
+        this.intentionalDisconnect = true;
+        this.terminal.write(`\r\n\x1b[38;2;255;71;87m✗ ${msg.message}\x1b[0m\r\n`);
+        this.terminal.write(`\x1b[90m${hints[msg.code] || 'Refresh to retry.'}\x1b[0m\r\n`);
+    }
+
+    flashBell() {
+        const body = document.getElementById('terminalBody');
+        if (!body) return;
+        body.classList.add('bell-flash');
+        setTimeout(() => body.classList.remove('bell-flash'), 150);
+    }
+
     showToast(message) {
         console.log('Toast:', message);
     }
@@ -1557,6 +1945,7 @@ class TerminalApp {
         this.isPlaying = true;
         this.isPaused = false;
         this.playbackIndex = 0;
+        this.playbackAltScreen = false;
 
         // Disconnect live terminal during playback
         this.intentionalDisconnect = true;
@@ -1580,9 +1969,13 @@ class TerminalApp {
         const event = this.playbackData.events[this.playbackIndex];
         const nextEvent = this.playbackData.events[this.playbackIndex + 1];
 
-        // Write output to terminal
-        if (event.type === 'output') {
+        // Write output to terminal (main terminal only, not extra panes)
+        if (event.pane) {
+            // Skipped
+        } else if (event.type === 'output') {
             this.terminal.write(event.data);
+        } else if (event.type === 'marker') {
+            this.playbackAltScreen = event.data === 'alt_screen_enter';
         }
 
         this.playbackIndex++;
@@ -1620,6 +2013,12 @@ class TerminalApp {
         }
 
         this.updatePlaybackUI();
+
+        // Leave a full-screen program's screen so the end notice is visible
+        if (this.playbackAltScreen) {
+            this.terminal.write('\x1b[?1049l');
+            this.playbackAltScreen = false;
+        }
         this.terminal.write('\r\n\x1b[38;2;128;128;128m────────────────────────────────────────\x1b[0m\r\n');
         this.terminal.write('\x1b[38;2;127;255;0m⏹ Playback ended\x1b[0m\r\n');
 
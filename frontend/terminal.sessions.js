@@ -11,6 +11,7 @@ let isSessionShared = false;
 let shareToken = null;
 let liveSocket = null;
 let viewerList = [];
+let listedSessions = [];
 
 async function initSessionPersistence() {
     const params = new URLSearchParams(window.location.search);
@@ -67,10 +68,18 @@ async function createNewSession() {
     const timeStr = now.toLocaleTimeString('en-GB', { hour: '2-digit', minute: '2-digit' });
     const name = `Session ${dateStr} ${timeStr}`;
 
+    // Reused until a create succeeds, so retrying after a lost response or a
+    // reload returns the session the server already created
+    let key = sessionStorage.getItem('pendingCreateKey');
+    if (!key) {
+        key = crypto.randomUUID ? crypto.randomUUID() : `${Date.now()}-${Math.random().toString(36).slice(2)}`;
+        sessionStorage.setItem('pendingCreateKey', key);
+    }
+
     try {
         const response = await fetch('/api/sessions', {
             method: 'POST',
-            headers: { 'Content-Type': 'application/json' },
+            headers: { 'Content-Type': 'application/json', 'Idempotency-Key': key },
             body: JSON.stringify({ name, mode: 'docker' })
         });
 
@@ -80,7 +89,8 @@ async function createNewSession() {
         }
 
         const created = await response.json();
-        showLiveToast('New session created: ' + name, 'success');
+        sessionStorage.removeItem('pendingCreateKey');
+        showLiveToast('New session created: ' + created.name, 'success');
         fetchSessions();
         openSessionView(created.id);
     } catch (e) {
@@ -126,14 +136,21 @@ async function shareSession() {
         return;
     }
 
+    const shareModeOptions = [
+        { value: 'view_only', label: 'View Only - Viewers can only watch' },
+        { value: 'shared_control', label: 'Shared Control - Everyone can type' }
+    ];
+    // Default (first allowed) mode first
+    const allowed = allowedPermissionModes();
+    shareModeOptions.sort((a, b) => allowed.indexOf(a.value) - allowed.indexOf(b.value));
+
     const modal = document.getElementById('containerModal');
     document.getElementById('modalTitle').textContent = 'Share Session Live';
     document.getElementById('modalBody').innerHTML = `
         <div class="form-group">
             <label>Permission Mode</label>
             <select id="sharePermissionMode" style="width: 100%; padding: 10px; background: var(--bg-tertiary); border: 1px solid var(--border-secondary); border-radius: 8px; color: var(--text-primary); margin-top: 8px;">
-                <option value="view_only">View Only - Viewers can only watch</option>
-                <option value="shared_control">Shared Control - Everyone can type</option>
+                ${shareModeOptions.filter(o => allowed.includes(o.value)).map(o => `<option value="${o.value}">${o.label}</option>`).join('')}
             </select>
         </div>
         <p style="font-size: 12px; color: var(--text-muted); margin: 12px 0;">
@@ -296,9 +313,10 @@ function handleLiveMessage(msg) {
             break;
 
         case 'input':
-            // Forward input from viewer to terminal
+            // Forward input from viewer to terminal, tagged so it doesn't
+            // count as the owner being active (share watchdog)
             if (window.terminalApp?.socket?.readyState === WebSocket.OPEN) {
-                window.terminalApp.socket.send(msg.data);
+                window.terminalApp.socket.send(JSON.stringify({ type: 'viewer_input', data: msg.data }));
             } else {
                 console.warn('Cannot forward live input: terminal socket not ready', window.terminalApp);
             }
@@ -351,7 +369,14 @@ function renderViewerList() {
             }
         ` : '';
 
-        return `<div class="${classes}">${extra} ${v.username} ${actions}</div>`;
+        // Viewers whose connection can't keep up miss output
+        let title = '';
+        if (v.dropped > 0) {
+            classes += ' lagging';
+            title = ` title="Connection can't keep up: ${v.dropped} messages dropped"`;
+        }
+
+        return `<div class="${classes}"${title}>${extra} ${v.username} ${actions}</div>`;
     }).join('');
 }
 
@@ -388,17 +413,31 @@ async function revokePermission(username) {
 
 
 
+// Permission modes the server allows for the current session, default first
+function allowedPermissionModes() {
+    if (currentSession && Array.isArray(currentSession.allowed_permission_modes)) {
+        return currentSession.allowed_permission_modes;
+    }
+    return ['view_only', 'shared_control', 'instructor'];
+}
+
 async function changePermissionMode() {
     if (!currentSession) return;
 
     const mode = document.getElementById('permissionMode').value;
 
     try {
-        await fetch(`/api/sessions/${currentSession.id}/permission`, {
+        const response = await fetch(`/api/sessions/${currentSession.id}/permission`, {
             method: 'POST',
             headers: { 'Content-Type': 'application/json' },
             body: JSON.stringify({ action: 'set_mode', mode })
         });
+        if (!response.ok) {
+            showLiveToast(await response.text(), 'info');
+            document.getElementById('permissionMode').value = currentSession.permission_mode;
+            return;
+        }
+        currentSession.permission_mode = mode;
         showLiveToast(`Permission mode: ${mode.replace('_', ' ')}`, 'info');
     } catch (e) {
         console.error('Failed to change permission mode:', e);
@@ -417,10 +456,27 @@ async function fetchSessions() {
     }
 }
 
+// describeSessionEnd says how an ended session ended ("exited with code 1")
+function describeSessionEnd(session) {
+    switch (session.end_reason) {
+        case 'normal':
+            return session.exit_code !== undefined ? `exited with code ${session.exit_code}` : 'closed';
+        case 'killed':
+            return 'killed';
+        case 'container_lost':
+            return 'container stopped';
+        case 'error':
+            return 'failed';
+    }
+    return escapeHtml(session.end_reason);
+}
+
 function renderSessionsList(sessions) {
     const list = document.getElementById('sessionsList');
     if (!list) return;
 
+    listedSessions = sessions || [];
+
     if (!sessions || sessions.length === 0) {
         list.innerHTML = '<div class="no-sessions">No sessions yet</div>';
         return;
@@ -446,21 +502,35 @@ function renderSessionsList(sessions) {
         return `
             <div class="session-item" onclick="resumeSession('${session.id}')">
                 <div class="session-icon">${icon}</div>
-                <div class="session-details">
+                <div class="session-details"${session.notes ? ` title="${escapeHtml(session.notes).replace(/"/g, '&quot;')}"` : ''}>
                     <div class="session-title">${escapeHtml(session.name)}</div>
                     <div class="session-meta">
                         <span>${date}</span>
                         <span class="session-duration">${duration}</span>
+                        ${session.end_reason ? `<span class="session-end">${describeSessionEnd(session)}</span>` : ''}
                     </div>
                 </div>
                 ${isLive ? `<div class="session-live-badge">LIVE</div>` : ''}
                 <div class="session-actions">
+                    <button class="btn-icon-sm" onclick="event.stopPropagation(); togglePinSession('${session.id}')" title="${session.is_pinned ? 'Unpin' : 'Pin to top'}">
+                        <svg viewBox="0 0 24 24" fill="${session.is_pinned ? 'currentColor' : 'none'}" stroke="currentColor" stroke-width="2" width="12" height="12">
+                            <polygon points="12 2 15.09 8.26 22 9.27 17 14.14 18.18 21.02 12 17.77 5.82 21.02 7 14.14 2 9.27 8.91 8.26 12 2"></polygon>
+                        </svg>
+                    </button>
                     <button class="btn-icon-sm" onclick="event.stopPropagation(); renameSession('${session.id}', '${escapeHtml(session.name).replace(/'/g, "\\'")}')" title="Rename">
                         <svg viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2" width="12" height="12">
                             <path d="M11 4H4a2 2 0 00-2 2v14a2 2 0 002 2h14a2 2 0 002-2v-7"></path>
                             <path d="M18.5 2.5a2.121 2.121 0 013 3L12 15l-4 1 1-4 9.5-9.5z"></path>
                         </svg>
                     </button>
+                    <button class="btn-icon-sm" onclick="event.stopPropagation(); editSessionNotes('${session.id}')" title="Notes">
+                        <svg viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2" width="12" height="12">
+                            <path d="M14 2H6a2 2 0 00-2 2v16a2 2 0 002 2h12a2 2 0 002-2V8z"></path>
+                            <polyline points="14 2 14 8 20 8"></polyline>
+                            <line x1="8" y1="13" x2="16" y2="13"></line>
+                            <line x1="8" y1="17" x2="14" y2="17"></line>
+                        </svg>
+                    </button>
                     <button class="btn-icon-sm" onclick="event.stopPropagation(); deleteSession('${session.id}')" title="Delete">
                         <svg viewBox="0 0 24 24" fill="none" stroke="currentColor" stroke-width="2" width="12" height="12">
                             <polyline points="3 6 5 6 21 6"></polyline>
@@ -505,6 +575,54 @@ async function renameSession(id, currentName) {
     }
 }
 
+async function editSessionNotes(id) {
+    const session = listedSessions.find(s => s.id === id);
+    const currentNotes = session?.notes || '';
+    const notes = prompt('Session notes:', currentNotes);
+    if (notes === null || notes === currentNotes) return;
+
+    try {
+        const response = await fetch(`/api/sessions/${id}`, {
+            method: 'PATCH',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ notes })
+        });
+
+        if (!response.ok) {
+            throw new Error(await response.text() || 'Failed to save notes');
+        }
+
+        showLiveToast('Notes saved', 'success');
+        fetchSessions(); // Refresh the list
+    } catch (e) {
+        console.error('Failed to save session notes:', e);
+        alert('Failed to save notes: ' + e.message);
+    }
+}
+
+async function togglePinSession(id) {
+    const session = listedSessions.find(s => s.id === id);
+    const pinned = !session?.is_pinned;
+
+    try {
+        const response = await fetch(`/api/sessions/${id}`, {
+            method: 'PATCH',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ is_pinned: pinned })
+        });
+
+        if (!response.ok) {
+            throw new Error(await response.text() || 'Failed to pin session');
+        }
+
+        showLiveToast(pinned ? 'Session pinned' : 'Session unpinned', 'success');
+        fetchSessions(); // Refresh the list
+    } catch (e) {
+        console.error('Failed to pin session:', e);
+        alert('Failed to pin session: ' + e.message);
+    }
+}
+
 async function playSession(id) {
     try {
         const response = await fetch(`/api/sessions/${id}/data`);
@@ -523,7 +641,8 @@ async function playSession(id) {
                     duration: data.session.duration,
                     createdAt: data.session.created_at
                 },
-                events: data.events.map(e => ({
+                // Extra panes have their own screens; play the main terminal
+                events: data.events.filter(e => !e.pane).map(e => ({
                     t: e.timestamp,
                     type: e.type,
                     data: e.data
@@ -577,8 +696,14 @@ function updateSessionUI() {
 
             // Sync permission mode to UI
             const permSelect = document.getElementById('permissionMode');
-            if (permSelect && currentSession.permission_mode) {
-                permSelect.value = currentSession.permission_mode;
+            if (permSelect) {
+                const allowed = allowedPermissionModes();
+                for (const option of permSelect.options) {
+                    option.hidden = !allowed.includes(option.value);
+                }
+                if (currentSession.permission_mode) {
+                    permSelect.value = currentSession.permission_mode;
+                }
             }
 
             fetchViewers();
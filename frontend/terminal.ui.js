@@ -103,6 +103,8 @@ function submitCreateContainer() {
 function copySelection() { window.terminalApp?.copySelection(); }
 function pasteClipboard() { window.terminalApp?.pasteClipboard(); }
 function clearTerminal() { window.terminalApp?.clearTerminal(); }
+function sendSignal(name) { window.terminalApp?.sendSignal(name); }
+function openMirror() { window.terminalApp?.openMirror(); }
 function toggleFullscreen() { window.terminalApp?.toggleFullscreen(); }
 
 // Command history functions
@@ -292,7 +294,8 @@ async function exportRecording() {
             events: data.events.map(e => ({
                 t: e.timestamp,
                 type: e.type,
-                data: e.data
+                data: e.data,
+                pane: e.pane // Only set for extra panes; dropped from the JSON otherwise
             }))
         };
 